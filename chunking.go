@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/getlantern/tiny-shadowsocks/internal/shadowio"
+)
+
+// newChunkPolicy validates the chunk sizing settings of cfg and returns a
+// constructor for the per-connection policy, or nil when chunks are only
+// split at MaxPacketSize. Sizes above MaxPacketSize are rejected rather
+// than clamped, so a typo does not silently turn the policy off.
+func newChunkPolicy(cfg *config.Config) (func() shadowio.ChunkPolicy, error) {
+	checkSize := func(name string, size int) error {
+		if size < 1 || size > MaxPacketSize {
+			return fmt.Errorf("%w: %s %d is outside 1..%d", ErrInvalidChunkPolicy, name, size, MaxPacketSize)
+		}
+		return nil
+	}
+
+	var policy func() shadowio.ChunkPolicy
+	switch cfg.ChunkPolicy {
+	case "":
+		return nil, nil
+	case "fixed":
+		if err := checkSize("chunk_size", cfg.ChunkSize); err != nil {
+			return nil, err
+		}
+		fixed := shadowio.FixedChunkSize(cfg.ChunkSize)
+		policy = func() shadowio.ChunkPolicy { return fixed }
+	case "random":
+		if err := checkSize("chunk_size_min", cfg.ChunkSizeMin); err != nil {
+			return nil, err
+		}
+		if err := checkSize("chunk_size_max", cfg.ChunkSizeMax); err != nil {
+			return nil, err
+		}
+		if cfg.ChunkSizeMin > cfg.ChunkSizeMax {
+			return nil, fmt.Errorf("%w: chunk_size_min %d is above chunk_size_max %d", ErrInvalidChunkPolicy, cfg.ChunkSizeMin, cfg.ChunkSizeMax)
+		}
+		random := shadowio.RandomChunkSize(cfg.ChunkSizeMin, cfg.ChunkSizeMax)
+		policy = func() shadowio.ChunkPolicy { return random }
+	case "distribution":
+		if len(cfg.ChunkSizes) == 0 {
+			return nil, fmt.Errorf("%w: chunk_sizes is empty", ErrInvalidChunkPolicy)
+		}
+		if len(cfg.ChunkWeights) != 0 && len(cfg.ChunkWeights) != len(cfg.ChunkSizes) {
+			return nil, fmt.Errorf("%w: %d chunk_weights for %d chunk_sizes", ErrInvalidChunkPolicy, len(cfg.ChunkWeights), len(cfg.ChunkSizes))
+		}
+		for _, size := range cfg.ChunkSizes {
+			if err := checkSize("chunk_sizes entry", size); err != nil {
+				return nil, err
+			}
+		}
+		for _, weight := range cfg.ChunkWeights {
+			if weight < 1 {
+				return nil, fmt.Errorf("%w: chunk_weights entry %d is not positive", ErrInvalidChunkPolicy, weight)
+			}
+		}
+		sampled := shadowio.SampledChunkSize(cfg.ChunkSizes, cfg.ChunkWeights)
+		policy = func() shadowio.ChunkPolicy { return sampled }
+	default:
+		return nil, fmt.Errorf("%w: unknown chunk_policy %q", ErrInvalidChunkPolicy, cfg.ChunkPolicy)
+	}
+
+	switch {
+	case cfg.ChunkPolicyChunks < 0:
+		return nil, fmt.Errorf("%w: chunk_policy_chunks %d is negative", ErrInvalidChunkPolicy, cfg.ChunkPolicyChunks)
+	case cfg.ChunkPolicyChunks > 0:
+		shared, chunks := policy, cfg.ChunkPolicyChunks
+		policy = func() shadowio.ChunkPolicy { return shadowio.FirstChunks(chunks, shared()) }
+	}
+	return policy, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+func TestNewChunkPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   config.Config
+		valid bool
+	}{
+		{"default", config.Config{}, true},
+		{"fixed", config.Config{ChunkPolicy: "fixed", ChunkSize: 1200}, true},
+		{"fixed without size", config.Config{ChunkPolicy: "fixed"}, false},
+		{"fixed above MaxPacketSize", config.Config{ChunkPolicy: "fixed", ChunkSize: MaxPacketSize + 1}, false},
+		{"random", config.Config{ChunkPolicy: "random", ChunkSizeMin: 100, ChunkSizeMax: 1400}, true},
+		{"random with inverted range", config.Config{ChunkPolicy: "random", ChunkSizeMin: 1400, ChunkSizeMax: 100}, false},
+		{"distribution", config.Config{ChunkPolicy: "distribution", ChunkSizes: []int{500, 1400}, ChunkWeights: []int{3, 1}}, true},
+		{"distribution without weights", config.Config{ChunkPolicy: "distribution", ChunkSizes: []int{500, 1400}}, true},
+		{"distribution with missing weights", config.Config{ChunkPolicy: "distribution", ChunkSizes: []int{500, 1400}, ChunkWeights: []int{3}}, false},
+		{"distribution with zero weight", config.Config{ChunkPolicy: "distribution", ChunkSizes: []int{500}, ChunkWeights: []int{0}}, false},
+		{"distribution without sizes", config.Config{ChunkPolicy: "distribution"}, false},
+		{"first chunks", config.Config{ChunkPolicy: "fixed", ChunkSize: 1200, ChunkPolicyChunks: 4}, true},
+		{"negative first chunks", config.Config{ChunkPolicy: "fixed", ChunkSize: 1200, ChunkPolicyChunks: -1}, false},
+		{"unknown", config.Config{ChunkPolicy: "exponential"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newChunkPolicy(&tc.cfg)
+			if tc.valid && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if !tc.valid && !errors.Is(err, ErrInvalidChunkPolicy) {
+				t.Errorf("Expected ErrInvalidChunkPolicy, got %v", err)
+			}
+		})
+	}
+}
+
+func TestClientConn_ChunkPolicy(t *testing.T) {
+	d, err := newDialerFromConfig(&config.Config{
+		Method:            "chacha20-ietf-poly1305",
+		Password:          "testpass",
+		ChunkPolicy:       "fixed",
+		ChunkSize:         100,
+		ChunkPolicyChunks: 4,
+	})
+	if err != nil {
+		t.Fatalf("newDialerFromConfig failed: %v", err)
+	}
+	writeBuf := &bytes.Buffer{}
+	conn := &mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf}
+	clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+
+	// the 7 byte address and the request share the first chunks, which
+	// leaves one 100 byte chunk for the following write
+	request := bytes.Repeat([]byte("q"), 293)
+	follow := bytes.Repeat([]byte("f"), 1000)
+	clientConn.Write(request)
+	clientConn.Write(follow)
+
+	if expected := d.keySaltLength + 5*chunkOverhead + 7 + len(request) + len(follow); writeBuf.Len() != expected {
+		t.Errorf("Expected %d bytes in 5 chunks on the wire, got %d", expected, writeBuf.Len())
+	}
+	_, got := decodeRequest(t, d, writeBuf.Bytes())
+	if !bytes.Equal(got, append(request, follow...)) {
+		t.Error("Expected the server to decode the chunked stream")
+	}
+}
@@ -7,9 +7,234 @@ package config
 //
 //tinyjson:json
 type Config struct {
-	RemoteAddr         string `json:"remote_addr"`
-	RemotePort         string `json:"remote_port"`
+	RemoteAddr string `json:"remote_addr"`
+	RemotePort string `json:"remote_port"`
+	// Password derives the master key. Closing a connection or replacing
+	// the dialer zeroes the copies of that key, but not the session keys
+	// expanded inside the AEAD ciphers, which are left for the GC.
 	Password           string `json:"password"`
 	Method             string `json:"method"`
 	InternalBufferSize int    `json:"internal_buffer_size"`
+	// BufferPoolSize is the number of buffers kept per size class by the
+	// chunk buffer pool. Zero keeps the default and a negative value
+	// disables pooling.
+	BufferPoolSize int `json:"buffer_pool_size"`
+	// CoalesceSize enables write coalescing: the writes made between two
+	// reads are batched into chunks of up to this many bytes. Every read
+	// sends what is held, since the server will not answer it otherwise,
+	// and the worker reads on each round, so a batch never outlives one
+	// round. Zero disables coalescing.
+	CoalesceSize int `json:"coalesce_size"`
+	// CoalesceDelayMs cuts a batch short, in milliseconds: a write finding
+	// the held data older than this sends it along with its own. It does
+	// not hold data any longer than until the next read.
+	CoalesceDelayMs int `json:"coalesce_delay_ms"`
+	// HandshakeTimeoutMs bounds, in milliseconds, the wait from the
+	// connection being created until the server salt is read. Zero, like
+	// for the other timeouts, disables it.
+	HandshakeTimeoutMs int `json:"handshake_timeout_ms"`
+	// FirstByteTimeoutMs bounds, in milliseconds, the wait from the request
+	// being sent until the first response chunk is decrypted.
+	FirstByteTimeoutMs int `json:"first_byte_timeout_ms"`
+	// IdleTimeoutMs closes connections that saw no traffic for this many
+	// milliseconds. The WATM conns are non-blocking and there is no timer,
+	// so the timeouts are checked when a read finds nothing or a write
+	// goes out, and a connection nothing touches is not closed.
+	IdleTimeoutMs int `json:"idle_timeout_ms"`
+	// ReplayFilterCapacity is the number of salts remembered per
+	// generation of the replay filters, one for server salts and one for
+	// the client's own request salts, each salt costing about 7 bytes per
+	// filter. Zero keeps the default and a negative value disables both.
+	ReplayFilterCapacity int `json:"replay_filter_capacity"`
+	// ReplayFilterIntervalSec rotates the replay filter generations at
+	// least this often, in seconds. Zero keeps the default.
+	ReplayFilterIntervalSec int `json:"replay_filter_interval_sec"`
+	// ChunkPolicy sizes the encrypted chunks independently of the
+	// application writes: "fixed" uses ChunkSize, "random" picks sizes
+	// between ChunkSizeMin and ChunkSizeMax, and "distribution" samples
+	// ChunkSizes with ChunkWeights. Empty only splits at the maximum chunk
+	// size.
+	ChunkPolicy  string `json:"chunk_policy"`
+	ChunkSize    int    `json:"chunk_size"`
+	ChunkSizeMin int    `json:"chunk_size_min"`
+	ChunkSizeMax int    `json:"chunk_size_max"`
+	ChunkSizes   []int  `json:"chunk_sizes"`
+	ChunkWeights []int  `json:"chunk_weights"`
+	// ChunkPolicyChunks limits the chunk policy to the first chunks of each
+	// connection, where record lengths are the most telling. Zero applies
+	// it to every chunk.
+	ChunkPolicyChunks int `json:"chunk_policy_chunks"`
+	// JitterWrites delays the first writes following the request flight,
+	// each one by a random duration between JitterMinMs and JitterMaxMs
+	// milliseconds. With JitterSplit set, each of those writes is also
+	// split in two parts sent one delay apart. Zero disables jitter.
+	// JitterMaxMs is at most 1000. Non-blocking conns never sleep: the
+	// delayed writes go out with the first read or write once they are
+	// due, or on Close.
+	JitterWrites int  `json:"jitter_writes"`
+	JitterMinMs  int  `json:"jitter_min_ms"`
+	JitterMaxMs  int  `json:"jitter_max_ms"`
+	JitterSplit  bool `json:"jitter_split"`
+	// SaltPrefix replaces the leading bytes of every request salt, so the
+	// connection starts like a protocol the network lets through. It is
+	// URL-unescaped, which keeps plain text as is and lets "%16%03%01"
+	// describe raw bytes. The rest of the salt stays random.
+	SaltPrefix string `json:"salt_prefix"`
+	// PaddingPolicy pads the initial flight, whose length otherwise gives
+	// away the destination address and first payload sizes: "none",
+	// "random" adds 0 to 900 bytes, and "bucket" pads up to the next of
+	// PaddingBuckets. Legacy AEAD methods have no padding field, so the
+	// flight is padded by splitting it into more chunks. Shadowsocks 2022
+	// methods, which carry padding in their header, are not supported and
+	// rejected along with their padding settings.
+	PaddingPolicy  string `json:"padding_policy"`
+	PaddingBuckets []int  `json:"padding_buckets"`
+	// Plugin names a SIP003 plugin built into the module, such as
+	// "obfs-local", that wraps the conn to the server. PluginOpts holds its
+	// options in the usual "key=value;key=value" form.
+	Plugin     string `json:"plugin"`
+	PluginOpts string `json:"plugin_opts"`
+	// Obfs wraps the stream with simple-obfs, "http" or "tls", without
+	// going through Plugin. ObfsHost is the host name shown to the network
+	// and ObfsURI the path of the fake HTTP request. Obfs cannot be
+	// combined with Plugin.
+	Obfs     string `json:"obfs"`
+	ObfsHost string `json:"obfs_host"`
+	ObfsURI  string `json:"obfs_uri"`
+	// Transport carries the shadowsocks stream over another protocol:
+	// "websocket" speaks the WebSocket mode of v2ray-plugin, "grpc" the gun
+	// stream of V2Ray and Xray over HTTP/2, "shadowtls" version 3 of
+	// ShadowTLS, "kcp" KCP over UDP, as kcptun does, and "poll" HTTP
+	// requests polling the server, as meek does. Like Obfs, it cannot be
+	// combined with Plugin.
+	Transport string `json:"transport"`
+	// WebSocketHost and WebSocketPath set the Host header and target of
+	// the upgrade request, and WebSocketHeaders adds headers to it.
+	// WebSocketEarlyData sends up to this many bytes of the first write in
+	// the Sec-WebSocket-Protocol header instead of waiting for the upgrade.
+	WebSocketHost      string            `json:"websocket_host"`
+	WebSocketPath      string            `json:"websocket_path"`
+	WebSocketHeaders   map[string]string `json:"websocket_headers"`
+	WebSocketEarlyData int               `json:"websocket_early_data"`
+	// GRPCServiceName is the gRPC service of the gun stream, "GunService"
+	// by default, and GRPCAuthority its :authority, ServerAddr by default.
+	// One of GRPCAuthority and ServerAddr is required.
+	GRPCServiceName string `json:"grpc_service_name"`
+	GRPCAuthority   string `json:"grpc_authority"`
+	// ShadowTLSPassword is shared with the ShadowTLS server and
+	// ShadowTLSServerName is the SNI of the handshake it relays.
+	ShadowTLSPassword   string `json:"shadowtls_password"`
+	ShadowTLSServerName string `json:"shadowtls_server_name"`
+	// KCPKey is the key of the kcptun server and KCPCrypt the packet
+	// encryption, "aes" by default. The conn to the server is dialed over
+	// UDP, so a host wrapping conns must dial UDP itself.
+	KCPKey   string `json:"kcp_key"`
+	KCPCrypt string `json:"kcp_crypt"`
+	// KCPMode is the retransmission profile: "normal", "fast", the default,
+	// "fast2", "fast3" or "manual", which takes KCPNoDelay, KCPIntervalMs,
+	// KCPResend and KCPNoCongestion.
+	KCPMode         string `json:"kcp_mode"`
+	KCPNoDelay      bool   `json:"kcp_nodelay"`
+	KCPIntervalMs   int    `json:"kcp_interval_ms"`
+	KCPResend       int    `json:"kcp_resend"`
+	KCPNoCongestion bool   `json:"kcp_no_congestion"`
+	// KCPMTU, KCPSendWindow and KCPReceiveWindow default to kcptun's 1350,
+	// 128 and 512. The windows are counted in packets.
+	KCPMTU           int `json:"kcp_mtu"`
+	KCPSendWindow    int `json:"kcp_send_window"`
+	KCPReceiveWindow int `json:"kcp_receive_window"`
+	// KCPDataShards and KCPParityShards size the FEC groups, 10 and 3 by
+	// default. A negative value disables FEC.
+	KCPDataShards   int `json:"kcp_data_shards"`
+	KCPParityShards int `json:"kcp_parity_shards"`
+	// KCPNoComp turns off the snappy compression, KCPAckNoDelay
+	// acknowledges every packet as it arrives and KCPKeepAliveSec is the
+	// session keepalive, 10 seconds by default.
+	KCPNoComp       bool `json:"kcp_nocomp"`
+	KCPAckNoDelay   bool `json:"kcp_ack_nodelay"`
+	KCPKeepAliveSec int  `json:"kcp_keepalive_sec"`
+	// PollHost and PollPath set the Host header, ServerAddr by default,
+	// and target of the poll requests, and PollHeaders adds headers to
+	// them. One of PollHost and ServerAddr is required. PollProxy sends
+	// them in the absolute form for an HTTP proxy in front of the server.
+	// PollMinIntervalMs and PollMaxIntervalMs bound how long the server
+	// holds a request while the session is idle, 100 and 5000 by default.
+	PollHost          string            `json:"poll_host"`
+	PollPath          string            `json:"poll_path"`
+	PollHeaders       map[string]string `json:"poll_headers"`
+	PollProxy         bool              `json:"poll_proxy"`
+	PollMinIntervalMs int               `json:"poll_min_interval_ms"`
+	PollMaxIntervalMs int               `json:"poll_max_interval_ms"`
+	// TLS wraps the conn to the server in TLS 1.3, below the Transport,
+	// Obfs or Plugin if one is set, for servers behind a TLS terminator and
+	// for transports served over HTTPS. It cannot be combined with the
+	// shadowtls transport, which does its own handshake, nor with KCP,
+	// which runs over UDP.
+	TLS bool `json:"tls"`
+	// TLSServerName is the SNI and the name the certificate must be valid
+	// for, the host of ServerAddr by default. TLSALPN lists the protocols
+	// offered, "h2" for the grpc transport and "http/1.1" for websocket and
+	// poll by default.
+	TLSServerName string   `json:"tls_server_name"`
+	TLSALPN       []string `json:"tls_alpn"`
+	// TLSCA is a PEM bundle of the authorities the server certificate must
+	// chain to, and TLSCAFile a file holding one, read through WASI.
+	TLSCA     string `json:"tls_ca"`
+	TLSCAFile string `json:"tls_ca_file"`
+	// TLSPinnedSHA256 lists hex SHA-256 digests of certificates. A server
+	// is trusted when its leaf certificate is one of them or chains to one
+	// of them, which then stand in for the roots. A leaf that is not pinned
+	// itself still has to match the server name.
+	TLSPinnedSHA256 []string `json:"tls_pinned_sha256"`
+	// TLSInsecureSkipVerify accepts any certificate. It is meant for
+	// testing.
+	TLSInsecureSkipVerify bool `json:"tls_insecure_skip_verify"`
+	// ServerAddr is the host and port of the shadowsocks server. The host
+	// dials it, so it is only needed when the conn goes elsewhere first.
+	ServerAddr string `json:"server_addr"`
+	// Hops are shadowsocks servers the conn passes before the server, for
+	// servers only reachable from a jump host. The host dials the first
+	// hop, which is asked to connect to the second, and the last one to
+	// ServerAddr. TLS and the Transport, Obfs or Plugin run through the
+	// hops to the server, so Hops cannot be combined with KCP. Coalescing,
+	// the chunk policy, jitter, SaltPrefix and padding shape the stream to
+	// the first hop, the one the network sees, instead of the stream to
+	// the server. The timeouts and the replay filter apply to both.
+	Hops []Hop `json:"hops"`
+	// Proxy reaches the server, or the first of the Hops, through an
+	// upstream proxy, which the host dials instead: "http" sends it an
+	// HTTP CONNECT for ServerAddr and "socks5" a SOCKS5 CONNECT.
+	// ProxyUsername and ProxyPassword authenticate to it when set. TLS and
+	// the Transport, Obfs or Plugin run through the tunnel, so Proxy cannot
+	// be combined with KCP, which runs over UDP.
+	Proxy         string `json:"proxy"`
+	ProxyUsername string `json:"proxy_username"`
+	ProxyPassword string `json:"proxy_password"`
+	// Multiplex carries the streams over shared shadowsocks connections
+	// with sing-mux, for servers with sing-box multiplexing enabled.
+	// MultiplexProtocol is "smux", the default, or "yamux", and
+	// MultiplexPadding pads the first frames of every connection.
+	Multiplex         bool   `json:"multiplex"`
+	MultiplexProtocol string `json:"multiplex_protocol"`
+	MultiplexPadding  bool   `json:"multiplex_padding"`
+	// MultiplexMaxStreams bounds the streams of one connection, zero being
+	// no limit. MultiplexIdleTimeoutMs keeps a connection without streams
+	// that many milliseconds for the next stream, zero keeping it until the
+	// server closes it. A WATM instance serves a single dial, so
+	// connections are only shared by the streams of one instance. With the
+	// wrapping transport the host dials every connection itself, so each
+	// one carries a session with a single stream: the max streams and idle
+	// timeout have no effect there, and multiplexing only adds its framing.
+	MultiplexMaxStreams    int `json:"multiplex_max_streams"`
+	MultiplexIdleTimeoutMs int `json:"multiplex_idle_timeout_ms"`
+}
+
+// Hop is a shadowsocks server in front of the server, with a method and
+// password of its own.
+//
+//tinyjson:json
+type Hop struct {
+	ServerAddr string `json:"server_addr"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
 }
@@ -15,7 +15,87 @@ var (
 	_ tinyjson.Marshaler
 )
 
-func tinyjson79908536DecodeGithubComGetlanternTinyShadowsocksConfig(in *jlexer.Lexer, out *Config) {
+func tinyjson79908536DecodeGithubComGetlanternTinyShadowsocksConfig(in *jlexer.Lexer, out *Hop) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "server_addr":
+			out.ServerAddr = string(in.String())
+		case "password":
+			out.Password = string(in.String())
+		case "method":
+			out.Method = string(in.String())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func tinyjson79908536EncodeGithubComGetlanternTinyShadowsocksConfig(out *jwriter.Writer, in Hop) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"server_addr\":"
+		out.RawString(prefix[1:])
+		out.String(string(in.ServerAddr))
+	}
+	{
+		const prefix string = ",\"password\":"
+		out.RawString(prefix)
+		out.String(string(in.Password))
+	}
+	{
+		const prefix string = ",\"method\":"
+		out.RawString(prefix)
+		out.String(string(in.Method))
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v Hop) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	tinyjson79908536EncodeGithubComGetlanternTinyShadowsocksConfig(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalTinyJSON supports tinyjson.Marshaler interface
+func (v Hop) MarshalTinyJSON(w *jwriter.Writer) {
+	tinyjson79908536EncodeGithubComGetlanternTinyShadowsocksConfig(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *Hop) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	tinyjson79908536DecodeGithubComGetlanternTinyShadowsocksConfig(&r, v)
+	return r.Error()
+}
+
+// UnmarshalTinyJSON supports tinyjson.Unmarshaler interface
+func (v *Hop) UnmarshalTinyJSON(l *jlexer.Lexer) {
+	tinyjson79908536DecodeGithubComGetlanternTinyShadowsocksConfig(l, v)
+}
+func tinyjson79908536DecodeGithubComGetlanternTinyShadowsocksConfig1(in *jlexer.Lexer, out *Config) {
 	isTopLevel := in.IsStart()
 	if in.IsNull() {
 		if isTopLevel {
@@ -44,6 +124,308 @@ func tinyjson79908536DecodeGithubComGetlanternTinyShadowsocksConfig(in *jlexer.L
 			out.Method = string(in.String())
 		case "internal_buffer_size":
 			out.InternalBufferSize = int(in.Int())
+		case "buffer_pool_size":
+			out.BufferPoolSize = int(in.Int())
+		case "coalesce_size":
+			out.CoalesceSize = int(in.Int())
+		case "coalesce_delay_ms":
+			out.CoalesceDelayMs = int(in.Int())
+		case "handshake_timeout_ms":
+			out.HandshakeTimeoutMs = int(in.Int())
+		case "first_byte_timeout_ms":
+			out.FirstByteTimeoutMs = int(in.Int())
+		case "idle_timeout_ms":
+			out.IdleTimeoutMs = int(in.Int())
+		case "replay_filter_capacity":
+			out.ReplayFilterCapacity = int(in.Int())
+		case "replay_filter_interval_sec":
+			out.ReplayFilterIntervalSec = int(in.Int())
+		case "chunk_policy":
+			out.ChunkPolicy = string(in.String())
+		case "chunk_size":
+			out.ChunkSize = int(in.Int())
+		case "chunk_size_min":
+			out.ChunkSizeMin = int(in.Int())
+		case "chunk_size_max":
+			out.ChunkSizeMax = int(in.Int())
+		case "chunk_sizes":
+			if in.IsNull() {
+				in.Skip()
+				out.ChunkSizes = nil
+			} else {
+				in.Delim('[')
+				if out.ChunkSizes == nil {
+					if !in.IsDelim(']') {
+						out.ChunkSizes = make([]int, 0, 8)
+					} else {
+						out.ChunkSizes = []int{}
+					}
+				} else {
+					out.ChunkSizes = (out.ChunkSizes)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v1 int
+					v1 = int(in.Int())
+					out.ChunkSizes = append(out.ChunkSizes, v1)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "chunk_weights":
+			if in.IsNull() {
+				in.Skip()
+				out.ChunkWeights = nil
+			} else {
+				in.Delim('[')
+				if out.ChunkWeights == nil {
+					if !in.IsDelim(']') {
+						out.ChunkWeights = make([]int, 0, 8)
+					} else {
+						out.ChunkWeights = []int{}
+					}
+				} else {
+					out.ChunkWeights = (out.ChunkWeights)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v2 int
+					v2 = int(in.Int())
+					out.ChunkWeights = append(out.ChunkWeights, v2)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "chunk_policy_chunks":
+			out.ChunkPolicyChunks = int(in.Int())
+		case "jitter_writes":
+			out.JitterWrites = int(in.Int())
+		case "jitter_min_ms":
+			out.JitterMinMs = int(in.Int())
+		case "jitter_max_ms":
+			out.JitterMaxMs = int(in.Int())
+		case "jitter_split":
+			out.JitterSplit = bool(in.Bool())
+		case "salt_prefix":
+			out.SaltPrefix = string(in.String())
+		case "padding_policy":
+			out.PaddingPolicy = string(in.String())
+		case "padding_buckets":
+			if in.IsNull() {
+				in.Skip()
+				out.PaddingBuckets = nil
+			} else {
+				in.Delim('[')
+				if out.PaddingBuckets == nil {
+					if !in.IsDelim(']') {
+						out.PaddingBuckets = make([]int, 0, 8)
+					} else {
+						out.PaddingBuckets = []int{}
+					}
+				} else {
+					out.PaddingBuckets = (out.PaddingBuckets)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v3 int
+					v3 = int(in.Int())
+					out.PaddingBuckets = append(out.PaddingBuckets, v3)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "plugin":
+			out.Plugin = string(in.String())
+		case "plugin_opts":
+			out.PluginOpts = string(in.String())
+		case "obfs":
+			out.Obfs = string(in.String())
+		case "obfs_host":
+			out.ObfsHost = string(in.String())
+		case "obfs_uri":
+			out.ObfsURI = string(in.String())
+		case "transport":
+			out.Transport = string(in.String())
+		case "websocket_host":
+			out.WebSocketHost = string(in.String())
+		case "websocket_path":
+			out.WebSocketPath = string(in.String())
+		case "websocket_headers":
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				in.Delim('{')
+				out.WebSocketHeaders = make(map[string]string)
+				for !in.IsDelim('}') {
+					key := string(in.String())
+					in.WantColon()
+					var v4 string
+					v4 = string(in.String())
+					(out.WebSocketHeaders)[key] = v4
+					in.WantComma()
+				}
+				in.Delim('}')
+			}
+		case "websocket_early_data":
+			out.WebSocketEarlyData = int(in.Int())
+		case "grpc_service_name":
+			out.GRPCServiceName = string(in.String())
+		case "grpc_authority":
+			out.GRPCAuthority = string(in.String())
+		case "shadowtls_password":
+			out.ShadowTLSPassword = string(in.String())
+		case "shadowtls_server_name":
+			out.ShadowTLSServerName = string(in.String())
+		case "kcp_key":
+			out.KCPKey = string(in.String())
+		case "kcp_crypt":
+			out.KCPCrypt = string(in.String())
+		case "kcp_mode":
+			out.KCPMode = string(in.String())
+		case "kcp_nodelay":
+			out.KCPNoDelay = bool(in.Bool())
+		case "kcp_interval_ms":
+			out.KCPIntervalMs = int(in.Int())
+		case "kcp_resend":
+			out.KCPResend = int(in.Int())
+		case "kcp_no_congestion":
+			out.KCPNoCongestion = bool(in.Bool())
+		case "kcp_mtu":
+			out.KCPMTU = int(in.Int())
+		case "kcp_send_window":
+			out.KCPSendWindow = int(in.Int())
+		case "kcp_receive_window":
+			out.KCPReceiveWindow = int(in.Int())
+		case "kcp_data_shards":
+			out.KCPDataShards = int(in.Int())
+		case "kcp_parity_shards":
+			out.KCPParityShards = int(in.Int())
+		case "kcp_nocomp":
+			out.KCPNoComp = bool(in.Bool())
+		case "kcp_ack_nodelay":
+			out.KCPAckNoDelay = bool(in.Bool())
+		case "kcp_keepalive_sec":
+			out.KCPKeepAliveSec = int(in.Int())
+		case "poll_host":
+			out.PollHost = string(in.String())
+		case "poll_path":
+			out.PollPath = string(in.String())
+		case "poll_headers":
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				in.Delim('{')
+				out.PollHeaders = make(map[string]string)
+				for !in.IsDelim('}') {
+					key := string(in.String())
+					in.WantColon()
+					var v5 string
+					v5 = string(in.String())
+					(out.PollHeaders)[key] = v5
+					in.WantComma()
+				}
+				in.Delim('}')
+			}
+		case "poll_proxy":
+			out.PollProxy = bool(in.Bool())
+		case "poll_min_interval_ms":
+			out.PollMinIntervalMs = int(in.Int())
+		case "poll_max_interval_ms":
+			out.PollMaxIntervalMs = int(in.Int())
+		case "tls":
+			out.TLS = bool(in.Bool())
+		case "tls_server_name":
+			out.TLSServerName = string(in.String())
+		case "tls_alpn":
+			if in.IsNull() {
+				in.Skip()
+				out.TLSALPN = nil
+			} else {
+				in.Delim('[')
+				if out.TLSALPN == nil {
+					if !in.IsDelim(']') {
+						out.TLSALPN = make([]string, 0, 4)
+					} else {
+						out.TLSALPN = []string{}
+					}
+				} else {
+					out.TLSALPN = (out.TLSALPN)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v6 string
+					v6 = string(in.String())
+					out.TLSALPN = append(out.TLSALPN, v6)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "tls_ca":
+			out.TLSCA = string(in.String())
+		case "tls_ca_file":
+			out.TLSCAFile = string(in.String())
+		case "tls_pinned_sha256":
+			if in.IsNull() {
+				in.Skip()
+				out.TLSPinnedSHA256 = nil
+			} else {
+				in.Delim('[')
+				if out.TLSPinnedSHA256 == nil {
+					if !in.IsDelim(']') {
+						out.TLSPinnedSHA256 = make([]string, 0, 4)
+					} else {
+						out.TLSPinnedSHA256 = []string{}
+					}
+				} else {
+					out.TLSPinnedSHA256 = (out.TLSPinnedSHA256)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v7 string
+					v7 = string(in.String())
+					out.TLSPinnedSHA256 = append(out.TLSPinnedSHA256, v7)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "tls_insecure_skip_verify":
+			out.TLSInsecureSkipVerify = bool(in.Bool())
+		case "server_addr":
+			out.ServerAddr = string(in.String())
+		case "hops":
+			if in.IsNull() {
+				in.Skip()
+				out.Hops = nil
+			} else {
+				in.Delim('[')
+				if out.Hops == nil {
+					if !in.IsDelim(']') {
+						out.Hops = make([]Hop, 0, 1)
+					} else {
+						out.Hops = []Hop{}
+					}
+				} else {
+					out.Hops = (out.Hops)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v8 Hop
+					(v8).UnmarshalTinyJSON(in)
+					out.Hops = append(out.Hops, v8)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "proxy":
+			out.Proxy = string(in.String())
+		case "proxy_username":
+			out.ProxyUsername = string(in.String())
+		case "proxy_password":
+			out.ProxyPassword = string(in.String())
+		case "multiplex":
+			out.Multiplex = bool(in.Bool())
+		case "multiplex_protocol":
+			out.MultiplexProtocol = string(in.String())
+		case "multiplex_padding":
+			out.MultiplexPadding = bool(in.Bool())
+		case "multiplex_max_streams":
+			out.MultiplexMaxStreams = int(in.Int())
+		case "multiplex_idle_timeout_ms":
+			out.MultiplexIdleTimeoutMs = int(in.Int())
 		default:
 			in.SkipRecursive()
 		}
@@ -54,7 +436,7 @@ func tinyjson79908536DecodeGithubComGetlanternTinyShadowsocksConfig(in *jlexer.L
 		in.Consumed()
 	}
 }
-func tinyjson79908536EncodeGithubComGetlanternTinyShadowsocksConfig(out *jwriter.Writer, in Config) {
+func tinyjson79908536EncodeGithubComGetlanternTinyShadowsocksConfig1(out *jwriter.Writer, in Config) {
 	out.RawByte('{')
 	first := true
 	_ = first
@@ -83,29 +465,497 @@ func tinyjson79908536EncodeGithubComGetlanternTinyShadowsocksConfig(out *jwriter
 		out.RawString(prefix)
 		out.Int(int(in.InternalBufferSize))
 	}
+	{
+		const prefix string = ",\"buffer_pool_size\":"
+		out.RawString(prefix)
+		out.Int(int(in.BufferPoolSize))
+	}
+	{
+		const prefix string = ",\"coalesce_size\":"
+		out.RawString(prefix)
+		out.Int(int(in.CoalesceSize))
+	}
+	{
+		const prefix string = ",\"coalesce_delay_ms\":"
+		out.RawString(prefix)
+		out.Int(int(in.CoalesceDelayMs))
+	}
+	{
+		const prefix string = ",\"handshake_timeout_ms\":"
+		out.RawString(prefix)
+		out.Int(int(in.HandshakeTimeoutMs))
+	}
+	{
+		const prefix string = ",\"first_byte_timeout_ms\":"
+		out.RawString(prefix)
+		out.Int(int(in.FirstByteTimeoutMs))
+	}
+	{
+		const prefix string = ",\"idle_timeout_ms\":"
+		out.RawString(prefix)
+		out.Int(int(in.IdleTimeoutMs))
+	}
+	{
+		const prefix string = ",\"replay_filter_capacity\":"
+		out.RawString(prefix)
+		out.Int(int(in.ReplayFilterCapacity))
+	}
+	{
+		const prefix string = ",\"replay_filter_interval_sec\":"
+		out.RawString(prefix)
+		out.Int(int(in.ReplayFilterIntervalSec))
+	}
+	{
+		const prefix string = ",\"chunk_policy\":"
+		out.RawString(prefix)
+		out.String(string(in.ChunkPolicy))
+	}
+	{
+		const prefix string = ",\"chunk_size\":"
+		out.RawString(prefix)
+		out.Int(int(in.ChunkSize))
+	}
+	{
+		const prefix string = ",\"chunk_size_min\":"
+		out.RawString(prefix)
+		out.Int(int(in.ChunkSizeMin))
+	}
+	{
+		const prefix string = ",\"chunk_size_max\":"
+		out.RawString(prefix)
+		out.Int(int(in.ChunkSizeMax))
+	}
+	{
+		const prefix string = ",\"chunk_sizes\":"
+		out.RawString(prefix)
+		if in.ChunkSizes == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v9, v10 := range in.ChunkSizes {
+				if v9 > 0 {
+					out.RawByte(',')
+				}
+				out.Int(int(v10))
+			}
+			out.RawByte(']')
+		}
+	}
+	{
+		const prefix string = ",\"chunk_weights\":"
+		out.RawString(prefix)
+		if in.ChunkWeights == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v11, v12 := range in.ChunkWeights {
+				if v11 > 0 {
+					out.RawByte(',')
+				}
+				out.Int(int(v12))
+			}
+			out.RawByte(']')
+		}
+	}
+	{
+		const prefix string = ",\"chunk_policy_chunks\":"
+		out.RawString(prefix)
+		out.Int(int(in.ChunkPolicyChunks))
+	}
+	{
+		const prefix string = ",\"jitter_writes\":"
+		out.RawString(prefix)
+		out.Int(int(in.JitterWrites))
+	}
+	{
+		const prefix string = ",\"jitter_min_ms\":"
+		out.RawString(prefix)
+		out.Int(int(in.JitterMinMs))
+	}
+	{
+		const prefix string = ",\"jitter_max_ms\":"
+		out.RawString(prefix)
+		out.Int(int(in.JitterMaxMs))
+	}
+	{
+		const prefix string = ",\"jitter_split\":"
+		out.RawString(prefix)
+		out.Bool(bool(in.JitterSplit))
+	}
+	{
+		const prefix string = ",\"salt_prefix\":"
+		out.RawString(prefix)
+		out.String(string(in.SaltPrefix))
+	}
+	{
+		const prefix string = ",\"padding_policy\":"
+		out.RawString(prefix)
+		out.String(string(in.PaddingPolicy))
+	}
+	{
+		const prefix string = ",\"padding_buckets\":"
+		out.RawString(prefix)
+		if in.PaddingBuckets == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v13, v14 := range in.PaddingBuckets {
+				if v13 > 0 {
+					out.RawByte(',')
+				}
+				out.Int(int(v14))
+			}
+			out.RawByte(']')
+		}
+	}
+	{
+		const prefix string = ",\"plugin\":"
+		out.RawString(prefix)
+		out.String(string(in.Plugin))
+	}
+	{
+		const prefix string = ",\"plugin_opts\":"
+		out.RawString(prefix)
+		out.String(string(in.PluginOpts))
+	}
+	{
+		const prefix string = ",\"obfs\":"
+		out.RawString(prefix)
+		out.String(string(in.Obfs))
+	}
+	{
+		const prefix string = ",\"obfs_host\":"
+		out.RawString(prefix)
+		out.String(string(in.ObfsHost))
+	}
+	{
+		const prefix string = ",\"obfs_uri\":"
+		out.RawString(prefix)
+		out.String(string(in.ObfsURI))
+	}
+	{
+		const prefix string = ",\"transport\":"
+		out.RawString(prefix)
+		out.String(string(in.Transport))
+	}
+	{
+		const prefix string = ",\"websocket_host\":"
+		out.RawString(prefix)
+		out.String(string(in.WebSocketHost))
+	}
+	{
+		const prefix string = ",\"websocket_path\":"
+		out.RawString(prefix)
+		out.String(string(in.WebSocketPath))
+	}
+	{
+		const prefix string = ",\"websocket_headers\":"
+		out.RawString(prefix)
+		if in.WebSocketHeaders == nil && (out.Flags&jwriter.NilMapAsEmpty) == 0 {
+			out.RawString(`null`)
+		} else {
+			out.RawByte('{')
+			v15First := true
+			for v15Name, v15Value := range in.WebSocketHeaders {
+				if v15First {
+					v15First = false
+				} else {
+					out.RawByte(',')
+				}
+				out.String(string(v15Name))
+				out.RawByte(':')
+				out.String(string(v15Value))
+			}
+			out.RawByte('}')
+		}
+	}
+	{
+		const prefix string = ",\"websocket_early_data\":"
+		out.RawString(prefix)
+		out.Int(int(in.WebSocketEarlyData))
+	}
+	{
+		const prefix string = ",\"grpc_service_name\":"
+		out.RawString(prefix)
+		out.String(string(in.GRPCServiceName))
+	}
+	{
+		const prefix string = ",\"grpc_authority\":"
+		out.RawString(prefix)
+		out.String(string(in.GRPCAuthority))
+	}
+	{
+		const prefix string = ",\"shadowtls_password\":"
+		out.RawString(prefix)
+		out.String(string(in.ShadowTLSPassword))
+	}
+	{
+		const prefix string = ",\"shadowtls_server_name\":"
+		out.RawString(prefix)
+		out.String(string(in.ShadowTLSServerName))
+	}
+	{
+		const prefix string = ",\"kcp_key\":"
+		out.RawString(prefix)
+		out.String(string(in.KCPKey))
+	}
+	{
+		const prefix string = ",\"kcp_crypt\":"
+		out.RawString(prefix)
+		out.String(string(in.KCPCrypt))
+	}
+	{
+		const prefix string = ",\"kcp_mode\":"
+		out.RawString(prefix)
+		out.String(string(in.KCPMode))
+	}
+	{
+		const prefix string = ",\"kcp_nodelay\":"
+		out.RawString(prefix)
+		out.Bool(bool(in.KCPNoDelay))
+	}
+	{
+		const prefix string = ",\"kcp_interval_ms\":"
+		out.RawString(prefix)
+		out.Int(int(in.KCPIntervalMs))
+	}
+	{
+		const prefix string = ",\"kcp_resend\":"
+		out.RawString(prefix)
+		out.Int(int(in.KCPResend))
+	}
+	{
+		const prefix string = ",\"kcp_no_congestion\":"
+		out.RawString(prefix)
+		out.Bool(bool(in.KCPNoCongestion))
+	}
+	{
+		const prefix string = ",\"kcp_mtu\":"
+		out.RawString(prefix)
+		out.Int(int(in.KCPMTU))
+	}
+	{
+		const prefix string = ",\"kcp_send_window\":"
+		out.RawString(prefix)
+		out.Int(int(in.KCPSendWindow))
+	}
+	{
+		const prefix string = ",\"kcp_receive_window\":"
+		out.RawString(prefix)
+		out.Int(int(in.KCPReceiveWindow))
+	}
+	{
+		const prefix string = ",\"kcp_data_shards\":"
+		out.RawString(prefix)
+		out.Int(int(in.KCPDataShards))
+	}
+	{
+		const prefix string = ",\"kcp_parity_shards\":"
+		out.RawString(prefix)
+		out.Int(int(in.KCPParityShards))
+	}
+	{
+		const prefix string = ",\"kcp_nocomp\":"
+		out.RawString(prefix)
+		out.Bool(bool(in.KCPNoComp))
+	}
+	{
+		const prefix string = ",\"kcp_ack_nodelay\":"
+		out.RawString(prefix)
+		out.Bool(bool(in.KCPAckNoDelay))
+	}
+	{
+		const prefix string = ",\"kcp_keepalive_sec\":"
+		out.RawString(prefix)
+		out.Int(int(in.KCPKeepAliveSec))
+	}
+	{
+		const prefix string = ",\"poll_host\":"
+		out.RawString(prefix)
+		out.String(string(in.PollHost))
+	}
+	{
+		const prefix string = ",\"poll_path\":"
+		out.RawString(prefix)
+		out.String(string(in.PollPath))
+	}
+	{
+		const prefix string = ",\"poll_headers\":"
+		out.RawString(prefix)
+		if in.PollHeaders == nil && (out.Flags&jwriter.NilMapAsEmpty) == 0 {
+			out.RawString(`null`)
+		} else {
+			out.RawByte('{')
+			v16First := true
+			for v16Name, v16Value := range in.PollHeaders {
+				if v16First {
+					v16First = false
+				} else {
+					out.RawByte(',')
+				}
+				out.String(string(v16Name))
+				out.RawByte(':')
+				out.String(string(v16Value))
+			}
+			out.RawByte('}')
+		}
+	}
+	{
+		const prefix string = ",\"poll_proxy\":"
+		out.RawString(prefix)
+		out.Bool(bool(in.PollProxy))
+	}
+	{
+		const prefix string = ",\"poll_min_interval_ms\":"
+		out.RawString(prefix)
+		out.Int(int(in.PollMinIntervalMs))
+	}
+	{
+		const prefix string = ",\"poll_max_interval_ms\":"
+		out.RawString(prefix)
+		out.Int(int(in.PollMaxIntervalMs))
+	}
+	{
+		const prefix string = ",\"tls\":"
+		out.RawString(prefix)
+		out.Bool(bool(in.TLS))
+	}
+	{
+		const prefix string = ",\"tls_server_name\":"
+		out.RawString(prefix)
+		out.String(string(in.TLSServerName))
+	}
+	{
+		const prefix string = ",\"tls_alpn\":"
+		out.RawString(prefix)
+		if in.TLSALPN == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v17, v18 := range in.TLSALPN {
+				if v17 > 0 {
+					out.RawByte(',')
+				}
+				out.String(string(v18))
+			}
+			out.RawByte(']')
+		}
+	}
+	{
+		const prefix string = ",\"tls_ca\":"
+		out.RawString(prefix)
+		out.String(string(in.TLSCA))
+	}
+	{
+		const prefix string = ",\"tls_ca_file\":"
+		out.RawString(prefix)
+		out.String(string(in.TLSCAFile))
+	}
+	{
+		const prefix string = ",\"tls_pinned_sha256\":"
+		out.RawString(prefix)
+		if in.TLSPinnedSHA256 == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v19, v20 := range in.TLSPinnedSHA256 {
+				if v19 > 0 {
+					out.RawByte(',')
+				}
+				out.String(string(v20))
+			}
+			out.RawByte(']')
+		}
+	}
+	{
+		const prefix string = ",\"tls_insecure_skip_verify\":"
+		out.RawString(prefix)
+		out.Bool(bool(in.TLSInsecureSkipVerify))
+	}
+	{
+		const prefix string = ",\"server_addr\":"
+		out.RawString(prefix)
+		out.String(string(in.ServerAddr))
+	}
+	{
+		const prefix string = ",\"hops\":"
+		out.RawString(prefix)
+		if in.Hops == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v21, v22 := range in.Hops {
+				if v21 > 0 {
+					out.RawByte(',')
+				}
+				(v22).MarshalTinyJSON(out)
+			}
+			out.RawByte(']')
+		}
+	}
+	{
+		const prefix string = ",\"proxy\":"
+		out.RawString(prefix)
+		out.String(string(in.Proxy))
+	}
+	{
+		const prefix string = ",\"proxy_username\":"
+		out.RawString(prefix)
+		out.String(string(in.ProxyUsername))
+	}
+	{
+		const prefix string = ",\"proxy_password\":"
+		out.RawString(prefix)
+		out.String(string(in.ProxyPassword))
+	}
+	{
+		const prefix string = ",\"multiplex\":"
+		out.RawString(prefix)
+		out.Bool(bool(in.Multiplex))
+	}
+	{
+		const prefix string = ",\"multiplex_protocol\":"
+		out.RawString(prefix)
+		out.String(string(in.MultiplexProtocol))
+	}
+	{
+		const prefix string = ",\"multiplex_padding\":"
+		out.RawString(prefix)
+		out.Bool(bool(in.MultiplexPadding))
+	}
+	{
+		const prefix string = ",\"multiplex_max_streams\":"
+		out.RawString(prefix)
+		out.Int(int(in.MultiplexMaxStreams))
+	}
+	{
+		const prefix string = ",\"multiplex_idle_timeout_ms\":"
+		out.RawString(prefix)
+		out.Int(int(in.MultiplexIdleTimeoutMs))
+	}
 	out.RawByte('}')
 }
 
 // MarshalJSON supports json.Marshaler interface
 func (v Config) MarshalJSON() ([]byte, error) {
 	w := jwriter.Writer{}
-	tinyjson79908536EncodeGithubComGetlanternTinyShadowsocksConfig(&w, v)
+	tinyjson79908536EncodeGithubComGetlanternTinyShadowsocksConfig1(&w, v)
 	return w.Buffer.BuildBytes(), w.Error
 }
 
 // MarshalTinyJSON supports tinyjson.Marshaler interface
 func (v Config) MarshalTinyJSON(w *jwriter.Writer) {
-	tinyjson79908536EncodeGithubComGetlanternTinyShadowsocksConfig(w, v)
+	tinyjson79908536EncodeGithubComGetlanternTinyShadowsocksConfig1(w, v)
 }
 
 // UnmarshalJSON supports json.Unmarshaler interface
 func (v *Config) UnmarshalJSON(data []byte) error {
 	r := jlexer.Lexer{Data: data}
-	tinyjson79908536DecodeGithubComGetlanternTinyShadowsocksConfig(&r, v)
+	tinyjson79908536DecodeGithubComGetlanternTinyShadowsocksConfig1(&r, v)
 	return r.Error()
 }
 
 // UnmarshalTinyJSON supports tinyjson.Unmarshaler interface
 func (v *Config) UnmarshalTinyJSON(l *jlexer.Lexer) {
-	tinyjson79908536DecodeGithubComGetlanternTinyShadowsocksConfig(l, v)
+	tinyjson79908536DecodeGithubComGetlanternTinyShadowsocksConfig1(l, v)
 }
@@ -1,18 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/sha1"
 	"errors"
+	"fmt"
+	"io"
 	"log/slog"
-	"os"
+	"net"
+	"net/url"
+	"syscall"
+	"time"
 
 	"github.com/getlantern/tiny-shadowsocks/bufio"
+	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/getlantern/tiny-shadowsocks/internal/mux"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	"github.com/getlantern/tiny-shadowsocks/internal/pool"
+	"github.com/getlantern/tiny-shadowsocks/internal/saltfilter"
 	"github.com/getlantern/tiny-shadowsocks/internal/shadowio"
 	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/replay"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
 )
@@ -22,8 +37,41 @@ type Dialer struct {
 	keySaltLength int
 	constructor   func(key []byte) (cipher.AEAD, error)
 	key           []byte
+
+	coalesceSize  int
+	coalesceDelay time.Duration
+	timeouts      timeouts
+	// chunkPolicy returns the chunk sizing policy of a new connection, nil
+	// when chunks are only split at MaxPacketSize
+	chunkPolicy  func() shadowio.ChunkPolicy
+	jitterPolicy *jitterPolicy
+	padding      paddingPolicy
+	saltPrefix   []byte
+	plugin       plugin.Plugin
+	saltFilter   replay.Filter
+	// requestSalts remembers the salts of recent requests, so that one of
+	// them coming back as a response salt is recognised as a reflection
+	requestSalts *saltfilter.Filter
+	// mux describes the multiplexed sessions, nil when every stream has
+	// its own connection
+	mux *mux.Config
+	// network is the network the conn to the server is dialed on, "tcp"
+	// or "udp"
+	network string
+	// hops are the shadowsocks servers the conn passes before the server,
+	// run by plugin
+	hops []*hop
 }
 
+const (
+	// minRandomSaltBytes is the part of the salt a prefix cannot take, so
+	// that session keys stay unique.
+	minRandomSaltBytes = 16
+
+	defaultReplayFilterCapacity = 4096
+	defaultReplayFilterInterval = 10 * time.Minute
+)
+
 func key(password []byte, keySize int) []byte {
 	var b, prev []byte
 	h := md5.New()
@@ -47,17 +95,111 @@ func newDialer(method, password string) (*Dialer, error) {
 		dialer.keySaltLength = 32
 		dialer.constructor = chacha20poly1305.NewX
 	default:
-		return nil, os.ErrInvalid
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedMethod, method)
 	}
 
 	if password == "" {
-		return nil, errors.New("password is required")
+		return nil, ErrMissingPassword
 	}
 
 	dialer.key = key([]byte(password), dialer.keySaltLength)
 	return dialer, nil
 }
 
+// newDialerFromConfig builds a dialer from the method and password in cfg
+// and applies the optional stream settings on top of it. With hops, the
+// settings that shape the stream go to the first hop instead, whose stream
+// is the one on the wire.
+func newDialerFromConfig(cfg *config.Config) (*Dialer, error) {
+	dialer, err := newDialer(cfg.Method, cfg.Password)
+	if err != nil {
+		return nil, err
+	}
+	if dialer.hops, err = newHops(cfg); err != nil {
+		return nil, err
+	}
+	shaped := dialer
+	if len(dialer.hops) > 0 {
+		shaped = dialer.hops[0].dialer
+		shaped.setSafeguards(cfg)
+	}
+	if err = shaped.setShaping(cfg); err != nil {
+		return nil, err
+	}
+	dialer.setSafeguards(cfg)
+	if dialer.plugin, err = newPlugin(cfg, dialer.hops); err != nil {
+		return nil, err
+	}
+	dialer.network = serverNetwork(cfg)
+	if dialer.mux, err = newMuxConfig(cfg); err != nil {
+		return nil, err
+	}
+	return dialer, nil
+}
+
+// setShaping applies the settings of cfg that change how the stream looks
+// on the wire: coalescing, chunk sizes, jitter, padding and the salt
+// prefix.
+func (d *Dialer) setShaping(cfg *config.Config) (err error) {
+	d.coalesceSize = cfg.CoalesceSize
+	d.coalesceDelay = time.Duration(cfg.CoalesceDelayMs) * time.Millisecond
+	if d.chunkPolicy, err = newChunkPolicy(cfg); err != nil {
+		return err
+	}
+	if d.jitterPolicy, err = newJitterPolicy(cfg); err != nil {
+		return err
+	}
+	if d.padding, err = newPaddingPolicy(cfg); err != nil {
+		return err
+	}
+	if cfg.SaltPrefix != "" {
+		prefix, err := url.PathUnescape(cfg.SaltPrefix)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidSaltPrefix, err)
+		}
+		if maxLength := d.keySaltLength - minRandomSaltBytes; len(prefix) > maxLength {
+			return fmt.Errorf("%w: %d bytes, at most %d fit a %d byte salt", ErrInvalidSaltPrefix, len(prefix), maxLength, d.keySaltLength)
+		}
+		d.saltPrefix = []byte(prefix)
+	}
+	return nil
+}
+
+// setSafeguards applies the timeouts and the replay filter of cfg, which
+// protect a stream wherever it runs.
+func (d *Dialer) setSafeguards(cfg *config.Config) {
+	d.timeouts = timeouts{
+		handshake: time.Duration(cfg.HandshakeTimeoutMs) * time.Millisecond,
+		firstByte: time.Duration(cfg.FirstByteTimeoutMs) * time.Millisecond,
+		idle:      time.Duration(cfg.IdleTimeoutMs) * time.Millisecond,
+	}
+	if cfg.ReplayFilterCapacity >= 0 {
+		capacity := cmp.Or(cfg.ReplayFilterCapacity, defaultReplayFilterCapacity)
+		interval := cmp.Or(time.Duration(cfg.ReplayFilterIntervalSec)*time.Second, defaultReplayFilterInterval)
+		d.saltFilter = saltfilter.New(capacity, interval)
+		d.requestSalts = saltfilter.New(capacity, interval)
+	}
+}
+
+// Wipe zeroes the master key and those of the hops, once the dialer is
+// being replaced or torn down. Connections already dialed keep working on
+// their own copy of the key. The AEAD ciphers of those connections hold
+// their expanded session keys until the GC collects them, since neither
+// cipher package can zero them.
+func (d *Dialer) Wipe() {
+	clear(d.key)
+	for _, hop := range d.hops {
+		hop.dialer.Wipe()
+	}
+}
+
+// releaseKey zeroes a derived session key before its buffer goes back to
+// the shared pool.
+func releaseKey(key *buf.Buffer) {
+	clear(key.Bytes())
+	key.Release()
+}
+
 func Kdf(key, iv []byte, buffer *buf.Buffer) error {
 	kdf := hkdf.New(sha1.New, key, iv, []byte("ss-subkey"))
 	_, err := buffer.ReadFullFrom(kdf, buffer.FreeLen())
@@ -65,36 +207,69 @@ func Kdf(key, iv []byte, buffer *buf.Buffer) error {
 }
 
 func (d *Dialer) DialConn(conn v1net.Conn, destination metadata.Socksaddr) (v1net.Conn, error) {
-	shadowsocksConn := &ClientConn{
-		Dialer:      d,
-		Conn:        conn,
-		destination: destination,
-	}
+	shadowsocksConn := d.newClientConn(conn, destination)
 	return shadowsocksConn, shadowsocksConn.writeRequest(nil)
 }
 
 func (d *Dialer) DialEarlyConn(conn v1net.Conn, destination metadata.Socksaddr) v1net.Conn {
+	return d.newClientConn(conn, destination)
+}
+
+func (d *Dialer) newClientConn(conn v1net.Conn, destination metadata.Socksaddr) *ClientConn {
+	now := time.Now()
 	return &ClientConn{
-		Dialer:      d,
-		Conn:        conn,
-		destination: destination,
+		Dialer:       d,
+		Conn:         conn,
+		key:          bytes.Clone(d.key),
+		destination:  destination,
+		jitter:       d.jitterPolicy.newJitter(),
+		createdAt:    now,
+		lastActivity: now,
 	}
 }
 
+var (
+	_ io.ReaderFrom      = (*ClientConn)(nil)
+	_ io.WriterTo        = (*ClientConn)(nil)
+	_ N.VectorisedWriter = (*ClientConn)(nil)
+	_ N.WriteCloser      = (*ClientConn)(nil)
+)
+
 type ClientConn struct {
 	*Dialer
-	v1net.Conn  // embedded Conn
+	v1net.Conn // embedded Conn
+	// key is a copy of the master key, which the session keys are derived
+	// from lazily, so that wiping the dialer leaves the conn working
+	key         []byte
 	destination metadata.Socksaddr
 	reader      *shadowio.Reader
 	writer      *shadowio.Writer
+	writeClosed bool
+	closed      bool
+	failed      error
+	nonBlocking bool
+	requestSalt []byte
+	// responseSalt holds the server salt as it arrives
+	responseSalt []byte
+	jitter       *jitter
+
+	createdAt     time.Time
+	requestSentAt time.Time
+	lastActivity  time.Time
+	armedDeadline time.Time
 }
 
 func (c *ClientConn) writeRequest(payload []byte) error {
 	requestBuffer := buf.New()
 	defer requestBuffer.Release()
-	requestBuffer.WriteRandom(c.keySaltLength)
+	salt := requestBuffer.WriteRandom(c.keySaltLength)
+	copy(salt, c.saltPrefix)
+	c.requestSalt = bytes.Clone(salt)
+	if c.requestSalts != nil {
+		c.requestSalts.Add(c.requestSalt)
+	}
 	key := buf.NewSize(c.keySaltLength)
-	defer key.Release()
+	defer releaseKey(key)
 	if err := Kdf(c.key, requestBuffer.Bytes(), key); err != nil {
 		slog.Error("failed to generate kdf for cipher", slog.Any("error", err))
 		return err
@@ -105,6 +280,20 @@ func (c *ClientConn) writeRequest(payload []byte) error {
 	}
 	bufferedRequestWriter := bufio.NewBufferedWriter(c.Conn, requestBuffer)
 	requestContentWriter := shadowio.NewWriter(bufferedRequestWriter, writeCipher, nil, MaxPacketSize)
+	var chunkPolicy shadowio.ChunkPolicy
+	if c.chunkPolicy != nil {
+		// the request and the stream share one policy so that a limit on
+		// the first chunks counts the request chunks too
+		chunkPolicy = c.chunkPolicy()
+		requestContentWriter.SetChunkPolicy(chunkPolicy)
+	}
+	if c.padding != nil {
+		// padding takes over the sizing of the request chunks
+		contentLength := metadata.SocksaddrSerializer.AddrPortLen(c.destination) + len(payload)
+		if sizes := c.requestChunkSizes(contentLength); sizes != nil {
+			requestContentWriter.SetChunkPolicy(&paddedChunkSize{padding: shadowio.SequenceChunkSize(sizes...), shared: chunkPolicy})
+		}
+	}
 	bufferedRequestContentWriter := bufio.NewBufferedWriter(requestContentWriter, buf.New())
 	if err = metadata.SocksaddrSerializer.WriteAddrPort(bufferedRequestContentWriter, c.destination); err != nil {
 		return err
@@ -122,19 +311,53 @@ func (c *ClientConn) writeRequest(payload []byte) error {
 		return err
 	}
 	c.writer = shadowio.NewWriter(c.Conn, writeCipher, requestContentWriter.TakeNonce(), MaxPacketSize)
+	if chunkPolicy != nil {
+		c.writer.SetChunkPolicy(chunkPolicy)
+	}
+	c.requestSentAt = time.Now()
+	c.touch()
+	if c.coalesceSize > 0 {
+		return c.writer.SetCoalescing(c.coalesceSize, c.coalesceDelay)
+	}
 	return nil
 }
 
+// readResponse reads the server salt and sets up the reader, keeping the
+// part of the salt read so far when the conn returns EAGAIN.
 func (c *ClientConn) readResponse() error {
-	buffer := buf.NewSize(c.keySaltLength)
-	defer buffer.Release()
-	if _, err := buffer.ReadFullFrom(c.Conn, c.keySaltLength); err != nil {
-		slog.Warn("failed to read salt", slog.Any("error", err))
-		return err
+	if c.responseSalt == nil {
+		c.responseSalt = make([]byte, 0, c.keySaltLength)
+	}
+	for len(c.responseSalt) < c.keySaltLength {
+		n, err := c.Conn.Read(c.responseSalt[len(c.responseSalt):c.keySaltLength])
+		c.responseSalt = c.responseSalt[:len(c.responseSalt)+n]
+		if len(c.responseSalt) == c.keySaltLength {
+			break
+		}
+		if errors.Is(err, syscall.EAGAIN) {
+			// the rest of the salt comes with a later read
+			return err
+		}
+		if err == io.EOF && len(c.responseSalt) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			slog.Warn("failed to read salt", slog.Any("error", err))
+			return fmt.Errorf("%w: %w", ErrBadSalt, err)
+		}
+	}
+	salt := c.responseSalt
+	if bytes.Equal(salt, c.requestSalt) || (c.requestSalts != nil && c.requestSalts.Contains(salt)) {
+		slog.Error("rejecting reflected server salt", slog.String("destination", c.destination.String()))
+		return fmt.Errorf("%w: %w", ErrBadSalt, ErrReflectedSalt)
+	}
+	if c.saltFilter != nil && !c.saltFilter.Check(salt) {
+		slog.Error("rejecting replayed server salt", slog.String("destination", c.destination.String()))
+		return fmt.Errorf("%w: %w", ErrBadSalt, ErrReplayedSalt)
 	}
 	key := buf.NewSize(c.keySaltLength)
-	defer key.Release()
-	if err := Kdf(c.key, buffer.Bytes(), key); err != nil {
+	defer releaseKey(key)
+	if err := Kdf(c.key, salt, key); err != nil {
 		slog.Error("failed to generate kdf for cipher", slog.Any("error", err))
 		return err
 	}
@@ -149,21 +372,68 @@ func (c *ClientConn) readResponse() error {
 }
 
 func (c *ClientConn) Read(p []byte) (n int, err error) {
+	if c.failed != nil {
+		return 0, c.failed
+	}
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	// reading means waiting for the server, which will not answer data
+	// still held back by coalescing
+	if err = c.releaseJitter(false); err != nil {
+		return
+	}
+	if err = c.Flush(); err != nil {
+		return
+	}
+	if err = c.armReadDeadline(); err != nil {
+		return
+	}
 	if c.reader == nil {
 		err = c.readResponse()
 		if err != nil {
+			return 0, c.checkTimeout(err)
+		}
+		if err = c.armReadDeadline(); err != nil {
 			return
 		}
 	}
-	buffer := buf.NewSize(len(p))
-	defer buffer.Release()
-	if err := c.reader.ReadBuffer(buffer); err != nil {
-		return 0, err
+	n, err = c.reader.Read(p)
+	if err != nil {
+		return n, c.checkTimeout(c.checkCredentials(err))
 	}
-	return copy(p, buffer.Bytes()), nil
+	c.touch()
+	return
+}
+
+// checkCredentials turns an authentication failure on the first response
+// chunk into ErrCredentialsRejected and logs it with the server context.
+func (c *ClientConn) checkCredentials(err error) error {
+	if err == nil || c.reader.Authenticated() || !errors.Is(err, ErrAuthFailed) {
+		return err
+	}
+	if c.failed != nil {
+		return c.failed
+	}
+	server := "unknown"
+	if remoteAddr := c.Conn.RemoteAddr(); remoteAddr != nil {
+		server = remoteAddr.String()
+	}
+	slog.Error("server rejected credentials",
+		slog.String("server", server),
+		slog.String("method", c.method),
+		slog.String("destination", c.destination.String()))
+	c.failed = fmt.Errorf("%w: %w", ErrCredentialsRejected, err)
+	return c.failed
 }
 
 func (c *ClientConn) Write(p []byte) (n int, err error) {
+	if c.writeClosed || c.closed {
+		return 0, net.ErrClosed
+	}
+	if err = c.checkStalled(); err != nil {
+		return
+	}
 	if c.writer == nil {
 		err = c.writeRequest(p)
 		if err == nil {
@@ -171,5 +441,164 @@ func (c *ClientConn) Write(p []byte) (n int, err error) {
 		}
 		return
 	}
-	return c.writer.Write(p)
+	if c.jitter.active() {
+		return c.writeJittered(p)
+	}
+	n, err = c.writer.Write(p)
+	if err == nil {
+		c.touch()
+	}
+	return
+}
+
+// Flush sends any data held back by write coalescing. Jittered writes are
+// left alone until they are due.
+func (c *ClientConn) Flush() error {
+	if c.writer == nil || c.writeClosed {
+		return nil
+	}
+	return c.writer.Flush()
+}
+
+// Close flushes pending writes, gives the stream buffers back to the pool,
+// wipes the copy of the master key and closes the underlying conn. Only
+// the master key copy is zeroed: the AEAD ciphers are dropped with their
+// expanded session keys left for the GC.
+func (c *ClientConn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	var flushErr error
+	if c.writer != nil {
+		if !c.writeClosed {
+			flushErr = errors.Join(c.releaseJitter(true), c.writer.Flush())
+		}
+		c.writer.Release()
+		c.writer = nil
+	}
+	if c.reader != nil {
+		c.reader.Release()
+		c.reader = nil
+	}
+	clear(c.key)
+	return errors.Join(flushErr, c.Conn.Close())
+}
+
+// SetNonBlock records the blocking mode so timeouts know whether they can
+// rely on conn deadlines, then forwards it to the underlying conn.
+func (c *ClientConn) SetNonBlock(nonblocking bool) error {
+	c.nonBlocking = nonblocking
+	return c.Conn.SetNonBlock(nonblocking)
+}
+
+// CloseWrite implements N.WriteCloser. Pending ciphertext is flushed, the
+// request header is sent if nothing was written yet, and then the
+// underlying conn is half-closed. Reads keep decrypting whatever the server
+// still sends until EOF.
+func (c *ClientConn) CloseWrite() error {
+	if c.closed {
+		return net.ErrClosed
+	}
+	if c.writeClosed {
+		return nil
+	}
+	if c.writer == nil {
+		if err := c.writeRequest(nil); err != nil {
+			return err
+		}
+	} else if err := errors.Join(c.releaseJitter(true), c.writer.Flush()); err != nil {
+		return err
+	}
+	c.writeClosed = true
+	return closeWrite(c.Conn)
+}
+
+// ReadFrom implements io.ReaderFrom so host copy loops can skip the
+// intermediate plaintext buffer. Reads still go through Write until the
+// request header is sent and the jittered writes are over.
+func (c *ClientConn) ReadFrom(r io.Reader) (n int64, err error) {
+	if c.writeClosed || c.closed {
+		return 0, net.ErrClosed
+	}
+	if err = c.checkStalled(); err != nil {
+		return
+	}
+	for c.writer == nil || c.jitter.active() {
+		payload := pool.Get(MaxPacketSize)
+		readN, readErr := r.Read(payload)
+		if readN > 0 {
+			_, err = c.Write(payload[:readN])
+			n += int64(readN)
+		}
+		pool.Put(payload)
+		if err != nil {
+			return
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				err = readErr
+			}
+			return
+		}
+	}
+	readN, err := c.writer.ReadFrom(r)
+	if readN > 0 {
+		c.touch()
+	}
+	return n + readN, err
+}
+
+// WriteTo implements io.WriterTo, handing every decrypted chunk to w
+// directly.
+func (c *ClientConn) WriteTo(w io.Writer) (n int64, err error) {
+	if c.failed != nil {
+		return 0, c.failed
+	}
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if err = c.Flush(); err != nil {
+		return
+	}
+	if err = c.armReadDeadline(); err != nil {
+		return
+	}
+	if c.reader == nil {
+		if err = c.readResponse(); err != nil {
+			return 0, c.checkTimeout(err)
+		}
+	}
+	if c.timeouts.enabled() {
+		w = &activityWriter{Writer: w, conn: c}
+		if err = c.armReadDeadline(); err != nil {
+			return
+		}
+	}
+	n, err = c.reader.WriteTo(w)
+	return n, c.checkTimeout(c.checkCredentials(err))
+}
+
+// WriteVectorised implements N.VectorisedWriter.
+func (c *ClientConn) WriteVectorised(buffers []*buf.Buffer) error {
+	if c.writeClosed || c.closed {
+		buf.ReleaseMulti(buffers)
+		return net.ErrClosed
+	}
+	if err := c.checkStalled(); err != nil {
+		buf.ReleaseMulti(buffers)
+		return err
+	}
+	if c.writer == nil || c.jitter.active() {
+		defer buf.ReleaseMulti(buffers)
+		payload := pool.Get(buf.LenMulti(buffers))
+		defer pool.Put(payload)
+		buf.CopyMulti(payload, buffers)
+		return common.Error(c.Write(payload))
+	}
+	if err := c.writer.WriteVectorised(buffers); err != nil {
+		return err
+	}
+	c.touch()
+	return nil
 }
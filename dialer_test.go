@@ -2,12 +2,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
 	"net"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/getlantern/tiny-shadowsocks/internal/conntest"
+	"github.com/getlantern/tiny-shadowsocks/internal/shadowio"
 	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/metadata"
 )
 
@@ -35,6 +42,31 @@ func (m *mockConn) SetWriteDeadline(t time.Time) error    { return nil }
 func (m *mockConn) SyscallConn() (syscall.RawConn, error) { return nil, nil }
 func (m *mockConn) SetNonBlock(nonblocking bool) error    { return nil }
 
+// listenTCP starts a loopback listener that hands its first accepted
+// connection to serve, and returns a v1net.Conn dialed to it.
+func listenTCP(t *testing.T, serve func(conn net.Conn)) v1net.Conn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &conntest.NetConn{Conn: conn}
+}
+
 func TestNewDialer(t *testing.T) {
 	t.Run("creating dialer with", func(t *testing.T) {
 		t.Run("valid method should return dialer", func(t *testing.T) {
@@ -52,15 +84,15 @@ func TestNewDialer(t *testing.T) {
 
 		t.Run("invalid method should return error", func(t *testing.T) {
 			_, err := newDialer("invalid-method", "password123")
-			if err == nil {
-				t.Error("Expected error for invalid method, got nil")
+			if !errors.Is(err, ErrUnsupportedMethod) {
+				t.Errorf("Expected ErrUnsupportedMethod for invalid method, got %v", err)
 			}
 		})
 
 		t.Run("empty password should return error", func(t *testing.T) {
 			_, err := newDialer("chacha20-ietf-poly1305", "")
-			if err == nil {
-				t.Error("Expected error for empty password, got nil")
+			if !errors.Is(err, ErrMissingPassword) {
+				t.Errorf("Expected ErrMissingPassword for empty password, got %v", err)
 			}
 		})
 	})
@@ -84,3 +116,498 @@ func TestDialConn_WriteRequest(t *testing.T) {
 		t.Error("Expected data to be written to mock connection")
 	}
 }
+
+// decodeRequest plays the server side of a request: it reads the salt
+// written by the client, derives the session key and returns the
+// destination and the decrypted payload.
+func decodeRequest(t *testing.T, d *Dialer, wire []byte) (metadata.Socksaddr, []byte) {
+	t.Helper()
+	key := buf.NewSize(d.keySaltLength)
+	defer key.Release()
+	if err := Kdf(d.key, wire[:d.keySaltLength], key); err != nil {
+		t.Fatalf("Kdf failed: %v", err)
+	}
+	readCipher, err := d.constructor(key.Bytes())
+	if err != nil {
+		t.Fatalf("failed to build cipher: %v", err)
+	}
+	reader := shadowio.NewReader(bytes.NewReader(wire[d.keySaltLength:]), readCipher)
+	destination, err := metadata.SocksaddrSerializer.ReadAddrPort(reader)
+	if err != nil {
+		t.Fatalf("failed to read destination: %v", err)
+	}
+	payload, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read payload: %v", err)
+	}
+	return destination, payload
+}
+
+// encodeResponse plays the server side of a response, returning the salt
+// followed by payload split into chunks.
+func encodeResponse(t *testing.T, d *Dialer, payload ...[]byte) []byte {
+	t.Helper()
+	var wire bytes.Buffer
+	salt := make([]byte, d.keySaltLength)
+	rand.Read(salt)
+	wire.Write(salt)
+	key := buf.NewSize(d.keySaltLength)
+	defer key.Release()
+	if err := Kdf(d.key, salt, key); err != nil {
+		t.Fatalf("Kdf failed: %v", err)
+	}
+	writeCipher, err := d.constructor(key.Bytes())
+	if err != nil {
+		t.Fatalf("failed to build cipher: %v", err)
+	}
+	writer := shadowio.NewWriter(&wire, writeCipher, nil, MaxPacketSize)
+	for _, p := range payload {
+		if _, err = writer.Write(p); err != nil {
+			t.Fatalf("failed to write response: %v", err)
+		}
+	}
+	return wire.Bytes()
+}
+
+func TestClientConn_ReadFrom(t *testing.T) {
+	d, _ := newDialer("chacha20-ietf-poly1305", "testpass")
+	writeBuf := &bytes.Buffer{}
+	conn := &mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf}
+	destination := metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080")
+	clientConn := d.DialEarlyConn(conn, destination).(*ClientConn)
+
+	payload := make([]byte, 3*MaxPacketSize+10)
+	rand.Read(payload)
+	n, err := clientConn.ReadFrom(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if n != int64(len(payload)) {
+		t.Errorf("Expected %d bytes read, got %d", len(payload), n)
+	}
+
+	gotDestination, got := decodeRequest(t, d, writeBuf.Bytes())
+	if gotDestination != destination {
+		t.Errorf("Expected destination %s, got %s", destination, gotDestination)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Expected server to decrypt the original payload")
+	}
+}
+
+func TestClientConn_WriteVectorised(t *testing.T) {
+	d, _ := newDialer("chacha20-ietf-poly1305", "testpass")
+	writeBuf := &bytes.Buffer{}
+	conn := &mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf}
+	clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080")).(*ClientConn)
+
+	if err := clientConn.WriteVectorised([]*buf.Buffer{buf.As([]byte("hello ")), buf.As([]byte("world"))}); err != nil {
+		t.Fatalf("WriteVectorised failed: %v", err)
+	}
+	if err := clientConn.WriteVectorised([]*buf.Buffer{buf.As([]byte(", ")), buf.As(bytes.Repeat([]byte("x"), MaxPacketSize))}); err != nil {
+		t.Fatalf("WriteVectorised failed: %v", err)
+	}
+
+	_, got := decodeRequest(t, d, writeBuf.Bytes())
+	expected := "hello world, " + string(bytes.Repeat([]byte("x"), MaxPacketSize))
+	if string(got) != expected {
+		t.Errorf("Expected %d bytes of vectorised payload, got %d", len(expected), len(got))
+	}
+}
+
+func TestClientConn_WriteTo(t *testing.T) {
+	d, _ := newDialer("chacha20-ietf-poly1305", "testpass")
+	first := []byte("first chunk")
+	second := make([]byte, MaxPacketSize+1)
+	rand.Read(second)
+	readBuf := bytes.NewBuffer(encodeResponse(t, d, first, second))
+	conn := &mockConn{readBuf: readBuf, writeBuf: &bytes.Buffer{}}
+	clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080")).(*ClientConn)
+
+	var got bytes.Buffer
+	n, err := clientConn.WriteTo(&got)
+	if err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if n != int64(len(first)+len(second)) {
+		t.Errorf("Expected %d bytes written, got %d", len(first)+len(second), n)
+	}
+	if !bytes.Equal(got.Bytes(), append(first, second...)) {
+		t.Error("Expected decrypted response to match server payload")
+	}
+}
+
+func TestClientConn_CoalescedWritesFlushOnRead(t *testing.T) {
+	d, _ := newDialerFromConfig(&config.Config{
+		Method:       "chacha20-ietf-poly1305",
+		Password:     "testpass",
+		CoalesceSize: 1024,
+	})
+	writeBuf := &bytes.Buffer{}
+	readBuf := bytes.NewBuffer(encodeResponse(t, d, []byte("pong")))
+	conn := &mockConn{readBuf: readBuf, writeBuf: writeBuf}
+	clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+
+	clientConn.Write([]byte("request"))
+	requestLen := writeBuf.Len()
+	for _, p := range []string{"p", "i", "n", "g"} {
+		clientConn.Write([]byte(p))
+	}
+	if writeBuf.Len() != requestLen {
+		t.Fatalf("Expected small writes to be coalesced, wire grew by %d bytes", writeBuf.Len()-requestLen)
+	}
+
+	p := make([]byte, 16)
+	n, err := clientConn.Read(p)
+	if err != nil || string(p[:n]) != "pong" {
+		t.Fatalf("Read = %q, %v", p[:n], err)
+	}
+	_, got := decodeRequest(t, d, writeBuf.Bytes())
+	if string(got) != "requestping" {
+		t.Errorf("Expected coalesced data to be flushed before reading, server got %q", got)
+	}
+}
+
+func TestClientConn_CoalesceDelay(t *testing.T) {
+	for _, tc := range []struct {
+		delayMs int
+		sent    string
+	}{
+		{0, ""},
+		// the second write finds the first one too old and sends both
+		{1, "ab"},
+	} {
+		d, _ := newDialerFromConfig(&config.Config{
+			Method:          "chacha20-ietf-poly1305",
+			Password:        "testpass",
+			CoalesceSize:    1024,
+			CoalesceDelayMs: tc.delayMs,
+		})
+		writeBuf := &bytes.Buffer{}
+		conn := &mockConn{readBuf: bytes.NewBuffer(encodeResponse(t, d, []byte("pong"))), writeBuf: writeBuf}
+		clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+		clientConn.Write(nil)
+
+		clientConn.Write([]byte("a"))
+		time.Sleep(2 * time.Millisecond)
+		clientConn.Write([]byte("b"))
+		clientConn.Write([]byte("c"))
+		if _, got := decodeRequest(t, d, writeBuf.Bytes()); string(got) != tc.sent {
+			t.Errorf("delay %dms: expected %q sent before reading, got %q", tc.delayMs, tc.sent, got)
+		}
+		// the read sends the rest however young it is
+		clientConn.Read(make([]byte, 16))
+		if _, got := decodeRequest(t, d, writeBuf.Bytes()); string(got) != "abc" {
+			t.Errorf("delay %dms: expected the read to send the rest, got %q", tc.delayMs, got)
+		}
+	}
+}
+
+func TestClientConn_CloseWrite(t *testing.T) {
+	d, _ := newDialer("chacha20-ietf-poly1305", "testpass")
+	response := make([]byte, 2*MaxPacketSize)
+	rand.Read(response)
+	wire := encodeResponse(t, d, response)
+	received := make(chan []byte, 1)
+	conn := listenTCP(t, func(conn net.Conn) {
+		// the server only answers once the client half-closed its side
+		request, _ := io.ReadAll(conn)
+		received <- request
+		conn.Write(wire)
+	})
+	clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+	if _, err := clientConn.Write([]byte("request body")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := clientConn.(*ClientConn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+	if _, err := clientConn.Write([]byte("late")); err == nil {
+		t.Error("Expected Write after CloseWrite to fail")
+	}
+
+	got, err := io.ReadAll(clientConn)
+	if err != nil {
+		t.Fatalf("ReadAll after CloseWrite failed: %v", err)
+	}
+	if !bytes.Equal(got, response) {
+		t.Error("Expected the full response to be decrypted after half-close")
+	}
+	if _, payload := decodeRequest(t, d, <-received); string(payload) != "request body" {
+		t.Errorf("Expected server to receive the request body, got %q", payload)
+	}
+}
+
+type closeTrackingConn struct {
+	mockConn
+	closed bool
+}
+
+func (c *closeTrackingConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestClientConn_Close(t *testing.T) {
+	d, _ := newDialerFromConfig(&config.Config{
+		Method:       "chacha20-ietf-poly1305",
+		Password:     "testpass",
+		CoalesceSize: 1024,
+	})
+	writeBuf := &bytes.Buffer{}
+	conn := &closeTrackingConn{mockConn: mockConn{readBuf: bytes.NewBuffer(encodeResponse(t, d, []byte("pong"))), writeBuf: writeBuf}}
+	clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080")).(*ClientConn)
+	clientConn.Write([]byte("request"))
+	clientConn.Read(make([]byte, 4))
+	clientConn.Write([]byte(" tail"))
+
+	if err := clientConn.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if !conn.closed {
+		t.Error("Expected underlying conn to be closed")
+	}
+	if clientConn.reader != nil || clientConn.writer != nil {
+		t.Error("Expected stream state to be released")
+	}
+	if _, payload := decodeRequest(t, d, writeBuf.Bytes()); string(payload) != "request tail" {
+		t.Errorf("Expected pending writes to be flushed on close, server got %q", payload)
+	}
+	if _, err := clientConn.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected net.ErrClosed after Close, got %v", err)
+	}
+	if err := clientConn.Close(); err != nil {
+		t.Errorf("Expected second Close to be a no-op, got %v", err)
+	}
+}
+
+func TestDialer_Wipe(t *testing.T) {
+	d, _ := newDialer("chacha20-ietf-poly1305", "testpass")
+	d.Wipe()
+	if !bytes.Equal(d.key, make([]byte, len(d.key))) {
+		t.Error("Expected master key to be zeroed")
+	}
+}
+
+func TestDialer_WipeLeavesConnsWorking(t *testing.T) {
+	d, _ := newDialer("chacha20-ietf-poly1305", "testpass")
+	writeBuf := &bytes.Buffer{}
+	conn := &mockConn{readBuf: bytes.NewBuffer(encodeResponse(t, d, []byte("hello"))), writeBuf: writeBuf}
+	clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+	clientConn.Write([]byte("request"))
+
+	// reconfiguring wipes the dialer while the conn is still in use
+	d.Wipe()
+	buffer := make([]byte, 16)
+	n, err := clientConn.Read(buffer)
+	if err != nil || string(buffer[:n]) != "hello" {
+		t.Fatalf("Expected the response to decrypt after Wipe, got %q, %v", buffer[:n], err)
+	}
+	clientConn.Close()
+	if key := clientConn.(*ClientConn).key; !bytes.Equal(key, make([]byte, len(key))) {
+		t.Error("Expected Close to zero the copy of the master key")
+	}
+}
+
+// dripConn hands out the response one byte per read with an EAGAIN
+// before each, like a non-blocking conn the data trickles into.
+type dripConn struct {
+	mockConn
+	ready bool
+}
+
+func (c *dripConn) Read(b []byte) (int, error) {
+	if c.ready = !c.ready; !c.ready {
+		return 0, syscall.EAGAIN
+	}
+	return c.mockConn.Read(b[:min(len(b), 1)])
+}
+
+func TestClientConn_ReadResumesAfterEAGAIN(t *testing.T) {
+	d, _ := newDialer("chacha20-ietf-poly1305", "testpass")
+	conn := &dripConn{mockConn: mockConn{
+		readBuf:  bytes.NewBuffer(encodeResponse(t, d, []byte("first"), []byte("second"))),
+		writeBuf: &bytes.Buffer{},
+	}}
+	clientConn, _ := d.DialConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+	clientConn.SetNonBlock(true)
+
+	var got []byte
+	buffer := make([]byte, 16)
+	for {
+		n, err := clientConn.Read(buffer)
+		got = append(got, buffer[:n]...)
+		if errors.Is(err, syscall.EAGAIN) {
+			continue
+		}
+		if err != nil {
+			break
+		}
+	}
+	if string(got) != "firstsecond" {
+		t.Errorf("Expected the salt and chunks to survive the EAGAINs, got %q", got)
+	}
+}
+
+func TestClientConn_ReadErrors(t *testing.T) {
+	d, _ := newDialer("chacha20-ietf-poly1305", "testpass")
+	other, _ := newDialer("chacha20-ietf-poly1305", "otherpass")
+	destination := metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080")
+	corrupted := encodeResponse(t, d, []byte("first"), []byte("second"))
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	for _, tc := range []struct {
+		name          string
+		response      []byte
+		reads         int
+		expected      error
+		credentialErr bool
+	}{
+		{"truncated salt", encodeResponse(t, d, []byte("pong"))[:10], 1, ErrBadSalt, false},
+		{"wrong password", encodeResponse(t, other, []byte("pong")), 1, ErrAuthFailed, true},
+		{"corrupted after first chunk", corrupted, 2, ErrAuthFailed, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := &mockConn{readBuf: bytes.NewBuffer(tc.response), writeBuf: &bytes.Buffer{}}
+			clientConn := d.DialEarlyConn(conn, destination)
+			var err error
+			for i := 0; i < tc.reads && err == nil; i++ {
+				_, err = clientConn.Read(make([]byte, 16))
+			}
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, err)
+			}
+			if errors.Is(err, ErrCredentialsRejected) != tc.credentialErr {
+				t.Errorf("Expected credentials rejected to be %v, got %v", tc.credentialErr, err)
+			}
+		})
+	}
+}
+
+func TestClientConn_CredentialsRejectedIsSticky(t *testing.T) {
+	d, _ := newDialer("chacha20-ietf-poly1305", "testpass")
+	other, _ := newDialer("chacha20-ietf-poly1305", "otherpass")
+	readBuf := bytes.NewBuffer(encodeResponse(t, other, []byte("pong"), []byte("more")))
+	clientConn := d.DialEarlyConn(&mockConn{readBuf: readBuf, writeBuf: &bytes.Buffer{}}, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+
+	_, first := clientConn.Read(make([]byte, 16))
+	remaining := readBuf.Len()
+	_, second := clientConn.Read(make([]byte, 16))
+	if !errors.Is(first, ErrCredentialsRejected) || second != first {
+		t.Errorf("Expected the same rejection on every read, got %v then %v", first, second)
+	}
+	if readBuf.Len() != remaining {
+		t.Error("Expected no further reads from the conn after rejection")
+	}
+}
+
+func TestClientConn_ReplayedResponse(t *testing.T) {
+	d, _ := newDialerFromConfig(&config.Config{Method: "chacha20-ietf-poly1305", Password: "testpass"})
+	response := encodeResponse(t, d, []byte("pong"))
+	destination := metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080")
+
+	first := d.DialEarlyConn(&mockConn{readBuf: bytes.NewBuffer(response), writeBuf: &bytes.Buffer{}}, destination)
+	if _, err := first.Read(make([]byte, 16)); err != nil {
+		t.Fatalf("Expected original response to be accepted, got %v", err)
+	}
+
+	replayed := d.DialEarlyConn(&mockConn{readBuf: bytes.NewBuffer(response), writeBuf: &bytes.Buffer{}}, destination)
+	_, err := replayed.Read(make([]byte, 16))
+	if !errors.Is(err, ErrReplayedSalt) || !errors.Is(err, ErrBadSalt) {
+		t.Errorf("Expected replayed response to be rejected, got %v", err)
+	}
+}
+
+func TestNewDialerFromConfig_ReplayFilterDisabled(t *testing.T) {
+	d, _ := newDialerFromConfig(&config.Config{Method: "chacha20-ietf-poly1305", Password: "testpass", ReplayFilterCapacity: -1})
+	if d.saltFilter != nil {
+		t.Error("Expected a negative capacity to disable the replay filter")
+	}
+}
+
+func TestClientConn_ReflectedRequest(t *testing.T) {
+	d, _ := newDialerFromConfig(&config.Config{Method: "chacha20-ietf-poly1305", Password: "testpass"})
+	destination := metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080")
+
+	// a reflecting middlebox sends the client's own request back as the
+	// response; both directions derive keys the same way, so without the
+	// check the reflected chunks would decrypt
+	t.Run("on the same connection", func(t *testing.T) {
+		conn := &mockConn{readBuf: &bytes.Buffer{}, writeBuf: &bytes.Buffer{}}
+		clientConn := d.DialEarlyConn(conn, destination)
+		clientConn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		conn.readBuf.Write(conn.writeBuf.Bytes())
+
+		_, err := clientConn.Read(make([]byte, 64))
+		if !errors.Is(err, ErrReflectedSalt) || !errors.Is(err, ErrBadSalt) {
+			t.Errorf("Expected reflected salt to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("from another connection", func(t *testing.T) {
+		first := &mockConn{readBuf: &bytes.Buffer{}, writeBuf: &bytes.Buffer{}}
+		d.DialEarlyConn(first, destination).Write([]byte("first request"))
+
+		second := &mockConn{readBuf: bytes.NewBuffer(first.writeBuf.Bytes()), writeBuf: &bytes.Buffer{}}
+		clientConn := d.DialEarlyConn(second, destination)
+		clientConn.Write([]byte("second request"))
+		_, err := clientConn.Read(make([]byte, 64))
+		if !errors.Is(err, ErrReflectedSalt) {
+			t.Errorf("Expected salt of a recent request to be rejected, got %v", err)
+		}
+	})
+}
+
+func TestNewDialerFromConfig_SaltPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		prefix   string
+		expected []byte
+		valid    bool
+	}{
+		{"raw", "POST ", []byte("POST "), true},
+		{"escaped", "%16%03%01%00%C2%A8%01%01", []byte{0x16, 0x03, 0x01, 0x00, 0xc2, 0xa8, 0x01, 0x01}, true},
+		{"longest", string(bytes.Repeat([]byte("x"), 16)), bytes.Repeat([]byte("x"), 16), true},
+		{"too long", string(bytes.Repeat([]byte("x"), 17)), nil, false},
+		{"bad escape", "%zz", nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := newDialerFromConfig(&config.Config{Method: "chacha20-ietf-poly1305", Password: "testpass", SaltPrefix: tc.prefix})
+			if !tc.valid {
+				if !errors.Is(err, ErrInvalidSaltPrefix) {
+					t.Errorf("Expected ErrInvalidSaltPrefix, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newDialerFromConfig failed: %v", err)
+			}
+			if !bytes.Equal(d.saltPrefix, tc.expected) {
+				t.Errorf("Expected prefix %x, got %x", tc.expected, d.saltPrefix)
+			}
+		})
+	}
+}
+
+func TestClientConn_SaltPrefix(t *testing.T) {
+	d, _ := newDialerFromConfig(&config.Config{Method: "chacha20-ietf-poly1305", Password: "testpass", SaltPrefix: "%16%03%01"})
+	var salts [][]byte
+	for i := 0; i < 2; i++ {
+		writeBuf := &bytes.Buffer{}
+		conn := &mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf}
+		clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+		clientConn.Write([]byte("hello"))
+
+		wire := writeBuf.Bytes()
+		if !bytes.HasPrefix(wire, []byte{0x16, 0x03, 0x01}) {
+			t.Fatalf("Expected the salt to start with the prefix, got %x", wire[:8])
+		}
+		if _, got := decodeRequest(t, d, wire); string(got) != "hello" {
+			t.Errorf("Expected the server to derive the key from the prefixed salt, got %q", got)
+		}
+		salts = append(salts, bytes.Clone(wire[3:d.keySaltLength]))
+	}
+	if bytes.Equal(salts[0], salts[1]) {
+		t.Error("Expected the rest of the salt to stay random")
+	}
+}
@@ -6,6 +6,8 @@ import (
 
 	"github.com/CosmWasm/tinyjson"
 	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/getlantern/tiny-shadowsocks/internal/mux"
+	"github.com/getlantern/tiny-shadowsocks/internal/pool"
 	v1 "github.com/refraction-networking/watm/tinygo/v1"
 	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
 	"github.com/sagernet/sing/common/metadata"
@@ -15,6 +17,9 @@ type ShadowsocksFixedDialingTransport struct {
 	dialer            func(network, address string) (v1net.Conn, error)
 	shadowsocksDialer *Dialer
 	destination       metadata.Socksaddr
+	// mux opens the streams when they are multiplexed, reusing the
+	// sessions of earlier dials
+	mux *mux.Client
 }
 
 var _ v1.FixedDialingTransport = (*ShadowsocksFixedDialingTransport)(nil)
@@ -25,13 +30,38 @@ func (fdt *ShadowsocksFixedDialingTransport) SetDialer(dialer func(network, addr
 }
 
 func (fdt *ShadowsocksFixedDialingTransport) DialFixed() (v1net.Conn, error) {
-	conn, err := fdt.dialer("tcp", "127.0.0.1:7777") // TODO: hardcoded address, any better idea?
+	if fdt.mux != nil {
+		stream, err := fdt.mux.Open(fdt.destination)
+		if err != nil {
+			return nil, err
+		}
+		return stream, stream.SetNonBlock(true)
+	}
+	conn, err := fdt.dialServer()
 	if err != nil {
-		slog.Error("failed to dial with dialer: ", slog.Any("error", err))
 		return nil, err
 	}
+	clientConn := fdt.shadowsocksDialer.DialEarlyConn(conn, fdt.destination)
+	return clientConn, clientConn.SetNonBlock(true) // must set non-block, otherwise will block on read and lose fairness
+}
 
-	return fdt.shadowsocksDialer.DialEarlyConn(conn, fdt.destination), conn.SetNonBlock(true) // must set non-block, otherwise will block on read and lose fairness
+// dialServer dials the server and wraps the conn with the plugin, if any,
+// which may dial it again when the conn breaks.
+func (fdt *ShadowsocksFixedDialingTransport) dialServer() (v1net.Conn, error) {
+	dial := func() (v1net.Conn, error) {
+		return fdt.dialer(fdt.shadowsocksDialer.network, "127.0.0.1:7777") // TODO: hardcoded address, any better idea?
+	}
+	conn, err := dial()
+	if err != nil {
+		slog.Error("failed to dial with dialer: ", slog.Any("error", err))
+		return nil, err
+	}
+	wrappedConn, err := fdt.shadowsocksDialer.wrapRedial(conn, dial)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return wrappedConn, nil
 }
 
 func (fdt *ShadowsocksFixedDialingTransport) Configure(cfg []byte) error {
@@ -41,11 +71,32 @@ func (fdt *ShadowsocksFixedDialingTransport) Configure(cfg []byte) error {
 		return err
 	}
 
-	dialer, err := newDialer(parsedConfig.Method, parsedConfig.Password)
+	if parsedConfig.BufferPoolSize != 0 {
+		pool.SetLimit(parsedConfig.BufferPoolSize)
+	}
+
+	dialer, err := newDialerFromConfig(&parsedConfig)
 	if err != nil {
 		return fmt.Errorf("failed to create dialer: %w", err)
 	}
+	if fdt.shadowsocksDialer != nil {
+		// the previous master key is no longer needed once replaced
+		fdt.shadowsocksDialer.Wipe()
+	}
 	fdt.shadowsocksDialer = dialer
 	fdt.destination = metadata.ParseSocksaddrHostPortStr(parsedConfig.RemoteAddr, parsedConfig.RemotePort)
+	if fdt.mux != nil {
+		fdt.mux.Close()
+		fdt.mux = nil
+	}
+	if dialer.mux != nil {
+		fdt.mux = mux.NewClient(func() (v1net.Conn, error) {
+			conn, err := fdt.dialServer()
+			if err != nil {
+				return nil, err
+			}
+			return dialer.DialEarlyConn(conn, mux.Destination), nil
+		}, *dialer.mux)
+	}
 	return nil
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	"github.com/getlantern/tiny-shadowsocks/internal/shadowio"
+)
+
+// Errors returned by the dialer and its connections. They are wrapped with
+// context, so callers match them with errors.Is.
+var (
+	// ErrAuthFailed means a chunk from the server did not authenticate.
+	ErrAuthFailed = shadowio.ErrAuthFailed
+	// ErrBadSalt means the server salt could not be read or was rejected.
+	ErrBadSalt = shadowio.ErrBadSalt
+	// ErrChunkLength means a chunk from the server declared a length above
+	// MaxPacketSize.
+	ErrChunkLength = shadowio.ErrChunkLength
+	// ErrNonceExhausted means a session key ran out of nonces.
+	ErrNonceExhausted = shadowio.ErrNonceExhausted
+	// ErrUnknownPlugin means no built-in plugin has the configured name.
+	ErrUnknownPlugin = plugin.ErrUnknownPlugin
+	// ErrInvalidPluginOptions means the plugin options are malformed or
+	// rejected by the plugin.
+	ErrInvalidPluginOptions = plugin.ErrInvalidOptions
+	// ErrUnknownTransport means the configured transport is not one of the
+	// built-in ones.
+	ErrUnknownTransport = errors.New("shadowsocks: unknown transport")
+	// ErrUnsupportedMethod means the configured method is not one of the
+	// supported AEAD ciphers.
+	ErrUnsupportedMethod = errors.New("shadowsocks: unsupported method")
+	// ErrCredentialsRejected means the very first chunk from the server did
+	// not authenticate, so the server and the client disagree on the
+	// password or the method rather than the stream being corrupted.
+	ErrCredentialsRejected = errors.New("shadowsocks: credentials rejected, wrong password or method")
+	// ErrReplayedSalt means the server salt was already seen, so the
+	// response is a replay. It is returned wrapped in ErrBadSalt.
+	ErrReplayedSalt = errors.New("shadowsocks: replayed salt")
+	// ErrReflectedSalt means the server salt is one the client used for its
+	// own requests, so the response is the client's traffic reflected back
+	// at it. It is returned wrapped in ErrBadSalt.
+	ErrReflectedSalt = errors.New("shadowsocks: reflected salt")
+	// ErrInvalidChunkPolicy means the chunk sizing settings are unknown or
+	// out of range.
+	ErrInvalidChunkPolicy = errors.New("shadowsocks: invalid chunk policy")
+	// ErrInvalidJitter means the write jitter settings are out of range.
+	ErrInvalidJitter = errors.New("shadowsocks: invalid jitter")
+	// ErrInvalidSaltPrefix means the salt prefix is not valid URL escaping
+	// or leaves too few random salt bytes.
+	ErrInvalidSaltPrefix = errors.New("shadowsocks: invalid salt prefix")
+	// ErrInvalidPadding means the padding policy is unknown or its buckets
+	// are out of range.
+	ErrInvalidPadding = errors.New("shadowsocks: invalid padding policy")
+	// ErrInvalidMultiplex means the multiplexing protocol is unknown or its
+	// limits are negative.
+	ErrInvalidMultiplex = errors.New("shadowsocks: invalid multiplex settings")
+	// ErrInvalidHops means a hop of the chain has no valid server address
+	// or cannot be combined with the other settings.
+	ErrInvalidHops = errors.New("shadowsocks: invalid hops")
+	// ErrMissingPassword means no password was configured.
+	ErrMissingPassword = errors.New("shadowsocks: password is required")
+	// ErrTimeout is matched by every timeout the module enforces on its
+	// own.
+	ErrTimeout = errors.New("shadowsocks: timeout")
+)
+
+// TimeoutError reports which phase of a connection stalled. It implements
+// net.Error and matches ErrTimeout with errors.Is.
+type TimeoutError struct {
+	Phase string
+}
+
+func (e *TimeoutError) Error() string   { return "shadowsocks: " + e.Phase + " timeout" }
+func (e *TimeoutError) Timeout() bool   { return true }
+func (e *TimeoutError) Temporary() bool { return false }
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+var (
+	_ net.Error = (*TimeoutError)(nil)
+
+	// ErrHandshakeTimeout means the server salt did not arrive in time.
+	ErrHandshakeTimeout = &TimeoutError{Phase: "handshake"}
+	// ErrFirstByteTimeout means no response chunk arrived in time after
+	// the request was sent.
+	ErrFirstByteTimeout = &TimeoutError{Phase: "first byte"}
+	// ErrIdleTimeout means the connection saw no traffic for too long.
+	ErrIdleTimeout = &TimeoutError{Phase: "idle"}
+)
@@ -12,6 +12,7 @@ require (
 	github.com/refraction-networking/watm v0.7.0-beta
 	github.com/sagernet/sing v0.6.11
 	golang.org/x/crypto v0.24.0
+	golang.org/x/net v0.26.0
 )
 
 require (
@@ -20,5 +21,6 @@ require (
 	github.com/josharian/intern v1.0.0 // indirect
 	github.com/tetratelabs/wazero v1.7.3 // indirect
 	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
 )
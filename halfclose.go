@@ -0,0 +1,15 @@
+package main
+
+import (
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// closeWrite half-closes conn. Wrappers that know how to do it themselves
+// are asked first, otherwise the write side of the socket is shut down.
+func closeWrite(conn v1net.Conn) error {
+	if c, ok := conn.(N.WriteCloser); ok {
+		return c.CloseWrite()
+	}
+	return shutdownWrite(conn.Fd())
+}
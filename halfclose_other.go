@@ -0,0 +1,9 @@
+//go:build !(wasi || wasip1)
+
+package main
+
+import "errors"
+
+func shutdownWrite(fd int32) error {
+	return errors.ErrUnsupported
+}
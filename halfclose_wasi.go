@@ -0,0 +1,18 @@
+//go:build wasi || wasip1
+
+package main
+
+import "syscall"
+
+const sdflagsWR = 2 // __WASI_SDFLAGS_WR
+
+//go:wasmimport wasi_snapshot_preview1 sock_shutdown
+//go:noescape
+func sock_shutdown(fd int32, how uint32) uint32
+
+func shutdownWrite(fd int32) error {
+	if errno := sock_shutdown(fd, sdflagsWR); errno != 0 {
+		return syscall.Errno(errno)
+	}
+	return nil
+}
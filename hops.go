@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/getlantern/tiny-shadowsocks/config"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+// hop runs the conn through a shadowsocks server in front of the server,
+// asking it to connect to the next hop. Its dialer has the method and key
+// of the hop. The first hop also takes the stream settings of the config,
+// since its stream is the one the network sees.
+type hop struct {
+	dialer      *Dialer
+	destination metadata.Socksaddr
+}
+
+// newHops builds the hops of cfg in the order the conn passes them, nil
+// when there are none.
+func newHops(cfg *config.Config) ([]*hop, error) {
+	if len(cfg.Hops) == 0 {
+		return nil, nil
+	}
+	if serverNetwork(cfg) == "udp" {
+		return nil, fmt.Errorf("%w: hops cannot be combined with kcp", ErrInvalidHops)
+	}
+	hops := make([]*hop, len(cfg.Hops))
+	for i, h := range cfg.Hops {
+		next := cfg.ServerAddr
+		if i+1 < len(cfg.Hops) {
+			next = cfg.Hops[i+1].ServerAddr
+		}
+		destination, err := parseServerAddr(next)
+		if err != nil {
+			return nil, fmt.Errorf("%w: hop %d: %w", ErrInvalidHops, i+1, err)
+		}
+		dialer, err := newDialer(h.Method, h.Password)
+		if err != nil {
+			return nil, fmt.Errorf("%w: hop %d: %w", ErrInvalidHops, i+1, err)
+		}
+		hops[i] = &hop{dialer: dialer, destination: destination}
+	}
+	return hops, nil
+}
+
+// parseServerAddr parses the host and port a hop connects to.
+func parseServerAddr(addr string) (metadata.Socksaddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return metadata.Socksaddr{}, err
+	}
+	destination := metadata.ParseSocksaddrHostPortStr(host, port)
+	if !destination.IsValid() || destination.Port == 0 {
+		return metadata.Socksaddr{}, fmt.Errorf("bad server address %q", addr)
+	}
+	return destination, nil
+}
+
+// WrapConn makes the hop a plugin. The request to the next hop goes with
+// the first write.
+func (h *hop) WrapConn(conn v1net.Conn) (v1net.Conn, error) {
+	return h.dialer.DialEarlyConn(conn, h.destination), nil
+}
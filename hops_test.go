@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/getlantern/tiny-shadowsocks/internal/conntest"
+	"github.com/getlantern/tiny-shadowsocks/internal/shadowio"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+// sessionCipher derives the cipher of a session the way a server keyed
+// like d does.
+func sessionCipher(t *testing.T, d *Dialer, salt []byte) cipher.AEAD {
+	t.Helper()
+	key := buf.NewSize(d.keySaltLength)
+	defer key.Release()
+	if err := Kdf(d.key, salt, key); err != nil {
+		t.Errorf("Kdf failed: %v", err)
+	}
+	aead, err := d.constructor(key.Bytes())
+	if err != nil {
+		t.Errorf("failed to build cipher: %v", err)
+	}
+	return aead
+}
+
+// listenShadowsocks starts a stand-in shadowsocks server keyed like d. It
+// relays every conn to the destination of its request, or echoes it when
+// echo is set, and reports the destinations it was asked for.
+func listenShadowsocks(t *testing.T, d *Dialer, echo bool) (addr string, destinations chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	destinations = make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		salt := make([]byte, d.keySaltLength)
+		if _, err := io.ReadFull(conn, salt); err != nil {
+			return
+		}
+		reader := shadowio.NewReader(conn, sessionCipher(t, d, salt))
+		destination, err := metadata.SocksaddrSerializer.ReadAddrPort(reader)
+		if err != nil {
+			return
+		}
+		destinations <- destination.String()
+		responseSalt := make([]byte, d.keySaltLength)
+		rand.Read(responseSalt)
+		conn.Write(responseSalt)
+		writer := shadowio.NewWriter(conn, sessionCipher(t, d, responseSalt), nil, MaxPacketSize)
+		if echo {
+			io.Copy(writer, reader)
+			return
+		}
+		next, err := net.Dial("tcp", destination.String())
+		if err != nil {
+			return
+		}
+		defer next.Close()
+		go io.Copy(next, reader)
+		io.Copy(writer, next)
+	}()
+	return listener.Addr().String(), destinations
+}
+
+func TestHops(t *testing.T) {
+	cfg := &config.Config{
+		Method:     "chacha20-ietf-poly1305",
+		Password:   "server",
+		RemoteAddr: "example.com",
+		RemotePort: "443",
+		Hops: []config.Hop{
+			{Method: "xchacha20-ietf-poly1305", Password: "jump"},
+			{Method: "chacha20-ietf-poly1305", Password: "middle"},
+		},
+	}
+	server, _ := newDialer(cfg.Method, cfg.Password)
+	jump, _ := newDialer(cfg.Hops[0].Method, cfg.Hops[0].Password)
+	middle, _ := newDialer(cfg.Hops[1].Method, cfg.Hops[1].Password)
+	var destinations [3]chan string
+	cfg.ServerAddr, destinations[2] = listenShadowsocks(t, server, true)
+	cfg.Hops[1].ServerAddr, destinations[1] = listenShadowsocks(t, middle, false)
+	cfg.Hops[0].ServerAddr, destinations[0] = listenShadowsocks(t, jump, false)
+	d, err := newDialerFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("newDialerFromConfig failed: %v", err)
+	}
+
+	raw, err := net.Dial("tcp", cfg.Hops[0].ServerAddr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	wrapped, err := d.wrapConn(&conntest.NetConn{Conn: raw})
+	if err != nil {
+		t.Fatalf("wrapConn failed: %v", err)
+	}
+	conn := d.DialEarlyConn(wrapped, metadata.ParseSocksaddrHostPortStr(cfg.RemoteAddr, cfg.RemotePort))
+	defer conn.Close()
+	message := bytes.Repeat([]byte("over two hops "), 5000)
+	if _, err := conn.Write(message); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	echoed := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(echoed, message) {
+		t.Error("Expected the server to echo through both hops")
+	}
+	// each hop is asked for the next one, the server for the destination
+	for i, expected := range []string{cfg.Hops[1].ServerAddr, cfg.ServerAddr, "example.com:443"} {
+		if got := <-destinations[i]; got != expected {
+			t.Errorf("Expected hop %d to be asked for %s, got %s", i+1, expected, got)
+		}
+	}
+
+	d.Wipe()
+	for i, hop := range d.hops {
+		if !bytes.Equal(hop.dialer.key, make([]byte, len(hop.dialer.key))) {
+			t.Errorf("Expected the key of hop %d to be wiped", i+1)
+		}
+	}
+}
+
+func TestNewHops_Invalid(t *testing.T) {
+	for _, cfg := range []config.Config{
+		{ServerAddr: "example.com", Hops: []config.Hop{{Method: "chacha20-ietf-poly1305", Password: "jump"}}},
+		{ServerAddr: "example.com:8388", Hops: []config.Hop{{Method: "rc4-md5", Password: "jump"}}},
+		{ServerAddr: "example.com:8388", Hops: []config.Hop{{Method: "chacha20-ietf-poly1305"}}},
+		{ServerAddr: "example.com:8388", Hops: []config.Hop{
+			{Method: "chacha20-ietf-poly1305", Password: "jump"},
+			{Method: "chacha20-ietf-poly1305", Password: "middle", ServerAddr: "middle:ss"},
+		}},
+		{ServerAddr: "example.com:8388", Transport: "kcp", Hops: []config.Hop{{Method: "chacha20-ietf-poly1305", Password: "jump"}}},
+	} {
+		cfg.Method, cfg.Password = "chacha20-ietf-poly1305", "testpass"
+		if _, err := newDialerFromConfig(&cfg); !errors.Is(err, ErrInvalidHops) {
+			t.Errorf("Expected %+v to be rejected, got %v", cfg, err)
+		}
+	}
+}
+
+func TestNewPlugin_HopsBehindProxy(t *testing.T) {
+	requests := make(chan string, 1)
+	raw := listenTCP(t, func(conn net.Conn) {
+		header := make([]byte, len("CONNECT jump.example.com:8388"))
+		io.ReadFull(conn, header)
+		requests <- string(header)
+	})
+	fdt := &ShadowsocksFixedDialingTransport{}
+	fdt.SetDialer(func(network, address string) (v1net.Conn, error) { return raw, nil })
+	err := fdt.Configure([]byte(`{"method":"chacha20-ietf-poly1305","password":"abc123","remote_addr":"example.com","remote_port":"443","server_addr":"ss.example.com:8388","hops":[{"server_addr":"jump.example.com:8388","method":"chacha20-ietf-poly1305","password":"jump"}],"proxy":"http"}`))
+	if err != nil {
+		t.Fatalf("Expected configuration success, got error: %v", err)
+	}
+	go fdt.DialFixed()
+	if got := <-requests; got != "CONNECT jump.example.com:8388" {
+		t.Errorf("Expected the proxy to connect to the first hop, got %q", got)
+	}
+}
+
+func TestHops_ShapeFirstHop(t *testing.T) {
+	cfg := &config.Config{
+		Method:            "chacha20-ietf-poly1305",
+		Password:          "server",
+		ServerAddr:        "server.example.com:8388",
+		SaltPrefix:        "GET ",
+		JitterWrites:      1,
+		IdleTimeoutMs:     1000,
+		ChunkPolicy:       "fixed",
+		ChunkSize:         100,
+		ChunkPolicyChunks: 2,
+		Hops:              []config.Hop{{ServerAddr: "jump.example.com:8388", Method: "chacha20-ietf-poly1305", Password: "jump"}},
+	}
+	d, err := newDialerFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("newDialerFromConfig failed: %v", err)
+	}
+	first := d.hops[0].dialer
+	if first.chunkPolicy == nil || first.jitterPolicy == nil || first.timeouts.idle == 0 || first.saltFilter == nil {
+		t.Error("Expected the first hop to take the stream settings")
+	}
+	if d.chunkPolicy != nil || d.jitterPolicy != nil || d.saltPrefix != nil {
+		t.Error("Expected the stream to the server to go without shaping")
+	}
+	if d.timeouts.idle == 0 || d.saltFilter == nil {
+		t.Error("Expected the stream to the server to keep the timeouts and the replay filter")
+	}
+
+	writeBuf := &bytes.Buffer{}
+	wrapped, err := d.wrapConn(&mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf})
+	if err != nil {
+		t.Fatalf("wrapConn failed: %v", err)
+	}
+	d.DialEarlyConn(wrapped, metadata.ParseSocksaddrHostPortStr("example.com", "443")).Write([]byte("request"))
+	if !bytes.HasPrefix(writeBuf.Bytes(), []byte("GET ")) {
+		t.Errorf("Expected the salt prefix on the wire, got %q", writeBuf.Bytes()[:4])
+	}
+}
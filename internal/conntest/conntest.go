@@ -0,0 +1,90 @@
+// Package conntest provides the v1net.Conn stand-ins shared by the tests
+// of the module and its plugins.
+package conntest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+// NetConn adapts a host net.Conn to v1net.Conn so tests can run a client
+// against local stand-in servers. Once Flaky is set, reads return at most
+// three bytes with an EAGAIN before each.
+type NetConn struct {
+	net.Conn
+	Flaky bool
+	again bool
+}
+
+func (c *NetConn) Read(p []byte) (int, error) {
+	if !c.Flaky {
+		return c.Conn.Read(p)
+	}
+	if c.again = !c.again; c.again {
+		return 0, syscall.EAGAIN
+	}
+	return c.Conn.Read(p[:min(len(p), 3)])
+}
+
+func (c *NetConn) Fd() int32                             { return 0 }
+func (c *NetConn) SyscallConn() (syscall.RawConn, error) { return nil, nil }
+func (c *NetConn) SetNonBlock(nonblocking bool) error    { return nil }
+
+// CloseWrite half-closes the host conn when it supports it.
+func (c *NetConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// ScriptedConn returns its Reads one by one, EAGAIN in between, the way a
+// non-blocking WATM conn hands over data as it arrives. Once the script
+// is done it returns io.EOF, or keeps returning EAGAIN with Open set.
+// Writes go to Written. With ShortWrites set, every other write is
+// refused with EAGAIN and the others take at most ShortWrites bytes, like
+// a full socket buffer.
+type ScriptedConn struct {
+	v1net.Conn
+	Reads       [][]byte
+	Written     bytes.Buffer
+	Again       bool
+	Open        bool
+	ShortWrites int
+	refuse      bool
+}
+
+func (c *ScriptedConn) Read(p []byte) (int, error) {
+	if c.Again = !c.Again; c.Again {
+		return 0, syscall.EAGAIN
+	}
+	if len(c.Reads) == 0 {
+		if c.Open {
+			return 0, syscall.EAGAIN
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, c.Reads[0])
+	if c.Reads[0] = c.Reads[0][n:]; len(c.Reads[0]) == 0 {
+		c.Reads = c.Reads[1:]
+	}
+	return n, nil
+}
+
+func (c *ScriptedConn) Write(p []byte) (int, error) {
+	if c.ShortWrites > 0 {
+		if c.refuse = !c.refuse; c.refuse {
+			return 0, syscall.EAGAIN
+		}
+		p = p[:min(len(p), c.ShortWrites)]
+	}
+	return c.Written.Write(p)
+}
+
+func (c *ScriptedConn) SetNonBlock(nonblocking bool) error { return nil }
+func (c *ScriptedConn) Close() error                       { return nil }
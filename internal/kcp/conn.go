@@ -0,0 +1,318 @@
+// Package kcp carries a byte stream over UDP with the KCP protocol the way
+// kcp-go, and so kcptun, does: the stream is cut into segments the peer
+// acknowledges, lost ones are retransmitted faster than TCP would, packets
+// may carry Reed-Solomon parity shards to recover losses without a
+// retransmission, and every packet is encrypted with one of kcptun's
+// crypts.
+//
+// There are no goroutines or timers under TinyGo, so retransmissions are
+// only sent when the conn is read or written. A blocking conn waits for
+// the next datagram no longer than the next retransmission is due. A
+// non-blocking one relies on the worker polling it: the kcptun server
+// sends a keepalive every 10 seconds that wakes the worker up at the
+// latest, so a conn should not be left idle while data is in flight.
+package kcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"syscall"
+	"time"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+const (
+	DefaultMTU           = 1350
+	DefaultSendWindow    = 128
+	DefaultReceiveWindow = 512
+)
+
+var (
+	// ErrDeadLink means a segment was retransmitted so many times that the
+	// peer is considered gone.
+	ErrDeadLink = errors.New("kcp: dead link")
+	// ErrUnknownMode means the mode name is not one of kcptun's.
+	ErrUnknownMode = errors.New("kcp: unknown mode")
+)
+
+// Mode is a set of retransmission settings, as kcptun's --mode flag
+// picks them.
+type Mode struct {
+	// NoDelay lowers the minimum RTO to 30ms and backs off slower.
+	NoDelay bool
+	// Interval is the period of the updates, clamped to 10ms-5s.
+	Interval time.Duration
+	// Resend is the number of acks skipping a segment that make it
+	// retransmitted right away. Zero waits for the RTO.
+	Resend int
+	// NoCongestion disables the congestion window.
+	NoCongestion bool
+}
+
+var modes = map[string]Mode{
+	"normal": {Interval: 40 * time.Millisecond, Resend: 2, NoCongestion: true},
+	"fast":   {Interval: 30 * time.Millisecond, Resend: 2, NoCongestion: true},
+	"fast2":  {NoDelay: true, Interval: 20 * time.Millisecond, Resend: 2, NoCongestion: true},
+	"fast3":  {NoDelay: true, Interval: 10 * time.Millisecond, Resend: 2, NoCongestion: true},
+}
+
+// ParseMode returns kcptun's mode of the given name, fast when empty.
+func ParseMode(name string) (Mode, error) {
+	if name == "" {
+		name = "fast"
+	}
+	mode, loaded := modes[name]
+	if !loaded {
+		return Mode{}, fmt.Errorf("%w: %q", ErrUnknownMode, name)
+	}
+	return mode, nil
+}
+
+// Config describes a conn the way kcptun's client flags do. The server
+// has to be configured alike, save for the windows.
+type Config struct {
+	// Crypt is the name of the packet encryption: aes, aes-128, aes-192,
+	// salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, none or
+	// null. Empty is aes.
+	Crypt string
+	// Key is the shared secret the crypt key is derived from.
+	Key  string
+	Mode Mode
+	// MTU is the maximum size of the datagrams. Zero is 1350.
+	MTU int
+	// SendWindow and ReceiveWindow are counted in segments. Zero is 128
+	// and 512.
+	SendWindow, ReceiveWindow int
+	// DataShards and ParityShards size the FEC groups: every DataShards
+	// packets are followed by ParityShards parity packets. Zero for either
+	// disables FEC.
+	DataShards, ParityShards int
+	// AckNoDelay acknowledges every packet as it arrives instead of once
+	// per interval.
+	AckNoDelay bool
+	// Conv identifies the conversation. Zero picks a random one, as
+	// kcptun's client does, and the server answers with the same.
+	Conv uint32
+}
+
+// Conn is a KCP conn over a connected UDP conn. It reads and writes the
+// stream, and passes syscall.EAGAIN through once the UDP conn is switched
+// to non-blocking mode.
+type Conn struct {
+	v1net.Conn
+	config      Config
+	crypt       blockCrypt
+	arq         *arq
+	encoder     *fecEncoder
+	decoder     *fecDecoder
+	nonBlocking bool
+
+	buffer  []byte
+	inbound []byte
+	// err is the first error writing a datagram
+	err error
+}
+
+// NewConn starts a KCP conversation over conn, which has to carry
+// datagrams.
+func NewConn(conn v1net.Conn, config Config) (*Conn, error) {
+	crypt, err := newBlockCrypt(config.Crypt, config.Key)
+	if err != nil {
+		return nil, err
+	}
+	if config.MTU == 0 {
+		config.MTU = DefaultMTU
+	}
+	if config.SendWindow == 0 {
+		config.SendWindow = DefaultSendWindow
+	}
+	if config.ReceiveWindow == 0 {
+		config.ReceiveWindow = DefaultReceiveWindow
+	}
+	headerSize := 0
+	if crypt != nil {
+		headerSize += cryptHeaderSize
+	}
+	fec := config.DataShards > 0 && config.ParityShards > 0
+	if fec {
+		headerSize += fecHeaderSizePlus2
+	}
+	if config.MTU <= headerSize+overhead || config.MTU > mtuLimit {
+		return nil, fmt.Errorf("kcp: invalid mtu %d", config.MTU)
+	}
+	if config.DataShards+config.ParityShards > 255 {
+		return nil, errors.New("kcp: too many shards")
+	}
+	if config.Conv == 0 {
+		var conv [4]byte
+		if _, err := rand.Read(conv[:]); err != nil {
+			return nil, err
+		}
+		config.Conv = binary.LittleEndian.Uint32(conv[:])
+	}
+	c := &Conn{
+		Conn:   conn,
+		config: config,
+		crypt:  crypt,
+		buffer: make([]byte, mtuLimit),
+	}
+	c.arq = newARQ(config.Conv, c.output)
+	c.arq.setMTU(config.MTU, headerSize)
+	c.arq.setNoDelay(boolToInt(config.Mode.NoDelay), int(config.Mode.Interval/time.Millisecond), config.Mode.Resend, config.Mode.NoCongestion)
+	c.arq.setWindow(config.SendWindow, config.ReceiveWindow)
+	if fec {
+		c.encoder = newFECEncoder(config.DataShards, config.ParityShards, headerSize-fecHeaderSizePlus2)
+		c.decoder = newFECDecoder(config.DataShards, config.ParityShards)
+	}
+	return c, nil
+}
+
+// SetNonBlock records the mode, since a blocking conn waits for the
+// datagrams with deadlines.
+func (c *Conn) SetNonBlock(nonblocking bool) error {
+	c.nonBlocking = nonblocking
+	if nonblocking {
+		if err := c.Conn.SetReadDeadline(time.Time{}); err != nil {
+			return err
+		}
+	}
+	return c.Conn.SetNonBlock(nonblocking)
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.inbound) == 0 {
+		if c.arq.state != 0 {
+			return 0, ErrDeadLink
+		}
+		if err := c.receive(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.inbound)
+	c.inbound = c.inbound[n:]
+	return n, nil
+}
+
+// receive handles the datagrams that arrived, waiting for one until the
+// next update is due when the conn blocks, updates the ARQ and takes the
+// stream data received in order.
+func (c *Conn) receive() error {
+	if !c.nonBlocking {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(max(c.arq.next(), time.Millisecond))); err != nil {
+			return err
+		}
+	}
+	for {
+		n, err := c.Conn.Read(c.buffer)
+		if n > 0 {
+			c.packetInput(c.buffer[:n])
+		}
+		if err == nil && c.nonBlocking {
+			continue
+		}
+		c.arq.update()
+		c.inbound = c.arq.receive(c.inbound)
+		switch {
+		case err == nil, errors.Is(err, os.ErrDeadlineExceeded):
+			return nil
+		case errors.Is(err, syscall.EAGAIN) && len(c.inbound) > 0:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// packetInput decrypts a datagram and hands its segments to the ARQ,
+// along with those FEC recovered.
+func (c *Conn) packetInput(data []byte) {
+	if c.crypt != nil {
+		if len(data) < cryptHeaderSize {
+			return
+		}
+		c.crypt.decrypt(data)
+		if crc32.ChecksumIEEE(data[cryptHeaderSize:]) != binary.LittleEndian.Uint32(data[nonceSize:]) {
+			return
+		}
+		data = data[cryptHeaderSize:]
+	}
+	if len(data) < fecHeaderSizePlus2 {
+		return
+	}
+	if flag := fecFlag(data); flag != typeData && flag != typeParity {
+		c.arq.input(data, true, c.config.AckNoDelay)
+		return
+	}
+	if fecFlag(data) == typeData {
+		c.arq.input(data[fecHeaderSizePlus2:], true, c.config.AckNoDelay)
+	}
+	if c.decoder == nil {
+		return
+	}
+	for _, recovered := range c.decoder.decode(data) {
+		if size := int(binary.LittleEndian.Uint16(recovered)); size >= 2 && size <= len(recovered) {
+			c.arq.input(recovered[2:size], false, c.config.AckNoDelay)
+		}
+	}
+}
+
+// Write queues p and sends what the windows allow. A blocking conn first
+// waits for the send window to have room, a non-blocking one queues past
+// it and sends the rest as acks arrive.
+func (c *Conn) Write(p []byte) (int, error) {
+	if !c.nonBlocking {
+		for c.arq.waitSend() >= int(c.arq.sndWnd) && c.arq.state == 0 && c.err == nil {
+			if err := c.receive(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if c.arq.state != 0 {
+		return 0, ErrDeadLink
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.arq.send(p)
+	c.arq.flush(false)
+	return len(p), c.err
+}
+
+// output sends a packet of the ARQ, then the parity packets it completes.
+func (c *Conn) output(buffer []byte) {
+	packet := append([]byte(nil), buffer...)
+	var parity [][]byte
+	if c.encoder != nil {
+		parity = c.encoder.encode(packet)
+	}
+	c.writePacket(packet)
+	for _, packet := range parity {
+		c.writePacket(packet)
+	}
+}
+
+func (c *Conn) writePacket(packet []byte) {
+	if c.crypt != nil {
+		rand.Read(packet[:nonceSize])
+		binary.LittleEndian.PutUint32(packet[nonceSize:], crc32.ChecksumIEEE(packet[cryptHeaderSize:]))
+		c.crypt.encrypt(packet)
+	}
+	// a datagram the socket has no room for is as good as lost, and
+	// retransmitted like one
+	if _, err := c.Conn.Write(packet); err != nil && c.err == nil &&
+		!errors.Is(err, syscall.EAGAIN) && !errors.Is(err, syscall.ENOBUFS) {
+		c.err = err
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,134 @@
+package kcp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/blowfish"
+	"golang.org/x/crypto/cast5"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/salsa20"
+	"golang.org/x/crypto/tea"
+	"golang.org/x/crypto/twofish"
+	"golang.org/x/crypto/xtea"
+)
+
+const (
+	nonceSize = 16
+	crcSize   = 4
+	// cryptHeaderSize is the random nonce and the checksum every packet
+	// starts with unless the crypt is "null".
+	cryptHeaderSize = nonceSize + crcSize
+
+	keySalt = "kcp-go"
+	xorSalt = "sH3CIVoF#rWLtJo6"
+	// mtuLimit is the size of the xor pad.
+	mtuLimit = 1500
+)
+
+// ErrUnknownCrypt means the crypt name is not one kcptun accepts, or one
+// that is not implemented.
+var ErrUnknownCrypt = errors.New("kcp: unknown crypt")
+
+// initialVector is the fixed IV kcp-go runs its block ciphers in CFB mode
+// with. Every packet starts with a random nonce instead.
+var initialVector = []byte{167, 115, 79, 156, 18, 172, 27, 1, 164, 21, 242, 193, 252, 120, 230, 107}
+
+// blockCrypt encrypts and decrypts whole packets in place.
+type blockCrypt interface {
+	encrypt(packet []byte)
+	decrypt(packet []byte)
+}
+
+// newBlockCrypt returns the crypt of the given kcptun name, keyed as
+// kcptun derives it from the shared key. It returns nil for "null", whose
+// packets have no crypt header.
+func newBlockCrypt(name, key string) (blockCrypt, error) {
+	pass := pbkdf2.Key([]byte(key), []byte(keySalt), 4096, 32, sha1.New)
+	var (
+		block cipher.Block
+		err   error
+	)
+	switch name {
+	case "null":
+		return nil, nil
+	case "none":
+		return noneCrypt{}, nil
+	case "xor":
+		return xorCrypt(pbkdf2.Key(pass, []byte(xorSalt), 32, mtuLimit, sha1.New)), nil
+	case "salsa20":
+		crypt := &salsa20Crypt{}
+		copy(crypt.key[:], pass)
+		return crypt, nil
+	case "", "aes":
+		block, err = aes.NewCipher(pass)
+	case "aes-128":
+		block, err = aes.NewCipher(pass[:16])
+	case "aes-192":
+		block, err = aes.NewCipher(pass[:24])
+	case "blowfish":
+		block, err = blowfish.NewCipher(pass)
+	case "twofish":
+		block, err = twofish.NewCipher(pass)
+	case "cast5":
+		block, err = cast5.NewCipher(pass[:16])
+	case "3des":
+		block, err = des.NewTripleDESCipher(pass[:24])
+	case "tea":
+		block, err = tea.NewCipherWithRounds(pass[:16], 16)
+	case "xtea":
+		block, err = xtea.NewCipher(pass[:16])
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCrypt, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cfbCrypt{block}, nil
+}
+
+// cfbCrypt runs a block cipher in CFB mode with the fixed IV.
+type cfbCrypt struct {
+	block cipher.Block
+}
+
+func (c cfbCrypt) encrypt(packet []byte) {
+	cipher.NewCFBEncrypter(c.block, initialVector[:c.block.BlockSize()]).XORKeyStream(packet, packet)
+}
+
+func (c cfbCrypt) decrypt(packet []byte) {
+	cipher.NewCFBDecrypter(c.block, initialVector[:c.block.BlockSize()]).XORKeyStream(packet, packet)
+}
+
+// salsa20Crypt uses the first 8 bytes of the nonce as the salsa20 nonce
+// and leaves them in the clear.
+type salsa20Crypt struct {
+	key [32]byte
+}
+
+func (c *salsa20Crypt) encrypt(packet []byte) {
+	salsa20.XORKeyStream(packet[8:], packet[8:], packet[:8], &c.key)
+}
+
+func (c *salsa20Crypt) decrypt(packet []byte) { c.encrypt(packet) }
+
+// xorCrypt xors the packets with a pad derived from the key.
+type xorCrypt []byte
+
+func (c xorCrypt) encrypt(packet []byte) {
+	for i := range packet {
+		packet[i] ^= c[i%len(c)]
+	}
+}
+
+func (c xorCrypt) decrypt(packet []byte) { c.encrypt(packet) }
+
+// noneCrypt keeps the crypt header but leaves the packets in the clear.
+type noneCrypt struct{}
+
+func (noneCrypt) encrypt([]byte) {}
+func (noneCrypt) decrypt([]byte) {}
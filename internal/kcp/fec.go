@@ -0,0 +1,175 @@
+package kcp
+
+import "encoding/binary"
+
+const (
+	// fecHeaderSize is the sequence number and type of every FEC packet.
+	fecHeaderSize = 6
+	// fecHeaderSizePlus2 adds the length data shards start with.
+	fecHeaderSizePlus2 = fecHeaderSize + 2
+	typeData           = 0xf1
+	typeParity         = 0xf2
+	// rxFECMulti is the number of groups the decoder keeps shards of.
+	rxFECMulti = 3
+)
+
+// fecEncoder numbers the packets and sends parity shards after every
+// dataShards packets. The shards are the packets from their length field
+// on, zero padded to the longest of the group.
+type fecEncoder struct {
+	rs           *reedSolomon
+	shardSize    int
+	headerOffset int
+	next         uint32
+	// paws wraps the sequence numbers on a group boundary
+	paws   uint32
+	shards [][]byte
+	count  int
+	max    int
+}
+
+func newFECEncoder(dataShards, parityShards, headerOffset int) *fecEncoder {
+	shardSize := dataShards + parityShards
+	return &fecEncoder{
+		rs:           newReedSolomon(dataShards, parityShards),
+		shardSize:    shardSize,
+		headerOffset: headerOffset,
+		paws:         0xffffffff / uint32(shardSize) * uint32(shardSize),
+		shards:       make([][]byte, shardSize),
+	}
+}
+
+// encode fills in the FEC header of packet, which has room for it at
+// headerOffset, and returns the parity packets once a group is complete.
+// They have the same room for the headers before headerOffset.
+func (e *fecEncoder) encode(packet []byte) [][]byte {
+	e.mark(packet[e.headerOffset:], typeData)
+	binary.LittleEndian.PutUint16(packet[e.headerOffset+fecHeaderSize:], uint16(len(packet)-e.headerOffset-fecHeaderSize))
+	payloadOffset := e.headerOffset + fecHeaderSize
+	// the packet is encrypted in place once encoded
+	e.shards[e.count] = append([]byte(nil), packet[payloadOffset:]...)
+	e.count++
+	e.max = max(e.max, len(packet))
+	if e.count < e.rs.dataShards {
+		return nil
+	}
+	shards := make([][]byte, e.shardSize)
+	for i := range e.rs.dataShards {
+		shards[i] = make([]byte, e.max-payloadOffset)
+		copy(shards[i], e.shards[i])
+	}
+	parity := make([][]byte, e.rs.parityShards)
+	for i := range parity {
+		parity[i] = make([]byte, e.max)
+		shards[e.rs.dataShards+i] = parity[i][payloadOffset:]
+	}
+	e.rs.encode(shards)
+	for _, packet := range parity {
+		e.mark(packet[e.headerOffset:], typeParity)
+	}
+	clear(e.shards)
+	e.count = 0
+	e.max = 0
+	return parity
+}
+
+func (e *fecEncoder) mark(header []byte, flag uint16) {
+	binary.LittleEndian.PutUint32(header, e.next)
+	binary.LittleEndian.PutUint16(header[4:], flag)
+	if flag == typeParity {
+		// sequence numbers only wrap on a parity shard
+		e.next = (e.next + 1) % e.paws
+	} else {
+		e.next++
+	}
+}
+
+// fecDecoder keeps the shards of the recent groups and recovers the lost
+// data shards of a group once enough of its shards arrived.
+type fecDecoder struct {
+	rs        *reedSolomon
+	shardSize int
+	// rx holds FEC packets, headers included, ordered by sequence number
+	rx [][]byte
+}
+
+func newFECDecoder(dataShards, parityShards int) *fecDecoder {
+	return &fecDecoder{rs: newReedSolomon(dataShards, parityShards), shardSize: dataShards + parityShards}
+}
+
+func fecSeqID(packet []byte) uint32 { return binary.LittleEndian.Uint32(packet) }
+func fecFlag(packet []byte) uint16  { return binary.LittleEndian.Uint16(packet[4:]) }
+
+// decode stores packet and returns the data shards it allowed to recover,
+// each starting with its length field.
+func (d *fecDecoder) decode(packet []byte) (recovered [][]byte) {
+	seqID := fecSeqID(packet)
+	insert := 0
+	for i := len(d.rx) - 1; i >= 0; i-- {
+		if seqID == fecSeqID(d.rx[i]) {
+			return nil
+		}
+		if timeDiff(seqID, fecSeqID(d.rx[i])) > 0 {
+			insert = i + 1
+			break
+		}
+	}
+	d.rx = append(d.rx, nil)
+	copy(d.rx[insert+1:], d.rx[insert:])
+	d.rx[insert] = append([]byte(nil), packet...)
+
+	shardBegin := seqID - seqID%uint32(d.shardSize)
+	shardEnd := shardBegin + uint32(d.shardSize) - 1
+	searchBegin := max(insert-int(seqID%uint32(d.shardSize)), 0)
+	searchEnd := min(searchBegin+d.shardSize-1, len(d.rx)-1)
+	if searchEnd-searchBegin+1 >= d.rs.dataShards {
+		shards := make([][]byte, d.shardSize)
+		var count, dataCount, first, maxLen int
+		for i := searchBegin; i <= searchEnd; i++ {
+			id := fecSeqID(d.rx[i])
+			if timeDiff(id, shardEnd) > 0 {
+				break
+			}
+			if timeDiff(id, shardBegin) < 0 {
+				continue
+			}
+			shards[id%uint32(d.shardSize)] = d.rx[i][fecHeaderSize:]
+			if count == 0 {
+				first = i
+			}
+			count++
+			if fecFlag(d.rx[i]) == typeData {
+				dataCount++
+			}
+			maxLen = max(maxLen, len(d.rx[i])-fecHeaderSize)
+		}
+		if dataCount == d.rs.dataShards || count >= d.rs.dataShards {
+			if dataCount < d.rs.dataShards {
+				present := make([]bool, d.rs.dataShards)
+				for i := range shards {
+					if shards[i] != nil {
+						if i < d.rs.dataShards {
+							present[i] = true
+						}
+						shard := make([]byte, maxLen)
+						copy(shard, shards[i])
+						shards[i] = shard
+					}
+				}
+				if d.rs.reconstructData(shards) == nil {
+					for i, ok := range present {
+						if !ok {
+							recovered = append(recovered, shards[i])
+						}
+					}
+				}
+			}
+			// the group is done with
+			d.rx = append(d.rx[:first], d.rx[first+count:]...)
+		}
+	}
+	if limit := rxFECMulti * d.shardSize; len(d.rx) > limit {
+		d.rx = append(d.rx[:0], d.rx[len(d.rx)-limit:]...)
+	}
+	return recovered
+}
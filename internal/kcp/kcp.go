@@ -0,0 +1,591 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	rtoNoDelay = 30
+	rtoMin     = 100
+	rtoDefault = 200
+	rtoMax     = 60000
+
+	cmdPush = 81
+	cmdAck  = 82
+	// cmdWindowAsk and cmdWindowTell probe the window of a peer that
+	// advertised none.
+	cmdWindowAsk  = 83
+	cmdWindowTell = 84
+
+	askSend = 1
+	askTell = 2
+
+	defaultSendWindow    = 32
+	defaultReceiveWindow = 32
+	defaultInterval      = 100
+	// overhead is the size of a segment header.
+	overhead    = 24
+	deadLink    = 20
+	thresholdIn = 2
+	thresholdLo = 2
+	probeInit   = 7000
+	probeLimit  = 120000
+)
+
+type segment struct {
+	conv     uint32
+	cmd      uint8
+	frg      uint8
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	rto      uint32
+	xmit     uint32
+	resendTS uint32
+	fastAck  uint32
+	acked    bool
+	data     []byte
+}
+
+// encode writes the segment header, little endian, to ptr and returns the
+// rest of ptr.
+func (seg *segment) encode(ptr []byte) []byte {
+	binary.LittleEndian.PutUint32(ptr, seg.conv)
+	ptr[4] = seg.cmd
+	ptr[5] = seg.frg
+	binary.LittleEndian.PutUint16(ptr[6:], seg.wnd)
+	binary.LittleEndian.PutUint32(ptr[8:], seg.ts)
+	binary.LittleEndian.PutUint32(ptr[12:], seg.sn)
+	binary.LittleEndian.PutUint32(ptr[16:], seg.una)
+	binary.LittleEndian.PutUint32(ptr[20:], uint32(len(seg.data)))
+	return ptr[overhead:]
+}
+
+type ack struct {
+	sn uint32
+	ts uint32
+}
+
+// arq is the KCP automatic repeat request protocol of kcp-go, in the
+// stream mode kcptun uses: the data is a byte stream and segments are
+// never fragments of a message. Nothing runs in the background, update has
+// to be called as the clock advances.
+type arq struct {
+	conv, mtu, mss, state  uint32
+	sndUna, sndNxt, rcvNxt uint32
+	ssthresh               uint32
+	rxRTTVar, rxSRTT       int32
+	rxRTO, rxMinRTO        uint32
+	sndWnd, rcvWnd, rmtWnd uint32
+	cwnd, probe            uint32
+	interval, tsFlush      uint32
+	noDelay                uint32
+	updated                bool
+	tsProbe, probeWait     uint32
+	incr                   uint32
+	fastResend             int32
+	noCwnd                 bool
+	// reserved is the room left at the start of every packet for the
+	// headers of the packet layer.
+	reserved int
+
+	sndQueue []segment
+	rcvQueue []segment
+	sndBuf   []segment
+	rcvBuf   []segment
+	ackList  []ack
+	buffer   []byte
+	output   func(packet []byte)
+}
+
+func newARQ(conv uint32, output func(packet []byte)) *arq {
+	a := &arq{
+		conv:     conv,
+		sndWnd:   defaultSendWindow,
+		rcvWnd:   defaultReceiveWindow,
+		rmtWnd:   defaultReceiveWindow,
+		rxRTO:    rtoDefault,
+		rxMinRTO: rtoMin,
+		interval: defaultInterval,
+		tsFlush:  defaultInterval,
+		ssthresh: thresholdIn,
+		output:   output,
+	}
+	a.setMTU(1400, 0)
+	return a
+}
+
+// setMTU sets the size of the packets, reserving room for the packet
+// layer headers at their start.
+func (a *arq) setMTU(mtu, reserved int) {
+	a.mtu = uint32(mtu)
+	a.reserved = reserved
+	a.mss = a.mtu - overhead - uint32(reserved)
+	a.buffer = make([]byte, mtu)
+}
+
+// setNoDelay configures the retransmissions: nodelay lowers the minimum
+// RTO and backs off slower, interval is the flush period in milliseconds,
+// resend the number of skipping acks triggering a fast retransmission and
+// nc disables the congestion window.
+func (a *arq) setNoDelay(nodelay, interval, resend int, nc bool) {
+	a.noDelay = uint32(nodelay)
+	if nodelay != 0 {
+		a.rxMinRTO = rtoNoDelay
+	} else {
+		a.rxMinRTO = rtoMin
+	}
+	a.interval = uint32(min(max(interval, 10), 5000))
+	a.fastResend = int32(resend)
+	a.noCwnd = nc
+}
+
+func (a *arq) setWindow(send, receive int) {
+	if send > 0 {
+		a.sndWnd = uint32(send)
+	}
+	if receive > 0 {
+		a.rcvWnd = uint32(receive)
+	}
+}
+
+// waitSend returns the number of segments not acknowledged yet.
+func (a *arq) waitSend() int {
+	return len(a.sndBuf) + len(a.sndQueue)
+}
+
+// send queues data, filling the last queued segment first.
+func (a *arq) send(data []byte) {
+	if n := len(a.sndQueue); n > 0 {
+		seg := &a.sndQueue[n-1]
+		if room := int(a.mss) - len(seg.data); room > 0 {
+			extend := min(room, len(data))
+			seg.data = append(seg.data, data[:extend]...)
+			data = data[extend:]
+		}
+	}
+	for len(data) > 0 {
+		size := min(len(data), int(a.mss))
+		seg := segment{data: make([]byte, size, a.mss)}
+		copy(seg.data, data)
+		a.sndQueue = append(a.sndQueue, seg)
+		data = data[size:]
+	}
+}
+
+// receive appends the data received in order to b.
+func (a *arq) receive(b []byte) []byte {
+	fastRecover := len(a.rcvQueue) >= int(a.rcvWnd)
+	for _, seg := range a.rcvQueue {
+		b = append(b, seg.data...)
+	}
+	a.rcvQueue = a.rcvQueue[:0]
+	a.moveReceived()
+	if len(a.rcvQueue) < int(a.rcvWnd) && fastRecover {
+		// tell the peer the window opened again
+		a.probe |= askTell
+	}
+	return b
+}
+
+// moveReceived moves the segments that follow the received ones from the
+// receive buffer to the receive queue.
+func (a *arq) moveReceived() {
+	count := 0
+	for _, seg := range a.rcvBuf {
+		if seg.sn != a.rcvNxt || len(a.rcvQueue)+count >= int(a.rcvWnd) {
+			break
+		}
+		a.rcvNxt++
+		count++
+	}
+	if count > 0 {
+		a.rcvQueue = append(a.rcvQueue, a.rcvBuf[:count]...)
+		a.rcvBuf = append(a.rcvBuf[:0], a.rcvBuf[count:]...)
+	}
+}
+
+func (a *arq) updateAck(rtt int32) {
+	if a.rxSRTT == 0 {
+		a.rxSRTT = rtt
+		a.rxRTTVar = rtt >> 1
+	} else {
+		delta := rtt - a.rxSRTT
+		a.rxSRTT += delta >> 3
+		if delta < 0 {
+			delta = -delta
+		}
+		if rtt < a.rxSRTT-a.rxRTTVar {
+			// samples below the expected range weigh less
+			a.rxRTTVar += (delta - a.rxRTTVar) >> 5
+		} else {
+			a.rxRTTVar += (delta - a.rxRTTVar) >> 2
+		}
+	}
+	rto := uint32(a.rxSRTT) + max(a.interval, uint32(a.rxRTTVar)<<2)
+	a.rxRTO = min(max(a.rxMinRTO, rto), rtoMax)
+}
+
+func (a *arq) shrinkBuf() {
+	if len(a.sndBuf) > 0 {
+		a.sndUna = a.sndBuf[0].sn
+	} else {
+		a.sndUna = a.sndNxt
+	}
+}
+
+func (a *arq) parseAck(sn uint32) {
+	if timeDiff(sn, a.sndUna) < 0 || timeDiff(sn, a.sndNxt) >= 0 {
+		return
+	}
+	for k := range a.sndBuf {
+		seg := &a.sndBuf[k]
+		if sn == seg.sn {
+			// freed when una passes it
+			seg.acked = true
+			seg.data = nil
+			break
+		}
+		if timeDiff(sn, seg.sn) < 0 {
+			break
+		}
+	}
+}
+
+func (a *arq) parseFastAck(sn, ts uint32) {
+	if timeDiff(sn, a.sndUna) < 0 || timeDiff(sn, a.sndNxt) >= 0 {
+		return
+	}
+	for k := range a.sndBuf {
+		seg := &a.sndBuf[k]
+		if timeDiff(sn, seg.sn) < 0 {
+			break
+		} else if sn != seg.sn && timeDiff(seg.ts, ts) <= 0 {
+			seg.fastAck++
+		}
+	}
+}
+
+func (a *arq) parseUna(una uint32) int {
+	count := 0
+	for _, seg := range a.sndBuf {
+		if timeDiff(una, seg.sn) <= 0 {
+			break
+		}
+		count++
+	}
+	if count > 0 {
+		a.sndBuf = append(a.sndBuf[:0], a.sndBuf[count:]...)
+	}
+	return count
+}
+
+// parseData stores a new segment in the receive buffer, in order.
+func (a *arq) parseData(seg segment) {
+	if timeDiff(seg.sn, a.rcvNxt+a.rcvWnd) >= 0 || timeDiff(seg.sn, a.rcvNxt) < 0 {
+		return
+	}
+	insert := 0
+	for i := len(a.rcvBuf) - 1; i >= 0; i-- {
+		if a.rcvBuf[i].sn == seg.sn {
+			return
+		}
+		if timeDiff(seg.sn, a.rcvBuf[i].sn) > 0 {
+			insert = i + 1
+			break
+		}
+	}
+	seg.data = append([]byte(nil), seg.data...)
+	a.rcvBuf = append(a.rcvBuf, segment{})
+	copy(a.rcvBuf[insert+1:], a.rcvBuf[insert:])
+	a.rcvBuf[insert] = seg
+	a.moveReceived()
+}
+
+// input handles the segments of a packet. Packets recovered by FEC are not
+// regular: their window and timestamps are stale. It returns false when the
+// packet is not a KCP packet of this conversation.
+func (a *arq) input(data []byte, regular, ackNoDelay bool) bool {
+	sndUna := a.sndUna
+	if len(data) < overhead {
+		return false
+	}
+	var latest uint32
+	var acked, windowSlides bool
+	for len(data) >= overhead {
+		conv := binary.LittleEndian.Uint32(data)
+		cmd, frg := data[4], data[5]
+		wnd := binary.LittleEndian.Uint16(data[6:])
+		ts := binary.LittleEndian.Uint32(data[8:])
+		sn := binary.LittleEndian.Uint32(data[12:])
+		una := binary.LittleEndian.Uint32(data[16:])
+		length := binary.LittleEndian.Uint32(data[20:])
+		data = data[overhead:]
+		if conv != a.conv || uint32(len(data)) < length || cmd < cmdPush || cmd > cmdWindowTell {
+			return false
+		}
+		if regular {
+			a.rmtWnd = uint32(wnd)
+		}
+		if a.parseUna(una) > 0 {
+			windowSlides = true
+		}
+		a.shrinkBuf()
+		switch cmd {
+		case cmdAck:
+			a.parseAck(sn)
+			a.parseFastAck(sn, ts)
+			acked = true
+			latest = ts
+		case cmdPush:
+			if timeDiff(sn, a.rcvNxt+a.rcvWnd) < 0 {
+				a.ackList = append(a.ackList, ack{sn, ts})
+				if timeDiff(sn, a.rcvNxt) >= 0 {
+					a.parseData(segment{conv: conv, cmd: cmd, frg: frg, wnd: wnd, ts: ts, sn: sn, una: una, data: data[:length]})
+				}
+			}
+		case cmdWindowAsk:
+			a.probe |= askTell
+		}
+		data = data[length:]
+	}
+	if acked && regular {
+		if current := currentMs(); timeDiff(current, latest) >= 0 {
+			a.updateAck(timeDiff(current, latest))
+		}
+	}
+	if !a.noCwnd && timeDiff(a.sndUna, sndUna) > 0 && a.cwnd < a.rmtWnd {
+		mss := a.mss
+		if a.cwnd < a.ssthresh {
+			a.cwnd++
+			a.incr += mss
+		} else {
+			a.incr = max(a.incr, mss)
+			a.incr += (mss*mss)/a.incr + mss/16
+			if (a.cwnd+1)*mss <= a.incr {
+				a.cwnd = (a.incr + mss - 1) / mss
+			}
+		}
+		if a.cwnd > a.rmtWnd {
+			a.cwnd = a.rmtWnd
+			a.incr = a.rmtWnd * mss
+		}
+	}
+	if windowSlides {
+		a.flush(false)
+	} else if ackNoDelay && len(a.ackList) > 0 {
+		a.flush(true)
+	}
+	return true
+}
+
+func (a *arq) unusedWindow() uint16 {
+	if len(a.rcvQueue) < int(a.rcvWnd) {
+		return uint16(int(a.rcvWnd) - len(a.rcvQueue))
+	}
+	return 0
+}
+
+// flush sends the pending acks and, unless ackOnly is set, the window
+// probes, the new segments the window allows and the retransmissions due.
+func (a *arq) flush(ackOnly bool) {
+	seg := segment{conv: a.conv, cmd: cmdAck, wnd: a.unusedWindow(), una: a.rcvNxt}
+	buffer := a.buffer
+	ptr := buffer[a.reserved:]
+	makeSpace := func(space int) {
+		if size := len(buffer) - len(ptr); size+space > int(a.mtu) {
+			a.output(buffer[:size])
+			ptr = buffer[a.reserved:]
+		}
+	}
+	flushBuffer := func() {
+		if size := len(buffer) - len(ptr); size > a.reserved {
+			a.output(buffer[:size])
+		}
+	}
+
+	for i, ack := range a.ackList {
+		makeSpace(overhead)
+		// acks of segments already received in order are redundant
+		if timeDiff(ack.sn, a.rcvNxt) >= 0 || i == len(a.ackList)-1 {
+			seg.sn, seg.ts = ack.sn, ack.ts
+			ptr = seg.encode(ptr)
+		}
+	}
+	a.ackList = a.ackList[:0]
+	if ackOnly {
+		flushBuffer()
+		return
+	}
+
+	if a.rmtWnd == 0 {
+		current := currentMs()
+		if a.probeWait == 0 {
+			a.probeWait = probeInit
+			a.tsProbe = current + a.probeWait
+		} else if timeDiff(current, a.tsProbe) >= 0 {
+			a.probeWait = min(max(a.probeWait, probeInit)*3/2, probeLimit)
+			a.tsProbe = current + a.probeWait
+			a.probe |= askSend
+		}
+	} else {
+		a.tsProbe = 0
+		a.probeWait = 0
+	}
+	if a.probe&askSend != 0 {
+		seg.cmd = cmdWindowAsk
+		makeSpace(overhead)
+		ptr = seg.encode(ptr)
+	}
+	if a.probe&askTell != 0 {
+		seg.cmd = cmdWindowTell
+		makeSpace(overhead)
+		ptr = seg.encode(ptr)
+	}
+	a.probe = 0
+
+	cwnd := min(a.sndWnd, a.rmtWnd)
+	if !a.noCwnd {
+		cwnd = min(a.cwnd, cwnd)
+	}
+	newSegments := 0
+	for k := range a.sndQueue {
+		if timeDiff(a.sndNxt, a.sndUna+cwnd) >= 0 {
+			break
+		}
+		newSeg := a.sndQueue[k]
+		newSeg.conv = a.conv
+		newSeg.cmd = cmdPush
+		newSeg.sn = a.sndNxt
+		a.sndBuf = append(a.sndBuf, newSeg)
+		a.sndNxt++
+		newSegments++
+	}
+	if newSegments > 0 {
+		a.sndQueue = append(a.sndQueue[:0], a.sndQueue[newSegments:]...)
+	}
+
+	resent := uint32(a.fastResend)
+	if a.fastResend <= 0 {
+		resent = 0xffffffff
+	}
+	current := currentMs()
+	var change, lost bool
+	for k := range a.sndBuf {
+		segment := &a.sndBuf[k]
+		if segment.acked {
+			continue
+		}
+		needSend := false
+		switch {
+		case segment.xmit == 0:
+			needSend = true
+			segment.rto = a.rxRTO
+			segment.resendTS = current + segment.rto
+		case segment.fastAck >= resent:
+			needSend = true
+			segment.fastAck = 0
+			segment.rto = a.rxRTO
+			segment.resendTS = current + segment.rto
+			change = true
+		case segment.fastAck > 0 && newSegments == 0:
+			// early retransmission
+			needSend = true
+			segment.fastAck = 0
+			segment.rto = a.rxRTO
+			segment.resendTS = current + segment.rto
+			change = true
+		case timeDiff(current, segment.resendTS) >= 0:
+			needSend = true
+			if a.noDelay == 0 {
+				segment.rto += a.rxRTO
+			} else {
+				segment.rto += a.rxRTO / 2
+			}
+			segment.fastAck = 0
+			segment.resendTS = current + segment.rto
+			lost = true
+		}
+		if needSend {
+			segment.xmit++
+			segment.ts = current
+			segment.wnd = seg.wnd
+			segment.una = seg.una
+			makeSpace(overhead + len(segment.data))
+			ptr = segment.encode(ptr)
+			ptr = ptr[copy(ptr, segment.data):]
+			if segment.xmit >= deadLink {
+				a.state = 0xffffffff
+			}
+		}
+	}
+	flushBuffer()
+
+	if !a.noCwnd {
+		if change {
+			// rate halving, RFC 6937
+			a.ssthresh = max((a.sndNxt-a.sndUna)/2, thresholdLo)
+			a.cwnd = a.ssthresh + resent
+			a.incr = a.cwnd * a.mss
+		}
+		if lost {
+			// congestion control, RFC 5681
+			a.ssthresh = max(cwnd/2, thresholdLo)
+			a.cwnd = 1
+			a.incr = a.mss
+		}
+		if a.cwnd < 1 {
+			a.cwnd = 1
+			a.incr = a.mss
+		}
+	}
+}
+
+// update flushes once per interval.
+func (a *arq) update() {
+	current := currentMs()
+	if !a.updated {
+		a.updated = true
+		a.tsFlush = current
+	}
+	slap := timeDiff(current, a.tsFlush)
+	if slap >= 10000 || slap < -10000 {
+		a.tsFlush = current
+		slap = 0
+	}
+	if slap >= 0 {
+		a.tsFlush += a.interval
+		if timeDiff(current, a.tsFlush) >= 0 {
+			a.tsFlush = current + a.interval
+		}
+		a.flush(false)
+	}
+}
+
+// next returns how long until update has something to do.
+func (a *arq) next() time.Duration {
+	if !a.updated {
+		return 0
+	}
+	current := currentMs()
+	wait := timeDiff(a.tsFlush, current)
+	for _, seg := range a.sndBuf {
+		if seg.acked {
+			continue
+		}
+		wait = min(wait, timeDiff(seg.resendTS, current))
+	}
+	return time.Duration(max(wait, 0)) * time.Millisecond
+}
+
+func timeDiff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+var epoch = time.Now()
+
+func currentMs() uint32 {
+	return uint32(time.Since(epoch) / time.Millisecond)
+}
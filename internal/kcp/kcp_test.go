@@ -0,0 +1,328 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	mathrand "math/rand"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// udpConn adapts a host UDP socket to v1net.Conn, sending to peer when the
+// socket is not connected. Non-blocking reads wait a millisecond at most
+// and return EAGAIN, the way a WATM conn does between polls.
+type udpConn struct {
+	*net.UDPConn
+	peer        *net.UDPAddr
+	nonBlocking bool
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	if c.nonBlocking {
+		c.UDPConn.SetReadDeadline(time.Now().Add(time.Millisecond))
+		n, err := c.UDPConn.Read(p)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return n, syscall.EAGAIN
+		}
+		return n, err
+	}
+	return c.UDPConn.Read(p)
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	if c.peer != nil {
+		return c.UDPConn.WriteToUDP(p, c.peer)
+	}
+	return c.UDPConn.Write(p)
+}
+
+func (c *udpConn) Fd() int32                          { return 0 }
+func (c *udpConn) SetNonBlock(nonblocking bool) error { c.nonBlocking = nonblocking; return nil }
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// lossyProxy relays datagrams between a client and server, dropping each
+// with the given probability. It returns the address the client sends to,
+// the one the server sees, and the count of dropped datagrams.
+func lossyProxy(t *testing.T, server *net.UDPConn, loss float64) (front, back *net.UDPAddr, dropped *atomic.Int64) {
+	t.Helper()
+	frontConn := listenUDP(t)
+	backConn, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { backConn.Close() })
+	dropped = &atomic.Int64{}
+	clientAddr := make(chan *net.UDPAddr, 1)
+	go func() {
+		random := mathrand.New(mathrand.NewSource(1))
+		buffer := make([]byte, 2048)
+		for first := true; ; first = false {
+			n, addr, err := frontConn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			if first {
+				clientAddr <- addr
+			}
+			if random.Float64() < loss {
+				dropped.Add(1)
+				continue
+			}
+			backConn.Write(buffer[:n])
+		}
+	}()
+	go func() {
+		random := mathrand.New(mathrand.NewSource(2))
+		buffer := make([]byte, 2048)
+		var addr *net.UDPAddr
+		for {
+			n, err := backConn.Read(buffer)
+			if err != nil {
+				return
+			}
+			if addr == nil {
+				addr = <-clientAddr
+			}
+			if random.Float64() < loss {
+				dropped.Add(1)
+				continue
+			}
+			frontConn.WriteToUDP(buffer[:n], addr)
+		}
+	}()
+	return frontConn.LocalAddr().(*net.UDPAddr), backConn.LocalAddr().(*net.UDPAddr), dropped
+}
+
+// echo serves a KCP conn that writes back whatever it reads.
+func echo(conn *Conn) {
+	buffer := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(buffer[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	fast3, _ := ParseMode("fast3")
+	for _, tc := range []struct {
+		name        string
+		config      Config
+		nonBlocking bool
+	}{
+		{"aes with fec", Config{Crypt: "aes", DataShards: 10, ParityShards: 3}, false},
+		{"salsa20 without fec", Config{Crypt: "salsa20"}, false},
+		{"null with fec, non-blocking", Config{Crypt: "null", DataShards: 4, ParityShards: 2, AckNoDelay: true}, true},
+		{"xor without fec, non-blocking", Config{Crypt: "xor", MTU: 576}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.Key = "test key"
+			tc.config.Mode = fast3
+			tc.config.Conv = 0x1234
+			serverSocket := listenUDP(t)
+			front, back, dropped := lossyProxy(t, serverSocket, 0.1)
+			server, err := NewConn(&udpConn{UDPConn: serverSocket, peer: back}, tc.config)
+			if err != nil {
+				t.Fatalf("NewConn failed: %v", err)
+			}
+			go echo(server)
+
+			clientSocket, err := net.DialUDP("udp", nil, front)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			t.Cleanup(func() { clientSocket.Close() })
+			// unblocks a test that fails to complete
+			timer := time.AfterFunc(20*time.Second, func() { clientSocket.Close() })
+			defer timer.Stop()
+			client, err := NewConn(&udpConn{UDPConn: clientSocket}, tc.config)
+			if err != nil {
+				t.Fatalf("NewConn failed: %v", err)
+			}
+			if err := client.SetNonBlock(tc.nonBlocking); err != nil {
+				t.Fatalf("SetNonBlock failed: %v", err)
+			}
+
+			data := make([]byte, 200*1024)
+			rand.Read(data)
+			var received []byte
+			buffer := make([]byte, 4096)
+			read := func() {
+				n, err := client.Read(buffer)
+				if err != nil && !errors.Is(err, syscall.EAGAIN) {
+					t.Fatalf("Read failed after %d bytes: %v", len(received), err)
+				}
+				received = append(received, buffer[:n]...)
+			}
+			for written := 0; written < len(data); written += 1000 {
+				if _, err := client.Write(data[written:min(written+1000, len(data))]); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+				if tc.nonBlocking {
+					// the worker reads between writes
+					read()
+				}
+			}
+			for len(received) < len(data) {
+				read()
+			}
+			if !bytes.Equal(received, data) {
+				t.Error("Expected the data to be echoed intact")
+			}
+			if dropped.Load() == 0 {
+				t.Error("Expected the proxy to drop datagrams")
+			}
+		})
+	}
+}
+
+func TestConn_DeadLink(t *testing.T) {
+	mode, _ := ParseMode("fast3")
+	// nothing answers on the other side
+	silent := listenUDP(t)
+	socket, err := net.DialUDP("udp", nil, silent.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer socket.Close()
+	client, err := NewConn(&udpConn{UDPConn: socket}, Config{Key: "test key", Mode: mode})
+	if err != nil {
+		t.Fatalf("NewConn failed: %v", err)
+	}
+	client.arq.rxMinRTO = 1
+	client.arq.rxRTO = 1
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := client.Read(make([]byte, 16)); !errors.Is(err, ErrDeadLink) {
+		t.Errorf("Expected ErrDeadLink, got %v", err)
+	}
+}
+
+func TestNewConn(t *testing.T) {
+	for _, config := range []Config{
+		{Crypt: "sm4"},
+		{MTU: 40},
+		{MTU: 9000},
+		{DataShards: 200, ParityShards: 100},
+	} {
+		if _, err := NewConn(&udpConn{}, config); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+	if _, err := ParseMode("turbo"); !errors.Is(err, ErrUnknownMode) {
+		t.Errorf("Expected ErrUnknownMode, got %v", err)
+	}
+}
+
+func TestCrypt(t *testing.T) {
+	for _, name := range []string{"aes", "aes-128", "aes-192", "salsa20", "blowfish", "twofish", "cast5", "3des", "tea", "xtea", "xor", "none"} {
+		crypt, err := newBlockCrypt(name, "test key")
+		if err != nil {
+			t.Fatalf("newBlockCrypt(%q) failed: %v", name, err)
+		}
+		packet := make([]byte, 1021)
+		rand.Read(packet)
+		plain := bytes.Clone(packet)
+		crypt.encrypt(packet)
+		if name != "none" && bytes.Equal(packet[8:], plain[8:]) {
+			t.Errorf("Expected %s to encrypt the packet", name)
+		}
+		crypt.decrypt(packet)
+		if !bytes.Equal(packet, plain) {
+			t.Errorf("Expected %s to decrypt the packet", name)
+		}
+	}
+	if crypt, err := newBlockCrypt("null", "test key"); crypt != nil || err != nil {
+		t.Errorf("Expected null to have no crypt, got %v, %v", crypt, err)
+	}
+	if _, err := newBlockCrypt("sm4", "test key"); !errors.Is(err, ErrUnknownCrypt) {
+		t.Errorf("Expected ErrUnknownCrypt, got %v", err)
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+	rs := newReedSolomon(10, 3)
+	shards := make([][]byte, 13)
+	for i := range shards {
+		shards[i] = make([]byte, 100)
+		if i < 10 {
+			rand.Read(shards[i])
+		}
+	}
+	rs.encode(shards)
+	original := make([][]byte, 10)
+	for i := range original {
+		original[i] = bytes.Clone(shards[i])
+	}
+	// any three shards may go
+	shards[0], shards[4], shards[11] = nil, nil, nil
+	if err := rs.reconstructData(shards); err != nil {
+		t.Fatalf("reconstructData failed: %v", err)
+	}
+	for i := range original {
+		if !bytes.Equal(shards[i], original[i]) {
+			t.Errorf("Expected shard %d to be recovered", i)
+		}
+	}
+	shards[1], shards[2], shards[3], shards[5] = nil, nil, nil, nil
+	if err := rs.reconstructData(shards); !errors.Is(err, errTooFewShards) {
+		t.Errorf("Expected errTooFewShards, got %v", err)
+	}
+}
+
+func TestFEC(t *testing.T) {
+	const headerOffset = cryptHeaderSize
+	encoder := newFECEncoder(4, 2, headerOffset)
+	decoder := newFECDecoder(4, 2)
+	var packets [][]byte
+	for i := range 4 {
+		packet := make([]byte, headerOffset+fecHeaderSizePlus2+50+i*10)
+		rand.Read(packet[headerOffset+fecHeaderSizePlus2:])
+		parity := encoder.encode(packet)
+		if (parity != nil) != (i == 3) {
+			t.Fatalf("Expected parity after the fourth packet only")
+		}
+		packets = append(packets, packet)
+		packets = append(packets, parity...)
+	}
+	if len(packets) != 6 {
+		t.Fatalf("Expected 2 parity packets, got %d", len(packets)-4)
+	}
+	// the second and third packets are lost
+	var recovered [][]byte
+	for _, i := range []int{0, 3, 4, 5} {
+		recovered = append(recovered, decoder.decode(packets[i][headerOffset:])...)
+	}
+	if len(recovered) != 2 {
+		t.Fatalf("Expected 2 packets to be recovered, got %d", len(recovered))
+	}
+	for i, shard := range recovered {
+		expected := packets[i+1][headerOffset+fecHeaderSize:]
+		size := int(shard[0]) | int(shard[1])<<8
+		if !bytes.Equal(shard[:size], expected) {
+			t.Errorf("Expected packet %d to be recovered intact", i+1)
+		}
+	}
+	if recovered := decoder.decode(packets[1][headerOffset:]); recovered != nil {
+		t.Errorf("Expected a late packet of a finished group to recover nothing, got %d", len(recovered))
+	}
+}
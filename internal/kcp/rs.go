@@ -0,0 +1,190 @@
+package kcp
+
+import "errors"
+
+var errTooFewShards = errors.New("kcp: too few shards to reconstruct")
+
+// The Reed-Solomon code of kcp-go's FEC, the one of
+// github.com/klauspost/reedsolomon: GF(2^8) with the polynomial 0x11d, and
+// an encoding matrix made systematic from a Vandermonde matrix.
+var gfExp, gfLog = func() (exp [510]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		exp[i+255] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])*n%255]
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m matrix) multiply(right matrix) matrix {
+	result := newMatrix(len(m), len(right[0]))
+	for r := range result {
+		for c := range result[r] {
+			var value byte
+			for i := range right {
+				value ^= gfMul(m[r][i], right[i][c])
+			}
+			result[r][c] = value
+		}
+	}
+	return result
+}
+
+// invert returns the inverse of a square matrix by Gauss-Jordan
+// elimination.
+func (m matrix) invert() (matrix, error) {
+	size := len(m)
+	work := newMatrix(size, 2*size)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][size+r] = 1
+	}
+	for r := 0; r < size; r++ {
+		if work[r][r] == 0 {
+			for below := r + 1; below < size; below++ {
+				if work[below][r] != 0 {
+					work[r], work[below] = work[below], work[r]
+					break
+				}
+			}
+		}
+		if work[r][r] == 0 {
+			return nil, errors.New("kcp: singular matrix")
+		}
+		if scale := work[r][r]; scale != 1 {
+			for c := range work[r] {
+				work[r][c] = gfDiv(work[r][c], scale)
+			}
+		}
+		for other := 0; other < size; other++ {
+			if other == r || work[other][r] == 0 {
+				continue
+			}
+			scale := work[other][r]
+			for c := range work[other] {
+				work[other][c] ^= gfMul(scale, work[r][c])
+			}
+		}
+	}
+	inverse := make(matrix, size)
+	for r := range work {
+		inverse[r] = work[r][size:]
+	}
+	return inverse, nil
+}
+
+// reedSolomon computes parity shards and recovers lost data shards.
+type reedSolomon struct {
+	dataShards, parityShards int
+	matrix                   matrix
+}
+
+func newReedSolomon(dataShards, parityShards int) *reedSolomon {
+	total := dataShards + parityShards
+	vandermonde := newMatrix(total, dataShards)
+	for r := range vandermonde {
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, _ := vandermonde[:dataShards].invert()
+	return &reedSolomon{dataShards: dataShards, parityShards: parityShards, matrix: vandermonde.multiply(top)}
+}
+
+// encode fills the parity shards from the data shards, all of the same
+// length.
+func (rs *reedSolomon) encode(shards [][]byte) {
+	for p, parity := range shards[rs.dataShards:] {
+		clear(parity)
+		row := rs.matrix[rs.dataShards+p]
+		for d, data := range shards[:rs.dataShards] {
+			mulAdd(parity, data, row[d])
+		}
+	}
+}
+
+// reconstructData rebuilds the nil data shards from any dataShards of the
+// shards present, all of the same length.
+func (rs *reedSolomon) reconstructData(shards [][]byte) error {
+	var present []int
+	for i, shard := range shards {
+		if shard != nil && len(present) < rs.dataShards {
+			present = append(present, i)
+		}
+	}
+	if len(present) < rs.dataShards {
+		return errTooFewShards
+	}
+	size := len(shards[present[0]])
+	sub := make(matrix, rs.dataShards)
+	for i, index := range present {
+		sub[i] = rs.matrix[index]
+	}
+	decode, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	for d := 0; d < rs.dataShards; d++ {
+		if shards[d] != nil {
+			continue
+		}
+		shard := make([]byte, size)
+		for i, index := range present {
+			mulAdd(shard, shards[index], decode[d][i])
+		}
+		shards[d] = shard
+	}
+	return nil
+}
+
+// mulAdd adds c times in to out.
+func mulAdd(out, in []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	logC := int(gfLog[c])
+	for i, b := range in {
+		if b != 0 {
+			out[i] ^= gfExp[int(gfLog[b])+logC]
+		}
+	}
+}
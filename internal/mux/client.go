@@ -0,0 +1,66 @@
+package mux
+
+import (
+	"slices"
+	"time"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+// Client opens streams on a pool of sessions, reusing a session while it
+// carries fewer than MaxStreams streams, and keeping sessions without
+// streams for IdleTimeout so the next stream skips the handshake.
+type Client struct {
+	dial     func() (v1net.Conn, error)
+	config   Config
+	sessions []*Session
+	now      func() time.Time
+}
+
+// NewClient returns a client opening sessions over the conns returned by
+// dial, which are shadowsocks conns to Destination.
+func NewClient(dial func() (v1net.Conn, error), config Config) *Client {
+	return &Client{dial: dial, config: config, now: time.Now}
+}
+
+// Open returns a new stream to destination.
+func (c *Client) Open(destination metadata.Socksaddr) (*Stream, error) {
+	c.expire()
+	for _, session := range c.sessions {
+		if session.usable() {
+			return session.Open(destination)
+		}
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	session := NewSession(conn, c.config)
+	session.pooled = true
+	c.sessions = append(c.sessions, session)
+	return session.Open(destination)
+}
+
+// expire closes the sessions that failed or stayed idle for too long.
+func (c *Client) expire() {
+	now := c.now()
+	c.sessions = slices.DeleteFunc(c.sessions, func(session *Session) bool {
+		idle := session.NumStreams() == 0
+		if session.closed || session.err != nil && idle ||
+			idle && c.config.IdleTimeout > 0 && now.Sub(session.idleSince) >= c.config.IdleTimeout {
+			session.Close()
+			return true
+		}
+		return false
+	})
+}
+
+// Close closes every session and the streams they carry.
+func (c *Client) Close() error {
+	for _, session := range c.sessions {
+		session.Close()
+	}
+	c.sessions = nil
+	return nil
+}
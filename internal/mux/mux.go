@@ -0,0 +1,127 @@
+// Package mux carries many streams over one shadowsocks connection the way
+// sing-mux does, so that sing-box servers with multiplexing enabled can
+// demultiplex them. The shadowsocks request names Destination, the session
+// starts with the sing-mux protocol header, optionally followed by padded
+// frames, and every stream opens with the address it is bound for.
+//
+// There are no goroutines under TinyGo: frames are read by whichever stream
+// is being read, and those for other streams are buffered until they are
+// read in turn. Reads resume across EAGAIN, so the session conn may be
+// non-blocking.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+// Destination is the address the shadowsocks request names to ask the
+// server for a multiplexed session.
+var Destination = metadata.Socksaddr{Fqdn: "sp.mux.sing-box.arpa", Port: 444}
+
+// Protocol is the multiplexing protocol of a session, numbered as in the
+// sing-mux protocol header.
+type Protocol byte
+
+const (
+	ProtocolSMux  Protocol = 0
+	ProtocolYAMux Protocol = 1
+)
+
+const (
+	version0 = 0
+	// version1 adds the padding flag to the protocol header
+	version1 = 1
+)
+
+// Errors of the sessions and streams. They are wrapped with context, so
+// callers match them with errors.Is.
+var (
+	// ErrUnknownProtocol means the protocol name is not one of the
+	// supported ones.
+	ErrUnknownProtocol = errors.New("mux: unknown protocol")
+	// ErrProtocol means the server sent a frame the protocol does not
+	// allow.
+	ErrProtocol = errors.New("mux: protocol error")
+	// ErrTooManyStreams means the session already carries MaxStreams
+	// streams.
+	ErrTooManyStreams = errors.New("mux: too many streams")
+	// ErrStreamRejected means the server could not connect the stream to
+	// its destination.
+	ErrStreamRejected = errors.New("mux: stream rejected")
+	// ErrStreamReset means the server reset the stream.
+	ErrStreamReset = errors.New("mux: stream reset")
+	// ErrSessionClosed means the session was closed, by either side.
+	ErrSessionClosed = errors.New("mux: session closed")
+)
+
+// Config describes the sessions.
+type Config struct {
+	Protocol Protocol
+	// Padding pads the first frames in each direction with 256 to 767
+	// bytes, which hides their lengths.
+	Padding bool
+	// MaxStreams is the number of streams a session carries at once. Zero
+	// is no limit.
+	MaxStreams int
+	// IdleTimeout is how long a Client keeps a session without streams
+	// for the next one to reuse. Zero keeps it until the server closes it.
+	IdleTimeout time.Duration
+	// Bare sessions speak plain smux or yamux, as kcptun does: there is no
+	// protocol header, padding or stream request, and the server connects
+	// every stream to the same place.
+	Bare bool
+	// KeepAlive sends a smux NOP when nothing was sent for that long, so
+	// that servers timing out silent sessions keep this one.
+	KeepAlive time.Duration
+}
+
+// ParseProtocol returns the protocol of the given name, smux when empty.
+func ParseProtocol(name string) (Protocol, error) {
+	switch name {
+	case "", "smux":
+		return ProtocolSMux, nil
+	case "yamux":
+		return ProtocolYAMux, nil
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrUnknownProtocol, name)
+	}
+}
+
+// protocolHeader returns the sing-mux header sent ahead of the first
+// frame.
+func protocolHeader(config Config) []byte {
+	if !config.Padding {
+		return []byte{version0, byte(config.Protocol)}
+	}
+	paddingLen := 256 + rand.Intn(512)
+	header := make([]byte, 5+paddingLen)
+	header[0] = version1
+	header[1] = byte(config.Protocol)
+	header[2] = 1
+	binary.BigEndian.PutUint16(header[3:], uint16(paddingLen))
+	return header
+}
+
+// protocolConn sends the protocol header with the first write.
+type protocolConn struct {
+	v1net.Conn
+	header []byte
+}
+
+func (c *protocolConn) Write(p []byte) (int, error) {
+	if c.header == nil {
+		return c.Conn.Write(p)
+	}
+	if _, err := c.Conn.Write(append(c.header, p...)); err != nil {
+		return 0, err
+	}
+	c.header = nil
+	return len(p), nil
+}
@@ -0,0 +1,360 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/conntest"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+// standIn is a sing-mux server that echoes every stream, or rejects them
+// with the reject message when it is set.
+type standIn struct {
+	conn         v1net.Conn
+	protocol     Protocol
+	reject       string
+	destinations chan string
+	closed       chan struct{}
+	streams      map[uint32]*standInStream
+}
+
+type standInStream struct {
+	buffered  []byte
+	requested bool
+}
+
+// serve starts a stand-in server and returns the client end of its conn.
+func serve(t *testing.T, reject string) (*conntest.NetConn, *standIn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	t.Cleanup(func() { client.Close(); server.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	s := &standIn{
+		conn:         &conntest.NetConn{Conn: server},
+		reject:       reject,
+		destinations: make(chan string, 16),
+		closed:       make(chan struct{}),
+		streams:      make(map[uint32]*standInStream),
+	}
+	go func() {
+		// runs until the client closes the conn
+		s.run()
+		close(s.closed)
+	}()
+	return &conntest.NetConn{Conn: client}, s
+}
+
+func (s *standIn) run() error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(s.conn, header); err != nil {
+		return err
+	}
+	s.protocol = Protocol(header[1])
+	if header[0] == version1 {
+		if _, err := io.ReadFull(s.conn, header[:1]); err != nil {
+			return err
+		}
+		if header[0] == 1 {
+			if _, err := io.ReadFull(s.conn, header); err != nil {
+				return err
+			}
+			if _, err := io.ReadFull(s.conn, make([]byte, binary.BigEndian.Uint16(header))); err != nil {
+				return err
+			}
+			s.conn = &paddingConn{Conn: s.conn}
+		}
+	}
+	for {
+		var err error
+		if s.protocol == ProtocolYAMux {
+			err = s.yamuxFrame()
+		} else {
+			err = s.smuxFrame()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *standIn) smuxFrame() error {
+	header := make([]byte, smuxHeaderSize)
+	if _, err := io.ReadFull(s.conn, header); err != nil {
+		return err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(s.conn, payload); err != nil {
+		return err
+	}
+	id := binary.LittleEndian.Uint32(header[4:])
+	switch header[1] {
+	case smuxSYN:
+		s.streams[id] = &standInStream{}
+	case smuxPSH:
+		out := s.receive(id, payload)
+		if out == nil {
+			return nil
+		}
+		frame := smuxFrame(nil, smuxPSH, id, out)
+		if s.reject != "" {
+			frame = smuxFrame(frame, smuxFIN, id, nil)
+		}
+		_, err := s.conn.Write(frame)
+		return err
+	case smuxFIN:
+		_, err := s.conn.Write(smuxFrame(nil, smuxFIN, id, nil))
+		return err
+	}
+	return nil
+}
+
+func (s *standIn) yamuxFrame() error {
+	header := make([]byte, yamuxHeaderSize)
+	if _, err := io.ReadFull(s.conn, header); err != nil {
+		return err
+	}
+	flags := binary.BigEndian.Uint16(header[2:])
+	id := binary.BigEndian.Uint32(header[4:])
+	length := binary.BigEndian.Uint32(header[8:])
+	var payload []byte
+	if header[1] == yamuxData {
+		payload = make([]byte, length)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			return err
+		}
+	}
+	var frame []byte
+	if flags&yamuxFlagSYN != 0 {
+		s.streams[id] = &standInStream{}
+		frame = yamuxFrame(frame, yamuxWindowUpdate, yamuxFlagACK, id, 0, nil)
+	}
+	if len(payload) > 0 {
+		// give the window back at once
+		frame = yamuxFrame(frame, yamuxWindowUpdate, 0, id, length, nil)
+		if out := s.receive(id, payload); out != nil {
+			var flags uint16
+			if s.reject != "" {
+				flags = yamuxFlagFIN
+			}
+			frame = yamuxFrame(frame, yamuxData, flags, id, uint32(len(out)), out)
+		}
+	}
+	if flags&yamuxFlagFIN != 0 {
+		frame = yamuxFrame(frame, yamuxData, yamuxFlagFIN, id, 0, nil)
+	}
+	if frame == nil {
+		return nil
+	}
+	_, err := s.conn.Write(frame)
+	return err
+}
+
+// receive returns what the stand-in answers to data on stream id: the
+// response once the request is complete, and then the data echoed.
+func (s *standIn) receive(id uint32, data []byte) []byte {
+	stream := s.streams[id]
+	if stream.requested {
+		return data
+	}
+	stream.buffered = append(stream.buffered, data...)
+	if len(stream.buffered) < 2 {
+		return nil
+	}
+	reader := bytes.NewReader(stream.buffered[2:])
+	destination, err := metadata.SocksaddrSerializer.ReadAddrPort(reader)
+	if err != nil {
+		return nil
+	}
+	stream.requested = true
+	s.destinations <- destination.String()
+	if s.reject != "" {
+		return append([]byte{statusError, byte(len(s.reject))}, s.reject...)
+	}
+	rest, _ := io.ReadAll(reader)
+	return append([]byte{statusSuccess}, rest...)
+}
+
+func readFull(t *testing.T, stream *Stream, length int) []byte {
+	t.Helper()
+	var read []byte
+	buffer := make([]byte, 4096)
+	for len(read) < length {
+		n, err := stream.Read(buffer)
+		if err != nil && !errors.Is(err, syscall.EAGAIN) {
+			t.Fatalf("Read failed after %d bytes: %v", len(read), err)
+		}
+		read = append(read, buffer[:n]...)
+	}
+	return read
+}
+
+func TestSession(t *testing.T) {
+	for _, config := range []Config{
+		{Protocol: ProtocolSMux},
+		{Protocol: ProtocolSMux, Padding: true},
+		{Protocol: ProtocolYAMux},
+		{Protocol: ProtocolYAMux, Padding: true},
+	} {
+		conn, server := serve(t, "")
+		session := NewSession(conn, config)
+		first, _ := session.Open(metadata.ParseSocksaddr("example.com:443"))
+		second, _ := session.Open(metadata.ParseSocksaddr("10.0.0.1:80"))
+		if _, err := first.Write([]byte("hello")); err != nil {
+			t.Fatalf("%+v: Write failed: %v", config, err)
+		}
+		// more than a yamux window and more than the padded frames
+		large := bytes.Repeat([]byte("x"), 300000)
+		if _, err := second.Write(large); err != nil {
+			t.Fatalf("%+v: Write failed: %v", config, err)
+		}
+		if echoed := readFull(t, second, len(large)); !bytes.Equal(echoed, large) {
+			t.Errorf("%+v: Expected the large payload to be echoed", config)
+		}
+		if echoed := readFull(t, first, 5); string(echoed) != "hello" {
+			t.Errorf("%+v: Expected hello, got %q", config, echoed)
+		}
+		if destination := <-server.destinations; destination != "example.com:443" {
+			t.Errorf("%+v: Unexpected destination %s", config, destination)
+		}
+		if destination := <-server.destinations; destination != "10.0.0.1:80" {
+			t.Errorf("%+v: Unexpected destination %s", config, destination)
+		}
+
+		if err := first.CloseWrite(); err != nil {
+			t.Fatalf("%+v: CloseWrite failed: %v", config, err)
+		}
+		if _, err := first.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%+v: Expected the server to end the stream, got %v", config, err)
+		}
+		first.Close()
+		if session.NumStreams() != 1 {
+			t.Errorf("%+v: Expected one stream left, got %d", config, session.NumStreams())
+		}
+		// the last stream takes the session with it
+		second.Close()
+		select {
+		case <-server.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%+v: Expected the session to be closed", config)
+		}
+	}
+}
+
+func TestRejected(t *testing.T) {
+	for _, protocol := range []Protocol{ProtocolSMux, ProtocolYAMux} {
+		conn, _ := serve(t, "connection refused")
+		stream, _ := NewSession(conn, Config{Protocol: protocol}).Open(metadata.ParseSocksaddr("10.0.0.1:80"))
+		_, err := stream.Read(make([]byte, 1))
+		if !errors.Is(err, ErrStreamRejected) || !bytes.Contains([]byte(err.Error()), []byte("connection refused")) {
+			t.Errorf("Expected the stream to be rejected, got %v", err)
+		}
+	}
+}
+
+func TestNonBlocking(t *testing.T) {
+	conn, _ := serve(t, "")
+	stream, _ := NewSession(conn, Config{Protocol: ProtocolYAMux, Padding: true}).Open(metadata.ParseSocksaddr("example.com:443"))
+	if err := stream.SetNonBlock(true); err != nil {
+		t.Fatalf("SetNonBlock failed: %v", err)
+	}
+	conn.Flaky = true
+	// beyond the window, the rest is sent by the reads
+	payload := bytes.Repeat([]byte("y"), 2*yamuxWindow)
+	if n, err := stream.Write(payload); err != nil || n != len(payload) {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if len(stream.queued) == 0 {
+		t.Error("Expected the data beyond the window to be queued")
+	}
+	if echoed := readFull(t, stream, len(payload)); !bytes.Equal(echoed, payload) {
+		t.Error("Expected the payload to be echoed")
+	}
+}
+
+func TestClient(t *testing.T) {
+	var servers []*standIn
+	dial := func() (v1net.Conn, error) {
+		conn, server := serve(t, "")
+		servers = append(servers, server)
+		return conn, nil
+	}
+	now := time.Now()
+	client := NewClient(dial, Config{MaxStreams: 2, IdleTimeout: time.Minute})
+	client.now = func() time.Time { return now }
+	defer client.Close()
+	destination := metadata.ParseSocksaddr("example.com:443")
+
+	var streams []*Stream
+	for range 3 {
+		stream, err := client.Open(destination)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		streams = append(streams, stream)
+	}
+	if len(servers) != 2 || streams[0].session != streams[1].session || streams[1].session == streams[2].session {
+		t.Fatalf("Expected two streams per session, dialed %d sessions", len(servers))
+	}
+
+	// an idle session is reused
+	for _, stream := range streams {
+		stream.Write([]byte("ping"))
+		readFull(t, stream, 4)
+		stream.Close()
+	}
+	reused, err := client.Open(destination)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if len(servers) != 2 || reused.session != streams[0].session {
+		t.Error("Expected the idle session to be reused")
+	}
+	reused.Close()
+
+	// until it stayed idle too long
+	now = now.Add(2 * time.Minute)
+	if _, err := client.Open(destination); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if len(servers) != 3 {
+		t.Errorf("Expected the idle sessions to expire, dialed %d sessions", len(servers))
+	}
+	for _, server := range servers[:2] {
+		select {
+		case <-server.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the expired sessions to be closed")
+		}
+	}
+}
+
+func TestParseProtocol(t *testing.T) {
+	for name, expected := range map[string]Protocol{"": ProtocolSMux, "smux": ProtocolSMux, "yamux": ProtocolYAMux} {
+		if protocol, err := ParseProtocol(name); err != nil || protocol != expected {
+			t.Errorf("ParseProtocol(%q) = %d, %v", name, protocol, err)
+		}
+	}
+	if _, err := ParseProtocol("h2mux"); !errors.Is(err, ErrUnknownProtocol) {
+		t.Errorf("Expected ErrUnknownProtocol, got %v", err)
+	}
+}
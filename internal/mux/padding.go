@@ -0,0 +1,104 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+const (
+	// paddedFrames is the number of padded frames in each direction, after
+	// which the stream is sent as is.
+	paddedFrames = 16
+	// maxPaddedData is the most data one padded frame carries.
+	maxPaddedData = 65535
+)
+
+// paddingConn frames the first writes and reads of a session as the data
+// length, the padding length, the data and the padding, all lengths being
+// big endian uint16.
+type paddingConn struct {
+	v1net.Conn
+	writeFrames int
+
+	readFrames       int
+	header           [4]byte
+	headerN          int
+	readRemaining    int
+	paddingRemaining int
+}
+
+func (c *paddingConn) Write(p []byte) (int, error) {
+	if c.writeFrames >= paddedFrames {
+		return c.Conn.Write(p)
+	}
+	var out []byte
+	for data := p; len(data) > 0; {
+		if c.writeFrames >= paddedFrames {
+			out = append(out, data...)
+			break
+		}
+		size := min(len(data), maxPaddedData)
+		paddingLen := 256 + rand.Intn(512)
+		out = binary.BigEndian.AppendUint16(out, uint16(size))
+		out = binary.BigEndian.AppendUint16(out, uint16(paddingLen))
+		out = append(out, data[:size]...)
+		out = append(out, make([]byte, paddingLen)...)
+		c.writeFrames++
+		data = data[size:]
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read returns the data of the padded frames, keeping its place in the
+// frame when the conn returns EAGAIN.
+func (c *paddingConn) Read(p []byte) (int, error) {
+	for {
+		if c.readRemaining > 0 {
+			n, err := c.Conn.Read(p[:min(len(p), c.readRemaining)])
+			c.readRemaining -= n
+			if n > 0 {
+				return n, nil
+			}
+			return 0, unexpectedEOF(err)
+		}
+		if c.paddingRemaining > 0 {
+			skipped, err := c.Conn.Read(make([]byte, c.paddingRemaining))
+			c.paddingRemaining -= skipped
+			if err != nil && c.paddingRemaining > 0 {
+				return 0, unexpectedEOF(err)
+			}
+			continue
+		}
+		if c.readFrames >= paddedFrames {
+			return c.Conn.Read(p)
+		}
+		n, err := c.Conn.Read(c.header[c.headerN:])
+		c.headerN += n
+		if c.headerN < len(c.header) {
+			if err == io.EOF && c.headerN == 0 {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, unexpectedEOF(err)
+			}
+			continue
+		}
+		c.headerN = 0
+		c.readFrames++
+		c.readRemaining = int(binary.BigEndian.Uint16(c.header[:2]))
+		c.paddingRemaining = int(binary.BigEndian.Uint16(c.header[2:]))
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
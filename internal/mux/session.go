@@ -0,0 +1,569 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+const (
+	smuxVersion    = 1
+	smuxHeaderSize = 8
+	smuxMaxFrame   = 32768
+
+	smuxSYN = 0
+	smuxFIN = 1
+	smuxPSH = 2
+	smuxNOP = 3
+	smuxUPD = 4
+)
+
+const (
+	yamuxVersion    = 0
+	yamuxHeaderSize = 12
+	// yamuxWindow is the initial window of every stream in both directions.
+	yamuxWindow = 256 * 1024
+
+	yamuxData         = 0
+	yamuxWindowUpdate = 1
+	yamuxPing         = 2
+	yamuxGoAway       = 3
+
+	yamuxFlagSYN = 1
+	yamuxFlagACK = 2
+	yamuxFlagFIN = 4
+	yamuxFlagRST = 8
+)
+
+// Session multiplexes streams over one conn to the server.
+type Session struct {
+	conn       v1net.Conn
+	config     Config
+	headerSize int
+	streams    map[uint32]*Stream
+	nextID     uint32
+	// pooled sessions belong to a Client, which decides when they close.
+	// The others close with their last stream.
+	pooled    bool
+	idleSince time.Time
+	lastSent  time.Time
+	closed    bool
+
+	nonBlocking bool
+	header      [yamuxHeaderSize]byte
+	headerN     int
+	payload     []byte
+	payloadN    int
+	err         error
+}
+
+// NewSession starts a session over conn, the shadowsocks conn to
+// Destination. Nothing is sent until the first stream writes or reads.
+func NewSession(conn v1net.Conn, config Config) *Session {
+	s := &Session{
+		conn:      conn,
+		config:    config,
+		streams:   make(map[uint32]*Stream),
+		idleSince: time.Now(),
+	}
+	if !config.Bare {
+		s.conn = &protocolConn{Conn: conn, header: protocolHeader(config)}
+		if config.Padding {
+			s.conn = &paddingConn{Conn: s.conn}
+		}
+	}
+	switch config.Protocol {
+	case ProtocolYAMux:
+		s.headerSize = yamuxHeaderSize
+		s.nextID = 1
+	default:
+		s.headerSize = smuxHeaderSize
+		// smux clients skip stream 1
+		s.nextID = 3
+	}
+	return s
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	return len(s.streams)
+}
+
+// Open returns a new stream to destination. The stream is announced to the
+// server with its first write.
+func (s *Session) Open(destination metadata.Socksaddr) (*Stream, error) {
+	if s.closed {
+		return nil, ErrSessionClosed
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.config.MaxStreams > 0 && len(s.streams) >= s.config.MaxStreams {
+		return nil, fmt.Errorf("%w: %d open", ErrTooManyStreams, len(s.streams))
+	}
+	stream := &Stream{
+		Conn:           s.conn,
+		session:        s,
+		id:             s.nextID,
+		destination:    destination,
+		requestWritten: s.config.Bare,
+		responseRead:   s.config.Bare,
+		sendWindow:     yamuxWindow,
+	}
+	s.nextID += 2
+	s.streams[stream.id] = stream
+	return stream, nil
+}
+
+// Close closes the conn and with it every stream.
+func (s *Session) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for _, stream := range s.streams {
+		stream.readErr = ErrSessionClosed
+	}
+	clear(s.streams)
+	return s.conn.Close()
+}
+
+// usable reports whether new streams can be opened.
+func (s *Session) usable() bool {
+	return !s.closed && s.err == nil && (s.config.MaxStreams == 0 || len(s.streams) < s.config.MaxStreams)
+}
+
+func (s *Session) write(b []byte) error {
+	if s.closed {
+		return ErrSessionClosed
+	}
+	if s.config.KeepAlive > 0 {
+		s.lastSent = time.Now()
+	}
+	_, err := s.conn.Write(b)
+	return err
+}
+
+// keepAlive sends a NOP when nothing was sent for KeepAlive. There is no
+// timer to do it, so it happens on the next read.
+func (s *Session) keepAlive() error {
+	if s.config.KeepAlive <= 0 || s.config.Protocol != ProtocolSMux || time.Since(s.lastSent) < s.config.KeepAlive {
+		return nil
+	}
+	return s.write(smuxFrame(nil, smuxNOP, 0, nil))
+}
+
+// remove forgets a closed stream, closing the session with its last stream
+// unless a Client keeps it for reuse.
+func (s *Session) remove(stream *Stream) error {
+	if s.streams[stream.id] != stream {
+		return nil
+	}
+	delete(s.streams, stream.id)
+	if len(s.streams) > 0 {
+		return nil
+	}
+	s.idleSince = time.Now()
+	if !s.pooled {
+		return s.Close()
+	}
+	return nil
+}
+
+// readFrame reads and handles one frame, keeping what it read so far when
+// the conn returns EAGAIN.
+func (s *Session) readFrame() error {
+	if s.closed {
+		return ErrSessionClosed
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.keepAlive(); err != nil {
+		return err
+	}
+	for s.headerN < s.headerSize {
+		n, err := s.conn.Read(s.header[s.headerN:s.headerSize])
+		s.headerN += n
+		if s.headerN < s.headerSize && err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("%w: %w", ErrSessionClosed, io.ErrUnexpectedEOF)
+			}
+			return err
+		}
+		if s.headerN == s.headerSize {
+			length, err := s.payloadLength()
+			if err != nil {
+				return s.fail(err)
+			}
+			if cap(s.payload) < length {
+				s.payload = make([]byte, length)
+			}
+			s.payload = s.payload[:length]
+			s.payloadN = 0
+		}
+	}
+	for s.payloadN < len(s.payload) {
+		n, err := s.conn.Read(s.payload[s.payloadN:])
+		s.payloadN += n
+		if s.payloadN < len(s.payload) && err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+	s.headerN = 0
+	var err error
+	if s.config.Protocol == ProtocolYAMux {
+		err = s.handleYAMux()
+	} else {
+		err = s.handleSMux()
+	}
+	if err != nil {
+		return s.fail(err)
+	}
+	return nil
+}
+
+// payloadLength validates the frame header and returns the length of the
+// payload following it.
+func (s *Session) payloadLength() (int, error) {
+	if s.config.Protocol == ProtocolYAMux {
+		if s.header[0] != yamuxVersion || s.header[1] > yamuxGoAway {
+			return 0, fmt.Errorf("%w: yamux version %d type %d", ErrProtocol, s.header[0], s.header[1])
+		}
+		if s.header[1] != yamuxData {
+			// the length of the other frames is a value
+			return 0, nil
+		}
+		length := binary.BigEndian.Uint32(s.header[8:])
+		if length > yamuxWindow {
+			return 0, fmt.Errorf("%w: %d byte frame", ErrProtocol, length)
+		}
+		return int(length), nil
+	}
+	if s.header[0] != smuxVersion || s.header[1] > smuxUPD {
+		return 0, fmt.Errorf("%w: smux version %d command %d", ErrProtocol, s.header[0], s.header[1])
+	}
+	return int(binary.LittleEndian.Uint16(s.header[2:])), nil
+}
+
+func (s *Session) handleSMux() error {
+	stream := s.streams[binary.LittleEndian.Uint32(s.header[4:])]
+	switch s.header[1] {
+	case smuxPSH:
+		if stream != nil {
+			stream.inbound = append(stream.inbound, s.payload...)
+		}
+	case smuxFIN:
+		if stream != nil && stream.readErr == nil {
+			stream.readErr = io.EOF
+		}
+	case smuxSYN:
+		// servers do not open streams, refuse it
+		return s.write(smuxFrame(nil, smuxFIN, binary.LittleEndian.Uint32(s.header[4:]), nil))
+	}
+	return nil
+}
+
+func (s *Session) handleYAMux() error {
+	flags := binary.BigEndian.Uint16(s.header[2:])
+	id := binary.BigEndian.Uint32(s.header[4:])
+	length := binary.BigEndian.Uint32(s.header[8:])
+	switch s.header[1] {
+	case yamuxPing:
+		if flags&yamuxFlagSYN != 0 {
+			return s.write(yamuxFrame(nil, yamuxPing, yamuxFlagACK, 0, length, nil))
+		}
+		return nil
+	case yamuxGoAway:
+		return fmt.Errorf("%w: go away, code %d", ErrSessionClosed, length)
+	}
+	stream := s.streams[id]
+	if stream == nil {
+		if flags&yamuxFlagSYN != 0 {
+			return s.write(yamuxFrame(nil, yamuxWindowUpdate, yamuxFlagRST, id, 0, nil))
+		}
+		return nil
+	}
+	if s.header[1] == yamuxData {
+		stream.inbound = append(stream.inbound, s.payload...)
+		stream.received += uint32(len(s.payload))
+		if stream.received >= yamuxWindow/2 && stream.readErr == nil {
+			// the stream buffers whatever arrives, so the window is given
+			// back as soon as it is half used
+			update := yamuxFrame(nil, yamuxWindowUpdate, 0, id, stream.received, nil)
+			stream.received = 0
+			if err := s.write(update); err != nil {
+				return err
+			}
+		}
+	} else {
+		stream.sendWindow += length
+	}
+	if flags&yamuxFlagRST != 0 {
+		stream.readErr = ErrStreamReset
+		stream.writeErr = ErrStreamReset
+	} else if flags&yamuxFlagFIN != 0 && stream.readErr == nil {
+		stream.readErr = io.EOF
+	}
+	return stream.flush()
+}
+
+// fail makes err the result of every later read.
+func (s *Session) fail(err error) error {
+	s.err = err
+	return err
+}
+
+func smuxFrame(b []byte, command byte, id uint32, payload []byte) []byte {
+	b = append(b, smuxVersion, command)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(payload)))
+	b = binary.LittleEndian.AppendUint32(b, id)
+	return append(b, payload...)
+}
+
+func yamuxFrame(b []byte, frameType byte, flags uint16, id, length uint32, payload []byte) []byte {
+	b = append(b, yamuxVersion, frameType)
+	b = binary.BigEndian.AppendUint16(b, flags)
+	b = binary.BigEndian.AppendUint32(b, id)
+	b = binary.BigEndian.AppendUint32(b, length)
+	return append(b, payload...)
+}
+
+// Stream is one logical conn of a session. It shares the session conn, so
+// the fd, addresses and deadlines are the session's.
+type Stream struct {
+	v1net.Conn
+	session     *Session
+	id          uint32
+	destination metadata.Socksaddr
+
+	opened         bool
+	requestWritten bool
+	responseRead   bool
+	writeClosed    bool
+	closed         bool
+	inbound        []byte
+	readErr        error
+	writeErr       error
+
+	// yamux flow control
+	sendWindow uint32
+	received   uint32
+	queued     []byte
+	finQueued  bool
+}
+
+// SetNonBlock forwards the mode to the session conn. In non-blocking mode
+// writes beyond the yamux window are queued and sent by later reads.
+func (s *Stream) SetNonBlock(nonblocking bool) error {
+	s.session.nonBlocking = nonblocking
+	return s.Conn.SetNonBlock(nonblocking)
+}
+
+// Write sends p, preceded on the first write by the stream request that
+// tells the server where to connect the stream.
+func (s *Stream) Write(p []byte) (int, error) {
+	if s.closed || s.writeClosed {
+		return 0, net.ErrClosed
+	}
+	if s.writeErr != nil {
+		return 0, s.writeErr
+	}
+	data := p
+	if !s.requestWritten {
+		data = streamRequest(s.destination, p)
+		s.requestWritten = true
+	} else if len(p) == 0 && s.opened {
+		return 0, nil
+	}
+	if err := s.send(data, false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// send frames data, ending the stream after it if fin is set.
+func (s *Stream) send(data []byte, fin bool) error {
+	var out []byte
+	if s.session.config.Protocol == ProtocolYAMux {
+		if !s.opened {
+			out = yamuxFrame(out, yamuxWindowUpdate, yamuxFlagSYN, s.id, 0, nil)
+			s.opened = true
+		}
+		s.queued = append(s.queued, data...)
+		s.finQueued = fin
+		if err := s.session.write(out); err != nil {
+			return err
+		}
+		if err := s.flush(); err != nil {
+			return err
+		}
+		for (len(s.queued) > 0 || s.finQueued) && !s.session.nonBlocking {
+			if err := s.session.readFrame(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !s.opened {
+		out = smuxFrame(out, smuxSYN, s.id, nil)
+		s.opened = true
+	}
+	for len(data) > 0 {
+		size := min(len(data), smuxMaxFrame)
+		out = smuxFrame(out, smuxPSH, s.id, data[:size])
+		data = data[size:]
+	}
+	if fin {
+		out = smuxFrame(out, smuxFIN, s.id, nil)
+	}
+	return s.session.write(out)
+}
+
+// flush sends as much of the queued yamux data as the window allows, and
+// the FIN once it is all sent.
+func (s *Stream) flush() error {
+	var out []byte
+	for len(s.queued) > 0 && s.sendWindow > 0 {
+		size := min(len(s.queued), int(s.sendWindow))
+		out = yamuxFrame(out, yamuxData, 0, s.id, uint32(size), s.queued[:size])
+		s.queued = s.queued[size:]
+		s.sendWindow -= uint32(size)
+	}
+	if len(s.queued) == 0 {
+		s.queued = nil
+		if s.finQueued {
+			out = yamuxFrame(out, yamuxData, yamuxFlagFIN, s.id, 0, nil)
+			s.finQueued = false
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return s.session.write(out)
+}
+
+// Read returns the data of the stream once the server confirmed it
+// connected it, reading the frames of every stream on the way.
+func (s *Stream) Read(p []byte) (n int, err error) {
+	if s.closed {
+		return 0, net.ErrClosed
+	}
+	if !s.requestWritten || !s.opened {
+		// the server waits for the request before answering
+		if _, err = s.Write(nil); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		if !s.responseRead {
+			if err = s.readResponse(); err != nil {
+				return 0, err
+			}
+		}
+		if s.responseRead && len(s.inbound) > 0 {
+			n = copy(p, s.inbound)
+			s.inbound = s.inbound[n:]
+			if len(s.inbound) == 0 {
+				s.inbound = nil
+			}
+			return n, nil
+		}
+		if s.readErr != nil {
+			if s.readErr == io.EOF && !s.responseRead {
+				return 0, fmt.Errorf("%w: no response", ErrStreamRejected)
+			}
+			return 0, s.readErr
+		}
+		if err = s.session.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readResponse parses the stream response once it is buffered: a status
+// byte, followed by a message when the server failed to connect.
+func (s *Stream) readResponse() error {
+	if len(s.inbound) == 0 {
+		return nil
+	}
+	switch s.inbound[0] {
+	case statusSuccess:
+		s.inbound = s.inbound[1:]
+		s.responseRead = true
+		return nil
+	case statusError:
+		length, n := binary.Uvarint(s.inbound[1:])
+		if n == 0 || n > 0 && uint64(len(s.inbound)-1-n) < length {
+			// incomplete
+			return nil
+		}
+		if n < 0 {
+			s.readErr = fmt.Errorf("%w: malformed response", ErrProtocol)
+		} else {
+			s.readErr = fmt.Errorf("%w: %s", ErrStreamRejected, s.inbound[1+n:1+n+int(length)])
+		}
+	default:
+		s.readErr = fmt.Errorf("%w: response status %d", ErrProtocol, s.inbound[0])
+	}
+	s.inbound = nil
+	s.responseRead = true
+	return s.readErr
+}
+
+// CloseWrite implements N.WriteCloser by ending the stream, which the
+// server reads as EOF. Reads go on until the server ends its side.
+func (s *Stream) CloseWrite() error {
+	if s.closed {
+		return net.ErrClosed
+	}
+	if s.writeClosed {
+		return nil
+	}
+	if !s.requestWritten || !s.opened {
+		if _, err := s.Write(nil); err != nil {
+			return err
+		}
+	}
+	s.writeClosed = true
+	if s.writeErr != nil {
+		return nil
+	}
+	return s.send(nil, true)
+}
+
+// Close ends the stream and removes it from the session, which closes
+// with its last stream unless a Client keeps it.
+func (s *Stream) Close() error {
+	if s.closed {
+		return nil
+	}
+	var err error
+	if s.opened && !s.writeClosed && s.writeErr == nil && s.session.err == nil && !s.session.closed {
+		s.writeClosed = true
+		err = s.send(nil, true)
+	}
+	s.closed = true
+	return errors.Join(err, s.session.remove(s))
+}
+
+const (
+	statusSuccess = 0
+	statusError   = 1
+)
+
+// streamRequest returns the request opening a TCP stream to destination,
+// big endian flags followed by the address, with payload appended.
+func streamRequest(destination metadata.Socksaddr, payload []byte) []byte {
+	request := bytes.NewBuffer(make([]byte, 2, 2+metadata.SocksaddrSerializer.AddrPortLen(destination)+len(payload)))
+	metadata.SocksaddrSerializer.WriteAddrPort(request, destination)
+	request.Write(payload)
+	return request.Bytes()
+}
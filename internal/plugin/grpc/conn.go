@@ -0,0 +1,529 @@
+package grpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	clientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	frameHeaderSize = 9
+
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	frameRSTStream    = 0x3
+	frameSettings     = 0x4
+	framePushPromise  = 0x5
+	framePing         = 0x6
+	frameGoAway       = 0x7
+	frameWindowUpdate = 0x8
+	frameContinuation = 0x9
+
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+
+	settingEnablePush        = 0x2
+	settingInitialWindowSize = 0x4
+	settingMaxFrameSize      = 0x5
+
+	// streamID is the only stream the client opens.
+	streamID = 1
+
+	defaultWindowSize   = 65535
+	defaultMaxFrameSize = 16384
+
+	// receiveWindow is what the client advertises for the stream and the
+	// connection. Received data is acknowledged once half of it is used.
+	receiveWindow = 1 << 20
+
+	grpcHeaderSize = 5
+	// hunkDataField is the tag of the bytes field of the Hunk message,
+	// field 1 with the length-delimited wire type.
+	hunkDataField = 1<<3 | 2
+)
+
+var (
+	// ErrProtocol means the server broke the HTTP/2 or gRPC framing.
+	ErrProtocol = errors.New("grpc: protocol error")
+	// ErrStreamReset means the server reset or refused the stream.
+	ErrStreamReset = errors.New("grpc: stream reset")
+	// ErrStatus means the call ended with a non-zero gRPC status or a
+	// non-200 HTTP status.
+	ErrStatus = errors.New("grpc: call failed")
+)
+
+// Conn is the client side of a gun stream. Reads decode the Hunk messages
+// of the response, answering SETTINGS and PING frames and acknowledging
+// received data on the way. Frames are reassembled across EAGAINs, those
+// the conn does not take go out with the next read or write, and data
+// that does not fit the server's flow control window waits for its
+// WINDOW_UPDATE: blocking conns read until it arrives, non-blocking conns
+// send it from the reads that receive the update.
+type Conn struct {
+	v1net.Conn
+	config      *Config
+	nonBlocking bool
+
+	started          bool
+	writeClosed      bool
+	connSendWindow   int64
+	streamSendWindow int64
+	peerWindowSize   int64
+	peerMaxFrameSize int
+	queued           []byte
+	// outbound holds the frames the conn did not take before returning
+	// EAGAIN, which go out ahead of anything else
+	outbound []byte
+
+	header      [frameHeaderSize]byte
+	headerN     int
+	payload     []byte
+	payloadN    int
+	headerBlock []byte
+	decoder     *hpack.Decoder
+	responded   bool
+	message     []byte
+	inbound     []byte
+	unacked     int
+	err         error
+}
+
+func newConn(conn v1net.Conn, config *Config) *Conn {
+	c := &Conn{
+		Conn:             conn,
+		config:           config,
+		connSendWindow:   defaultWindowSize,
+		streamSendWindow: defaultWindowSize,
+		peerWindowSize:   defaultWindowSize,
+		peerMaxFrameSize: defaultMaxFrameSize,
+	}
+	c.decoder = hpack.NewDecoder(4096, nil)
+	return c
+}
+
+// SetNonBlock records the mode, since writes that exceed the flow control
+// window wait for it only when the conn blocks.
+func (c *Conn) SetNonBlock(nonblocking bool) error {
+	c.nonBlocking = nonblocking
+	return c.Conn.SetNonBlock(nonblocking)
+}
+
+// start returns the connection preface, the client settings and the
+// request headers.
+func (c *Conn) start() []byte {
+	out := []byte(clientPreface)
+	settings := make([]byte, 0, 12)
+	settings = appendSetting(settings, settingEnablePush, 0)
+	settings = appendSetting(settings, settingInitialWindowSize, receiveWindow)
+	out = appendFrame(out, frameSettings, 0, 0, settings)
+	out = appendFrame(out, frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, receiveWindow-defaultWindowSize))
+
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	scheme := "http"
+	if c.config.TLS {
+		scheme = "https"
+	}
+	for _, field := range []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: scheme},
+		{Name: ":path", Value: "/" + c.config.ServiceName + "/Tun"},
+		{Name: ":authority", Value: c.config.Authority},
+		{Name: "content-type", Value: "application/grpc"},
+		{Name: "te", Value: "trailers"},
+		{Name: "user-agent", Value: "grpc-go/1.58.3"},
+	} {
+		encoder.WriteField(field)
+	}
+	return appendFrame(out, frameHeaders, flagEndHeaders, streamID, block.Bytes())
+}
+
+func appendSetting(b []byte, id uint16, value uint32) []byte {
+	b = binary.BigEndian.AppendUint16(b, id)
+	return binary.BigEndian.AppendUint32(b, value)
+}
+
+func appendFrame(b []byte, frameType, flags byte, stream uint32, payload []byte) []byte {
+	b = append(b, byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)), frameType, flags)
+	b = binary.BigEndian.AppendUint32(b, stream)
+	return append(b, payload...)
+}
+
+func (c *Conn) Write(p []byte) (n int, err error) {
+	if c.writeClosed {
+		return 0, net.ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var out []byte
+	if !c.started {
+		out = c.start()
+		c.started = true
+	}
+	c.queued = append(c.queued, 0)
+	c.queued = binary.BigEndian.AppendUint32(c.queued, uint32(1+uvarintLen(len(p))+len(p)))
+	c.queued = append(c.queued, hunkDataField)
+	c.queued = binary.AppendUvarint(c.queued, uint64(len(p)))
+	c.queued = append(c.queued, p...)
+	// from here on the hunk is queued and counts as written, so a retry
+	// after EAGAIN does not send it twice
+	if err = c.flush(out); err != nil {
+		return len(p), err
+	}
+	for len(c.queued) > 0 && !c.nonBlocking {
+		if err = c.readFrame(); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// flush writes out followed by as much of the queued data as the flow
+// control windows allow.
+func (c *Conn) flush(out []byte) error {
+	for len(c.queued) > 0 {
+		size := int(min(int64(len(c.queued)), int64(c.peerMaxFrameSize), c.connSendWindow, c.streamSendWindow))
+		if size <= 0 {
+			break
+		}
+		out = appendFrame(out, frameData, 0, streamID, c.queued[:size])
+		c.queued = c.queued[size:]
+		c.connSendWindow -= int64(size)
+		c.streamSendWindow -= int64(size)
+	}
+	if len(c.queued) == 0 {
+		c.queued = nil
+	}
+	return c.send(out)
+}
+
+// send writes frames behind the outbound ones, keeping what the conn does
+// not take when it returns EAGAIN for the next call.
+func (c *Conn) send(frames []byte) error {
+	c.outbound = append(c.outbound, frames...)
+	for len(c.outbound) > 0 {
+		n, err := c.Conn.Write(c.outbound)
+		c.outbound = c.outbound[n:]
+		if err != nil {
+			return err
+		}
+	}
+	c.outbound = nil
+	return nil
+}
+
+// later turns EAGAIN into success for frames sent while reading, which
+// stay outbound until the next read or write.
+func later(err error) error {
+	if errors.Is(err, syscall.EAGAIN) {
+		return nil
+	}
+	return err
+}
+
+// CloseWrite implements N.WriteCloser by ending the request stream, which
+// is how a gun client half-closes. Queued data is sent first.
+func (c *Conn) CloseWrite() error {
+	if c.writeClosed {
+		return nil
+	}
+	for len(c.queued) > 0 {
+		if err := c.readFrame(); err != nil {
+			return err
+		}
+	}
+	var out []byte
+	if !c.started {
+		out = c.start()
+		c.started = true
+	}
+	c.writeClosed = true
+	return c.send(appendFrame(out, frameData, flagEndStream, streamID, nil))
+}
+
+func (c *Conn) Read(p []byte) (n int, err error) {
+	if !c.started {
+		return 0, fmt.Errorf("%w: read before the request", ErrProtocol)
+	}
+	if err = later(c.send(nil)); err != nil {
+		return 0, err
+	}
+	for len(c.inbound) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if err = c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, c.inbound)
+	c.inbound = c.inbound[n:]
+	if len(c.inbound) == 0 {
+		c.inbound = nil
+	}
+	return
+}
+
+// readFrame reads and handles one frame, keeping what it read so far when
+// the conn returns EAGAIN.
+func (c *Conn) readFrame() error {
+	if c.err != nil {
+		return c.err
+	}
+	for c.headerN < frameHeaderSize {
+		n, err := c.Conn.Read(c.header[c.headerN:])
+		c.headerN += n
+		if c.headerN < frameHeaderSize && err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if c.headerN == frameHeaderSize {
+			length := int(c.header[0])<<16 | int(c.header[1])<<8 | int(c.header[2])
+			if length > defaultMaxFrameSize {
+				return c.fail(fmt.Errorf("%w: %d byte frame", ErrProtocol, length))
+			}
+			if cap(c.payload) < length {
+				c.payload = make([]byte, length)
+			}
+			c.payload = c.payload[:length]
+			c.payloadN = 0
+		}
+	}
+	for c.payloadN < len(c.payload) {
+		n, err := c.Conn.Read(c.payload[c.payloadN:])
+		c.payloadN += n
+		if c.payloadN < len(c.payload) && err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	c.headerN = 0
+	frameType, flags := c.header[3], c.header[4]
+	stream := binary.BigEndian.Uint32(c.header[5:]) & 0x7fffffff
+	if err := c.handleFrame(frameType, flags, stream, c.payload); err != nil {
+		return c.fail(err)
+	}
+	return nil
+}
+
+// fail makes err the result of every later read.
+func (c *Conn) fail(err error) error {
+	c.err = err
+	return err
+}
+
+func (c *Conn) handleFrame(frameType, flags byte, stream uint32, payload []byte) error {
+	switch frameType {
+	case frameData:
+		if stream != streamID {
+			return fmt.Errorf("%w: data on stream %d", ErrProtocol, stream)
+		}
+		c.unacked += len(payload)
+		data, err := unpad(flags, payload)
+		if err != nil {
+			return err
+		}
+		if err = c.receiveMessages(data); err != nil {
+			return err
+		}
+		if flags&flagEndStream != 0 {
+			c.err = io.EOF
+		}
+		if c.unacked >= receiveWindow/2 {
+			increment := binary.BigEndian.AppendUint32(nil, uint32(c.unacked))
+			c.unacked = 0
+			out := appendFrame(nil, frameWindowUpdate, 0, 0, increment)
+			return later(c.send(appendFrame(out, frameWindowUpdate, 0, streamID, increment)))
+		}
+	case frameHeaders, frameContinuation:
+		if frameType == frameHeaders {
+			block, err := unpad(flags, payload)
+			if err != nil {
+				return err
+			}
+			if flags&flagPriority != 0 {
+				if len(block) < 5 {
+					return fmt.Errorf("%w: short priority", ErrProtocol)
+				}
+				block = block[5:]
+			}
+			c.headerBlock = append(c.headerBlock[:0], block...)
+			if flags&flagEndStream != 0 {
+				// trailers end the response
+				c.err = io.EOF
+			}
+		} else {
+			c.headerBlock = append(c.headerBlock, payload...)
+		}
+		if flags&flagEndHeaders != 0 {
+			return c.handleHeaders()
+		}
+	case frameRSTStream:
+		if stream == streamID && len(payload) == 4 {
+			return fmt.Errorf("%w: error code %d", ErrStreamReset, binary.BigEndian.Uint32(payload))
+		}
+	case frameSettings:
+		if flags&flagAck != 0 {
+			return nil
+		}
+		for ; len(payload) >= 6; payload = payload[6:] {
+			value := binary.BigEndian.Uint32(payload[2:])
+			switch binary.BigEndian.Uint16(payload) {
+			case settingInitialWindowSize:
+				c.streamSendWindow += int64(value) - c.peerWindowSize
+				c.peerWindowSize = int64(value)
+			case settingMaxFrameSize:
+				c.peerMaxFrameSize = int(min(value, 1<<24-1))
+			}
+		}
+		return later(c.flush(appendFrame(nil, frameSettings, flagAck, 0, nil)))
+	case framePing:
+		if flags&flagAck == 0 {
+			return later(c.send(appendFrame(nil, framePing, flagAck, 0, payload)))
+		}
+	case frameGoAway:
+		if len(payload) >= 8 && binary.BigEndian.Uint32(payload)&0x7fffffff < streamID {
+			return fmt.Errorf("%w: refused with error code %d", ErrStreamReset, binary.BigEndian.Uint32(payload[4:]))
+		}
+	case frameWindowUpdate:
+		if len(payload) != 4 {
+			return fmt.Errorf("%w: window update size", ErrProtocol)
+		}
+		increment := int64(binary.BigEndian.Uint32(payload) & 0x7fffffff)
+		if stream == 0 {
+			c.connSendWindow += increment
+		} else if stream == streamID {
+			c.streamSendWindow += increment
+		}
+		return later(c.flush(nil))
+	case framePushPromise:
+		return fmt.Errorf("%w: push promise", ErrProtocol)
+	}
+	return nil
+}
+
+// unpad strips the padding of DATA and HEADERS frames.
+func unpad(flags byte, payload []byte) ([]byte, error) {
+	if flags&flagPadded == 0 {
+		return payload, nil
+	}
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, fmt.Errorf("%w: bad padding", ErrProtocol)
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+// handleHeaders checks the response headers and the trailers: the call
+// must be answered with a 200 and end with a zero grpc-status.
+func (c *Conn) handleHeaders() error {
+	fields, err := c.decoder.DecodeFull(c.headerBlock)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrProtocol, err)
+	}
+	first := !c.responded
+	c.responded = true
+	var status, grpcStatus, grpcMessage string
+	for _, field := range fields {
+		switch field.Name {
+		case ":status":
+			status = field.Value
+		case "grpc-status":
+			grpcStatus = field.Value
+		case "grpc-message":
+			grpcMessage = field.Value
+		}
+	}
+	if first && status != "200" {
+		return fmt.Errorf("%w: http status %s", ErrStatus, status)
+	}
+	if grpcStatus != "" && grpcStatus != "0" {
+		return fmt.Errorf("%w: status %s %q", ErrStatus, grpcStatus, grpcMessage)
+	}
+	return nil
+}
+
+// receiveMessages appends data to the pending gRPC messages and decodes the
+// complete ones.
+func (c *Conn) receiveMessages(data []byte) error {
+	c.message = append(c.message, data...)
+	for len(c.message) >= grpcHeaderSize {
+		if c.message[0] != 0 {
+			return fmt.Errorf("%w: compressed message", ErrProtocol)
+		}
+		length := int(binary.BigEndian.Uint32(c.message[1:]))
+		if len(c.message) < grpcHeaderSize+length {
+			break
+		}
+		hunk := c.message[grpcHeaderSize : grpcHeaderSize+length]
+		if err := c.receiveHunk(hunk); err != nil {
+			return err
+		}
+		c.message = append(c.message[:0], c.message[grpcHeaderSize+length:]...)
+	}
+	return nil
+}
+
+// receiveHunk decodes a Hunk message, skipping fields it does not know.
+func (c *Conn) receiveHunk(hunk []byte) error {
+	for len(hunk) > 0 {
+		tag, n := binary.Uvarint(hunk)
+		if n <= 0 {
+			return fmt.Errorf("%w: bad hunk tag", ErrProtocol)
+		}
+		hunk = hunk[n:]
+		var size uint64
+		switch tag & 7 {
+		case 0:
+			if _, n = binary.Uvarint(hunk); n <= 0 {
+				return fmt.Errorf("%w: bad hunk varint", ErrProtocol)
+			}
+			size = uint64(n)
+		case 1:
+			size = 8
+		case 2:
+			length, n := binary.Uvarint(hunk)
+			if n <= 0 || length > uint64(len(hunk)-n) {
+				return fmt.Errorf("%w: bad hunk length", ErrProtocol)
+			}
+			hunk = hunk[n:]
+			if tag == hunkDataField {
+				c.inbound = append(c.inbound, hunk[:length]...)
+			}
+			size = length
+		case 5:
+			size = 4
+		default:
+			return fmt.Errorf("%w: hunk wire type %d", ErrProtocol, tag&7)
+		}
+		if size > uint64(len(hunk)) {
+			return fmt.Errorf("%w: truncated hunk", ErrProtocol)
+		}
+		hunk = hunk[size:]
+	}
+	return nil
+}
+
+func uvarintLen(x int) int {
+	n := 1
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
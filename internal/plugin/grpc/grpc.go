@@ -0,0 +1,54 @@
+// Package grpc carries the shadowsocks stream in a gRPC bidirectional
+// stream using the "gun" framing of V2Ray and Xray: every chunk of the
+// stream is a Hunk message sent to /<service>/Tun. The HTTP/2 client is
+// minimal, a single stream over a connection that speaks HTTP/2 with prior
+// knowledge, so it runs under TinyGo and in the non-blocking WATM model.
+package grpc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+const defaultServiceName = "GunService"
+
+// Config describes the gRPC call.
+type Config struct {
+	// ServiceName is the gRPC service, the request path being
+	// /<ServiceName>/Tun.
+	ServiceName string
+	// Authority is sent as the :authority pseudo-header.
+	Authority string
+	// TLS sets the :scheme to https, for conns that were wrapped with TLS
+	// before reaching this plugin.
+	TLS bool
+}
+
+// Plugin opens a gun stream on every conn it wraps.
+type Plugin struct {
+	config Config
+}
+
+// New returns a plugin calling the Tun method of config.ServiceName.
+func New(config Config) (*Plugin, error) {
+	if config.ServiceName == "" {
+		config.ServiceName = defaultServiceName
+	}
+	if strings.ContainsAny(config.ServiceName, "/ ") {
+		return nil, fmt.Errorf("%w: service name %q", plugin.ErrInvalidOptions, config.ServiceName)
+	}
+	if config.Authority == "" {
+		return nil, fmt.Errorf("%w: missing authority", plugin.ErrInvalidOptions)
+	}
+	return &Plugin{config: config}, nil
+}
+
+// WrapConn returns the gun stream over conn. Nothing is sent until the
+// first write, which carries the connection preface and the request
+// headers along with its data.
+func (p *Plugin) WrapConn(conn v1net.Conn) (v1net.Conn, error) {
+	return newConn(conn, &p.config), nil
+}
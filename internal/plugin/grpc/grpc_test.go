@@ -0,0 +1,246 @@
+package grpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/conntest"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
+)
+
+// serveGun starts a stand-in h2c gRPC server echoing every message of the
+// Tun call back in two halves, and reports the request.
+func serveGun(t *testing.T) (v1net.Conn, chan *http.Request) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	requests := make(chan *http.Request, 1)
+	server := &http.Server{Handler: h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			header := make([]byte, grpcHeaderSize)
+			if _, err := io.ReadFull(r.Body, header); err != nil {
+				break
+			}
+			message := make([]byte, binary.BigEndian.Uint32(header[1:]))
+			if _, err := io.ReadFull(r.Body, message); err != nil {
+				break
+			}
+			message = append(header, message...)
+			half := len(message) / 2
+			w.Write(message[:half])
+			w.(http.Flusher).Flush()
+			w.Write(message[half:])
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{})}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &conntest.NetConn{Conn: conn}, requests
+}
+
+func TestStandInServer(t *testing.T) {
+	p, err := New(Config{ServiceName: "example.Tunnel", Authority: "cdn.example.com"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	raw, requests := serveGun(t)
+	conn, err := p.WrapConn(raw)
+	if err != nil {
+		t.Fatalf("WrapConn failed: %v", err)
+	}
+
+	// the second payload is larger than the initial flow control window
+	for _, payload := range [][]byte{bytes.Repeat([]byte("a"), 40), bytes.Repeat([]byte("b"), 200000)} {
+		if n, err := conn.Write(payload); err != nil || n != len(payload) {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+		echoed := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, echoed); err != nil {
+			t.Fatalf("ReadFull failed: %v", err)
+		}
+		if !bytes.Equal(echoed, payload) {
+			t.Fatalf("Expected %d bytes to be echoed", len(payload))
+		}
+	}
+
+	request := <-requests
+	if request.Method != http.MethodPost || request.Host != "cdn.example.com" || request.URL.Path != "/example.Tunnel/Tun" ||
+		request.Header.Get("Content-Type") != "application/grpc" || request.ProtoMajor != 2 {
+		t.Errorf("Unexpected request %s %s %s %v", request.Method, request.Host, request.URL, request.Header)
+	}
+
+	if err = conn.(*Conn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the call to end with EOF, got %v", err)
+	}
+}
+
+func headersFrame(flags byte, fields ...hpack.HeaderField) []byte {
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	for _, field := range fields {
+		encoder.WriteField(field)
+	}
+	return appendFrame(nil, frameHeaders, flags|flagEndHeaders, streamID, block.Bytes())
+}
+
+// readFrames parses the client side of the connection after the preface.
+func readFrames(t *testing.T, wire []byte) (frames []http2.FrameHeader, dataLen int) {
+	t.Helper()
+	framer := http2.NewFramer(nil, bytes.NewReader(bytes.TrimPrefix(wire, []byte(clientPreface))))
+	for {
+		frame, err := framer.ReadFrame()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("Failed to parse the client frames: %v", err)
+		}
+		if data, ok := frame.(*http2.DataFrame); ok {
+			dataLen += len(data.Data())
+		}
+		frames = append(frames, frame.Header())
+	}
+}
+
+func TestShortWrites(t *testing.T) {
+	p, _ := New(Config{Authority: "cdn.example.com"})
+	raw := &conntest.ScriptedConn{Open: true, ShortWrites: 20}
+	conn, _ := p.WrapConn(raw)
+	conn.SetNonBlock(true)
+
+	// the refused hunk is queued, so it counts as written
+	for _, payload := range []string{"hello", "world"} {
+		if n, err := conn.Write([]byte(payload)); n != len(payload) || err != nil && !errors.Is(err, syscall.EAGAIN) {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+	}
+	// reads send what is left
+	for i := 0; i < 100; i++ {
+		conn.Read(make([]byte, 16))
+	}
+	frames, dataLen := readFrames(t, raw.Written.Bytes())
+	if hunks := 2 * (grpcHeaderSize + 2 + 5); dataLen != hunks {
+		t.Errorf("Expected both hunks sent once, %d bytes, got %d in %d frames", hunks, dataLen, len(frames))
+	}
+}
+
+func TestNonBlocking(t *testing.T) {
+	p, _ := New(Config{Authority: "cdn.example.com"})
+	raw := &conntest.ScriptedConn{Open: true}
+	conn, _ := p.WrapConn(raw)
+	conn.SetNonBlock(true)
+
+	payload := bytes.Repeat([]byte("q"), 70000)
+	if n, err := conn.Write(payload); err != nil || n != len(payload) {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if _, dataLen := readFrames(t, raw.Written.Bytes()); dataLen != defaultWindowSize {
+		t.Errorf("Expected the write to stop at the flow control window, sent %d bytes", dataLen)
+	}
+	raw.Written.Reset()
+
+	hunk := []byte{0, 0, 0, 0, 8, hunkDataField, 6, 'a', 'b', 'c', 'd', 'e', 'f'}
+	data := appendFrame(nil, frameData, 0, streamID, hunk)
+	raw.Reads = [][]byte{
+		appendFrame(nil, frameSettings, 0, 0, appendSetting(nil, settingMaxFrameSize, 1<<15)),
+		appendFrame(nil, framePing, 0, 0, []byte("pingpong")),
+		headersFrame(0, hpack.HeaderField{Name: ":status", Value: "200"}),
+		data[:4], data[4:12], data[12:],
+		appendFrame(nil, frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, 1<<20)),
+		appendFrame(nil, frameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, 1<<20)),
+	}
+	var got []byte
+	buffer := make([]byte, 4)
+	for len(got) < 6 {
+		n, err := conn.Read(buffer)
+		if err != nil && !errors.Is(err, syscall.EAGAIN) {
+			t.Fatalf("Read failed: %v", err)
+		}
+		got = append(got, buffer[:n]...)
+	}
+	if string(got) != "abcdef" {
+		t.Errorf("Expected the hunk to be reassembled across EAGAINs, got %q", got)
+	}
+	for len(raw.Reads) > 0 {
+		if _, err := conn.Read(buffer); !errors.Is(err, syscall.EAGAIN) {
+			t.Fatalf("Expected EAGAIN, got %v", err)
+		}
+	}
+
+	frames, dataLen := readFrames(t, raw.Written.Bytes())
+	var settingsAck, pingAck bool
+	for _, frame := range frames {
+		settingsAck = settingsAck || frame.Type == http2.FrameSettings && frame.Flags.Has(http2.FlagSettingsAck)
+		pingAck = pingAck || frame.Type == http2.FramePing && frame.Flags.Has(http2.FlagPingAck)
+	}
+	if !settingsAck || !pingAck {
+		t.Errorf("Expected the settings and the ping to be acknowledged, got %v", frames)
+	}
+	if total := grpcHeaderSize + 1 + uvarintLen(len(payload)) + len(payload); dataLen != total-defaultWindowSize {
+		t.Errorf("Expected the rest of the write once the window opened, sent %d bytes", dataLen)
+	}
+}
+
+func TestCallFailure(t *testing.T) {
+	for _, tc := range []struct {
+		reads    [][]byte
+		expected error
+	}{
+		{[][]byte{headersFrame(flagEndStream, hpack.HeaderField{Name: ":status", Value: "404"})}, ErrStatus},
+		{[][]byte{
+			headersFrame(0, hpack.HeaderField{Name: ":status", Value: "200"}),
+			headersFrame(flagEndStream, hpack.HeaderField{Name: "grpc-status", Value: "14"}),
+		}, ErrStatus},
+		{[][]byte{appendFrame(nil, frameRSTStream, 0, streamID, []byte{0, 0, 0, 7})}, ErrStreamReset},
+	} {
+		p, _ := New(Config{Authority: "cdn.example.com"})
+		raw := &conntest.ScriptedConn{Reads: tc.reads, Open: true}
+		conn, _ := p.WrapConn(raw)
+		conn.Write([]byte("hello"))
+		var err error
+		for err == nil || errors.Is(err, syscall.EAGAIN) {
+			_, err = conn.Read(make([]byte, 16))
+		}
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("Expected %v, got %v", tc.expected, err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(Config{}); !errors.Is(err, plugin.ErrInvalidOptions) {
+		t.Errorf("Expected a missing authority to be rejected, got %v", err)
+	}
+	if _, err := New(Config{ServiceName: "a/b", Authority: "cdn.example.com"}); !errors.Is(err, plugin.ErrInvalidOptions) {
+		t.Errorf("Expected a service name with a slash to be rejected, got %v", err)
+	}
+}
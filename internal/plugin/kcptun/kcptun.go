@@ -0,0 +1,171 @@
+// Package kcptun carries the shadowsocks stream over UDP the way the
+// kcptun client does, for networks where TCP throughput collapses under
+// loss and latency. The stream runs over a plain smux session, optionally
+// compressed with snappy, over KCP with FEC and packet encryption. It is
+// registered as the "kcptun" plugin, and the conn it wraps has to be a
+// connected UDP conn.
+package kcptun
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/kcp"
+	"github.com/getlantern/tiny-shadowsocks/internal/mux"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+const (
+	DefaultKey          = "it's a secrect"
+	DefaultDataShards   = 10
+	DefaultParityShards = 3
+	DefaultKeepAlive    = 10 * time.Second
+)
+
+func init() {
+	plugin.Register("kcptun", parseOptions)
+}
+
+// Config describes the kcptun client.
+type Config struct {
+	kcp.Config
+	// NoComp turns off the snappy compression, which the server must
+	// agree on.
+	NoComp bool
+	// KeepAlive is how often the smux session shows it is alive. The
+	// kcptun server drops sessions silent for 30 seconds.
+	KeepAlive time.Duration
+}
+
+// Plugin runs a kcptun session over every conn it wraps.
+type Plugin struct {
+	config Config
+}
+
+// New returns a plugin for the server described by config. The KCP
+// settings are checked on the first conn.
+func New(config Config) (*Plugin, error) {
+	if config.Key == "" {
+		return nil, fmt.Errorf("%w: missing key", plugin.ErrInvalidOptions)
+	}
+	if config.KeepAlive <= 0 {
+		config.KeepAlive = DefaultKeepAlive
+	}
+	return &Plugin{config: config}, nil
+}
+
+// parseOptions builds the plugin from the options of the kcptun client,
+// with the same names and defaults: "key", "crypt", "mode", "mtu",
+// "sndwnd", "rcvwnd", "datashard" or "ds", "parityshard" or "ps",
+// "nocomp", "acknodelay" and "keepalive" in seconds. The "manual" mode
+// takes "nodelay", "interval", "resend" and "nc". Only version 1 of smux
+// is implemented, so "smuxver" has to be 1.
+func parseOptions(opts plugin.Options) (plugin.Plugin, error) {
+	var config Config
+	config.Key = opts.Get("key", DefaultKey)
+	config.Crypt = opts.Get("crypt", "aes")
+	var err error
+	if mode := opts.Get("mode", "fast"); mode == "manual" {
+		config.Mode.NoDelay, err = boolOption(opts, "nodelay", false)
+		if err != nil {
+			return nil, err
+		}
+		interval, err := intOption(opts, "interval", 50)
+		if err != nil {
+			return nil, err
+		}
+		config.Mode.Interval = time.Duration(interval) * time.Millisecond
+		if config.Mode.Resend, err = intOption(opts, "resend", 0); err != nil {
+			return nil, err
+		}
+		if config.Mode.NoCongestion, err = boolOption(opts, "nc", false); err != nil {
+			return nil, err
+		}
+	} else if config.Mode, err = kcp.ParseMode(mode); err != nil {
+		return nil, fmt.Errorf("%w: %w", plugin.ErrInvalidOptions, err)
+	}
+	for _, option := range []struct {
+		target   *int
+		names    []string
+		fallback int
+	}{
+		{&config.MTU, []string{"mtu"}, kcp.DefaultMTU},
+		{&config.SendWindow, []string{"sndwnd"}, kcp.DefaultSendWindow},
+		{&config.ReceiveWindow, []string{"rcvwnd"}, kcp.DefaultReceiveWindow},
+		{&config.DataShards, []string{"datashard", "ds"}, DefaultDataShards},
+		{&config.ParityShards, []string{"parityshard", "ps"}, DefaultParityShards},
+	} {
+		*option.target = option.fallback
+		for _, name := range option.names {
+			if *option.target, err = intOption(opts, name, *option.target); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if config.NoComp, err = boolOption(opts, "nocomp", false); err != nil {
+		return nil, err
+	}
+	if config.AckNoDelay, err = boolOption(opts, "acknodelay", false); err != nil {
+		return nil, err
+	}
+	keepAlive, err := intOption(opts, "keepalive", int(DefaultKeepAlive/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	config.KeepAlive = time.Duration(keepAlive) * time.Second
+	if version := opts.Get("smuxver", "1"); version != "1" {
+		return nil, fmt.Errorf("%w: unsupported smux version %q", plugin.ErrInvalidOptions, version)
+	}
+	return New(config)
+}
+
+func intOption(opts plugin.Options, name string, fallback int) (int, error) {
+	if !opts.Has(name) {
+		return fallback, nil
+	}
+	value, err := strconv.Atoi(opts[name])
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%w: bad %s %q", plugin.ErrInvalidOptions, name, opts[name])
+	}
+	return value, nil
+}
+
+// boolOption reads a flag given alone or as a number, as kcptun's
+// nodelay and nc are.
+func boolOption(opts plugin.Options, name string, fallback bool) (bool, error) {
+	if !opts.Has(name) {
+		return fallback, nil
+	}
+	switch opts[name] {
+	case "", "1", "true":
+		return true, nil
+	case "0", "false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: bad %s %q", plugin.ErrInvalidOptions, name, opts[name])
+	}
+}
+
+// WrapConn starts a KCP conversation over conn and returns the first
+// stream of a smux session over it, which the server connects to the
+// shadowsocks server.
+func (p *Plugin) WrapConn(conn v1net.Conn) (v1net.Conn, error) {
+	kcpConn, err := kcp.NewConn(conn, p.config.Config)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", plugin.ErrInvalidOptions, err)
+	}
+	var sessionConn v1net.Conn = kcpConn
+	if !p.config.NoComp {
+		sessionConn = &snappyConn{Conn: kcpConn}
+	}
+	session := mux.NewSession(sessionConn, mux.Config{
+		Protocol:  mux.ProtocolSMux,
+		Bare:      true,
+		KeepAlive: p.config.KeepAlive,
+	})
+	// bare streams carry no destination, the server has a fixed target
+	return session.Open(metadata.Socksaddr{})
+}
@@ -0,0 +1,207 @@
+package kcptun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/conntest"
+	"github.com/getlantern/tiny-shadowsocks/internal/kcp"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+// udpConn adapts a host UDP socket to v1net.Conn, sending to peer when the
+// socket is not connected.
+type udpConn struct {
+	*net.UDPConn
+	peer *net.UDPAddr
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	if c.peer != nil {
+		return c.UDPConn.WriteToUDP(p, c.peer)
+	}
+	return c.UDPConn.Write(p)
+}
+
+func (c *udpConn) Fd() int32                          { return 0 }
+func (c *udpConn) SetNonBlock(nonblocking bool) error { return nil }
+
+func TestParseOptions(t *testing.T) {
+	p, err := plugin.New("kcptun", "")
+	if err != nil {
+		t.Fatalf("Expected the defaults to be accepted, got %v", err)
+	}
+	fast, _ := kcp.ParseMode("fast")
+	expected := Config{
+		Config: kcp.Config{
+			Crypt:         "aes",
+			Key:           DefaultKey,
+			Mode:          fast,
+			MTU:           1350,
+			SendWindow:    128,
+			ReceiveWindow: 512,
+			DataShards:    10,
+			ParityShards:  3,
+		},
+		KeepAlive: 10 * time.Second,
+	}
+	if config := p.(*Plugin).config; config != expected {
+		t.Errorf("Expected kcptun's defaults %+v, got %+v", expected, config)
+	}
+	p, err = plugin.New("kcptun", "key=secret;crypt=salsa20;mode=manual;nodelay=1;interval=20;resend=2;nc;ds=0;parityshard=0;mtu=1200;sndwnd=256;nocomp;acknodelay;keepalive=5;smuxver=1")
+	if err != nil {
+		t.Fatalf("Expected the options to be accepted, got %v", err)
+	}
+	expected = Config{
+		Config: kcp.Config{
+			Crypt:         "salsa20",
+			Key:           "secret",
+			Mode:          kcp.Mode{NoDelay: true, Interval: 20 * time.Millisecond, Resend: 2, NoCongestion: true},
+			MTU:           1200,
+			SendWindow:    256,
+			ReceiveWindow: 512,
+			AckNoDelay:    true,
+		},
+		NoComp:    true,
+		KeepAlive: 5 * time.Second,
+	}
+	if config := p.(*Plugin).config; config != expected {
+		t.Errorf("Expected %+v, got %+v", expected, config)
+	}
+	for _, opts := range []string{"key=", "mode=turbo", "mtu=big", "sndwnd=-1", "mode=manual;nodelay=yes", "smuxver=2"} {
+		if _, err := plugin.New("kcptun", opts); !errors.Is(err, plugin.ErrInvalidOptions) {
+			t.Errorf("Expected %q to be rejected, got %v", opts, err)
+		}
+	}
+}
+
+func TestSnappyConn(t *testing.T) {
+	block := []byte{
+		12,                  // uncompressed length
+		0x08, 'a', 'b', 'c', // literal of 3
+		0x15, 3, // copy of 9 at offset 3
+	}
+	compressed := appendChunkHeader(nil, chunkCompressed, checksumSize+len(block))
+	compressed = binary.LittleEndian.AppendUint32(compressed, maskedCRC([]byte("abcabcabcabc")))
+	compressed = append(compressed, block...)
+	// skippable chunks are ignored
+	padding := append(appendChunkHeader(nil, chunkPadding, 3), 0, 0, 0)
+	writer := &snappyConn{Conn: &conntest.ScriptedConn{}}
+	writer.Write([]byte("hello"))
+	uncompressed := writer.Conn.(*conntest.ScriptedConn).Written.Bytes()
+	if !bytes.HasPrefix(uncompressed, []byte("\xff\x06\x00\x00sNaPpY")) {
+		t.Errorf("Expected the stream identifier first, got %x", uncompressed)
+	}
+
+	// split in two so that chunks straddle reads
+	stream := append(append(bytes.Clone(uncompressed), padding...), compressed...)
+	reader := &snappyConn{Conn: &conntest.ScriptedConn{Reads: [][]byte{stream[:15], stream[15:]}}}
+	var got []byte
+	buffer := make([]byte, 4)
+	for {
+		n, err := reader.Read(buffer)
+		got = append(got, buffer[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != syscall.EAGAIN {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if string(got) != "helloabcabcabcabc" {
+		t.Errorf("Expected the chunks to decode, got %q", got)
+	}
+
+	corrupt := bytes.Clone(uncompressed)
+	corrupt[len(corrupt)-1] ^= 1
+	reader = &snappyConn{Conn: &conntest.ScriptedConn{Reads: [][]byte{corrupt}}}
+	for {
+		if _, err := reader.Read(buffer); err != syscall.EAGAIN {
+			if !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Expected ErrCorrupt, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+// serveSMux runs a plain smux server over conn that echoes every stream.
+func serveSMux(conn v1net.Conn) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return err
+		}
+		payload := make([]byte, binary.LittleEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return err
+		}
+		if header[1] == 2 {
+			// a PSH goes back on the same stream
+			if _, err := conn.Write(append(bytes.Clone(header), payload...)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func TestWrapConn(t *testing.T) {
+	for _, noComp := range []bool{false, true} {
+		serverSocket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer serverSocket.Close()
+		clientSocket, err := net.DialUDP("udp", nil, serverSocket.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer clientSocket.Close()
+		mode, _ := kcp.ParseMode("fast2")
+		config := Config{
+			Config:    kcp.Config{Key: "secret", Mode: mode, DataShards: 10, ParityShards: 3, Conv: 42},
+			NoComp:    noComp,
+			KeepAlive: time.Millisecond,
+		}
+		server, err := kcp.NewConn(&udpConn{UDPConn: serverSocket, peer: clientSocket.LocalAddr().(*net.UDPAddr)}, config.Config)
+		if err != nil {
+			t.Fatalf("NewConn failed: %v", err)
+		}
+		var serverConn v1net.Conn = server
+		if !noComp {
+			serverConn = &snappyConn{Conn: server}
+		}
+		go serveSMux(serverConn)
+
+		p, err := New(config)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		stream, err := p.WrapConn(&udpConn{UDPConn: clientSocket})
+		if err != nil {
+			t.Fatalf("WrapConn failed: %v", err)
+		}
+		message := bytes.Repeat([]byte("shadowsocks "), 1000)
+		if _, err := stream.Write(message); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		// unblocks a test that fails to complete
+		timer := time.AfterFunc(5*time.Second, func() { clientSocket.Close() })
+		echoed := make([]byte, len(message))
+		if _, err := io.ReadFull(stream, echoed); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !bytes.Equal(echoed, message) {
+			t.Errorf("Expected the stream to be echoed, nocomp %v", noComp)
+		}
+		stream.Close()
+		timer.Stop()
+	}
+}
@@ -0,0 +1,210 @@
+package kcptun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+const (
+	chunkCompressed   = 0x00
+	chunkUncompressed = 0x01
+	chunkPadding      = 0xfe
+	chunkStreamID     = 0xff
+
+	chunkHeaderSize = 4
+	checksumSize    = 4
+	// maxChunkData is the most data a chunk carries, uncompressed.
+	maxChunkData = 65536
+
+	streamID = "sNaPpY"
+)
+
+// ErrCorrupt means the server sent a snappy stream that does not decode.
+var ErrCorrupt = errors.New("kcptun: corrupt snappy stream")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// maskedCRC is the checksum of the snappy framing format.
+func maskedCRC(b []byte) uint32 {
+	c := crc32.Checksum(b, crcTable)
+	return (c>>15 | c<<17) + 0xa282ead8
+}
+
+// snappyConn speaks the snappy framing format kcptun compresses the
+// session with. Writes go out as uncompressed chunks, which every snappy
+// reader accepts and spares the client the compression. Reads decode both
+// kinds of chunks, and chunks are reassembled across EAGAINs.
+type snappyConn struct {
+	v1net.Conn
+	headerSent bool
+	chunk      []byte
+	chunkN     int
+	decoded    []byte
+}
+
+func (c *snappyConn) Write(p []byte) (int, error) {
+	var frames []byte
+	if !c.headerSent {
+		frames = appendChunkHeader(frames, chunkStreamID, len(streamID))
+		frames = append(frames, streamID...)
+	}
+	for data := p; len(data) > 0; {
+		n := min(len(data), maxChunkData)
+		frames = appendChunkHeader(frames, chunkUncompressed, checksumSize+n)
+		frames = binary.LittleEndian.AppendUint32(frames, maskedCRC(data[:n]))
+		frames = append(frames, data[:n]...)
+		data = data[n:]
+	}
+	if len(frames) == 0 {
+		return 0, nil
+	}
+	if _, err := c.Conn.Write(frames); err != nil {
+		return 0, err
+	}
+	c.headerSent = true
+	return len(p), nil
+}
+
+func appendChunkHeader(b []byte, chunkType byte, length int) []byte {
+	return append(b, chunkType, byte(length), byte(length>>8), byte(length>>16))
+}
+
+func (c *snappyConn) Read(p []byte) (int, error) {
+	for len(c.decoded) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.decoded)
+	c.decoded = c.decoded[n:]
+	return n, nil
+}
+
+// readChunk reads the next chunk and decodes its data, keeping what it read
+// so far when the conn returns EAGAIN.
+func (c *snappyConn) readChunk() error {
+	if c.chunk == nil {
+		c.chunk = make([]byte, chunkHeaderSize)
+	}
+	for c.chunkN < len(c.chunk) {
+		n, err := c.Conn.Read(c.chunk[c.chunkN:])
+		c.chunkN += n
+		if c.chunkN == chunkHeaderSize && len(c.chunk) == chunkHeaderSize {
+			length := int(c.chunk[1]) | int(c.chunk[2])<<8 | int(c.chunk[3])<<16
+			c.chunk = append(c.chunk, make([]byte, length)...)
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && c.chunkN > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	chunkType, data := c.chunk[0], c.chunk[chunkHeaderSize:]
+	c.chunk, c.chunkN = nil, 0
+	switch {
+	case chunkType == chunkStreamID:
+		if string(data) != streamID {
+			return fmt.Errorf("%w: bad stream identifier", ErrCorrupt)
+		}
+		return nil
+	case chunkType == chunkCompressed || chunkType == chunkUncompressed:
+		if len(data) < checksumSize {
+			return fmt.Errorf("%w: short chunk", ErrCorrupt)
+		}
+		checksum, payload := binary.LittleEndian.Uint32(data), data[checksumSize:]
+		if chunkType == chunkCompressed {
+			var err error
+			if payload, err = decodeBlock(payload); err != nil {
+				return err
+			}
+		}
+		if maskedCRC(payload) != checksum {
+			return fmt.Errorf("%w: bad checksum", ErrCorrupt)
+		}
+		c.decoded = payload
+		return nil
+	case chunkType >= 0x80:
+		// padding and skippable chunks
+		return nil
+	default:
+		return fmt.Errorf("%w: reserved chunk type %#x", ErrCorrupt, chunkType)
+	}
+}
+
+// decodeBlock decompresses a snappy block: the uncompressed length, then
+// literals and copies of earlier output.
+func decodeBlock(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > maxChunkData {
+		return nil, fmt.Errorf("%w: bad block length", ErrCorrupt)
+	}
+	src = src[n:]
+	dst := make([]byte, 0, length)
+	for len(src) > 0 {
+		tag := src[0]
+		var size, offset int
+		switch tag & 3 {
+		case 0:
+			size = int(tag>>2) + 1
+			src = src[1:]
+			if size > 60 {
+				extra := size - 60
+				if len(src) < extra {
+					return nil, fmt.Errorf("%w: short literal", ErrCorrupt)
+				}
+				size = 0
+				for i := extra - 1; i >= 0; i-- {
+					size = size<<8 | int(src[i])
+				}
+				size++
+				src = src[extra:]
+			}
+			if size > len(src) || len(dst)+size > int(length) {
+				return nil, fmt.Errorf("%w: bad literal", ErrCorrupt)
+			}
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, fmt.Errorf("%w: short copy", ErrCorrupt)
+			}
+			size = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, fmt.Errorf("%w: short copy", ErrCorrupt)
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, fmt.Errorf("%w: short copy", ErrCorrupt)
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+size > int(length) {
+			return nil, fmt.Errorf("%w: bad copy", ErrCorrupt)
+		}
+		// copies may overlap the bytes they produce
+		for start := len(dst) - offset; size > 0; size-- {
+			dst = append(dst, dst[start])
+			start++
+		}
+	}
+	if len(dst) != int(length) {
+		return nil, fmt.Errorf("%w: block length mismatch", ErrCorrupt)
+	}
+	return dst, nil
+}
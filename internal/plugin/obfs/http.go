@@ -0,0 +1,113 @@
+package obfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+// maxResponseHeaderSize bounds the fake HTTP response header the server
+// sends before its data.
+const maxResponseHeaderSize = 8 * 1024
+
+// ErrBadResponse means the server did not answer the fake upgrade request
+// like a simple-obfs server would.
+var ErrBadResponse = errors.New("obfs: bad http response")
+
+// httpConn sends the first write as the body of a WebSocket upgrade
+// request and strips the fake 101 response from the first reads. Both run
+// lazily, so the request can be written and the header read across
+// EAGAINs on a non-blocking conn.
+type httpConn struct {
+	v1net.Conn
+	host, uri    string
+	requestSent  bool
+	request      []byte
+	responseRead bool
+	header       []byte
+	pending      []byte
+}
+
+// Write sends p, as the body of the request on the first call. The
+// request counts as written once encoded, and whatever the conn did not
+// take of it goes out ahead of the next read or write.
+func (c *httpConn) Write(p []byte) (n int, err error) {
+	if c.requestSent {
+		if err = c.flushRequest(); err != nil {
+			return 0, err
+		}
+		return c.Conn.Write(p)
+	}
+	var key [16]byte
+	rand.Read(key[:])
+	request := fmt.Appendf(nil, "GET %s HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"User-Agent: curl/7.%d.%d\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Content-Length: %d\r\n"+
+		"\r\n",
+		c.uri, c.host, mrand.Intn(51), mrand.Intn(2), base64.StdEncoding.EncodeToString(key[:]), len(p))
+	c.request = append(request, p...)
+	c.requestSent = true
+	return len(p), c.flushRequest()
+}
+
+// flushRequest writes what is left of the request, keeping the rest when
+// the conn returns EAGAIN.
+func (c *httpConn) flushRequest() error {
+	for len(c.request) > 0 {
+		n, err := c.Conn.Write(c.request)
+		c.request = c.request[n:]
+		if err != nil {
+			return err
+		}
+	}
+	c.request = nil
+	return nil
+}
+
+func (c *httpConn) Read(p []byte) (n int, err error) {
+	if err = c.flushRequest(); err != nil {
+		return 0, err
+	}
+	if len(c.pending) > 0 {
+		n = copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return
+	}
+	if c.responseRead {
+		return c.Conn.Read(p)
+	}
+	var scratch [1024]byte
+	for {
+		readN, readErr := c.Conn.Read(scratch[:])
+		c.header = append(c.header, scratch[:readN]...)
+		if end := bytes.Index(c.header, []byte("\r\n\r\n")); end >= 0 {
+			if !bytes.HasPrefix(c.header, []byte("HTTP/1.1 101 ")) {
+				return 0, fmt.Errorf("%w: %q", ErrBadResponse, c.header[:bytes.IndexByte(c.header, '\r')])
+			}
+			c.pending = c.header[end+4:]
+			c.header = nil
+			c.responseRead = true
+			if len(c.pending) > 0 || readErr != nil {
+				n = copy(p, c.pending)
+				c.pending = c.pending[n:]
+				return n, readErr
+			}
+			return c.Conn.Read(p)
+		}
+		if len(c.header) > maxResponseHeaderSize {
+			return 0, fmt.Errorf("%w: header exceeds %d bytes", ErrBadResponse, maxResponseHeaderSize)
+		}
+		if readErr != nil {
+			return 0, readErr
+		}
+	}
+}
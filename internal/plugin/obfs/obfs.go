@@ -0,0 +1,55 @@
+// Package obfs implements the client side of simple-obfs, registered as
+// the "obfs-local" plugin.
+package obfs
+
+import (
+	"fmt"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+const (
+	defaultHost = "www.bing.com"
+	defaultURI  = "/"
+)
+
+func init() {
+	plugin.Register("obfs-local", New)
+}
+
+// Plugin disguises the shadowsocks stream as the traffic of another
+// protocol, as selected by the "obfs" option.
+type Plugin struct {
+	mode string
+	host string
+	uri  string
+}
+
+// New builds the plugin from the simple-obfs options: "obfs" selects the
+// mode, "http" or "tls", "obfs-host" the host name shown to the network,
+// in the Host header or the SNI, and "obfs-uri" the path of the HTTP
+// request.
+func New(opts plugin.Options) (plugin.Plugin, error) {
+	p := &Plugin{
+		mode: opts.Get("obfs", ""),
+		host: opts.Get("obfs-host", defaultHost),
+		uri:  opts.Get("obfs-uri", defaultURI),
+	}
+	switch p.mode {
+	case "http", "tls":
+	default:
+		return nil, fmt.Errorf("%w: unsupported obfs mode %q", plugin.ErrInvalidOptions, p.mode)
+	}
+	if p.host == "" {
+		return nil, fmt.Errorf("%w: empty obfs-host", plugin.ErrInvalidOptions)
+	}
+	return p, nil
+}
+
+func (p *Plugin) WrapConn(conn v1net.Conn) (v1net.Conn, error) {
+	if p.mode == "tls" {
+		return &tlsConn{Conn: conn, host: p.host}, nil
+	}
+	return &httpConn{Conn: conn, host: p.host, uri: p.uri}, nil
+}
@@ -0,0 +1,321 @@
+package obfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/conntest"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+func TestNew(t *testing.T) {
+	for _, opts := range []string{"obfs=http", "obfs=tls", "obfs=http;obfs-host=example.com;obfs-uri=/ws"} {
+		if _, err := plugin.New("obfs-local", opts); err != nil {
+			t.Errorf("Expected %q to be accepted, got %v", opts, err)
+		}
+	}
+	for _, opts := range []string{"", "obfs=quic", "obfs=http;obfs-host="} {
+		if _, err := plugin.New("obfs-local", opts); !errors.Is(err, plugin.ErrInvalidOptions) {
+			t.Errorf("Expected %q to be rejected, got %v", opts, err)
+		}
+	}
+}
+
+func TestHTTPConn(t *testing.T) {
+	p, _ := New(plugin.Options{"obfs": "http", "obfs-host": "example.com", "obfs-uri": "/ws"})
+	raw := &conntest.ScriptedConn{Reads: [][]byte{
+		[]byte("HTTP/1.1 101 Switching Protocols\r\nServer: nginx\r\n"),
+		[]byte("Upgrade: websocket\r\n\r\nfirst"),
+		[]byte("second"),
+	}}
+	conn, _ := p.WrapConn(raw)
+
+	if n, err := conn.Write([]byte("hello")); err != nil || n != 5 {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	conn.Write([]byte("world"))
+	if !bytes.HasSuffix(raw.Written.Bytes(), []byte("\r\n\r\nhelloworld")) {
+		t.Errorf("Expected later writes to go out unframed, got %q", raw.Written.Bytes())
+	}
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw.Written.Bytes())))
+	if err != nil {
+		t.Fatalf("Expected an HTTP request on the wire: %v", err)
+	}
+	body, _ := io.ReadAll(request.Body)
+	if request.Host != "example.com" || request.URL.Path != "/ws" || request.Header.Get("Upgrade") != "websocket" || string(body) != "hello" {
+		t.Errorf("Unexpected request %s %s %v with body %q", request.Host, request.URL, request.Header, body)
+	}
+	if length, _ := strconv.Atoi(request.Header.Get("Content-Length")); length != 5 {
+		t.Errorf("Expected Content-Length 5, got %d", length)
+	}
+
+	var got []byte
+	p2 := make([]byte, 3)
+	for {
+		n, err := conn.Read(p2)
+		got = append(got, p2[:n]...)
+		if errors.Is(err, syscall.EAGAIN) {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if string(got) != "firstsecond" {
+		t.Errorf("Expected the response header to be stripped across EAGAINs, got %q", got)
+	}
+}
+
+func TestHTTPConnShortWrites(t *testing.T) {
+	p, _ := New(plugin.Options{"obfs": "http", "obfs-host": "example.com"})
+	raw := &conntest.ScriptedConn{Open: true, ShortWrites: 40}
+	conn, _ := p.WrapConn(raw)
+	// the request is refused at first, but it carries the data all the same
+	if n, err := conn.Write([]byte("hello")); n != 5 || !errors.Is(err, syscall.EAGAIN) {
+		t.Fatalf("Expected the write to be queued with EAGAIN, got %d, %v", n, err)
+	}
+	for {
+		if _, err := conn.Write([]byte("world")); err == nil {
+			break
+		} else if !errors.Is(err, syscall.EAGAIN) {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw.Written.Bytes())))
+	if err != nil {
+		t.Fatalf("Expected a single valid request, got %v", err)
+	}
+	body, _ := io.ReadAll(request.Body)
+	if string(body) != "hello" || !bytes.HasSuffix(raw.Written.Bytes(), []byte("\r\n\r\nhelloworld")) {
+		t.Errorf("Expected the request once followed by the next write, got %q", raw.Written.Bytes())
+	}
+}
+
+func TestHTTPConnBadResponse(t *testing.T) {
+	p, _ := New(plugin.Options{"obfs": "http"})
+	conn, _ := p.WrapConn(&conntest.ScriptedConn{Reads: [][]byte{[]byte("HTTP/1.1 403 Forbidden\r\n\r\n")}, Again: true})
+	conn.Write([]byte("hello"))
+	if _, err := conn.Read(make([]byte, 16)); !errors.Is(err, ErrBadResponse) {
+		t.Errorf("Expected ErrBadResponse, got %v", err)
+	}
+}
+
+// readRecord reads one TLS record, returning its type and payload.
+func readRecord(r io.Reader) (byte, []byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	_, err := io.ReadFull(r, payload)
+	return header[0], payload, err
+}
+
+func appendRecord(b []byte, contentType byte, payload []byte) []byte {
+	b = append(b, contentType, 0x03, 0x03)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...)
+}
+
+// parseClientHello returns the SNI and the session ticket of a ClientHello
+// handshake message.
+func parseClientHello(hello []byte) (sni string, ticket []byte, err error) {
+	if hello[0] != handshakeClientHello || int(hello[1])<<16|int(binary.BigEndian.Uint16(hello[2:])) != len(hello)-4 {
+		return "", nil, fmt.Errorf("not a ClientHello spanning the record: %x", hello[:4])
+	}
+	body := hello[4+2+32:]
+	body = body[1+int(body[0]):]                       // session id
+	body = body[2+int(binary.BigEndian.Uint16(body)):] // cipher suites
+	body = body[1+int(body[0]):]                       // compression methods
+	if int(binary.BigEndian.Uint16(body)) != len(body)-2 {
+		return "", nil, errors.New("extensions do not span the rest of the hello")
+	}
+	for extensions := body[2:]; len(extensions) > 0; {
+		extensionType := binary.BigEndian.Uint16(extensions)
+		length := int(binary.BigEndian.Uint16(extensions[2:]))
+		data := extensions[4 : 4+length]
+		switch extensionType {
+		case 0x0000:
+			sni = string(data[5:])
+		case 0x0023:
+			ticket = data
+		}
+		extensions = extensions[4+length:]
+	}
+	return
+}
+
+// serveObfs starts a stand-in simple-obfs server that echoes everything
+// back, and returns a conn dialed to it.
+func serveObfs(t *testing.T, mode string) v1net.Conn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		switch mode {
+		case "http":
+			request, err := http.ReadRequest(reader)
+			if err != nil || request.Header.Get("Upgrade") != "websocket" {
+				return
+			}
+			body, _ := io.ReadAll(request.Body)
+			conn.Write(append([]byte("HTTP/1.1 101 Switching Protocols\r\nServer: nginx/1.18.0\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"), body...))
+			io.Copy(conn, reader)
+		case "tls":
+			contentType, hello, err := readRecord(reader)
+			if err != nil || contentType != recordHandshake {
+				return
+			}
+			sni, ticket, err := parseClientHello(hello)
+			if err != nil || sni != "cdn.example.com" {
+				return
+			}
+			serverHello := make([]byte, 91)
+			serverHello[0] = 0x02
+			response := appendRecord(nil, recordHandshake, serverHello)
+			response = appendRecord(response, recordChangeCipherSpec, []byte{1})
+			conn.Write(appendRecord(response, recordHandshake, ticket))
+			for {
+				contentType, payload, err := readRecord(reader)
+				if err != nil || contentType != recordApplicationData {
+					return
+				}
+				conn.Write(appendRecord(nil, recordApplicationData, payload))
+			}
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &conntest.NetConn{Conn: conn}
+}
+
+func TestStandInServer(t *testing.T) {
+	for _, mode := range []string{"http", "tls"} {
+		t.Run(mode, func(t *testing.T) {
+			p, _ := New(plugin.Options{"obfs": mode, "obfs-host": "cdn.example.com"})
+			conn, _ := p.WrapConn(serveObfs(t, mode))
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			first := bytes.Repeat([]byte("a"), 20000)
+			for _, payload := range [][]byte{first, []byte("second")} {
+				if n, err := conn.Write(payload); err != nil || n != len(payload) {
+					t.Fatalf("Write = %d, %v", n, err)
+				}
+				echoed := make([]byte, len(payload))
+				if _, err := io.ReadFull(conn, echoed); err != nil {
+					t.Fatalf("ReadFull failed: %v", err)
+				}
+				if !bytes.Equal(echoed, payload) {
+					t.Fatalf("Expected the server to echo %d bytes", len(payload))
+				}
+			}
+		})
+	}
+}
+
+func TestTLSConnFraming(t *testing.T) {
+	p, _ := New(plugin.Options{"obfs": "tls", "obfs-host": "cdn.example.com"})
+	serverHello := appendRecord(nil, recordHandshake, make([]byte, 91))
+	raw := &conntest.ScriptedConn{Reads: [][]byte{
+		serverHello[:3],
+		append(serverHello[3:], appendRecord(nil, recordChangeCipherSpec, []byte{1})...),
+		appendRecord(nil, recordHandshake, []byte("first")),
+		appendRecord(nil, recordApplicationData, []byte("second")),
+	}}
+	conn, _ := p.WrapConn(raw)
+
+	conn.Write([]byte("hello"))
+	conn.Write([]byte("world"))
+	wire := bytes.NewReader(raw.Written.Bytes())
+	contentType, hello, _ := readRecord(wire)
+	if sni, ticket, err := parseClientHello(hello); err != nil || contentType != recordHandshake || sni != "cdn.example.com" || string(ticket) != "hello" {
+		t.Errorf("Expected a ClientHello for cdn.example.com carrying the first write, got SNI %q ticket %q, %v", sni, ticket, err)
+	}
+	if contentType, data, _ := readRecord(wire); contentType != recordApplicationData || string(data) != "world" {
+		t.Errorf("Expected later writes in application data records, got %#x %q", contentType, data)
+	}
+
+	var got []byte
+	p2 := make([]byte, 4)
+	for {
+		n, err := conn.Read(p2)
+		got = append(got, p2[:n]...)
+		if errors.Is(err, syscall.EAGAIN) {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if string(got) != "firstsecond" {
+		t.Errorf("Expected the handshake records to be skipped across EAGAINs, got %q", got)
+	}
+
+	bad, _ := p.WrapConn(&conntest.ScriptedConn{Reads: [][]byte{appendRecord(nil, recordApplicationData, []byte("early"))}, Again: true})
+	if _, err := bad.Read(make([]byte, 16)); !errors.Is(err, ErrBadRecord) {
+		t.Errorf("Expected ErrBadRecord for data before the handshake, got %v", err)
+	}
+}
+
+func TestTLSConnShortWrites(t *testing.T) {
+	p, _ := New(plugin.Options{"obfs": "tls", "obfs-host": "cdn.example.com"})
+	raw := &conntest.ScriptedConn{Open: true, ShortWrites: 40}
+	conn, _ := p.WrapConn(raw)
+	// the hello is refused at first, but it carries the data all the same
+	if n, err := conn.Write([]byte("hello")); n != 5 || !errors.Is(err, syscall.EAGAIN) {
+		t.Fatalf("Expected the write to be queued with EAGAIN, got %d, %v", n, err)
+	}
+	next := []byte("world")
+	for len(next) > 0 {
+		n, err := conn.Write(next)
+		if err != nil && !errors.Is(err, syscall.EAGAIN) {
+			t.Fatalf("Write failed: %v", err)
+		}
+		next = next[n:]
+	}
+	for {
+		if _, err := conn.Write(nil); err == nil {
+			break
+		}
+	}
+	wire := bytes.NewReader(raw.Written.Bytes())
+	_, hello, _ := readRecord(wire)
+	if _, ticket, err := parseClientHello(hello); err != nil || string(ticket) != "hello" {
+		t.Errorf("Expected a single ClientHello carrying the first write, got ticket %q, %v", ticket, err)
+	}
+	if contentType, data, _ := readRecord(wire); contentType != recordApplicationData || string(data) != "world" {
+		t.Errorf("Expected the next write in one application data record, got %#x %q", contentType, data)
+	}
+	if wire.Len() != 0 {
+		t.Errorf("Expected nothing after the data record, got %d bytes", wire.Len())
+	}
+}
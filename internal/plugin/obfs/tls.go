@@ -0,0 +1,201 @@
+package obfs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+const (
+	recordHeaderSize = 5
+	maxRecordSize    = 1 << 14
+
+	recordChangeCipherSpec = 0x14
+	recordHandshake        = 0x16
+	recordApplicationData  = 0x17
+
+	handshakeClientHello = 0x01
+)
+
+// ErrBadRecord means the server did not answer with the TLS records a
+// simple-obfs server sends.
+var ErrBadRecord = errors.New("obfs: bad tls record")
+
+// cipherSuites, signatureAlgorithms and the other fixed extensions
+// reproduce the ClientHello simple-obfs sends.
+var (
+	cipherSuites = []byte{
+		0xc0, 0x2c, 0xc0, 0x30, 0x00, 0x9f, 0xcc, 0xa9, 0xcc, 0xa8, 0xcc, 0xaa, 0xc0, 0x2b, 0xc0, 0x2f,
+		0x00, 0x9e, 0xc0, 0x24, 0xc0, 0x28, 0x00, 0x6b, 0xc0, 0x23, 0xc0, 0x27, 0x00, 0x67, 0xc0, 0x0a,
+		0xc0, 0x14, 0x00, 0x39, 0xc0, 0x09, 0xc0, 0x13, 0x00, 0x33, 0x00, 0x9d, 0x00, 0x9c, 0x00, 0x3d,
+		0x00, 0x3c, 0x00, 0x35, 0x00, 0x2f, 0x00, 0xff,
+	}
+	signatureAlgorithms = []byte{
+		0x06, 0x01, 0x06, 0x02, 0x06, 0x03, 0x05, 0x01, 0x05, 0x02, 0x05, 0x03, 0x04, 0x01, 0x04, 0x02,
+		0x04, 0x03, 0x03, 0x01, 0x03, 0x02, 0x03, 0x03, 0x02, 0x01, 0x02, 0x02, 0x02, 0x03,
+	}
+	otherExtensions = append([]byte{
+		0x00, 0x0b, 0x00, 0x04, 0x03, 0x01, 0x00, 0x02, // ec_point_formats
+		0x00, 0x0a, 0x00, 0x0a, 0x00, 0x08, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x19, 0x00, 0x18, // supported_groups
+		0x00, 0x0d, 0x00, 0x20, 0x00, 0x1e, // signature_algorithms
+	}, append(signatureAlgorithms,
+		0x00, 0x16, 0x00, 0x00, // encrypt_then_mac
+		0x00, 0x17, 0x00, 0x00, // extended_master_secret
+	)...)
+)
+
+// tlsConn sends the first write as the session ticket of a fake
+// ClientHello and the following ones as application data records. Reads
+// skip the fake ServerHello and ChangeCipherSpec and return the payload of
+// every later record. Record headers and payloads are reassembled across
+// EAGAINs on a non-blocking conn, and the records the conn did not take
+// go out ahead of the next read or write.
+type tlsConn struct {
+	v1net.Conn
+	host        string
+	helloSent   bool
+	outbound    []byte
+	serverHello bool
+	cipherSpec  bool
+	header      [recordHeaderSize]byte
+	headerN     int
+	remaining   int
+	skip        bool
+}
+
+// Write frames p into records, which count as written once framed.
+func (c *tlsConn) Write(p []byte) (n int, err error) {
+	if err = c.flush(); err != nil {
+		return 0, err
+	}
+	var out []byte
+	if !c.helloSent {
+		// the ticket has to fit the ClientHello record along with the
+		// rest of the hello, whatever is left goes into data records
+		ticket := p[:min(len(p), maxRecordSize-512)]
+		out = c.clientHello(ticket)
+		p = p[len(ticket):]
+		n = len(ticket)
+	}
+	for len(p) > 0 {
+		record := p[:min(len(p), maxRecordSize)]
+		out = append(out, recordApplicationData, 0x03, 0x03, 0, 0)
+		binary.BigEndian.PutUint16(out[len(out)-2:], uint16(len(record)))
+		out = append(out, record...)
+		p = p[len(record):]
+		n += len(record)
+	}
+	c.outbound = out
+	c.helloSent = true
+	return n, c.flush()
+}
+
+// flush writes the outbound records, keeping what the conn does not take
+// when it returns EAGAIN.
+func (c *tlsConn) flush() error {
+	for len(c.outbound) > 0 {
+		n, err := c.Conn.Write(c.outbound)
+		c.outbound = c.outbound[n:]
+		if err != nil {
+			return err
+		}
+	}
+	c.outbound = nil
+	return nil
+}
+
+func (c *tlsConn) clientHello(ticket []byte) []byte {
+	hello := make([]byte, 0, 256+len(c.host)+len(ticket))
+	hello = append(hello, recordHandshake, 0x03, 0x01, 0, 0)
+	hello = append(hello, handshakeClientHello, 0, 0, 0)
+	hello = append(hello, 0x03, 0x03)
+	hello = binary.BigEndian.AppendUint32(hello, uint32(time.Now().Unix()))
+	var random [28 + 32]byte
+	rand.Read(random[:])
+	hello = append(hello, random[:28]...)
+	hello = append(hello, 32)
+	hello = append(hello, random[28:]...)
+	hello = binary.BigEndian.AppendUint16(hello, uint16(len(cipherSuites)))
+	hello = append(hello, cipherSuites...)
+	hello = append(hello, 1, 0)
+
+	extensionsStart := len(hello)
+	hello = append(hello, 0, 0)
+	hello = append(hello, 0x00, 0x23)
+	hello = binary.BigEndian.AppendUint16(hello, uint16(len(ticket)))
+	hello = append(hello, ticket...)
+	hello = append(hello, 0x00, 0x00)
+	hello = binary.BigEndian.AppendUint16(hello, uint16(len(c.host)+5))
+	hello = binary.BigEndian.AppendUint16(hello, uint16(len(c.host)+3))
+	hello = append(hello, 0)
+	hello = binary.BigEndian.AppendUint16(hello, uint16(len(c.host)))
+	hello = append(hello, c.host...)
+	hello = append(hello, otherExtensions...)
+
+	binary.BigEndian.PutUint16(hello[extensionsStart:], uint16(len(hello)-extensionsStart-2))
+	handshakeLength := len(hello) - recordHeaderSize - 4
+	hello[recordHeaderSize+1] = byte(handshakeLength >> 16)
+	binary.BigEndian.PutUint16(hello[recordHeaderSize+2:], uint16(handshakeLength))
+	binary.BigEndian.PutUint16(hello[3:], uint16(len(hello)-recordHeaderSize))
+	return hello
+}
+
+func (c *tlsConn) Read(p []byte) (n int, err error) {
+	if err = c.flush(); err != nil {
+		return 0, err
+	}
+	for {
+		if c.remaining > 0 && !c.skip {
+			n, err = c.Conn.Read(p[:min(len(p), c.remaining)])
+			c.remaining -= n
+			return
+		}
+		if c.remaining > 0 {
+			var discard [256]byte
+			readN, readErr := c.Conn.Read(discard[:min(len(discard), c.remaining)])
+			c.remaining -= readN
+			if readErr != nil {
+				return 0, readErr
+			}
+			continue
+		}
+		readN, readErr := c.Conn.Read(c.header[c.headerN:])
+		c.headerN += readN
+		if c.headerN < recordHeaderSize {
+			if readErr == nil {
+				continue
+			}
+			return 0, readErr
+		}
+		c.headerN = 0
+		if err = c.nextRecord(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// nextRecord decides what to do with the record whose header was just
+// read: the handshake records before the ChangeCipherSpec are skipped, and
+// every record after it carries data.
+func (c *tlsConn) nextRecord() error {
+	contentType := c.header[0]
+	c.remaining = int(binary.BigEndian.Uint16(c.header[3:]))
+	if c.header[1] != 0x03 || c.remaining > maxRecordSize+256 {
+		return fmt.Errorf("%w: header %x", ErrBadRecord, c.header)
+	}
+	switch {
+	case c.cipherSpec && (contentType == recordApplicationData || contentType == recordHandshake):
+		c.skip = false
+	case !c.serverHello && contentType == recordHandshake:
+		c.serverHello, c.skip = true, true
+	case c.serverHello && !c.cipherSpec && contentType == recordChangeCipherSpec:
+		c.cipherSpec, c.skip = true, true
+	default:
+		return fmt.Errorf("%w: unexpected type %#x", ErrBadRecord, contentType)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+// Package plugin provides SIP003-style plugins that run inside the module.
+// A WATM cannot spawn the usual plugin processes, so each plugin instead
+// wraps the conn to the server below the shadowsocks layer.
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+var (
+	// ErrUnknownPlugin means no plugin is registered under the name.
+	ErrUnknownPlugin = errors.New("plugin: unknown plugin")
+	// ErrInvalidOptions means a plugin options string is malformed or
+	// holds values the plugin does not accept.
+	ErrInvalidOptions = errors.New("plugin: invalid options")
+)
+
+// Plugin wraps the conn to the shadowsocks server.
+type Plugin interface {
+	// WrapConn returns a conn that carries the shadowsocks stream over
+	// conn. It is called before the conn is switched to non-blocking mode,
+	// and the returned conn must pass syscall.EAGAIN through unwrapped once
+	// it is, resuming where it stopped on the next call.
+	WrapConn(conn v1net.Conn) (v1net.Conn, error)
+}
+
+// Redialer is implemented by plugins that can carry on over a new conn to
+// the server when the one they wrap breaks, such as those polling over
+// HTTP, where every request stands on its own.
+type Redialer interface {
+	Plugin
+	// WrapRedial is WrapConn with a way to dial the server again. The
+	// conns redial returns still block.
+	WrapRedial(conn v1net.Conn, redial func() (v1net.Conn, error)) (v1net.Conn, error)
+}
+
+// Chain returns a plugin applying plugins in order, each wrapping the conn
+// the previous one returned, so the first one is closest to the socket.
+func Chain(plugins ...Plugin) Plugin {
+	return chain(plugins)
+}
+
+type chain []Plugin
+
+func (c chain) WrapConn(conn v1net.Conn) (v1net.Conn, error) {
+	for _, p := range c {
+		var err error
+		if conn, err = p.WrapConn(conn); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// WrapRedial lets the last plugin redial when it is a Redialer, running
+// the new conns through the plugins below it.
+func (c chain) WrapRedial(conn v1net.Conn, redial func() (v1net.Conn, error)) (v1net.Conn, error) {
+	last, ok := c[len(c)-1].(Redialer)
+	if !ok {
+		return c.WrapConn(conn)
+	}
+	below := c[:len(c)-1]
+	conn, err := below.WrapConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	if redial == nil {
+		return last.WrapRedial(conn, nil)
+	}
+	return last.WrapRedial(conn, func() (v1net.Conn, error) {
+		conn, err := redial()
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := below.WrapConn(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return wrapped, nil
+	})
+}
+
+// Factory builds a plugin from its parsed options.
+type Factory func(opts Options) (Plugin, error)
+
+var (
+	access    sync.Mutex
+	factories = map[string]Factory{}
+)
+
+// Register makes a plugin available under name, usually the name of the
+// SIP003 binary it replaces. It panics if the name is taken.
+func Register(name string, factory Factory) {
+	access.Lock()
+	defer access.Unlock()
+	if _, loaded := factories[name]; loaded {
+		panic("plugin: " + name + " registered twice")
+	}
+	factories[name] = factory
+}
+
+// Names returns the registered plugin names, sorted.
+func Names() []string {
+	access.Lock()
+	defer access.Unlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New builds the plugin registered under name from a SIP003 options
+// string.
+func New(name, opts string) (Plugin, error) {
+	options, err := ParseOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromOptions(name, options)
+}
+
+// NewFromOptions builds the plugin registered under name from options that
+// are already parsed, such as those derived from dedicated config fields.
+func NewFromOptions(name string, opts Options) (Plugin, error) {
+	access.Lock()
+	factory, loaded := factories[name]
+	access.Unlock()
+	if !loaded {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPlugin, name)
+	}
+	return factory(opts)
+}
+
+// Options holds the key=value pairs of a SIP003 options string. Keys given
+// without a value, such as "tls", map to an empty string.
+type Options map[string]string
+
+// Get returns the value of key, or fallback when it is not set.
+func (o Options) Get(key, fallback string) string {
+	if value, loaded := o[key]; loaded {
+		return value
+	}
+	return fallback
+}
+
+// Has reports whether key is set, with or without a value.
+func (o Options) Has(key string) bool {
+	_, loaded := o[key]
+	return loaded
+}
+
+// ParseOptions parses a SIP003 options string such as
+// "obfs=http;obfs-host=example.com". Pairs are separated by ';', keys and
+// values by '=', and a backslash escapes the next character.
+func ParseOptions(s string) (Options, error) {
+	options := Options{}
+	var (
+		key, value strings.Builder
+		current    = &key
+		hasValue   bool
+	)
+	flush := func() error {
+		if key.Len() == 0 {
+			if hasValue || value.Len() > 0 {
+				return fmt.Errorf("%w: empty key in %q", ErrInvalidOptions, s)
+			}
+			return nil
+		}
+		options[key.String()] = value.String()
+		key.Reset()
+		value.Reset()
+		current, hasValue = &key, false
+		return nil
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			if i+1 == len(s) {
+				return nil, fmt.Errorf("%w: trailing backslash in %q", ErrInvalidOptions, s)
+			}
+			i++
+			current.WriteByte(s[i])
+		case c == '=' && !hasValue:
+			current, hasValue = &value, true
+		case c == ';':
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
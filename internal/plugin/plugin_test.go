@@ -0,0 +1,123 @@
+package plugin
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+func TestParseOptions(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected Options
+	}{
+		{"", Options{}},
+		{"obfs=http;obfs-host=example.com", Options{"obfs": "http", "obfs-host": "example.com"}},
+		{"tls;host=example.com;", Options{"tls": "", "host": "example.com"}},
+		{`path=/a\;b;header=k\=v`, Options{"path": "/a;b", "header": "k=v"}},
+		{"mode=a=b", Options{"mode": "a=b"}},
+		{"key=", Options{"key": ""}},
+	} {
+		got, err := ParseOptions(tc.input)
+		if err != nil {
+			t.Errorf("ParseOptions(%q) failed: %v", tc.input, err)
+			continue
+		}
+		if !maps.Equal(got, tc.expected) {
+			t.Errorf("ParseOptions(%q) = %v, expected %v", tc.input, got, tc.expected)
+		}
+	}
+
+	for _, input := range []string{"=value", `key=value\`} {
+		if _, err := ParseOptions(input); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("Expected ParseOptions(%q) to fail with ErrInvalidOptions, got %v", input, err)
+		}
+	}
+}
+
+type identityPlugin struct {
+	opts Options
+}
+
+func (p *identityPlugin) WrapConn(conn v1net.Conn) (v1net.Conn, error) {
+	return conn, nil
+}
+
+func TestRegistry(t *testing.T) {
+	Register("test-identity", func(opts Options) (Plugin, error) {
+		return &identityPlugin{opts: opts}, nil
+	})
+	if !slices.Contains(Names(), "test-identity") {
+		t.Errorf("Expected registered plugin to be listed, got %v", Names())
+	}
+
+	p, err := New("test-identity", "mode=fast")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if p.(*identityPlugin).opts.Get("mode", "") != "fast" {
+		t.Errorf("Expected options to reach the factory, got %v", p.(*identityPlugin).opts)
+	}
+
+	if _, err = New("missing", ""); !errors.Is(err, ErrUnknownPlugin) {
+		t.Errorf("Expected ErrUnknownPlugin, got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a name twice to panic")
+		}
+	}()
+	Register("test-identity", nil)
+}
+
+// taggingPlugin records the order it wraps conns in.
+type taggingPlugin struct {
+	tag   string
+	order *[]string
+}
+
+func (p *taggingPlugin) WrapConn(conn v1net.Conn) (v1net.Conn, error) {
+	*p.order = append(*p.order, p.tag)
+	return conn, nil
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	p := Chain(&taggingPlugin{"tls", &order}, &taggingPlugin{"websocket", &order})
+	if _, err := p.WrapConn(nil); err != nil {
+		t.Fatalf("WrapConn failed: %v", err)
+	}
+	if !slices.Equal(order, []string{"tls", "websocket"}) {
+		t.Errorf("Expected the plugins to wrap in order, got %v", order)
+	}
+}
+
+// redialingPlugin redials as soon as it wraps a conn.
+type redialingPlugin struct {
+	taggingPlugin
+}
+
+func (p *redialingPlugin) WrapRedial(conn v1net.Conn, redial func() (v1net.Conn, error)) (v1net.Conn, error) {
+	*p.order = append(*p.order, p.tag)
+	return redial()
+}
+
+func TestChain_Redial(t *testing.T) {
+	var order []string
+	p := Chain(&taggingPlugin{"tls", &order}, &redialingPlugin{taggingPlugin{"poll", &order}})
+	_, err := p.(Redialer).WrapRedial(nil, func() (v1net.Conn, error) {
+		order = append(order, "redial")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("WrapRedial failed: %v", err)
+	}
+	// the new conn goes through TLS again
+	if !slices.Equal(order, []string{"tls", "poll", "redial", "tls"}) {
+		t.Errorf("Expected the redialed conn to be wrapped below the redialer, got %v", order)
+	}
+}
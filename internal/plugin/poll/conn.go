@@ -0,0 +1,435 @@
+package poll
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+const (
+	// maxBodySize bounds the bytes a request carries, the rest waits for
+	// the next one.
+	maxBodySize     = 64 * 1024
+	maxHeaderSize   = 16 * 1024
+	maxResponseSize = 4 * 1024 * 1024
+	// maxRetries is how many times in a row a request is sent again before
+	// the session is given up.
+	maxRetries = 5
+
+	headerSessionID = "X-Session-Id"
+	headerSeq       = "X-Seq"
+	headerPollWait  = "X-Poll-Wait"
+)
+
+var (
+	// ErrBadResponse means the server or a proxy sent a response that is
+	// not valid HTTP or has an error status.
+	ErrBadResponse = errors.New("poll: bad response")
+	// ErrPollFailed means a request kept failing, so the session is lost.
+	ErrPollFailed = errors.New("poll: request failed")
+)
+
+var crlf = []byte("\r\n")
+
+// Conn is the client end of a polling session. Reads and writes resume
+// across EAGAIN once the conn is switched to non-blocking mode, and the
+// conn to the server may be replaced by a new one, so its Fd changes.
+type Conn struct {
+	v1net.Conn
+	config      *Config
+	redial      func() (v1net.Conn, error)
+	nonBlocking bool
+	sessionID   string
+
+	// seq numbers the outstanding request, which is kept in request to be
+	// sent again until its response arrives, and unsent is what is left
+	// of it to write when the conn returned EAGAIN
+	seq      uint64
+	request  []byte
+	unsent   []byte
+	carried  bool
+	interval time.Duration
+	retries  int
+	// reconnect is set once the server announced it closes the conn
+	reconnect bool
+
+	pending    []byte
+	response   []byte
+	downstream []byte
+	closed     bool
+	err        error
+}
+
+func newConn(conn v1net.Conn, config *Config, redial func() (v1net.Conn, error)) (*Conn, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	return &Conn{
+		Conn:      conn,
+		config:    config,
+		redial:    redial,
+		sessionID: hex.EncodeToString(id[:]),
+		interval:  config.MinInterval,
+	}, nil
+}
+
+// SetNonBlock records the mode, which the conns dialed later get too.
+func (c *Conn) SetNonBlock(nonblocking bool) error {
+	c.nonBlocking = nonblocking
+	return c.Conn.SetNonBlock(nonblocking)
+}
+
+// Write queues p for the next request, sending one right away unless a
+// request is outstanding. Once queued p counts as written, so a retry
+// after EAGAIN does not queue it twice.
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.pending = append(c.pending, p...)
+	var err error
+	switch {
+	case c.request == nil:
+		err = c.send()
+	case len(c.unsent) > 0:
+		err = c.transmit()
+	}
+	return len(p), err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.downstream) == 0 {
+		if c.closed {
+			return 0, net.ErrClosed
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		var err error
+		switch {
+		case c.request == nil:
+			err = c.send()
+		case len(c.unsent) > 0:
+			err = c.transmit()
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := c.readResponse(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.downstream)
+	c.downstream = c.downstream[n:]
+	return n, nil
+}
+
+func (c *Conn) Close() error {
+	c.closed = true
+	return c.Conn.Close()
+}
+
+// send issues the next request, carrying what was written so far.
+func (c *Conn) send() error {
+	if c.reconnect {
+		if err := c.reconnectConn(io.ErrUnexpectedEOF); err != nil {
+			return err
+		}
+	}
+	body := c.pending[:min(len(c.pending), maxBodySize)]
+	c.seq++
+	c.request = c.appendRequest(nil, body)
+	c.unsent = c.request
+	c.carried = len(body) > 0
+	c.pending = c.pending[len(body):]
+	return c.transmit()
+}
+
+func (c *Conn) appendRequest(b, body []byte) []byte {
+	target := c.config.Path
+	if c.config.Proxy {
+		target = "http://" + c.config.Host + target
+	}
+	b = fmt.Appendf(b, "POST %s HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"%s: %s\r\n"+
+		"%s: %d\r\n"+
+		"%s: %d\r\n"+
+		"Content-Type: application/octet-stream\r\n"+
+		"Content-Length: %d\r\n",
+		target, c.config.Host,
+		headerSessionID, c.sessionID,
+		headerSeq, c.seq,
+		headerPollWait, c.interval/time.Millisecond,
+		len(body))
+	names := make([]string, 0, len(c.config.Headers))
+	for name := range c.config.Headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		b = fmt.Appendf(b, "%s: %s\r\n", name, c.config.Headers[name])
+	}
+	b = append(b, crlf...)
+	return append(b, body...)
+}
+
+// transmit writes what is left of the outstanding request, keeping the
+// rest for the next call when the conn returns EAGAIN.
+func (c *Conn) transmit() error {
+	for len(c.unsent) > 0 {
+		n, err := c.Conn.Write(c.unsent)
+		c.unsent = c.unsent[n:]
+		switch {
+		case err == nil:
+		case errors.Is(err, syscall.EAGAIN):
+			return err
+		default:
+			return c.retry(err, true)
+		}
+	}
+	return nil
+}
+
+// retry sends the outstanding request again after it failed with cause,
+// over a new conn when the old one broke.
+func (c *Conn) retry(cause error, broken bool) error {
+	c.retries++
+	if c.retries > maxRetries {
+		return c.fail(cause)
+	}
+	if broken || c.reconnect {
+		if err := c.reconnectConn(cause); err != nil {
+			return err
+		}
+	}
+	c.unsent = c.request
+	return c.transmit()
+}
+
+// reconnectConn replaces the conn to the server, failing with cause when
+// the plugin may not redial.
+func (c *Conn) reconnectConn(cause error) error {
+	if c.redial == nil {
+		return c.fail(cause)
+	}
+	conn, err := c.redial()
+	if err != nil {
+		return c.fail(err)
+	}
+	c.Conn.Close()
+	c.Conn = conn
+	c.reconnect = false
+	c.response = nil
+	if c.nonBlocking {
+		if err := conn.SetNonBlock(true); err != nil {
+			return c.fail(err)
+		}
+	}
+	return nil
+}
+
+func (c *Conn) fail(err error) error {
+	c.err = fmt.Errorf("%w: %w", ErrPollFailed, err)
+	return c.err
+}
+
+// readResponse reads until the outstanding request is answered, keeping
+// what it read so far when the conn returns EAGAIN.
+func (c *Conn) readResponse() error {
+	var scratch [4096]byte
+	for {
+		resp, size, err := parseResponse(c.response, false)
+		if err != nil {
+			// whatever mangled it, the request goes again on a fresh conn
+			if err = c.retry(err, true); err != nil {
+				return err
+			}
+			continue
+		}
+		if resp != nil {
+			c.response = append(c.response[:0], c.response[size:]...)
+			if answered, err := c.handle(resp); answered || err != nil {
+				return err
+			}
+			continue
+		}
+		if len(c.response) > maxResponseSize {
+			return c.fail(fmt.Errorf("%w: response exceeds %d bytes", ErrBadResponse, maxResponseSize))
+		}
+		n, err := c.Conn.Read(scratch[:])
+		c.response = append(c.response, scratch[:n]...)
+		switch {
+		case err == nil:
+		case errors.Is(err, syscall.EAGAIN):
+			return err
+		case err == io.EOF && len(c.response) > 0:
+			// a response without a length ends with the conn
+			if resp, _, _ := parseResponse(c.response, true); resp != nil {
+				c.response = nil
+				if answered, err := c.handle(resp); answered || err != nil {
+					return err
+				}
+				continue
+			}
+			fallthrough
+		default:
+			if err = c.retry(err, true); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handle processes a response and reports whether it answered the
+// outstanding request, in which case the next request is sent right away.
+func (c *Conn) handle(resp *response) (answered bool, err error) {
+	if resp.close {
+		c.reconnect = true
+	}
+	switch {
+	case resp.status >= 100 && resp.status < 200:
+		return false, nil
+	case resp.status != 200:
+		return false, c.retry(fmt.Errorf("%w: status %d", ErrBadResponse, resp.status), false)
+	case resp.seq != "" && resp.seq != strconv.FormatUint(c.seq, 10):
+		// the answer to an earlier attempt
+		return false, nil
+	}
+	c.request = nil
+	c.retries = 0
+	c.downstream = append(c.downstream, resp.body...)
+	if len(resp.body) > 0 || c.carried || len(c.pending) > 0 {
+		c.interval = c.config.MinInterval
+	} else {
+		c.interval = min(c.interval*3/2, c.config.MaxInterval)
+	}
+	return true, c.send()
+}
+
+type response struct {
+	status int
+	seq    string
+	close  bool
+	body   []byte
+}
+
+// parseResponse parses the response at the start of b, returning nil when
+// it is not complete yet, along with its size. Responses delimited by the
+// end of the conn are only complete at eof.
+func parseResponse(b []byte, eof bool) (*response, int, error) {
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(b) > maxHeaderSize {
+			return nil, 0, fmt.Errorf("%w: header exceeds %d bytes", ErrBadResponse, maxHeaderSize)
+		}
+		return nil, 0, nil
+	}
+	lines := bytes.Split(b[:end], crlf)
+	statusLine := lines[0]
+	if len(statusLine) < 12 || !bytes.HasPrefix(statusLine, []byte("HTTP/1.")) || statusLine[8] != ' ' {
+		return nil, 0, fmt.Errorf("%w: status line %q", ErrBadResponse, statusLine)
+	}
+	status, err := strconv.Atoi(string(statusLine[9:12]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: status line %q", ErrBadResponse, statusLine)
+	}
+	resp := &response{status: status, close: statusLine[7] == '0'}
+	length, chunked := -1, false
+	for _, line := range lines[1:] {
+		name, value, _ := bytes.Cut(line, []byte(":"))
+		value = bytes.TrimSpace(value)
+		switch strings.ToLower(string(bytes.TrimSpace(name))) {
+		case "content-length":
+			if length, err = strconv.Atoi(string(value)); err != nil || length < 0 {
+				return nil, 0, fmt.Errorf("%w: content length %q", ErrBadResponse, value)
+			}
+		case "transfer-encoding":
+			chunked = bytes.Contains(bytes.ToLower(value), []byte("chunked"))
+		case "connection":
+			if bytes.EqualFold(value, []byte("close")) {
+				resp.close = true
+			} else if bytes.EqualFold(value, []byte("keep-alive")) {
+				resp.close = false
+			}
+		case strings.ToLower(headerSeq):
+			resp.seq = string(value)
+		}
+	}
+	body := b[end+4:]
+	switch {
+	case status/100 == 1 || status == 204 || status == 304:
+		return resp, end + 4, nil
+	case chunked:
+		data, n, err := parseChunked(body)
+		if err != nil || n < 0 {
+			return nil, 0, err
+		}
+		resp.body = data
+		return resp, end + 4 + n, nil
+	case length >= 0:
+		if len(body) < length {
+			return nil, 0, nil
+		}
+		resp.body = bytes.Clone(body[:length])
+		return resp, end + 4 + length, nil
+	case eof:
+		resp.body = bytes.Clone(body)
+		resp.close = true
+		return resp, len(b), nil
+	}
+	return nil, 0, nil
+}
+
+// parseChunked decodes a chunked body, returning a negative size when it
+// is not complete yet.
+func parseChunked(b []byte) (body []byte, n int, err error) {
+	for {
+		lineEnd := bytes.Index(b[n:], crlf)
+		if lineEnd < 0 {
+			return nil, -1, nil
+		}
+		sizeField, _, _ := bytes.Cut(b[n:n+lineEnd], []byte(";"))
+		size, err := strconv.ParseUint(string(bytes.TrimSpace(sizeField)), 16, 32)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: chunk size %q", ErrBadResponse, sizeField)
+		}
+		n += lineEnd + len(crlf)
+		if size == 0 {
+			// the trailer ends with an empty line
+			for {
+				lineEnd := bytes.Index(b[n:], crlf)
+				if lineEnd < 0 {
+					return nil, -1, nil
+				}
+				n += lineEnd + len(crlf)
+				if lineEnd == 0 {
+					return body, n, nil
+				}
+			}
+		}
+		if len(b)-n < int(size)+len(crlf) {
+			return nil, -1, nil
+		}
+		body = append(body, b[n:n+int(size)]...)
+		if !bytes.Equal(b[n+int(size):n+int(size)+len(crlf)], crlf) {
+			return nil, 0, fmt.Errorf("%w: chunk not terminated", ErrBadResponse)
+		}
+		n += int(size) + len(crlf)
+	}
+}
@@ -0,0 +1,115 @@
+// Package poll carries the shadowsocks stream in the bodies of HTTP POST
+// requests and their responses, the way meek does, for networks that let
+// nothing but HTTP request/response through a proxy. It is registered as
+// the "http-poll" plugin.
+//
+// Every request carries the bytes written since the previous one, the
+// session ID and a sequence number, and its response carries the bytes the
+// server has for the client. One request is always outstanding: the server
+// holds it until it has data or the poll interval the request names runs
+// out. The interval grows while the session is idle and drops back as soon
+// as data flows, so the client needs no timer. A request that fails, with
+// an error status or a broken conn, is sent again with the same sequence
+// number, over a new conn when the plugin may redial, and the server
+// answers a number it already handled with the response it gave then.
+package poll
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+const (
+	defaultPath        = "/"
+	defaultMinInterval = 100 * time.Millisecond
+	defaultMaxInterval = 5 * time.Second
+)
+
+func init() {
+	plugin.Register("http-poll", parseOptions)
+}
+
+// Config describes the requests.
+type Config struct {
+	// Host is sent in the Host header.
+	Host string
+	// Path is the request target, query included.
+	Path string
+	// Headers are added to every request.
+	Headers map[string]string
+	// Proxy sends the requests in the absolute form HTTP proxies expect,
+	// for conns to a proxy rather than to the server.
+	Proxy bool
+	// MinInterval and MaxInterval bound how long the server may hold a
+	// request without data, 100ms and 5s by default. The interval starts
+	// at MinInterval and grows by half after every empty round trip.
+	MinInterval, MaxInterval time.Duration
+}
+
+// Plugin polls the server over every conn it wraps.
+type Plugin struct {
+	config Config
+}
+
+var _ plugin.Redialer = (*Plugin)(nil)
+
+// New returns a plugin polling as described by config.
+func New(config Config) (*Plugin, error) {
+	if config.Host == "" {
+		return nil, fmt.Errorf("%w: missing host", plugin.ErrInvalidOptions)
+	}
+	if config.Path == "" {
+		config.Path = defaultPath
+	}
+	if config.Path[0] != '/' {
+		return nil, fmt.Errorf("%w: path %q does not start with /", plugin.ErrInvalidOptions, config.Path)
+	}
+	if config.MinInterval == 0 {
+		config.MinInterval = defaultMinInterval
+	}
+	if config.MaxInterval == 0 {
+		config.MaxInterval = max(defaultMaxInterval, config.MinInterval)
+	}
+	if config.MinInterval < 0 || config.MaxInterval < config.MinInterval {
+		return nil, fmt.Errorf("%w: poll intervals %v to %v", plugin.ErrInvalidOptions, config.MinInterval, config.MaxInterval)
+	}
+	return &Plugin{config: config}, nil
+}
+
+// parseOptions builds the plugin from "host", "path", "proxy" and the
+// "min-interval" and "max-interval" in milliseconds.
+func parseOptions(opts plugin.Options) (plugin.Plugin, error) {
+	config := Config{Host: opts.Get("host", ""), Path: opts.Get("path", ""), Proxy: opts.Has("proxy")}
+	for _, option := range []struct {
+		name   string
+		target *time.Duration
+	}{
+		{"min-interval", &config.MinInterval},
+		{"max-interval", &config.MaxInterval},
+	} {
+		if value := opts.Get(option.name, ""); value != "" {
+			ms, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s %q: %w", plugin.ErrInvalidOptions, option.name, value, err)
+			}
+			*option.target = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return New(config)
+}
+
+// WrapConn polls over conn. Requests that fail are retried over it as long
+// as it stays open.
+func (p *Plugin) WrapConn(conn v1net.Conn) (v1net.Conn, error) {
+	return p.WrapRedial(conn, nil)
+}
+
+// WrapRedial polls over conn and the conns redial returns once it breaks.
+// Nothing is sent until the first read or write.
+func (p *Plugin) WrapRedial(conn v1net.Conn, redial func() (v1net.Conn, error)) (v1net.Conn, error) {
+	return newConn(conn, &p.config, redial)
+}
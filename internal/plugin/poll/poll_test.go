@@ -0,0 +1,334 @@
+package poll
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/conntest"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+// server is a stand-in for the server end of polling sessions. It echoes
+// what a session sends, holds requests it has nothing for up to their poll
+// wait, answers a sequence number it already handled with the response it
+// gave then, and keeps requests that arrive ahead of a missing one until
+// that one arrives.
+type server struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	// faults fails the first attempt of a sequence number, with "503"
+	// before handling it or "drop" after, closing the conn unanswered
+	faults map[uint64]string
+}
+
+type session struct {
+	next      uint64
+	echo      []byte
+	early     map[uint64][]byte
+	responses map[uint64][]byte
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	seq, err := strconv.ParseUint(r.Header.Get(headerSeq), 10, 64)
+	if err != nil || r.Method != http.MethodPost {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	wait, _ := strconv.Atoi(r.Header.Get(headerPollWait))
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	fault := s.faults[seq]
+	delete(s.faults, seq)
+	if fault == "503" {
+		s.mu.Unlock()
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	response := s.handle(r.Header.Get(headerSessionID), seq, body)
+	s.mu.Unlock()
+	if fault == "drop" {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+		return
+	}
+	if len(response) == 0 {
+		time.Sleep(time.Duration(wait) * time.Millisecond)
+	}
+	w.Header().Set(headerSeq, strconv.FormatUint(seq, 10))
+	w.Write(response)
+}
+
+func (s *server) handle(id string, seq uint64, body []byte) []byte {
+	if s.sessions == nil {
+		s.sessions = make(map[string]*session)
+	}
+	sess := s.sessions[id]
+	if sess == nil {
+		sess = &session{next: 1, early: make(map[uint64][]byte), responses: make(map[uint64][]byte)}
+		s.sessions[id] = sess
+	}
+	if response, ok := sess.responses[seq]; ok {
+		return response
+	}
+	if seq > sess.next {
+		sess.early[seq] = body
+		sess.responses[seq] = nil
+		return nil
+	}
+	sess.echo = append(sess.echo, body...)
+	for sess.next++; sess.early[sess.next] != nil; sess.next++ {
+		sess.echo = append(sess.echo, sess.early[sess.next]...)
+		delete(sess.early, sess.next)
+	}
+	response := sess.echo
+	sess.echo = nil
+	sess.responses[seq] = response
+	return response
+}
+
+func TestParseOptions(t *testing.T) {
+	p, err := plugin.New("http-poll", "host=example.com;path=/poll?v=1;proxy;min-interval=50;max-interval=2000")
+	if err != nil {
+		t.Fatalf("Expected the options to be accepted, got %v", err)
+	}
+	expected := Config{Host: "example.com", Path: "/poll?v=1", Proxy: true, MinInterval: 50 * time.Millisecond, MaxInterval: 2 * time.Second}
+	if config := p.(*Plugin).config; fmt.Sprint(config) != fmt.Sprint(expected) {
+		t.Errorf("Expected %+v, got %+v", expected, config)
+	}
+	p, _ = plugin.New("http-poll", "host=example.com")
+	if config := p.(*Plugin).config; config.Path != "/" || config.MinInterval != defaultMinInterval || config.MaxInterval != defaultMaxInterval {
+		t.Errorf("Expected the defaults, got %+v", config)
+	}
+	for _, opts := range []string{"", "host=example.com;path=poll", "host=example.com;min-interval=fast", "host=example.com;min-interval=500;max-interval=100"} {
+		if _, err := plugin.New("http-poll", opts); !errors.Is(err, plugin.ErrInvalidOptions) {
+			t.Errorf("Expected %q to be rejected, got %v", opts, err)
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		faults map[uint64]string
+		redial bool
+	}{
+		{"reliable", nil, false},
+		{"failing with redial", map[uint64]string{1: "503", 2: "drop", 3: "drop", 4: "503"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := &server{faults: tc.faults}
+			ts := httptest.NewServer(handler)
+			defer ts.Close()
+			dial := func() (v1net.Conn, error) {
+				conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+				if err != nil {
+					return nil, err
+				}
+				return &conntest.NetConn{Conn: conn}, nil
+			}
+			var redial func() (v1net.Conn, error)
+			if tc.redial {
+				redial = dial
+			}
+			p, err := New(Config{Host: ts.Listener.Addr().String(), Path: "/poll", MinInterval: time.Millisecond, MaxInterval: 20 * time.Millisecond})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			conn, _ := dial()
+			stream, err := p.WrapRedial(conn, redial)
+			if err != nil {
+				t.Fatalf("WrapRedial failed: %v", err)
+			}
+			defer stream.Close()
+
+			data := make([]byte, 200*1024)
+			rand.Read(data)
+			if _, err := stream.Write(data); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			echoed := make([]byte, len(data))
+			if _, err := io.ReadFull(stream, echoed); err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if !bytes.Equal(echoed, data) {
+				t.Error("Expected the data to be echoed intact")
+			}
+			if len(handler.faults) != 0 {
+				t.Errorf("Expected every fault to be hit, %v left", handler.faults)
+			}
+		})
+	}
+}
+
+func TestConn_NoRedial(t *testing.T) {
+	ts := httptest.NewServer(&server{faults: map[uint64]string{1: "drop"}})
+	defer ts.Close()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	p, _ := New(Config{Host: "example.com"})
+	stream, _ := p.WrapConn(&conntest.NetConn{Conn: conn})
+	defer stream.Close()
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := stream.Read(make([]byte, 16)); !errors.Is(err, ErrPollFailed) {
+		t.Errorf("Expected ErrPollFailed, got %v", err)
+	}
+}
+
+func TestConn_Responses(t *testing.T) {
+	empty := func(seq int) []byte {
+		return fmt.Appendf(nil, "HTTP/1.1 200 OK\r\nX-Seq: %d\r\nContent-Length: 0\r\n\r\n", seq)
+	}
+	conn := &conntest.ScriptedConn{Reads: [][]byte{
+		empty(1),
+		empty(2),
+		// a late answer to an earlier attempt is skipped
+		[]byte("HTTP/1.1 200 OK\r\nX-Seq: 2\r\nContent-Length: 5\r\n\r\nstale"),
+		empty(3),
+		[]byte("HTTP/1.1 200 OK\r\nx-seq: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"),
+		[]byte("HTTP/1.1 200 OK\r\nX-Seq: 5\r\nTransfer-Encoding: chunked\r\n\r\n2;ext\r\nda\r\n2\r\nta\r\n0\r\nTrailer: x\r\n\r\n"),
+	}}
+	p, _ := New(Config{Host: "example.com", Path: "/poll", Headers: map[string]string{"User-Agent": "test"}, Proxy: true, MaxInterval: 300 * time.Millisecond})
+	stream, _ := p.WrapConn(conn)
+	buffer := make([]byte, 16)
+	var n int
+	var err error
+	for n == 0 {
+		if n, err = stream.Read(buffer); err != nil && err != syscall.EAGAIN {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if string(buffer[:n]) != "data" {
+		t.Errorf("Expected the data of the fifth response, got %q", buffer[:n])
+	}
+
+	reader := bufio.NewReader(&conn.Written)
+	var waits []string
+	for seq := 1; ; seq++ {
+		request, err := http.ReadRequest(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Expected request %d to be valid, got %v", seq, err)
+		}
+		if request.Method != http.MethodPost || request.RequestURI != "http://example.com/poll" ||
+			request.Header.Get("User-Agent") != "test" || request.Header.Get(headerSeq) != strconv.Itoa(seq) {
+			t.Errorf("Unexpected request %d: %s %s %v", seq, request.Method, request.RequestURI, request.Header)
+		}
+		waits = append(waits, request.Header.Get(headerPollWait))
+	}
+	// idle round trips stretch the interval up to the maximum, data resets it
+	if expected := "[100 150 225 300 300 100]"; fmt.Sprint(waits) != expected {
+		t.Errorf("Expected poll waits %s, got %v", expected, waits)
+	}
+}
+
+func TestConn_ShortWrites(t *testing.T) {
+	conn := &conntest.ScriptedConn{
+		Reads:       [][]byte{[]byte("HTTP/1.1 200 OK\r\nX-Seq: 1\r\nContent-Length: 2\r\n\r\nok")},
+		Open:        true,
+		ShortWrites: 40,
+	}
+	p, _ := New(Config{Host: "example.com", Path: "/poll"})
+	stream, _ := p.WrapConn(conn)
+	// the request is refused at first, but its data is queued all the same
+	if n, err := stream.Write([]byte("hello")); n != 5 || !errors.Is(err, syscall.EAGAIN) {
+		t.Fatalf("Expected the write to be queued with EAGAIN, got %d, %v", n, err)
+	}
+	buffer := make([]byte, 16)
+	var n int
+	for n == 0 {
+		var err error
+		if n, err = stream.Read(buffer); err != nil && !errors.Is(err, syscall.EAGAIN) {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if string(buffer[:n]) != "ok" {
+		t.Errorf("Expected the response data, got %q", buffer[:n])
+	}
+
+	request, err := http.ReadRequest(bufio.NewReader(&conn.Written))
+	if err != nil {
+		t.Fatalf("Expected the first request to be valid, got %v", err)
+	}
+	if body, _ := io.ReadAll(request.Body); string(body) != "hello" {
+		t.Errorf("Expected the request to carry the data once, got %q", body)
+	}
+}
+
+func TestServer_Reordering(t *testing.T) {
+	handler := &server{}
+	post := func(seq int, body string) string {
+		request := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+		request.Header.Set(headerSessionID, "session")
+		request.Header.Set(headerSeq, strconv.Itoa(seq))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Body.String()
+	}
+	if response := post(2, "world"); response != "" {
+		t.Errorf("Expected a request ahead of a missing one to be held, got %q", response)
+	}
+	if response := post(1, "hello "); response != "hello world" {
+		t.Errorf("Expected the held request to follow, got %q", response)
+	}
+	if response := post(1, "hello "); response != "hello world" {
+		t.Errorf("Expected a retransmission to get the same response, got %q", response)
+	}
+	if response := post(3, "!"); response != "!" {
+		t.Errorf("Expected the session to go on, got %q", response)
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		eof  bool
+		body string
+		size int
+	}{
+		{"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nokextra", false, "ok", 40},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\no", false, "", 0},
+		{"HTTP/1.0 200 OK\r\n\r\nuntil eof", false, "", 0},
+		{"HTTP/1.0 200 OK\r\n\r\nuntil eof", true, "until eof", 28},
+		{"HTTP/1.1 204 No Content\r\n\r\n", false, "", 27},
+	} {
+		resp, size, err := parseResponse([]byte(tc.raw), tc.eof)
+		if err != nil {
+			t.Fatalf("parseResponse(%q) failed: %v", tc.raw, err)
+		}
+		if size != tc.size || (resp != nil && string(resp.body) != tc.body) {
+			t.Errorf("parseResponse(%q) = %+v, %d, expected %q, %d", tc.raw, resp, size, tc.body, tc.size)
+		}
+	}
+	for _, raw := range []string{
+		"SSH-2.0-OpenSSH\r\n\r\n",
+		"HTTP/1.1 20x OK\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+	} {
+		if _, _, err := parseResponse([]byte(raw), false); !errors.Is(err, ErrBadResponse) {
+			t.Errorf("Expected %q to be rejected, got %v", raw, err)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Package proxy tunnels the conn to the server through an upstream HTTP or
+// SOCKS5 proxy, for networks that only let traffic out through one. The
+// conn it wraps goes to the proxy, and the tunnel to the server is up once
+// WrapConn returns, before any other plugin or the shadowsocks handshake
+// speaks.
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+const (
+	ProtocolHTTP   = "http"
+	ProtocolSOCKS5 = "socks5"
+
+	// maxHeaderSize bounds the response of an HTTP proxy to CONNECT.
+	maxHeaderSize = 16 * 1024
+)
+
+var (
+	// ErrAuthFailed means the proxy refused the credentials, or wanted
+	// some when none were configured.
+	ErrAuthFailed = errors.New("proxy: authentication failed")
+	// ErrRejected means the proxy refused to connect to the server.
+	ErrRejected = errors.New("proxy: connect rejected")
+	// ErrBadReply means the proxy does not speak the protocol.
+	ErrBadReply = errors.New("proxy: bad reply")
+)
+
+// Config describes the proxy and the server to reach through it.
+type Config struct {
+	// Protocol is ProtocolHTTP for HTTP CONNECT or ProtocolSOCKS5.
+	Protocol string
+	// Target is the host and port of the server.
+	Target string
+	// Username and Password are sent with basic authentication over HTTP
+	// and the username/password method over SOCKS5 when Username is set.
+	Username, Password string
+}
+
+// Plugin opens a tunnel to the server over every conn it wraps.
+type Plugin struct {
+	config Config
+	host   string
+	port   uint16
+}
+
+// New returns a plugin tunneling through the proxy described by config.
+func New(config Config) (*Plugin, error) {
+	if config.Protocol != ProtocolHTTP && config.Protocol != ProtocolSOCKS5 {
+		return nil, fmt.Errorf("%w: unknown proxy protocol %q", plugin.ErrInvalidOptions, config.Protocol)
+	}
+	host, portField, err := net.SplitHostPort(config.Target)
+	if err != nil {
+		return nil, fmt.Errorf("%w: proxy target: %w", plugin.ErrInvalidOptions, err)
+	}
+	port, err := strconv.ParseUint(portField, 10, 16)
+	if err != nil || host == "" || len(host) > 255 {
+		return nil, fmt.Errorf("%w: proxy target %q", plugin.ErrInvalidOptions, config.Target)
+	}
+	if config.Protocol == ProtocolSOCKS5 && (len(config.Username) > 255 || len(config.Password) > 255) {
+		return nil, fmt.Errorf("%w: SOCKS5 credentials exceed 255 bytes", plugin.ErrInvalidOptions)
+	}
+	return &Plugin{config: config, host: host, port: uint16(port)}, nil
+}
+
+// WrapConn opens the tunnel over conn, which still blocks, and returns conn
+// once the proxy relays it to the server.
+func (p *Plugin) WrapConn(conn v1net.Conn) (v1net.Conn, error) {
+	var err error
+	if p.config.Protocol == ProtocolHTTP {
+		err = p.connectHTTP(conn)
+	} else {
+		err = p.connectSOCKS5(conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p *Plugin) connectHTTP(conn v1net.Conn) error {
+	request := fmt.Appendf(nil, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n", p.config.Target)
+	if p.config.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.config.Username + ":" + p.config.Password))
+		request = fmt.Appendf(request, "Proxy-Authorization: Basic %s\r\n", credentials)
+	}
+	request = append(request, "\r\n"...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	// byte by byte, so that nothing the server sends after the header is
+	// taken from the conn
+	var header []byte
+	var b [1]byte
+	for !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		if len(header) >= maxHeaderSize {
+			return fmt.Errorf("%w: response header exceeds %d bytes", ErrBadReply, maxHeaderSize)
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return err
+		}
+		header = append(header, b[0])
+	}
+	statusLine, _, _ := strings.Cut(string(header), "\r\n")
+	proto, status, _ := strings.Cut(statusLine, " ")
+	if !strings.HasPrefix(proto, "HTTP/1.") || len(status) < 3 {
+		return fmt.Errorf("%w: status line %q", ErrBadReply, statusLine)
+	}
+	switch code := status[:3]; {
+	case code == "407":
+		return fmt.Errorf("%w: %s", ErrAuthFailed, status)
+	case code[0] != '2':
+		return fmt.Errorf("%w: %s", ErrRejected, status)
+	}
+	return nil
+}
+
+const (
+	socksVersion         = 5
+	socksMethodNone      = 0
+	socksMethodPassword  = 2
+	socksNoMethod        = 0xff
+	socksPasswordVersion = 1
+	socksConnect         = 1
+	socksIPv4            = 1
+	socksDomain          = 3
+	socksIPv6            = 4
+)
+
+// socksReplies are the messages of the SOCKS5 reply codes.
+var socksReplies = []string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (p *Plugin) connectSOCKS5(conn v1net.Conn) error {
+	greeting := []byte{socksVersion, 1, socksMethodNone}
+	if p.config.Username != "" {
+		greeting = []byte{socksVersion, 2, socksMethodNone, socksMethodPassword}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("%w: version %d", ErrBadReply, reply[0])
+	}
+	switch reply[1] {
+	case socksMethodNone:
+	case socksMethodPassword:
+		if p.config.Username == "" {
+			return fmt.Errorf("%w: the proxy wants a password", ErrAuthFailed)
+		}
+		if err := p.authenticate(conn); err != nil {
+			return err
+		}
+	case socksNoMethod:
+		return fmt.Errorf("%w: no acceptable method", ErrAuthFailed)
+	default:
+		return fmt.Errorf("%w: method %d", ErrBadReply, reply[1])
+	}
+
+	request := []byte{socksVersion, socksConnect, 0}
+	if addr, err := netip.ParseAddr(p.host); err == nil && addr.Is4() {
+		request = append(append(request, socksIPv4), addr.AsSlice()...)
+	} else if err == nil {
+		request = append(append(request, socksIPv6), addr.AsSlice()...)
+	} else {
+		request = append(append(request, socksDomain, byte(len(p.host))), p.host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, p.port)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	// the version, reply code, reserved byte and address type
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("%w: version %d", ErrBadReply, header[0])
+	}
+	if code := int(header[1]); code != 0 {
+		message := "unknown error"
+		if code < len(socksReplies) {
+			message = socksReplies[code]
+		}
+		return fmt.Errorf("%w: %s", ErrRejected, message)
+	}
+	// the address the proxy bound is of no use
+	var boundSize int
+	switch header[3] {
+	case socksIPv4:
+		boundSize = net.IPv4len
+	case socksIPv6:
+		boundSize = net.IPv6len
+	case socksDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return err
+		}
+		boundSize = int(length[0])
+	default:
+		return fmt.Errorf("%w: address type %d", ErrBadReply, header[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, boundSize+2))
+	return err
+}
+
+// authenticate runs the username/password method of RFC 1929.
+func (p *Plugin) authenticate(conn v1net.Conn) error {
+	request := []byte{socksPasswordVersion, byte(len(p.config.Username))}
+	request = append(request, p.config.Username...)
+	request = append(request, byte(len(p.config.Password)))
+	request = append(request, p.config.Password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("%w: status %d", ErrAuthFailed, reply[1])
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/conntest"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+// serveProxy runs serve as the proxy end of a pipe and returns the client
+// end.
+func serveProxy(t *testing.T, serve func(conn net.Conn) error) v1net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer server.Close()
+		if err := serve(server); err != nil {
+			return
+		}
+		// the tunnel echoes once it is up
+		io.Copy(server, server)
+	}()
+	return &conntest.NetConn{Conn: client}
+}
+
+// httpProxy is a stand-in HTTP proxy answering CONNECT to target with
+// status, when the request carries authorization if that is set.
+func httpProxy(target, authorization string, status int) func(conn net.Conn) error {
+	return func(conn net.Conn) error {
+		request, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return err
+		}
+		switch {
+		case request.Method != http.MethodConnect || request.Host != target:
+			status = http.StatusBadRequest
+		case authorization != "" && request.Header.Get("Proxy-Authorization") != authorization:
+			status = http.StatusProxyAuthRequired
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nVia: test\r\n\r\n", status, http.StatusText(status))
+		if status != http.StatusOK {
+			return errors.New("rejected")
+		}
+		// the server speaks first, the client must not take it with the header
+		_, err = io.WriteString(conn, "banner")
+		return err
+	}
+}
+
+// socksProxy is a stand-in SOCKS5 proxy expecting the CONNECT request
+// to carry the address bytes target, answering it with code, and taking
+// username and password when credentials is set.
+func socksProxy(target []byte, credentials string, code byte) func(conn net.Conn) error {
+	return func(conn net.Conn) error {
+		var greeting [2]byte
+		if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+			return err
+		}
+		methods := make([]byte, greeting[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return err
+		}
+		if credentials == "" {
+			conn.Write([]byte{5, 0})
+		} else if !bytes.Contains(methods, []byte{2}) {
+			conn.Write([]byte{5, 0xff})
+			return errors.New("no acceptable method")
+		} else {
+			conn.Write([]byte{5, 2})
+			var lengths [2]byte
+			if _, err := io.ReadFull(conn, lengths[:]); err != nil {
+				return err
+			}
+			username := make([]byte, lengths[1])
+			io.ReadFull(conn, username)
+			io.ReadFull(conn, lengths[1:])
+			password := make([]byte, lengths[1])
+			io.ReadFull(conn, password)
+			if string(username)+":"+string(password) != credentials {
+				conn.Write([]byte{1, 1})
+				return errors.New("bad credentials")
+			}
+			conn.Write([]byte{1, 0})
+		}
+		request := make([]byte, 3+len(target))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return err
+		}
+		if !bytes.Equal(request, append([]byte{5, 1, 0}, target...)) {
+			code = 4
+		}
+		// bound to a domain, which the client must skip
+		conn.Write(append([]byte{5, code, 0, 3, 4}, "host\x00\x00"...))
+		if code != 0 {
+			return errors.New("rejected")
+		}
+		return nil
+	}
+}
+
+// expectEcho reads first, what the server sends on its own, and checks
+// that the tunnel echoes.
+func expectEcho(t *testing.T, conn v1net.Conn, first string) {
+	t.Helper()
+	buffer := make([]byte, len(first))
+	if _, err := io.ReadFull(conn, buffer); err != nil || string(buffer) != first {
+		t.Fatalf("Expected %q first, got %q, %v", first, buffer, err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buffer = make([]byte, 5)
+	if _, err := io.ReadFull(conn, buffer); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(buffer) != "hello" {
+		t.Errorf("Expected the tunnel to echo, got %q", buffer)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, config := range []Config{
+		{Protocol: "socks4", Target: "example.com:8388"},
+		{Protocol: ProtocolHTTP, Target: "example.com"},
+		{Protocol: ProtocolHTTP, Target: "example.com:http"},
+		{Protocol: ProtocolSOCKS5, Target: ":8388"},
+		{Protocol: ProtocolSOCKS5, Target: "example.com:8388", Username: string(make([]byte, 256))},
+	} {
+		if _, err := New(config); !errors.Is(err, plugin.ErrInvalidOptions) {
+			t.Errorf("Expected %+v to be rejected, got %v", config, err)
+		}
+	}
+}
+
+func TestWrapConn_HTTP(t *testing.T) {
+	p, _ := New(Config{Protocol: ProtocolHTTP, Target: "example.com:8388", Username: "user", Password: "pass"})
+	conn, err := p.WrapConn(serveProxy(t, httpProxy("example.com:8388", "Basic dXNlcjpwYXNz", http.StatusOK)))
+	if err != nil {
+		t.Fatalf("WrapConn failed: %v", err)
+	}
+	expectEcho(t, conn, "banner")
+
+	for _, tc := range []struct {
+		config Config
+		status int
+		err    error
+	}{
+		{Config{Protocol: ProtocolHTTP, Target: "example.com:8388"}, http.StatusOK, ErrAuthFailed},
+		{Config{Protocol: ProtocolHTTP, Target: "example.com:8388", Username: "user", Password: "wrong"}, http.StatusOK, ErrAuthFailed},
+		{Config{Protocol: ProtocolHTTP, Target: "example.com:8388", Username: "user", Password: "pass"}, http.StatusBadGateway, ErrRejected},
+	} {
+		p, _ := New(tc.config)
+		if _, err := p.WrapConn(serveProxy(t, httpProxy("example.com:8388", "Basic dXNlcjpwYXNz", tc.status))); !errors.Is(err, tc.err) {
+			t.Errorf("Expected %v for %+v, got %v", tc.err, tc.config, err)
+		}
+	}
+	_, err = p.WrapConn(serveProxy(t, func(conn net.Conn) error {
+		http.ReadRequest(bufio.NewReader(conn))
+		io.WriteString(conn, "SSH-2.0-OpenSSH\r\n\r\n")
+		return errors.New("not a proxy")
+	}))
+	if !errors.Is(err, ErrBadReply) {
+		t.Errorf("Expected ErrBadReply, got %v", err)
+	}
+}
+
+func TestWrapConn_SOCKS5(t *testing.T) {
+	domain := append([]byte{3, 11}, "example.com"...)
+	domain = binary.BigEndian.AppendUint16(domain, 8388)
+	ipv4 := binary.BigEndian.AppendUint16([]byte{1, 192, 0, 2, 1}, 443)
+	ipv6 := append([]byte{4}, net.ParseIP("2001:db8::1")...)
+	ipv6 = binary.BigEndian.AppendUint16(ipv6, 443)
+	for _, tc := range []struct {
+		config Config
+		target []byte
+	}{
+		{Config{Target: "example.com:8388", Username: "user", Password: "pass"}, domain},
+		{Config{Target: "192.0.2.1:443"}, ipv4},
+		{Config{Target: "[2001:db8::1]:443"}, ipv6},
+	} {
+		tc.config.Protocol = ProtocolSOCKS5
+		p, err := New(tc.config)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		credentials := ""
+		if tc.config.Username != "" {
+			credentials = "user:pass"
+		}
+		conn, err := p.WrapConn(serveProxy(t, socksProxy(tc.target, credentials, 0)))
+		if err != nil {
+			t.Fatalf("WrapConn to %s failed: %v", tc.config.Target, err)
+		}
+		expectEcho(t, conn, "")
+	}
+
+	for _, tc := range []struct {
+		config Config
+		code   byte
+		err    error
+	}{
+		{Config{Protocol: ProtocolSOCKS5, Target: "example.com:8388"}, 0, ErrAuthFailed},
+		{Config{Protocol: ProtocolSOCKS5, Target: "example.com:8388", Username: "user", Password: "wrong"}, 0, ErrAuthFailed},
+		{Config{Protocol: ProtocolSOCKS5, Target: "example.com:8388", Username: "user", Password: "pass"}, 5, ErrRejected},
+	} {
+		p, _ := New(tc.config)
+		if _, err := p.WrapConn(serveProxy(t, socksProxy(domain, "user:pass", tc.code))); !errors.Is(err, tc.err) {
+			t.Errorf("Expected %v for %+v, got %v", tc.err, tc.config, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package shadowtls
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+const (
+	recordHeaderSize = 5
+	macHeaderSize    = recordHeaderSize + hmacSize
+	maxRecordPayload = 16384
+
+	recordAlert           = 21
+	recordHandshake       = 22
+	recordApplicationData = 23
+
+	typeServerHello = 2
+	// serverRandomOffset is where the random starts in a record carrying a
+	// ServerHello: the record header, message type, length and version.
+	serverRandomOffset = recordHeaderSize + 1 + 3 + 2
+	serverRandomSize   = 32
+)
+
+// ErrBadRecord means a record of the data stream failed authentication or
+// had an unexpected type.
+var ErrBadRecord = errors.New("shadowtls: bad record")
+
+// handshakeConn hands the records of the handshake to the TLS client one
+// at a time. It takes the server random from the ServerHello, and strips
+// the tag and the mask from the application data records the ShadowTLS
+// server modified, remembering whether the last one was.
+type handshakeConn struct {
+	v1net.Conn
+	password     string
+	record       []byte
+	serverRandom []byte
+	readMAC      hash.Hash
+	maskKey      []byte
+	authorized   bool
+}
+
+func (c *handshakeConn) Read(p []byte) (int, error) {
+	if len(c.record) == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.record)
+	c.record = c.record[n:]
+	return n, nil
+}
+
+func (c *handshakeConn) readRecord() error {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return err
+	}
+	record := make([]byte, recordHeaderSize+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(c.Conn, record[recordHeaderSize:]); err != nil {
+		return err
+	}
+	switch record[0] {
+	case recordHandshake:
+		if len(record) > serverRandomOffset+serverRandomSize && record[recordHeaderSize] == typeServerHello {
+			c.serverRandom = record[serverRandomOffset : serverRandomOffset+serverRandomSize : serverRandomOffset+serverRandomSize]
+			c.readMAC = hmac.New(sha1.New, []byte(c.password))
+			c.readMAC.Write(c.serverRandom)
+			c.maskKey = kdf(c.password, c.serverRandom)
+		}
+	case recordApplicationData:
+		c.authorized = false
+		if len(record) > macHeaderSize && c.readMAC != nil {
+			c.readMAC.Write(record[macHeaderSize:])
+			if hmac.Equal(c.readMAC.Sum(nil)[:hmacSize], record[recordHeaderSize:macHeaderSize]) {
+				xorSlice(record[macHeaderSize:], c.maskKey)
+				// move the header over the tag
+				copy(record[hmacSize:], record[:recordHeaderSize])
+				record = record[hmacSize:]
+				binary.BigEndian.PutUint16(record[3:], uint16(len(record)-recordHeaderSize))
+				c.authorized = true
+			}
+		}
+	}
+	c.record = record
+	return nil
+}
+
+// Conn is the data stream that follows the handshake. Every record carries
+// the first bytes of a running HMAC of the stream, keyed by the password
+// and seeded with the server random, one per direction. Records the site
+// sent after the handshake, tagged like those of the handshake, are
+// skipped. Records are reassembled across EAGAINs.
+type Conn struct {
+	v1net.Conn
+	writeMAC  hash.Hash
+	verifyMAC hash.Hash
+	ignoreMAC hash.Hash
+
+	header   [recordHeaderSize]byte
+	headerN  int
+	payload  []byte
+	payloadN int
+	inbound  []byte
+}
+
+func newConn(conn v1net.Conn, password string, serverRandom []byte, ignoreMAC hash.Hash) *Conn {
+	writeMAC := hmac.New(sha1.New, []byte(password))
+	writeMAC.Write(serverRandom)
+	writeMAC.Write([]byte("C"))
+	verifyMAC := hmac.New(sha1.New, []byte(password))
+	verifyMAC.Write(serverRandom)
+	verifyMAC.Write([]byte("S"))
+	return &Conn{Conn: conn, writeMAC: writeMAC, verifyMAC: verifyMAC, ignoreMAC: ignoreMAC}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	var out []byte
+	for data := p; len(data) > 0; {
+		size := min(len(data), maxRecordPayload)
+		out = append(out, recordApplicationData, 3, 3)
+		out = binary.BigEndian.AppendUint16(out, uint16(hmacSize+size))
+		c.writeMAC.Write(data[:size])
+		tag := c.writeMAC.Sum(nil)[:hmacSize]
+		c.writeMAC.Write(tag)
+		out = append(out, tag...)
+		out = append(out, data[:size]...)
+		data = data[size:]
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Conn) Read(p []byte) (n int, err error) {
+	for len(c.inbound) == 0 {
+		if err = c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, c.inbound)
+	c.inbound = c.inbound[n:]
+	return
+}
+
+// readRecord reads the next record into inbound, keeping what it read so
+// far when the conn returns EAGAIN.
+func (c *Conn) readRecord() error {
+	for c.headerN < recordHeaderSize {
+		n, err := c.Conn.Read(c.header[c.headerN:])
+		c.headerN += n
+		if c.headerN < recordHeaderSize && err != nil {
+			return err
+		}
+		if c.headerN == recordHeaderSize {
+			c.payload = make([]byte, binary.BigEndian.Uint16(c.header[3:]))
+			c.payloadN = 0
+		}
+	}
+	for c.payloadN < len(c.payload) {
+		n, err := c.Conn.Read(c.payload[c.payloadN:])
+		c.payloadN += n
+		if c.payloadN < len(c.payload) && err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	c.headerN = 0
+	switch c.header[0] {
+	case recordAlert:
+		return fmt.Errorf("%w: alert from the server", net.ErrClosed)
+	case recordApplicationData:
+	default:
+		return fmt.Errorf("%w: record type %d", ErrBadRecord, c.header[0])
+	}
+	if c.ignoreMAC != nil {
+		if verifyRecord(c.ignoreMAC, c.header[:], c.payload, false) {
+			return nil
+		}
+		c.ignoreMAC = nil
+	}
+	if !verifyRecord(c.verifyMAC, c.header[:], c.payload, true) {
+		return fmt.Errorf("%w: authentication failed", ErrBadRecord)
+	}
+	c.inbound = c.payload[hmacSize:]
+	return nil
+}
+
+// verifyRecord checks the tag of a record against mac, then feeds the tag
+// back into mac when update is set, as the data stream does.
+func verifyRecord(mac hash.Hash, header, payload []byte, update bool) bool {
+	if header[1] != 3 || header[2] != 3 || len(payload) < hmacSize {
+		return false
+	}
+	mac.Write(payload[hmacSize:])
+	tag := mac.Sum(nil)[:hmacSize]
+	if update {
+		mac.Write(tag)
+	}
+	return bytes.Equal(payload[:hmacSize], tag)
+}
@@ -0,0 +1,112 @@
+// Package shadowtls hides the shadowsocks stream behind a real TLS
+// handshake with a legitimate site, using version 3 of the ShadowTLS
+// protocol. The client tags its ClientHello so the ShadowTLS server lets
+// the handshake through to the site, checks that the server answered with
+// records only it can tag, then switches to application data records
+// authenticated with the password. It is registered as the "shadow-tls"
+// plugin.
+package shadowtls
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	"github.com/getlantern/tiny-shadowsocks/internal/tls13"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+const hmacSize = 4
+
+// ErrUnauthorized means the server did not prove it knows the password,
+// which happens when the handshake reached the site without going through
+// a ShadowTLS server.
+var ErrUnauthorized = errors.New("shadowtls: server not authenticated")
+
+func init() {
+	plugin.Register("shadow-tls", parseOptions)
+}
+
+// Config describes the ShadowTLS client.
+type Config struct {
+	// Password is shared with the ShadowTLS server.
+	Password string
+	// ServerName is the SNI of the handshake, the site the server relays
+	// it to.
+	ServerName string
+}
+
+// Plugin runs a ShadowTLS handshake on every conn it wraps.
+type Plugin struct {
+	config Config
+}
+
+// New returns a plugin for the server described by config.
+func New(config Config) (*Plugin, error) {
+	if config.Password == "" {
+		return nil, fmt.Errorf("%w: missing password", plugin.ErrInvalidOptions)
+	}
+	if config.ServerName == "" {
+		return nil, fmt.Errorf("%w: missing server name", plugin.ErrInvalidOptions)
+	}
+	return &Plugin{config: config}, nil
+}
+
+// parseOptions builds the plugin from the options of the shadow-tls
+// binary: "host" is the SNI and "passwd" the password. Only version 3 is
+// implemented, so "v3" is accepted and implied.
+func parseOptions(opts plugin.Options) (plugin.Plugin, error) {
+	return New(Config{Password: opts.Get("passwd", ""), ServerName: opts.Get("host", "")})
+}
+
+// WrapConn runs the handshake over conn, which still blocks, and returns
+// the authenticated data stream.
+func (p *Plugin) WrapConn(conn v1net.Conn) (v1net.Conn, error) {
+	handshake := &handshakeConn{Conn: conn, password: p.config.Password}
+	_, err := tls13.Handshake(handshake, &tls13.Config{
+		ServerName: p.config.ServerName,
+		SessionID:  p.sessionID,
+		// the server proves itself with the tags of the handshake records,
+		// the certificate is the site's
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !handshake.authorized {
+		return nil, ErrUnauthorized
+	}
+	return newConn(conn, p.config.Password, handshake.serverRandom, handshake.readMAC), nil
+}
+
+// sessionID fills the session ID with random bytes followed by the first
+// bytes of the HMAC of the ClientHello, computed while the tag is still
+// zeroed.
+func (p *Plugin) sessionID(hello, sessionID []byte) error {
+	if _, err := rand.Read(sessionID[:len(sessionID)-hmacSize]); err != nil {
+		return err
+	}
+	mac := hmac.New(sha1.New, []byte(p.config.Password))
+	mac.Write(hello)
+	copy(sessionID[len(sessionID)-hmacSize:], mac.Sum(nil))
+	return nil
+}
+
+// kdf derives the key the server masks the application data of the
+// handshake with.
+func kdf(password string, serverRandom []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(password))
+	h.Write(serverRandom)
+	return h.Sum(nil)
+}
+
+func xorSlice(data, key []byte) {
+	for i := range data {
+		data[i] ^= key[i%len(key)]
+	}
+}
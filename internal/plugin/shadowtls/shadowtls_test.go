@@ -0,0 +1,303 @@
+package shadowtls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/conntest"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+// serveHandshake starts a fake handshake server, a crypto/tls server for
+// server name that completes handshakes and nothing else.
+func serveHandshake(t *testing.T, name string) string {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+	record := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, err
+	}
+	record = append(record, make([]byte, binary.BigEndian.Uint16(record[3:]))...)
+	_, err := io.ReadFull(r, record[recordHeaderSize:])
+	return record, err
+}
+
+// tagRecord frames data as an application data record tagged with mac.
+func tagRecord(mac hash.Hash, data []byte) []byte {
+	mac.Write(data)
+	tag := mac.Sum(nil)[:hmacSize]
+	mac.Write(tag)
+	record := binary.BigEndian.AppendUint16([]byte{recordApplicationData, 3, 3}, uint16(hmacSize+len(data)))
+	return append(append(record, tag...), data...)
+}
+
+// serveShadowTLS starts a stand-in ShadowTLS v3 server relaying the
+// handshake to handshakeAddr. Once the client is authenticated it echoes
+// the data stream. A ClientHello without a valid tag is relayed as is, as
+// a real server would.
+func serveShadowTLS(t *testing.T, password, handshakeAddr string) v1net.Conn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		site, err := net.Dial("tcp", handshakeAddr)
+		if err != nil {
+			return
+		}
+		defer site.Close()
+		hello, err := readRecord(conn)
+		if err != nil {
+			return
+		}
+		site.Write(hello)
+		const sessionIDOffset = recordHeaderSize + 1 + 3 + 2 + 32 + 1
+		tag := bytes.Clone(hello[sessionIDOffset+28 : sessionIDOffset+32])
+		clear(hello[sessionIDOffset+28 : sessionIDOffset+32])
+		mac := hmac.New(sha1.New, []byte(password))
+		mac.Write(hello[recordHeaderSize:])
+		if !hmac.Equal(mac.Sum(nil)[:hmacSize], tag) {
+			go io.Copy(site, conn)
+			io.Copy(conn, site)
+			return
+		}
+
+		serverRandom := make(chan []byte, 1)
+		relayed := make(chan struct{})
+		go func() {
+			defer close(relayed)
+			var handshakeMAC hash.Hash
+			var maskKey []byte
+			for {
+				record, err := readRecord(site)
+				if err != nil {
+					return
+				}
+				switch {
+				case record[0] == recordHandshake && record[recordHeaderSize] == typeServerHello:
+					random := record[serverRandomOffset : serverRandomOffset+serverRandomSize]
+					serverRandom <- random
+					handshakeMAC = hmac.New(sha1.New, []byte(password))
+					handshakeMAC.Write(random)
+					maskKey = kdf(password, random)
+				case record[0] == recordApplicationData && handshakeMAC != nil:
+					data := record[recordHeaderSize:]
+					xorSlice(data, maskKey)
+					handshakeMAC.Write(data)
+					modified := binary.BigEndian.AppendUint16([]byte{recordApplicationData, 3, 3}, uint16(hmacSize+len(data)))
+					record = append(append(modified, handshakeMAC.Sum(nil)[:hmacSize]...), data...)
+				}
+				conn.Write(record)
+			}
+		}()
+
+		random := <-serverRandom
+		newMAC := func(direction string) hash.Hash {
+			mac := hmac.New(sha1.New, []byte(password))
+			mac.Write(random)
+			mac.Write([]byte(direction))
+			return mac
+		}
+		var clientMAC hash.Hash
+		var record []byte
+		for {
+			if record, err = readRecord(conn); err != nil {
+				return
+			}
+			if record[0] == recordApplicationData {
+				clientMAC = newMAC("C")
+				if verifyRecord(clientMAC, record, record[recordHeaderSize:], true) {
+					break
+				}
+			}
+			site.Write(record)
+		}
+		// let the records the site already sent reach the client first
+		site.Close()
+		<-relayed
+
+		serverMAC := newMAC("S")
+		for {
+			// echo in two records
+			data := record[macHeaderSize:]
+			conn.Write(append(tagRecord(serverMAC, data[:len(data)/2]), tagRecord(serverMAC, data[len(data)/2:])...))
+			if record, err = readRecord(conn); err != nil {
+				return
+			}
+			if !verifyRecord(clientMAC, record, record[recordHeaderSize:], true) {
+				return
+			}
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &conntest.NetConn{Conn: conn}
+}
+
+func TestStandInServer(t *testing.T) {
+	handshakeAddr := serveHandshake(t, "www.example.com")
+	p, err := New(Config{Password: "secret", ServerName: "www.example.com"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	conn, err := p.WrapConn(serveShadowTLS(t, "secret", handshakeAddr))
+	if err != nil {
+		t.Fatalf("WrapConn failed: %v", err)
+	}
+	for _, payload := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("x"), 40000)} {
+		if n, err := conn.Write(payload); err != nil || n != len(payload) {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+		echoed := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, echoed); err != nil {
+			t.Fatalf("ReadFull failed: %v", err)
+		}
+		if !bytes.Equal(echoed, payload) {
+			t.Fatalf("Expected %d bytes to be echoed", len(payload))
+		}
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	handshakeAddr := serveHandshake(t, "www.example.com")
+	p, _ := New(Config{Password: "wrong", ServerName: "www.example.com"})
+	// the handshake reaches the site untouched, so it succeeds, but the
+	// server never proves it knows the password
+	if _, err := p.WrapConn(serveShadowTLS(t, "secret", handshakeAddr)); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized, got %v", err)
+	}
+}
+
+func TestNonBlockingRead(t *testing.T) {
+	serverRandom := bytes.Repeat([]byte{7}, serverRandomSize)
+	newMAC := func(direction string) hash.Hash {
+		mac := hmac.New(sha1.New, []byte("secret"))
+		mac.Write(serverRandom)
+		mac.Write([]byte(direction))
+		return mac
+	}
+	handshakeMAC := hmac.New(sha1.New, []byte("secret"))
+	handshakeMAC.Write(serverRandom)
+	ignoreMAC := hmac.New(sha1.New, []byte("secret"))
+	ignoreMAC.Write(serverRandom)
+
+	// a session ticket tagged like the handshake, then two data records
+	ticket := []byte("ticket")
+	handshakeMAC.Write(ticket)
+	stream := binary.BigEndian.AppendUint16([]byte{recordApplicationData, 3, 3}, uint16(hmacSize+len(ticket)))
+	stream = append(append(stream, handshakeMAC.Sum(nil)[:hmacSize]...), ticket...)
+	serverMAC := newMAC("S")
+	stream = append(stream, tagRecord(serverMAC, []byte("first"))...)
+	stream = append(stream, tagRecord(serverMAC, []byte("second"))...)
+	raw := &conntest.ScriptedConn{}
+	for len(stream) > 0 {
+		size := min(len(stream), 3)
+		raw.Reads = append(raw.Reads, stream[:size])
+		stream = stream[size:]
+	}
+	conn := newConn(raw, "secret", serverRandom, ignoreMAC)
+
+	var got []byte
+	buffer := make([]byte, 4)
+	for {
+		n, err := conn.Read(buffer)
+		got = append(got, buffer[:n]...)
+		if errors.Is(err, syscall.EAGAIN) {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if string(got) != "firstsecond" {
+		t.Errorf("Expected the records reassembled across EAGAINs without the ticket, got %q", got)
+	}
+
+	conn.Write([]byte("data"))
+	if !bytes.Equal(raw.Written.Bytes(), tagRecord(newMAC("C"), []byte("data"))) {
+		t.Errorf("Unexpected record %x", raw.Written.Bytes())
+	}
+
+	raw.Reads = [][]byte{tagRecord(newMAC("X"), []byte("forged"))}
+	_, err := conn.Read(buffer)
+	for errors.Is(err, syscall.EAGAIN) {
+		_, err = conn.Read(buffer)
+	}
+	if !errors.Is(err, ErrBadRecord) {
+		t.Errorf("Expected ErrBadRecord, got %v", err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	if _, err := plugin.New("shadow-tls", "host=www.example.com;passwd=secret;v3"); err != nil {
+		t.Errorf("Expected the options to be accepted, got %v", err)
+	}
+	for _, opts := range []string{"host=www.example.com", "passwd=secret"} {
+		if _, err := plugin.New("shadow-tls", opts); !errors.Is(err, plugin.ErrInvalidOptions) {
+			t.Errorf("Expected %q to be rejected, got %v", opts, err)
+		}
+	}
+}
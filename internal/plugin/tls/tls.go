@@ -0,0 +1,90 @@
+// Package tls wraps the conn to the server in TLS 1.3, for servers behind
+// a TLS terminator such as stunnel and for the transports that run over
+// HTTPS. The handshake is the one of internal/tls13.
+package tls
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	"github.com/getlantern/tiny-shadowsocks/internal/tls13"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+// Config describes the TLS client.
+type Config struct {
+	// ServerName is sent as SNI and must be a name of the certificate.
+	ServerName string
+	// NextProtos are offered with ALPN.
+	NextProtos []string
+	// RootCAs is a PEM bundle of the authorities the certificate must
+	// chain to. Without it the system roots are used, which a WATM usually
+	// does not have.
+	RootCAs []byte
+	// PinnedSHA256 are the hex SHA-256 digests of accepted certificates,
+	// colons allowed. The server is trusted when its leaf is one of them or
+	// is signed through its chain by one of them, in place of the roots.
+	// A leaf that is not pinned itself still has to match ServerName.
+	PinnedSHA256 []string
+	// InsecureSkipVerify accepts any certificate. It is meant for tests.
+	InsecureSkipVerify bool
+}
+
+// Plugin runs a TLS handshake on every conn it wraps.
+type Plugin struct {
+	config *tls13.Config
+}
+
+// New returns a plugin verifying the server as described by config.
+func New(config Config) (*Plugin, error) {
+	tlsConfig := &tls13.Config{
+		ServerName:         config.ServerName,
+		NextProtos:         config.NextProtos,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if len(config.RootCAs) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(config.RootCAs) {
+			return nil, fmt.Errorf("%w: no certificate in the CA bundle", plugin.ErrInvalidOptions)
+		}
+	}
+	for _, pin := range config.PinnedSHA256 {
+		digest, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(digest) != 32 {
+			return nil, fmt.Errorf("%w: pinned digest %q is not a hex SHA-256", plugin.ErrInvalidOptions, pin)
+		}
+		tlsConfig.PinnedSHA256 = append(tlsConfig.PinnedSHA256, digest)
+	}
+	if config.ServerName == "" && len(tlsConfig.PinnedSHA256) == 0 && !config.InsecureSkipVerify {
+		return nil, fmt.Errorf("%w: missing server name", plugin.ErrInvalidOptions)
+	}
+	return &Plugin{config: tlsConfig}, nil
+}
+
+// WrapConn runs the handshake over conn, which still blocks.
+func (p *Plugin) WrapConn(conn v1net.Conn) (v1net.Conn, error) {
+	state, err := tls13.Handshake(conn, p.config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, err := tls13.NewConn(conn, state)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, tls: tlsConn}, nil
+}
+
+// Conn carries the stream in TLS application data records.
+type Conn struct {
+	v1net.Conn
+	tls *tls13.Conn
+}
+
+func (c *Conn) Read(p []byte) (int, error)  { return c.tls.Read(p) }
+func (c *Conn) Write(p []byte) (int, error) { return c.tls.Write(p) }
+
+// CloseWrite implements N.WriteCloser with a close_notify alert.
+func (c *Conn) CloseWrite() error { return c.tls.CloseWrite() }
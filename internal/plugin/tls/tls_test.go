@@ -0,0 +1,170 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	gotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/conntest"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	"github.com/getlantern/tiny-shadowsocks/internal/tls13"
+)
+
+// testCA returns a PEM CA and a server certificate it issued for name.
+func testCA(t *testing.T, name string) ([]byte, gotls.Certificate) {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create the CA: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create the certificate: %v", err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return caPEM, gotls.Certificate{Certificate: [][]byte{der, caDER}, PrivateKey: key}
+}
+
+// serveEcho starts a TLS server echoing what it reads, offering protos
+// with ALPN, and reports the protocol it negotiated.
+func serveEcho(t *testing.T, certificate gotls.Certificate, protos ...string) (*conntest.NetConn, chan string) {
+	t.Helper()
+	listener, err := gotls.Listen("tcp", "127.0.0.1:0", &gotls.Config{
+		Certificates: []gotls.Certificate{certificate},
+		NextProtos:   protos,
+	})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	negotiated := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if conn.(*gotls.Conn).Handshake() != nil {
+			return
+		}
+		negotiated <- conn.(*gotls.Conn).ConnectionState().NegotiatedProtocol
+		io.Copy(conn, conn)
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &conntest.NetConn{Conn: conn}, negotiated
+}
+
+func TestStandInServer(t *testing.T) {
+	caPEM, certificate := testCA(t, "tls.example.com")
+	p, err := New(Config{ServerName: "tls.example.com", NextProtos: []string{"h2"}, RootCAs: caPEM})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	raw, negotiated := serveEcho(t, certificate, "http/1.1", "h2")
+	conn, err := p.WrapConn(raw)
+	if err != nil {
+		t.Fatalf("WrapConn failed: %v", err)
+	}
+	if protocol := <-negotiated; protocol != "h2" {
+		t.Errorf("Expected h2 to be negotiated, got %q", protocol)
+	}
+
+	// records are reassembled across EAGAINs once the conn is non-blocking
+	raw.Flaky = true
+	payload := bytes.Repeat([]byte("x"), 20000)
+	if n, err := conn.Write(payload); err != nil || n != len(payload) {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	var echoed []byte
+	buffer := make([]byte, 4096)
+	for len(echoed) < len(payload) {
+		n, err := conn.Read(buffer)
+		if err != nil && !errors.Is(err, syscall.EAGAIN) {
+			t.Fatalf("Read failed: %v", err)
+		}
+		echoed = append(echoed, buffer[:n]...)
+	}
+	if !bytes.Equal(echoed, payload) {
+		t.Errorf("Expected %d bytes to be echoed, got %d", len(payload), len(echoed))
+	}
+}
+
+func TestVerification(t *testing.T) {
+	caPEM, certificate := testCA(t, "tls.example.com")
+	otherPEM, _ := testCA(t, "tls.example.com")
+	pin := sha256.Sum256(certificate.Certificate[0])
+	for _, tc := range []struct {
+		name     string
+		config   Config
+		expected error
+	}{
+		{"other CA", Config{ServerName: "tls.example.com", RootCAs: otherPEM}, tls13.ErrVerify},
+		{"wrong name", Config{ServerName: "example.org", RootCAs: caPEM}, tls13.ErrVerify},
+		{"pinned", Config{ServerName: "127.0.0.1", PinnedSHA256: []string{hex.EncodeToString(pin[:])}}, nil},
+		{"insecure", Config{InsecureSkipVerify: true}, nil},
+	} {
+		p, err := New(tc.config)
+		if err != nil {
+			t.Fatalf("%s: New failed: %v", tc.name, err)
+		}
+		raw, _ := serveEcho(t, certificate)
+		if _, err = p.WrapConn(raw); !errors.Is(err, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, config := range []Config{
+		{},
+		{ServerName: "tls.example.com", RootCAs: []byte("not a certificate")},
+		{ServerName: "tls.example.com", PinnedSHA256: []string{"abcd"}},
+	} {
+		if _, err := New(config); !errors.Is(err, plugin.ErrInvalidOptions) {
+			t.Errorf("Expected %+v to be rejected, got %v", config, err)
+		}
+	}
+	colons := bytes.Repeat([]byte("ab:"), 32)
+	if _, err := New(Config{PinnedSHA256: []string{string(colons[:len(colons)-1])}}); err != nil {
+		t.Errorf("Expected a pin with colons to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	finalBit = 0x80
+	maskBit  = 0x80
+
+	maxResponseHeaderSize = 8 * 1024
+	maxControlPayload     = 125
+
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var (
+	// ErrBadHandshake means the server did not accept the upgrade.
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	// ErrBadFrame means the server sent a frame a client cannot accept.
+	ErrBadFrame = errors.New("websocket: bad frame")
+)
+
+// Conn is a client WebSocket connection. Writes go out as masked binary
+// frames and reads return the payload of the data frames, answering pings
+// on the way. Frame headers are reassembled across EAGAINs, so the conn
+// keeps working once it is switched to non-blocking mode.
+type Conn struct {
+	v1net.Conn
+	config      *Config
+	nonBlocking bool
+
+	key      string
+	sent     bool
+	upgraded bool
+	closed   bool
+	response []byte
+	pending  []byte
+	queued   []byte
+
+	header    [14]byte
+	headerN   int
+	opcode    byte
+	remaining uint64
+	control   []byte
+}
+
+// SetNonBlock records the mode, since writes issued before the upgrade
+// completes wait for it only when the conn blocks.
+func (c *Conn) SetNonBlock(nonblocking bool) error {
+	c.nonBlocking = nonblocking
+	return c.Conn.SetNonBlock(nonblocking)
+}
+
+// handshake sends the upgrade request, carrying earlyData in the
+// Sec-WebSocket-Protocol header, and reads the response unless the conn
+// is non-blocking, in which case Read finishes it.
+func (c *Conn) handshake(earlyData []byte) error {
+	var key [16]byte
+	rand.Read(key[:])
+	c.key = base64.StdEncoding.EncodeToString(key[:])
+	request := fmt.Appendf(nil, "GET %s HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Sec-WebSocket-Version: 13\r\n",
+		c.config.Path, c.config.Host, c.key)
+	if len(earlyData) > 0 {
+		request = fmt.Appendf(request, "Sec-WebSocket-Protocol: %s\r\n", base64.RawURLEncoding.EncodeToString(earlyData))
+	}
+	names := make([]string, 0, len(c.config.Headers))
+	for name := range c.config.Headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		request = fmt.Appendf(request, "%s: %s\r\n", name, c.config.Headers[name])
+	}
+	request = append(request, "\r\n"...)
+	if _, err := c.Conn.Write(request); err != nil {
+		return err
+	}
+	c.sent = true
+	if c.nonBlocking {
+		return nil
+	}
+	return c.readResponse()
+}
+
+// readResponse reads the upgrade response, keeping what it read so far
+// when the conn returns EAGAIN, then sends the frames queued meanwhile.
+func (c *Conn) readResponse() error {
+	var scratch [1024]byte
+	for {
+		n, err := c.Conn.Read(scratch[:])
+		c.response = append(c.response, scratch[:n]...)
+		if end := bytes.Index(c.response, []byte("\r\n\r\n")); end >= 0 {
+			if err := c.checkResponse(c.response[:end]); err != nil {
+				return err
+			}
+			c.pending = c.response[end+4:]
+			c.response = nil
+			c.upgraded = true
+			if len(c.queued) > 0 {
+				queued := c.queued
+				c.queued = nil
+				if _, err := c.Conn.Write(queued); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if len(c.response) > maxResponseHeaderSize {
+			return fmt.Errorf("%w: response header exceeds %d bytes", ErrBadHandshake, maxResponseHeaderSize)
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+}
+
+func (c *Conn) checkResponse(header []byte) error {
+	lines := bytes.Split(header, []byte("\r\n"))
+	if !bytes.HasPrefix(lines[0], []byte("HTTP/1.1 101")) {
+		return fmt.Errorf("%w: %q", ErrBadHandshake, lines[0])
+	}
+	digest := sha1.Sum([]byte(c.key + acceptGUID))
+	expected := base64.StdEncoding.EncodeToString(digest[:])
+	for _, line := range lines[1:] {
+		name, value, _ := bytes.Cut(line, []byte(":"))
+		if bytes.EqualFold(bytes.TrimSpace(name), []byte("Sec-WebSocket-Accept")) {
+			if string(bytes.TrimSpace(value)) != expected {
+				return fmt.Errorf("%w: wrong Sec-WebSocket-Accept", ErrBadHandshake)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: missing Sec-WebSocket-Accept", ErrBadHandshake)
+}
+
+func (c *Conn) Write(p []byte) (n int, err error) {
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	frames := p
+	if !c.sent {
+		early := p[:min(len(p), c.config.EarlyData)]
+		if err = c.handshake(early); err != nil {
+			return 0, err
+		}
+		frames = p[len(early):]
+	}
+	if len(frames) == 0 {
+		return len(p), nil
+	}
+	frame := appendFrame(nil, opBinary, frames)
+	if !c.upgraded {
+		if c.nonBlocking {
+			c.queued = append(c.queued, frame...)
+			return len(p), nil
+		}
+		if err = c.readResponse(); err != nil {
+			return 0, err
+		}
+	}
+	if _, err = c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// appendFrame appends a final, masked client frame.
+func appendFrame(b []byte, opcode byte, payload []byte) []byte {
+	b = append(b, finalBit|opcode)
+	switch length := len(payload); {
+	case length <= 125:
+		b = append(b, maskBit|byte(length))
+	case length <= 0xffff:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(length))
+	}
+	var mask [4]byte
+	rand.Read(mask[:])
+	b = append(b, mask[:]...)
+	start := len(b)
+	b = append(b, payload...)
+	for i := range payload {
+		b[start+i] ^= mask[i%4]
+	}
+	return b
+}
+
+// readRaw reads what the server sent, starting with whatever followed the
+// upgrade response.
+func (c *Conn) readRaw(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *Conn) Read(p []byte) (n int, err error) {
+	if c.closed {
+		return 0, io.EOF
+	}
+	if !c.upgraded {
+		if !c.sent {
+			return 0, fmt.Errorf("%w: read before the upgrade request", ErrBadHandshake)
+		}
+		if err = c.readResponse(); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		if c.remaining > 0 && c.opcode < opClose {
+			n, err = c.readRaw(p[:min(uint64(len(p)), c.remaining)])
+			c.remaining -= uint64(n)
+			return
+		}
+		if c.remaining > 0 {
+			var scratch [maxControlPayload]byte
+			readN, readErr := c.readRaw(scratch[:c.remaining])
+			c.control = append(c.control, scratch[:readN]...)
+			c.remaining -= uint64(readN)
+			if c.remaining > 0 {
+				if readErr == nil {
+					continue
+				}
+				return 0, readErr
+			}
+			if err = c.handleControl(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		headerSize := c.headerSize()
+		for c.headerN < headerSize {
+			readN, readErr := c.readRaw(c.header[c.headerN:headerSize])
+			c.headerN += readN
+			if c.headerN < headerSize && readErr != nil {
+				return 0, readErr
+			}
+			headerSize = c.headerSize()
+		}
+		if err = c.nextFrame(headerSize); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// headerSize returns the size of the frame header being read, known once
+// its first 2 bytes are.
+func (c *Conn) headerSize() int {
+	if c.headerN < 2 {
+		return 2
+	}
+	switch c.header[1] & 0x7f {
+	case 126:
+		return 4
+	case 127:
+		return 10
+	}
+	return 2
+}
+
+// nextFrame parses the frame header just read.
+func (c *Conn) nextFrame(headerSize int) error {
+	c.headerN = 0
+	if c.header[1]&maskBit != 0 {
+		return fmt.Errorf("%w: masked server frame", ErrBadFrame)
+	}
+	opcode := c.header[0] & 0x0f
+	switch headerSize {
+	case 2:
+		c.remaining = uint64(c.header[1] & 0x7f)
+	case 4:
+		c.remaining = uint64(binary.BigEndian.Uint16(c.header[2:]))
+	default:
+		c.remaining = binary.BigEndian.Uint64(c.header[2:])
+	}
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		// fragments of a message carry stream bytes like whole messages
+		c.opcode = opBinary
+	case opClose, opPing, opPong:
+		if c.remaining > maxControlPayload || c.header[0]&finalBit == 0 {
+			return fmt.Errorf("%w: oversized or fragmented control frame", ErrBadFrame)
+		}
+		c.opcode = opcode
+		c.control = c.control[:0]
+		if c.remaining == 0 {
+			return c.handleControl()
+		}
+	default:
+		return fmt.Errorf("%w: opcode %#x", ErrBadFrame, opcode)
+	}
+	return nil
+}
+
+func (c *Conn) handleControl() error {
+	opcode := c.opcode
+	c.opcode = opBinary
+	switch opcode {
+	case opPing:
+		_, err := c.Conn.Write(appendFrame(nil, opPong, c.control))
+		return err
+	case opClose:
+		c.closed = true
+		c.Conn.Write(appendFrame(nil, opClose, c.control[:min(len(c.control), 2)]))
+		return io.EOF
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Package websocket carries the shadowsocks stream in the binary frames of
+// a WebSocket connection, the way v2ray-plugin does in its default mode.
+// It is registered as the "v2ray-plugin" plugin.
+package websocket
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+const (
+	defaultHost = "cloudfront.com"
+	defaultPath = "/"
+)
+
+func init() {
+	plugin.Register("v2ray-plugin", parseOptions)
+}
+
+// Config describes the upgrade request.
+type Config struct {
+	// Host is sent in the Host header.
+	Host string
+	// Path is the request target, query included.
+	Path string
+	// Headers are added to the upgrade request.
+	Headers map[string]string
+	// EarlyData is the most bytes of the first write sent base64-encoded
+	// in the Sec-WebSocket-Protocol header, saving a round trip. Zero
+	// sends the upgrade request on its own and waits for the response.
+	EarlyData int
+}
+
+// Plugin opens a WebSocket connection on every conn it wraps.
+type Plugin struct {
+	config Config
+}
+
+// New returns a plugin upgrading conns as described by config, with the
+// host and path defaulting to those of v2ray-plugin.
+func New(config Config) (*Plugin, error) {
+	if config.Host == "" {
+		config.Host = defaultHost
+	}
+	if config.Path == "" {
+		config.Path = defaultPath
+	}
+	if config.Path[0] != '/' {
+		return nil, fmt.Errorf("%w: path %q does not start with /", plugin.ErrInvalidOptions, config.Path)
+	}
+	if config.EarlyData < 0 {
+		return nil, fmt.Errorf("%w: negative early data size %d", plugin.ErrInvalidOptions, config.EarlyData)
+	}
+	return &Plugin{config: config}, nil
+}
+
+// parseOptions builds the plugin from v2ray-plugin options. Only the
+// websocket mode without TLS is supported, and "mux" is ignored since
+// v2ray-plugin servers accept plain streams either way. "ed" sets the
+// early data size.
+func parseOptions(opts plugin.Options) (plugin.Plugin, error) {
+	if mode := opts.Get("mode", "websocket"); mode != "websocket" {
+		return nil, fmt.Errorf("%w: unsupported mode %q", plugin.ErrInvalidOptions, mode)
+	}
+	if opts.Has("tls") {
+		return nil, fmt.Errorf("%w: tls is not supported by v2ray-plugin here", plugin.ErrInvalidOptions)
+	}
+	config := Config{Host: opts.Get("host", ""), Path: opts.Get("path", "")}
+	if ed := opts.Get("ed", ""); ed != "" {
+		earlyData, err := strconv.Atoi(ed)
+		if err != nil {
+			return nil, fmt.Errorf("%w: ed %q: %w", plugin.ErrInvalidOptions, ed, err)
+		}
+		config.EarlyData = earlyData
+	}
+	return New(config)
+}
+
+// WrapConn upgrades conn. Without early data the handshake is done right
+// away, while conn still blocks; servers built on gorilla/websocket, like
+// v2ray-plugin, reject frames that arrive before their response. With
+// early data it waits for the first write instead.
+func (p *Plugin) WrapConn(conn v1net.Conn) (v1net.Conn, error) {
+	c := &Conn{Conn: conn, config: &p.config}
+	if p.config.EarlyData == 0 {
+		if err := c.handshake(nil); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
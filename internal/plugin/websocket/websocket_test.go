@@ -0,0 +1,235 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/conntest"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+// readFrame reads one client frame and unmasks it.
+func readFrame(r io.Reader) (opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		_, err = io.ReadFull(r, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		_, err = io.ReadFull(r, extended[:])
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if header[1]&maskBit == 0 {
+		return 0, nil, errors.New("unmasked client frame")
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0] & 0x0f, payload, nil
+}
+
+// serverFrame builds an unmasked server frame.
+func serverFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{finalBit | opcode}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	return append(frame, payload...)
+}
+
+// serveWebSocket starts a stand-in WebSocket server that pings the client,
+// then echoes the early data and every data frame back. It reports the
+// upgrade request and whether the ping was answered.
+func serveWebSocket(t *testing.T) (v1net.Conn, chan *http.Request, chan bool) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	requests, ponged := make(chan *http.Request, 1), make(chan bool, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		requests <- request
+		digest := sha1.Sum([]byte(request.Header.Get("Sec-WebSocket-Key") + acceptGUID))
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(digest[:]) + "\r\n\r\n"))
+		conn.Write(serverFrame(opPing, []byte("hb")))
+		if early, _ := base64.RawURLEncoding.DecodeString(request.Header.Get("Sec-WebSocket-Protocol")); len(early) > 0 {
+			conn.Write(serverFrame(opBinary, early))
+		}
+		for {
+			opcode, payload, err := readFrame(reader)
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case opPong:
+				ponged <- string(payload) == "hb"
+			case opBinary:
+				// split the echo in a fragmented message
+				half := len(payload) / 2
+				conn.Write(append(append([]byte{opBinary}, serverFrame(opContinuation, payload[:half])[1:]...), serverFrame(opContinuation, payload[half:])...))
+			}
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &conntest.NetConn{Conn: conn}, requests, ponged
+}
+
+func TestStandInServer(t *testing.T) {
+	for _, earlyData := range []int{0, 16} {
+		p, err := New(Config{
+			Host:      "cdn.example.com",
+			Path:      "/ws?id=1",
+			Headers:   map[string]string{"User-Agent": "test-agent"},
+			EarlyData: earlyData,
+		})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		raw, requests, ponged := serveWebSocket(t)
+		conn, err := p.WrapConn(raw)
+		if err != nil {
+			t.Fatalf("WrapConn failed: %v", err)
+		}
+
+		for _, payload := range [][]byte{bytes.Repeat([]byte("a"), 40), bytes.Repeat([]byte("b"), 70000)} {
+			if n, err := conn.Write(payload); err != nil || n != len(payload) {
+				t.Fatalf("Write = %d, %v", n, err)
+			}
+			echoed := make([]byte, len(payload))
+			if _, err := io.ReadFull(conn, echoed); err != nil {
+				t.Fatalf("ReadFull failed: %v", err)
+			}
+			if !bytes.Equal(echoed, payload) {
+				t.Fatalf("Expected %d bytes to be echoed", len(payload))
+			}
+		}
+
+		request := <-requests
+		if request.Host != "cdn.example.com" || request.RequestURI != "/ws?id=1" || request.UserAgent() != "test-agent" {
+			t.Errorf("Unexpected upgrade request %s %s %v", request.Host, request.RequestURI, request.Header)
+		}
+		early, _ := base64.RawURLEncoding.DecodeString(request.Header.Get("Sec-WebSocket-Protocol"))
+		if len(early) != earlyData {
+			t.Errorf("Expected %d bytes of early data, got %d", earlyData, len(early))
+		}
+		if !<-ponged {
+			t.Error("Expected the ping to be answered with its payload")
+		}
+	}
+}
+
+func TestNonBlockingEarlyData(t *testing.T) {
+	p, _ := New(Config{EarlyData: 4})
+	raw := &conntest.ScriptedConn{}
+	conn, _ := p.WrapConn(raw)
+	conn.SetNonBlock(true)
+
+	if n, err := conn.Write([]byte("earlyqueued")); err != nil || n != 11 {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw.Written.Bytes())))
+	if err != nil {
+		t.Fatalf("Expected an upgrade request: %v", err)
+	}
+	if early, _ := base64.RawURLEncoding.DecodeString(request.Header.Get("Sec-WebSocket-Protocol")); string(early) != "earl" {
+		t.Errorf("Expected early data %q, got %q", "earl", early)
+	}
+	requestLen := raw.Written.Len()
+
+	digest := sha1.Sum([]byte(request.Header.Get("Sec-WebSocket-Key") + acceptGUID))
+	response := []byte("HTTP/1.1 101 Switching Protocols\r\nSec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(digest[:]) + "\r\n\r\n")
+	large := serverFrame(opBinary, bytes.Repeat([]byte("z"), 300))
+	raw.Reads = [][]byte{response[:20], response[20:], large[:1], large[1:3], large[3:]}
+
+	var got []byte
+	buffer := make([]byte, 64)
+	for {
+		n, err := conn.Read(buffer)
+		got = append(got, buffer[:n]...)
+		if errors.Is(err, syscall.EAGAIN) {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if !bytes.Equal(got, bytes.Repeat([]byte("z"), 300)) {
+		t.Errorf("Expected the frame to be reassembled across EAGAINs, got %d bytes", len(got))
+	}
+	if opcode, payload, err := readFrame(bytes.NewReader(raw.Written.Bytes()[requestLen:])); err != nil || opcode != opBinary || string(payload) != "yqueued" {
+		t.Errorf("Expected the rest of the write to be sent once upgraded, got %#x %q, %v", opcode, payload, err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	for _, opts := range []string{"", "mode=websocket;host=cdn.example.com;path=/ws;mux=0", "ed=2048"} {
+		if _, err := plugin.New("v2ray-plugin", opts); err != nil {
+			t.Errorf("Expected %q to be accepted, got %v", opts, err)
+		}
+	}
+	for _, opts := range []string{"mode=quic", "tls", "path=ws", "ed=lots"} {
+		if _, err := plugin.New("v2ray-plugin", opts); !errors.Is(err, plugin.ErrInvalidOptions) {
+			t.Errorf("Expected %q to be rejected, got %v", opts, err)
+		}
+	}
+}
+
+func TestBadHandshake(t *testing.T) {
+	p, _ := New(Config{})
+	raw := &conntest.ScriptedConn{Reads: [][]byte{[]byte("HTTP/1.1 101 Switching Protocols\r\nSec-WebSocket-Accept: nope\r\n\r\n")}, Again: true}
+	if _, err := p.WrapConn(raw); !errors.Is(err, ErrBadHandshake) {
+		t.Errorf("Expected ErrBadHandshake, got %v", err)
+	}
+}
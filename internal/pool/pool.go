@@ -0,0 +1,152 @@
+// Package pool implements a bounded, size-classed byte slice pool.
+//
+// sync.Pool under TinyGo never drops items and never shrinks, so the
+// shadowsocks stream keeps its own free lists with a fixed number of
+// slices per size class instead.
+package pool
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	minClassShift = 6  // 64 B
+	maxClassShift = 15 // 32 KiB
+
+	// chunkClassSize fits a full AEAD chunk, its 0x3FFF byte payload
+	// with the encrypted length and both tags, which would otherwise
+	// take a 32 KiB slice.
+	chunkClassSize = 0x3FFF + 2 + 2*16
+	chunkClass     = maxClassShift - minClassShift
+	classCount     = maxClassShift - minClassShift + 2
+
+	// DefaultLimit is the number of slices kept per size class when the
+	// limit is not configured.
+	DefaultLimit = 4
+)
+
+// Pool keeps up to limit free slices for every power of two size between
+// 64 B and 32 KiB, plus a class between 16 KiB and 32 KiB sized for a full
+// AEAD chunk. Larger requests are allocated directly and never pooled.
+type Pool struct {
+	access  sync.Mutex
+	limit   int
+	classes [classCount][][]byte
+}
+
+// New returns a pool that keeps at most limit slices per size class.
+// A limit of zero disables pooling.
+func New(limit int) *Pool {
+	return &Pool{limit: max(limit, 0)}
+}
+
+// Get returns a slice of length size. Its capacity is rounded up to the
+// size class it belongs to.
+func (p *Pool) Get(size int) []byte {
+	if size <= 0 {
+		return nil
+	}
+	class, ok := classOf(size)
+	if !ok {
+		return make([]byte, size)
+	}
+	p.access.Lock()
+	free := p.classes[class]
+	if n := len(free); n > 0 {
+		b := free[n-1]
+		free[n-1] = nil
+		p.classes[class] = free[:n-1]
+		p.access.Unlock()
+		return b[:size]
+	}
+	p.access.Unlock()
+	return make([]byte, size, classSize(class))
+}
+
+// Put gives b back to the pool. Slices that were not obtained from Get,
+// or that arrive once the class is full, are left to the garbage collector.
+func (p *Pool) Put(b []byte) {
+	c := cap(b)
+	if c == 0 {
+		return
+	}
+	class, ok := classOf(c)
+	if !ok || classSize(class) != c {
+		return
+	}
+	p.access.Lock()
+	defer p.access.Unlock()
+	if len(p.classes[class]) >= p.limit {
+		return
+	}
+	p.classes[class] = append(p.classes[class], b[:c])
+}
+
+// SetLimit changes the number of slices kept per size class, dropping
+// the slices that no longer fit.
+func (p *Pool) SetLimit(limit int) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.limit = max(limit, 0)
+	for i, free := range p.classes {
+		if len(free) > p.limit {
+			clear(free[p.limit:])
+			p.classes[i] = free[:p.limit]
+		}
+	}
+}
+
+// Limit returns the number of slices kept per size class.
+func (p *Pool) Limit() int {
+	p.access.Lock()
+	defer p.access.Unlock()
+	return p.limit
+}
+
+func classOf(size int) (int, bool) {
+	shift := bits.Len(uint(size - 1))
+	if shift < minClassShift {
+		shift = minClassShift
+	}
+	switch {
+	case shift > maxClassShift:
+		return 0, false
+	case shift < maxClassShift:
+		return shift - minClassShift, true
+	case size <= chunkClassSize:
+		return chunkClass, true
+	default:
+		return chunkClass + 1, true
+	}
+}
+
+// classSize returns the capacity of the slices in class.
+func classSize(class int) int {
+	switch {
+	case class < chunkClass:
+		return 1 << (class + minClassShift)
+	case class == chunkClass:
+		return chunkClassSize
+	default:
+		return 1 << maxClassShift
+	}
+}
+
+// Default is the pool shared by the shadowsocks reader and writer.
+var Default = New(DefaultLimit)
+
+// Get returns a slice of length size from the default pool.
+func Get(size int) []byte {
+	return Default.Get(size)
+}
+
+// Put gives b back to the default pool.
+func Put(b []byte) {
+	Default.Put(b)
+}
+
+// SetLimit changes the per class limit of the default pool.
+func SetLimit(limit int) {
+	Default.SetLimit(limit)
+}
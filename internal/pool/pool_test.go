@@ -0,0 +1,114 @@
+package pool
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestPoolGet(t *testing.T) {
+	p := New(DefaultLimit)
+	for _, tc := range []struct {
+		size, capacity int
+	}{
+		{1, 64},
+		{64, 64},
+		{65, 128},
+		{16 * 1024, 16 * 1024},
+		{16*1024 + 1, chunkClassSize},
+		{0x3FFF + 2 + 2*16, chunkClassSize},
+		{chunkClassSize + 1, 32 * 1024},
+		{32 * 1024, 32 * 1024},
+		{32*1024 + 1, 32*1024 + 1},
+	} {
+		b := p.Get(tc.size)
+		if len(b) != tc.size || cap(b) != tc.capacity {
+			t.Errorf("Get(%d): expected len %d cap %d, got len %d cap %d", tc.size, tc.size, tc.capacity, len(b), cap(b))
+		}
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	p := New(1)
+	b := p.Get(100)
+	p.Put(b)
+	if reused := p.Get(120); &reused[0] != &b[0] {
+		t.Error("Expected slice to be reused from the same size class")
+	}
+}
+
+func TestPoolBounded(t *testing.T) {
+	p := New(2)
+	for i := 0; i < 5; i++ {
+		p.Put(make([]byte, 256))
+	}
+	if n := len(p.classes[2]); n != 2 {
+		t.Errorf("Expected 2 pooled slices, got %d", n)
+	}
+
+	p.SetLimit(1)
+	if n := len(p.classes[2]); n != 1 {
+		t.Errorf("Expected SetLimit to trim the class to 1 slice, got %d", n)
+	}
+
+	p.SetLimit(-1)
+	p.Put(make([]byte, 256))
+	if n := len(p.classes[2]); n != 0 {
+		t.Errorf("Expected pooling to be disabled, got %d pooled slices", n)
+	}
+}
+
+func TestPoolPutForeignSlice(t *testing.T) {
+	p := New(DefaultLimit)
+	p.Put(make([]byte, 100))
+	p.Put(make([]byte, chunkClassSize+1))
+	p.Put(nil)
+	for i, free := range p.classes {
+		if len(free) != 0 {
+			t.Errorf("Expected class %d to stay empty, got %d slices", i, len(free))
+		}
+	}
+}
+
+func TestPoolReuseChunkClass(t *testing.T) {
+	p := New(1)
+	b := p.Get(chunkClassSize)
+	p.Put(b)
+	if reused := p.Get(16*1024 + 1); &reused[0] != &b[0] {
+		t.Error("Expected a full chunk slice to be reused from the chunk class")
+	}
+}
+
+// BenchmarkGet compares allocating exactly the requested size, as the
+// reader and writer did before pooling, with getting the slice from a pool
+// that is disabled or not.
+func BenchmarkGet(b *testing.B) {
+	for _, size := range []int{64, 1400, chunkClassSize} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.Run("make", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					sink = make([]byte, size)
+				}
+			})
+			for _, bc := range []struct {
+				name  string
+				limit int
+			}{
+				{"unpooled", 0},
+				{"pooled", DefaultLimit},
+			} {
+				b.Run(bc.name, func(b *testing.B) {
+					p := New(bc.limit)
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						sink = p.Get(size)
+						p.Put(sink)
+					}
+				})
+			}
+		})
+	}
+}
+
+// sink keeps the benchmarked slices from being optimised away.
+var sink []byte
@@ -0,0 +1,140 @@
+// Package saltfilter implements a bounded, time-decaying set of salts used
+// to detect replayed server responses.
+package saltfilter
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/replay"
+)
+
+// falsePositiveRate is the probability that a fresh salt is reported as
+// replayed, per generation.
+const falsePositiveRate = 1e-6
+
+var _ replay.Filter = (*Filter)(nil)
+
+// Filter is a rotating Bloom filter made of two generations. Salts are
+// added to the current generation and looked up in both; the current
+// generation becomes the previous one, and the previous one is cleared and
+// reused, once it holds capacity salts or once interval has passed. A salt
+// is therefore remembered for at least one full generation.
+type Filter struct {
+	access    sync.Mutex
+	capacity  int
+	interval  time.Duration
+	hashes    int
+	seed      [16]byte
+	current   bloom
+	previous  bloom
+	lastClean time.Time
+}
+
+type bloom struct {
+	bits  []uint64
+	count int
+}
+
+// New returns a filter remembering up to capacity salts per generation,
+// rotated at least every interval when interval is positive. Each
+// generation needs about 3.6 bytes per salt.
+func New(capacity int, interval time.Duration) *Filter {
+	capacity = max(capacity, 1)
+	bitCount := int(math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	words := (bitCount + 63) / 64
+	f := &Filter{
+		capacity:  capacity,
+		interval:  interval,
+		hashes:    max(int(math.Round(float64(words*64)/float64(capacity)*math.Ln2)), 1),
+		current:   bloom{bits: make([]uint64, words)},
+		previous:  bloom{bits: make([]uint64, words)},
+		lastClean: time.Now(),
+	}
+	// a secret seed keeps the bit positions unpredictable to whoever picks
+	// the salts
+	rand.Read(f.seed[:])
+	return f
+}
+
+// Check records salt and reports whether it was not seen before.
+func (f *Filter) Check(salt []byte) bool {
+	f.access.Lock()
+	defer f.access.Unlock()
+	f.maybeRotate(time.Now())
+	h1, h2 := f.sum(salt)
+	if f.current.contains(h1, h2, f.hashes) || f.previous.contains(h1, h2, f.hashes) {
+		return false
+	}
+	f.current.add(h1, h2, f.hashes)
+	return true
+}
+
+// Add records salt without looking it up.
+func (f *Filter) Add(salt []byte) {
+	f.access.Lock()
+	defer f.access.Unlock()
+	f.maybeRotate(time.Now())
+	h1, h2 := f.sum(salt)
+	f.current.add(h1, h2, f.hashes)
+}
+
+// Contains reports whether salt was recorded, without recording it.
+func (f *Filter) Contains(salt []byte) bool {
+	f.access.Lock()
+	defer f.access.Unlock()
+	h1, h2 := f.sum(salt)
+	return f.current.contains(h1, h2, f.hashes) || f.previous.contains(h1, h2, f.hashes)
+}
+
+// Size returns the memory used by the filter's bit sets, in bytes.
+func (f *Filter) Size() int {
+	return 2 * 8 * len(f.current.bits)
+}
+
+func (f *Filter) maybeRotate(now time.Time) {
+	if f.current.count >= f.capacity || (f.interval > 0 && now.Sub(f.lastClean) >= f.interval) {
+		f.rotate(now)
+	}
+}
+
+func (f *Filter) rotate(now time.Time) {
+	f.previous, f.current = f.current, f.previous
+	clear(f.current.bits)
+	f.current.count = 0
+	f.lastClean = now
+}
+
+func (f *Filter) sum(salt []byte) (uint64, uint64) {
+	h := sha256.New()
+	h.Write(f.seed[:])
+	h.Write(salt)
+	var digest [sha256.Size]byte
+	h.Sum(digest[:0])
+	return binary.LittleEndian.Uint64(digest[:8]), binary.LittleEndian.Uint64(digest[8:16]) | 1
+}
+
+// contains and add use double hashing, the i-th position being h1 + i*h2.
+func (b *bloom) contains(h1, h2 uint64, hashes int) bool {
+	m := uint64(len(b.bits) * 64)
+	for i := 0; i < hashes; i++ {
+		position := (h1 + uint64(i)*h2) % m
+		if b.bits[position/64]&(1<<(position%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloom) add(h1, h2 uint64, hashes int) {
+	m := uint64(len(b.bits) * 64)
+	for i := 0; i < hashes; i++ {
+		position := (h1 + uint64(i)*h2) % m
+		b.bits[position/64] |= 1 << (position % 64)
+	}
+	b.count++
+}
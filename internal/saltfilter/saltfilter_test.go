@@ -0,0 +1,88 @@
+package saltfilter
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func newSalt() []byte {
+	salt := make([]byte, 32)
+	rand.Read(salt)
+	return salt
+}
+
+func TestFilterCheck(t *testing.T) {
+	f := New(100, 0)
+	salt := newSalt()
+	if !f.Check(salt) {
+		t.Fatal("Expected a new salt to pass")
+	}
+	if f.Check(salt) {
+		t.Error("Expected a repeated salt to be rejected")
+	}
+	if !f.Check(newSalt()) {
+		t.Error("Expected another new salt to pass")
+	}
+}
+
+func TestFilterRotatesOnCapacity(t *testing.T) {
+	f := New(10, 0)
+	first := newSalt()
+	f.Check(first)
+	for i := 0; i < 9; i++ {
+		f.Check(newSalt())
+	}
+	// the first generation is full, it becomes the previous one and is
+	// still consulted
+	f.Check(newSalt())
+	if f.Check(first) {
+		t.Error("Expected salt from the previous generation to be remembered")
+	}
+	for i := 0; i < 10; i++ {
+		f.Check(newSalt())
+	}
+	if !f.Check(first) {
+		t.Error("Expected salt to be forgotten after two rotations")
+	}
+}
+
+func TestFilterRotatesOnInterval(t *testing.T) {
+	f := New(100, time.Millisecond)
+	salt := newSalt()
+	f.Check(salt)
+	time.Sleep(2 * time.Millisecond)
+	if f.Check(salt) {
+		t.Error("Expected salt to survive one rotation")
+	}
+	time.Sleep(2 * time.Millisecond)
+	f.Check(newSalt())
+	time.Sleep(2 * time.Millisecond)
+	if !f.Check(salt) {
+		t.Error("Expected salt to decay after two rotations")
+	}
+}
+
+func TestFilterSize(t *testing.T) {
+	f := New(4096, 0)
+	if size := f.Size(); size > 32*1024 {
+		t.Errorf("Expected default sized filter to stay under 32 KiB, got %d bytes", size)
+	}
+	for i := 0; i < 4096; i++ {
+		if !f.Check(newSalt()) {
+			t.Fatalf("Unexpected false positive after %d salts", i)
+		}
+	}
+}
+
+func TestFilterAddContains(t *testing.T) {
+	f := New(100, 0)
+	salt := newSalt()
+	if f.Contains(salt) {
+		t.Fatal("Expected unknown salt not to be contained")
+	}
+	f.Add(salt)
+	if !f.Contains(salt) || !f.Contains(salt) {
+		t.Error("Expected added salt to be contained, repeatedly")
+	}
+}
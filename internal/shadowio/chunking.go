@@ -0,0 +1,113 @@
+package shadowio
+
+import (
+	"math/rand"
+)
+
+// ChunkPolicy decides how much payload goes into each chunk the Writer
+// emits, so chunk boundaries no longer mirror application writes. Every
+// chunk stays a regular AEAD chunk, which keeps any policy compatible with
+// standard servers.
+type ChunkPolicy interface {
+	// NextChunkSize returns the payload size limit of the next chunk. A
+	// value that is not positive means no limit besides the writer's
+	// maximum packet size, larger values are clamped to it.
+	NextChunkSize() int
+}
+
+// FixedChunkSize splits payloads into chunks of size bytes.
+func FixedChunkSize(size int) ChunkPolicy {
+	return fixedChunkSize(size)
+}
+
+type fixedChunkSize int
+
+func (p fixedChunkSize) NextChunkSize() int {
+	return int(p)
+}
+
+// RandomChunkSize picks every chunk size uniformly between min and max.
+func RandomChunkSize(min, max int) ChunkPolicy {
+	return &randomChunkSize{min: min, max: max}
+}
+
+type randomChunkSize struct {
+	min, max int
+}
+
+func (p *randomChunkSize) NextChunkSize() int {
+	return p.min + rand.Intn(p.max-p.min+1)
+}
+
+// SampledChunkSize picks every chunk size from sizes, each one with the
+// matching weight. Missing weights count as 1.
+func SampledChunkSize(sizes []int, weights []int) ChunkPolicy {
+	p := &sampledChunkSize{sizes: sizes, cumulative: make([]int, len(sizes))}
+	var total int
+	for i := range sizes {
+		weight := 1
+		if i < len(weights) {
+			weight = weights[i]
+		}
+		total += weight
+		p.cumulative[i] = total
+	}
+	return p
+}
+
+type sampledChunkSize struct {
+	sizes      []int
+	cumulative []int
+}
+
+func (p *sampledChunkSize) NextChunkSize() int {
+	if len(p.sizes) == 0 {
+		return 0
+	}
+	target := rand.Intn(p.cumulative[len(p.cumulative)-1])
+	for i, bound := range p.cumulative {
+		if target < bound {
+			return p.sizes[i]
+		}
+	}
+	return p.sizes[len(p.sizes)-1]
+}
+
+// SequenceChunkSize sizes chunks from sizes in order, after which chunks
+// are only limited by the maximum packet size. Like FirstChunks, the
+// returned policy is stateful.
+func SequenceChunkSize(sizes ...int) ChunkPolicy {
+	s := sequenceChunkSize(sizes)
+	return &s
+}
+
+type sequenceChunkSize []int
+
+func (s *sequenceChunkSize) NextChunkSize() int {
+	if len(*s) == 0 {
+		return 0
+	}
+	size := (*s)[0]
+	*s = (*s)[1:]
+	return size
+}
+
+// FirstChunks applies policy to the first n chunks only, after which
+// chunks are only limited by the maximum packet size. The returned policy
+// counts chunks, so each connection needs its own.
+func FirstChunks(n int, policy ChunkPolicy) ChunkPolicy {
+	return &firstChunks{remaining: n, policy: policy}
+}
+
+type firstChunks struct {
+	remaining int
+	policy    ChunkPolicy
+}
+
+func (p *firstChunks) NextChunkSize() int {
+	if p.remaining <= 0 {
+		return 0
+	}
+	p.remaining--
+	return p.policy.NextChunkSize()
+}
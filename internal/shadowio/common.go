@@ -1,11 +1,14 @@
 // Package shadowio implements the shadowsocks writer and reader
 package shadowio
 
-func increaseNonce(nonce []byte) {
+// increaseNonce increments the little endian nonce counter. It returns
+// false once the counter wraps around to zero.
+func increaseNonce(nonce []byte) bool {
 	for i := range nonce {
 		nonce[i]++
 		if nonce[i] != 0 {
-			return
+			return true
 		}
 	}
+	return false
 }
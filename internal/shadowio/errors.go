@@ -0,0 +1,18 @@
+package shadowio
+
+import "errors"
+
+var (
+	// ErrAuthFailed means a chunk did not authenticate. On the first chunk
+	// of a stream it usually means the password or method is wrong,
+	// afterwards that the stream was corrupted or tampered with.
+	ErrAuthFailed = errors.New("shadowsocks: message authentication failed")
+	// ErrBadSalt means the salt opening a stream could not be read or was
+	// rejected.
+	ErrBadSalt = errors.New("shadowsocks: bad salt")
+	// ErrChunkLength means a decrypted chunk length is out of range.
+	ErrChunkLength = errors.New("shadowsocks: chunk length out of range")
+	// ErrNonceExhausted means the nonce counter wrapped around and the
+	// session key cannot be used for any more chunks.
+	ErrNonceExhausted = errors.New("shadowsocks: nonce exhausted")
+)
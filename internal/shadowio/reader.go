@@ -3,15 +3,22 @@ package shadowio
 import (
 	"crypto/cipher"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"syscall"
 
+	"github.com/getlantern/tiny-shadowsocks/internal/pool"
 	"github.com/sagernet/sing/common/buf"
 	N "github.com/sagernet/sing/common/network"
 )
 
 const PacketLengthBufferSize = 2
 
+// MaxPayloadSize is the largest chunk payload allowed by the AEAD spec.
+const MaxPayloadSize = 0x3FFF
+
 const (
 	// Overhead
 	// crypto/cipher.gcmTagSize
@@ -22,14 +29,22 @@ const (
 var (
 	_ N.ExtendedReader = (*Reader)(nil)
 	_ N.ReadWaiter     = (*Reader)(nil)
+	_ io.WriterTo      = (*Reader)(nil)
 )
 
 type Reader struct {
 	reader          io.Reader
 	cipher          cipher.AEAD
 	nonce           []byte
-	cache           *buf.Buffer
+	cache           []byte
+	cacheData       []byte
+	header          [PacketLengthBufferSize + Overhead]byte
+	headerN         int
+	payload         []byte
+	payloadN        int
 	readWaitOptions N.ReadWaitOptions
+	exhausted       bool
+	authenticated   bool
 }
 
 func NewReader(upstream io.Reader, cipher cipher.AEAD) *Reader {
@@ -53,34 +68,43 @@ func (r *Reader) ReadFixedBuffer(pLen int) (*buf.Buffer, error) {
 		return nil, err
 	}
 	buffer.Truncate(pLen)
-	r.cache = buffer
+	r.cache = buffer.Bytes()
 	return buffer, nil
 }
 
 func (r *Reader) Decrypt(destination []byte, source []byte) error {
-	_, err := r.cipher.Open(destination[:0], r.nonce, source, nil)
+	_, err := r.open(destination, source)
+	return err
+}
+
+// open authenticates and decrypts source into destination with the next
+// nonce.
+func (r *Reader) open(destination []byte, source []byte) ([]byte, error) {
+	if r.exhausted {
+		return nil, ErrNonceExhausted
+	}
+	plaintext, err := r.cipher.Open(destination[:0], r.nonce, source, nil)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %w", ErrAuthFailed, err)
 	}
-	increaseNonce(r.nonce)
-	return nil
+	r.exhausted = !increaseNonce(r.nonce)
+	return plaintext, nil
 }
 
 func (r *Reader) Read(p []byte) (n int, err error) {
 	for {
 		if r.cache != nil {
-			if r.cache.IsEmpty() {
-				r.cache.Release()
-				r.cache = nil
+			if len(r.cache) == 0 {
+				r.releaseCache()
 			} else {
-				n = copy(p, r.cache.Bytes())
+				n = copy(p, r.cache)
 				if n > 0 {
-					r.cache.Advance(n)
+					r.cache = r.cache[n:]
 					return
 				}
 			}
 		}
-		r.cache, err = r.readBuffer()
+		err = r.fillCache()
 		if err != nil {
 			return
 		}
@@ -91,25 +115,61 @@ func (r *Reader) ReadBuffer(buffer *buf.Buffer) error {
 	var err error
 	for {
 		if r.cache != nil {
-			if r.cache.IsEmpty() {
-				r.cache.Release()
-				r.cache = nil
+			if len(r.cache) == 0 {
+				r.releaseCache()
 			} else {
-				n := copy(buffer.FreeBytes(), r.cache.Bytes())
+				n := copy(buffer.FreeBytes(), r.cache)
 				if n > 0 {
 					buffer.Truncate(n)
-					r.cache.Advance(n)
+					r.cache = r.cache[n:]
 					return nil
 				}
 			}
 		}
-		r.cache, err = r.readBuffer()
+		err = r.fillCache()
 		if err != nil {
 			return err
 		}
 	}
 }
 
+// WriteTo implements io.WriterTo. Every chunk is decrypted in place and
+// handed to w without going through an intermediate buffer.
+func (r *Reader) WriteTo(w io.Writer) (n int64, err error) {
+	if len(r.cache) > 0 {
+		var writeN int
+		writeN, err = w.Write(r.cache)
+		n += int64(writeN)
+		r.cache = r.cache[writeN:]
+		if err != nil {
+			return
+		}
+	}
+	if r.cache != nil {
+		r.releaseCache()
+	}
+	for {
+		var data []byte
+		data, err = r.readChunk()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		var writeN int
+		writeN, err = w.Write(data)
+		n += int64(writeN)
+		if err != nil {
+			// keep what the writer did not take for the next read
+			r.cacheData = data
+			r.cache = data[writeN:]
+			return
+		}
+		pool.Put(data)
+	}
+}
+
 func (r *Reader) InitializeReadWaiter(options N.ReadWaitOptions) (needCopy bool) {
 	r.readWaitOptions = options
 	return options.NeedHeadroom()
@@ -119,24 +179,23 @@ func (r *Reader) WaitReadBuffer() (buffer *buf.Buffer, err error) {
 	if r.readWaitOptions.NeedHeadroom() {
 		for {
 			if r.cache != nil {
-				if r.cache.IsEmpty() {
-					r.cache.Release()
-					r.cache = nil
+				if len(r.cache) == 0 {
+					r.releaseCache()
 				} else {
 					buffer = r.readWaitOptions.NewBuffer()
 					var n int
-					n, err = buffer.Write(r.cache.Bytes())
+					n, err = buffer.Write(r.cache)
 					if err != nil {
 						buffer.Release()
 						return
 					}
 					buffer.Truncate(n)
-					r.cache.Advance(n)
+					r.cache = r.cache[n:]
 					r.readWaitOptions.PostReturn(buffer)
 					return
 				}
 			}
-			r.cache, err = r.readBuffer()
+			err = r.fillCache()
 			if err != nil {
 				return
 			}
@@ -144,48 +203,141 @@ func (r *Reader) WaitReadBuffer() (buffer *buf.Buffer, err error) {
 	} else {
 		cache := r.cache
 		if cache != nil {
+			// the caller owns the buffer from now on, so its slice
+			// never goes back to the pool
 			r.cache = nil
-			return cache, nil
+			r.cacheData = nil
+			return buf.As(cache), nil
 		}
-		return r.readBuffer()
+		data, err := r.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		return buf.As(data), nil
 	}
 }
 
-func (r *Reader) readBuffer() (*buf.Buffer, error) {
-	// reading packet length
-	buffer := buf.NewSize(PacketLengthBufferSize + Overhead)
-	_, err := buffer.ReadFullFrom(r.reader, buffer.FreeLen())
+// fillCache decrypts the next chunk into a pooled slice and keeps it as
+// the read cache until it is drained.
+func (r *Reader) fillCache() error {
+	data, err := r.readChunk()
 	if err != nil {
-		slog.Warn("failed to read encoded packet length", slog.Any("error", err))
-		buffer.Release()
-		return nil, err
+		return err
 	}
-	_, err = r.cipher.Open(buffer.Index(0), r.nonce, buffer.Bytes(), nil)
-	if err != nil {
-		slog.Error("failed to decode packet length", slog.Any("error", err))
-		buffer.Release()
-		return nil, err
+	r.cacheData = data
+	r.cache = data
+	return nil
+}
+
+// Fill reads the next chunk ahead into the cache unless one is cached
+// already, so that the following read returns it.
+func (r *Reader) Fill() error {
+	if r.cache != nil {
+		return nil
 	}
-	// reading content
-	length := int(binary.BigEndian.Uint16(buffer.To(PacketLengthBufferSize)))
-	buffer.Release()
-	buffer = buf.NewSize(length + Overhead)
-	_, err = buffer.ReadFullFrom(r.reader, buffer.FreeLen())
-	if err != nil {
-		slog.Warn("failed to read encoded content", slog.Any("error", err))
-		buffer.Release()
+	return r.fillCache()
+}
+
+// Authenticated reports whether at least one chunk length authenticated,
+// which tells a key mismatch apart from later stream corruption.
+func (r *Reader) Authenticated() bool {
+	return r.authenticated
+}
+
+// Release gives the cached chunk back to the pool, wipes the nonce and
+// drops the cipher. The reader must not be used afterwards.
+func (r *Reader) Release() {
+	if r.cache != nil {
+		r.releaseCache()
+	}
+	if r.payload != nil {
+		pool.Put(r.payload)
+		r.payload = nil
+	}
+	r.cipher = nil
+	clear(r.nonce)
+	clear(r.header[:])
+}
+
+func (r *Reader) releaseCache() {
+	pool.Put(r.cacheData)
+	r.cache = nil
+	r.cacheData = nil
+}
+
+// readChunk reads and decrypts a single chunk. The length is decoded into
+// the reader's own header array, so the only slice needed per chunk is the
+// pooled one holding the payload. What was read of the chunk is kept when
+// the upstream returns EAGAIN, so the next call picks up where this one
+// stopped, and the nonce only moves on once the length or the payload
+// decrypts.
+func (r *Reader) readChunk() ([]byte, error) {
+	if r.payload == nil {
+		header := r.header[:]
+		if err := r.readFull(header, &r.headerN); err != nil {
+			logReadError("failed to read encoded packet length", err)
+			return nil, err
+		}
+		r.headerN = 0
+		_, err := r.open(header, header)
+		if err != nil {
+			// a failure on the very first chunk is reported by the caller,
+			// which knows which server and method were used
+			if r.authenticated {
+				slog.Error("failed to decode packet length", slog.Any("error", err))
+			}
+			return nil, err
+		}
+		r.authenticated = true
+		length := int(binary.BigEndian.Uint16(header[:PacketLengthBufferSize]))
+		if length > MaxPayloadSize {
+			slog.Error("decoded packet length out of range", slog.Int("length", length))
+			return nil, fmt.Errorf("%w: %d", ErrChunkLength, length)
+		}
+		r.payload = pool.Get(length + Overhead)
+		r.payloadN = 0
+	}
+	if err := r.readFull(r.payload, &r.payloadN); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		logReadError("failed to read encoded content", err)
 		return nil, err
 	}
-	// if length was extracted, decoded correctly and the content was read successfully
-	// increase nonce
-	increaseNonce(r.nonce)
-	_, err = r.cipher.Open(buffer.Index(0), r.nonce, buffer.Bytes(), nil)
-	if err != nil {
+	buffer := r.payload
+	r.payload = nil
+	if _, err := r.open(buffer, buffer); err != nil {
 		slog.Error("failed to decode content", slog.Any("error", err))
-		buffer.Release()
+		pool.Put(buffer)
 		return nil, err
 	}
-	increaseNonce(r.nonce)
-	buffer.Truncate(length)
-	return buffer, nil
+	return buffer[:len(buffer)-Overhead], nil
+}
+
+// readFull fills b from the upstream, counting the bytes read so far in
+// filled, which survives an error such as EAGAIN. Like io.ReadFull it
+// returns io.EOF only when nothing was read.
+func (r *Reader) readFull(b []byte, filled *int) error {
+	for *filled < len(b) {
+		n, err := r.reader.Read(b[*filled:])
+		*filled += n
+		if *filled == len(b) {
+			break
+		}
+		if err == io.EOF && *filled > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logReadError logs a failed read, unless the upstream only has nothing
+// to read yet.
+func logReadError(message string, err error) {
+	if !errors.Is(err, syscall.EAGAIN) {
+		slog.Warn(message, slog.Any("error", err))
+	}
 }
@@ -0,0 +1,451 @@
+package shadowio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/internal/pool"
+	"github.com/sagernet/sing/common/buf"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const benchmarkMaxPacketSize = 16*1024 - 1
+
+func newTestCipher(t testing.TB) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestWriterReaderRoundTrip(t *testing.T) {
+	key := newTestCipher(t)
+	writeCipher, _ := chacha20poly1305.New(key)
+	readCipher, _ := chacha20poly1305.New(key)
+
+	payload := make([]byte, 3*benchmarkMaxPacketSize+123)
+	rand.Read(payload)
+
+	var wire bytes.Buffer
+	w := NewWriter(&wire, writeCipher, nil, benchmarkMaxPacketSize)
+	if _, err := w.Write(payload[:10]); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := w.Write(payload[10:]); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	got, err := io.ReadAll(NewReader(&wire, readCipher))
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Expected decrypted stream to match the written payload")
+	}
+}
+
+// reportAllocsPerMB reports heap allocations per MiB of plaintext so the
+// pooled and unpooled variants can be compared directly.
+// dripReader hands out one byte per read, returning EAGAIN before each,
+// like a non-blocking conn the data trickles into.
+type dripReader struct {
+	data  []byte
+	ready bool
+}
+
+func (r *dripReader) Read(p []byte) (int, error) {
+	if r.ready = !r.ready; !r.ready {
+		return 0, syscall.EAGAIN
+	}
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestReaderResumesAfterEAGAIN(t *testing.T) {
+	key := newTestCipher(t)
+	writeCipher, _ := chacha20poly1305.New(key)
+	readCipher, _ := chacha20poly1305.New(key)
+	var wire bytes.Buffer
+	w := NewWriter(&wire, writeCipher, nil, benchmarkMaxPacketSize)
+	w.Write([]byte("first"))
+	w.Write([]byte("second"))
+
+	r := NewReader(&dripReader{data: wire.Bytes()}, readCipher)
+	var got []byte
+	buffer := make([]byte, 16)
+	for eagains := 0; ; {
+		n, err := r.Read(buffer)
+		got = append(got, buffer[:n]...)
+		if errors.Is(err, syscall.EAGAIN) {
+			eagains++
+			continue
+		}
+		if err == io.EOF {
+			if eagains < wire.Len() {
+				t.Errorf("Expected an EAGAIN before each of the %d bytes, got %d", wire.Len(), eagains)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed after %q: %v", got, err)
+		}
+	}
+	if string(got) != "firstsecond" {
+		t.Errorf("Expected the chunks to survive the EAGAINs, got %q", got)
+	}
+}
+
+func reportAllocsPerMB(b *testing.B, run func()) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	run()
+	runtime.ReadMemStats(&after)
+	mb := float64(b.N) * float64(benchmarkMaxPacketSize*4) / (1 << 20)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/mb, "allocs/MB")
+}
+
+func withPoolLimit(b *testing.B, limit int) {
+	previous := pool.Default.Limit()
+	pool.SetLimit(limit)
+	b.Cleanup(func() { pool.SetLimit(previous) })
+}
+
+func BenchmarkWriter(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		limit int
+	}{
+		{"unpooled", 0},
+		{"pooled", pool.DefaultLimit},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			withPoolLimit(b, bc.limit)
+			writeCipher, _ := chacha20poly1305.New(newTestCipher(b))
+			w := NewWriter(io.Discard, writeCipher, nil, benchmarkMaxPacketSize)
+			payload := make([]byte, benchmarkMaxPacketSize*4)
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			reportAllocsPerMB(b, func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := w.Write(payload); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		limit int
+	}{
+		{"unpooled", 0},
+		{"pooled", pool.DefaultLimit},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			withPoolLimit(b, bc.limit)
+			key := newTestCipher(b)
+			writeCipher, _ := chacha20poly1305.New(key)
+			readCipher, _ := chacha20poly1305.New(key)
+
+			var wire bytes.Buffer
+			w := NewWriter(&wire, writeCipher, nil, benchmarkMaxPacketSize)
+			payload := make([]byte, benchmarkMaxPacketSize*4)
+			for i := 0; i < b.N; i++ {
+				if _, err := w.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			r := NewReader(bytes.NewReader(wire.Bytes()), readCipher)
+			p := make([]byte, len(payload))
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			reportAllocsPerMB(b, func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := io.ReadFull(r, p); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestWriterCoalescing(t *testing.T) {
+	key := newTestCipher(t)
+	writeCipher, _ := chacha20poly1305.New(key)
+	readCipher, _ := chacha20poly1305.New(key)
+
+	var wire bytes.Buffer
+	w := NewWriter(&wire, writeCipher, nil, benchmarkMaxPacketSize)
+	if err := w.SetCoalescing(16, 0); err != nil {
+		t.Fatalf("SetCoalescing failed: %v", err)
+	}
+
+	for _, p := range []string{"a", "bc", "def"} {
+		if n, err := w.Write([]byte(p)); err != nil || n != len(p) {
+			t.Fatalf("Write(%q) = %d, %v", p, n, err)
+		}
+	}
+	if wire.Len() != 0 {
+		t.Fatalf("Expected writes to be held back, got %d bytes on the wire", wire.Len())
+	}
+	if w.Buffered() != 6 {
+		t.Errorf("Expected 6 buffered bytes, got %d", w.Buffered())
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if expected := PacketLengthBufferSize + 2*Overhead + 6; wire.Len() != expected {
+		t.Errorf("Expected a single %d byte chunk after Flush, got %d bytes", expected, wire.Len())
+	}
+
+	// crossing the threshold emits full chunks and keeps the remainder
+	if _, err := w.Write([]byte("0123456789abcdefXYZ")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if w.Buffered() != 3 {
+		t.Errorf("Expected 3 buffered bytes after crossing the threshold, got %d", w.Buffered())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	got, err := io.ReadAll(NewReader(&wire, readCipher))
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(got) != "abcdef0123456789abcdefXYZ" {
+		t.Errorf("Unexpected decrypted stream %q", got)
+	}
+}
+
+func TestWriterCoalescingDelay(t *testing.T) {
+	writeCipher, _ := chacha20poly1305.New(newTestCipher(t))
+	var wire bytes.Buffer
+	w := NewWriter(&wire, writeCipher, nil, benchmarkMaxPacketSize)
+	if err := w.SetCoalescing(1024, time.Millisecond); err != nil {
+		t.Fatalf("SetCoalescing failed: %v", err)
+	}
+
+	w.Write([]byte("first"))
+	if wire.Len() != 0 {
+		t.Fatal("Expected first write to be held back")
+	}
+	time.Sleep(2 * time.Millisecond)
+	w.Write([]byte("second"))
+	if w.Buffered() != 0 {
+		t.Errorf("Expected pending data to be flushed once the delay elapsed, %d bytes left", w.Buffered())
+	}
+	if expected := PacketLengthBufferSize + 2*Overhead + len("firstsecond"); wire.Len() != expected {
+		t.Errorf("Expected one %d byte chunk, got %d bytes", expected, wire.Len())
+	}
+}
+
+func TestWriterRelease(t *testing.T) {
+	writeCipher, _ := chacha20poly1305.New(newTestCipher(t))
+	w := NewWriter(io.Discard, writeCipher, nil, benchmarkMaxPacketSize)
+	w.SetCoalescing(64, 0)
+	w.Write([]byte("secret"))
+	pending := w.pending
+
+	w.Release()
+	if w.pending != nil || !bytes.Equal(pending[:6], make([]byte, 6)) {
+		t.Error("Expected pending data to be wiped and released")
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	key := newTestCipher(t)
+	newWire := func(payload []byte) []byte {
+		writeCipher, _ := chacha20poly1305.New(key)
+		var wire bytes.Buffer
+		NewWriter(&wire, writeCipher, nil, benchmarkMaxPacketSize).Write(payload)
+		return wire.Bytes()
+	}
+
+	t.Run("wrong key fails authentication", func(t *testing.T) {
+		readCipher, _ := chacha20poly1305.New(newTestCipher(t))
+		_, err := NewReader(bytes.NewReader(newWire([]byte("hello"))), readCipher).Read(make([]byte, 16))
+		if !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("Expected ErrAuthFailed, got %v", err)
+		}
+	})
+
+	t.Run("truncated chunk", func(t *testing.T) {
+		readCipher, _ := chacha20poly1305.New(key)
+		wire := newWire([]byte("hello"))
+		_, err := NewReader(bytes.NewReader(wire[:len(wire)-1]), readCipher).Read(make([]byte, 16))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+		}
+	})
+
+	t.Run("oversized chunk length", func(t *testing.T) {
+		writeCipher, _ := chacha20poly1305.New(key)
+		readCipher, _ := chacha20poly1305.New(key)
+		header := make([]byte, PacketLengthBufferSize, PacketLengthBufferSize+Overhead)
+		binary.BigEndian.PutUint16(header, MaxPayloadSize+1)
+		wire := writeCipher.Seal(header[:0], make([]byte, writeCipher.NonceSize()), header, nil)
+		_, err := NewReader(bytes.NewReader(wire), readCipher).Read(make([]byte, 16))
+		if !errors.Is(err, ErrChunkLength) {
+			t.Errorf("Expected ErrChunkLength, got %v", err)
+		}
+	})
+}
+
+// lockCheckingPolicy fails the test when the writer asks it for a size
+// without holding its lock, which guards the policy state shared by the
+// write paths.
+type lockCheckingPolicy struct {
+	t *testing.T
+	w *Writer
+}
+
+func (p *lockCheckingPolicy) NextChunkSize() int {
+	if p.w.access.TryLock() {
+		p.w.access.Unlock()
+		p.t.Error("Expected the chunk policy to be called with the writer lock held")
+	}
+	return 100
+}
+
+func TestWriterChunkPolicyLocked(t *testing.T) {
+	writeCipher, _ := chacha20poly1305.New(newTestCipher(t))
+	w := NewWriter(io.Discard, writeCipher, nil, benchmarkMaxPacketSize)
+	w.SetChunkPolicy(&lockCheckingPolicy{t: t, w: w})
+	payload := make([]byte, 1000)
+	w.Write(payload)
+	w.ReadFrom(bytes.NewReader(payload))
+	w.WriteVectorised([]*buf.Buffer{buf.As(bytes.Clone(payload))})
+	w.WriteBuffer(buf.As(bytes.Clone(payload)))
+}
+
+func TestNonceExhausted(t *testing.T) {
+	key := newTestCipher(t)
+	writeCipher, _ := chacha20poly1305.New(key)
+	nonce := bytes.Repeat([]byte{0xff}, writeCipher.NonceSize())
+	w := NewWriter(io.Discard, writeCipher, nonce, benchmarkMaxPacketSize)
+	if _, err := w.Write([]byte("x")); !errors.Is(err, ErrNonceExhausted) {
+		t.Errorf("Expected writer to stop once the nonce wraps, got %v", err)
+	}
+
+	readCipher, _ := chacha20poly1305.New(key)
+	r := NewReader(nil, readCipher)
+	copy(r.nonce, bytes.Repeat([]byte{0xff}, readCipher.NonceSize()))
+	if err := r.Decrypt(nil, readCipher.Seal(nil, r.nonce, nil, nil)); err != nil {
+		t.Fatalf("Expected last nonce to be usable, got %v", err)
+	}
+	if err := r.Decrypt(nil, nil); !errors.Is(err, ErrNonceExhausted) {
+		t.Errorf("Expected reader to stop once the nonce wraps, got %v", err)
+	}
+}
+
+// chunkLengths decrypts the length headers of wire and returns the payload
+// length of every chunk.
+func chunkLengths(t *testing.T, key []byte, wire []byte) []int {
+	t.Helper()
+	readCipher, _ := chacha20poly1305.New(key)
+	nonce := make([]byte, readCipher.NonceSize())
+	var lengths []int
+	for len(wire) > 0 {
+		header, err := readCipher.Open(nil, nonce, wire[:PacketLengthBufferSize+Overhead], nil)
+		if err != nil {
+			t.Fatalf("failed to open chunk length: %v", err)
+		}
+		increaseNonce(nonce)
+		increaseNonce(nonce)
+		length := int(binary.BigEndian.Uint16(header))
+		lengths = append(lengths, length)
+		wire = wire[PacketLengthBufferSize+2*Overhead+length:]
+	}
+	return lengths
+}
+
+func TestWriterChunkPolicy(t *testing.T) {
+	payload := make([]byte, 1000)
+	rand.Read(payload)
+
+	for _, write := range []struct {
+		name  string
+		write func(w *Writer) error
+	}{
+		{"Write", func(w *Writer) error {
+			_, err := w.Write(payload)
+			return err
+		}},
+		{"ReadFrom", func(w *Writer) error {
+			_, err := w.ReadFrom(bytes.NewReader(payload))
+			return err
+		}},
+		{"WriteVectorised", func(w *Writer) error {
+			return w.WriteVectorised([]*buf.Buffer{buf.As(payload[:300]), buf.As(payload[300:])})
+		}},
+	} {
+		t.Run(write.name, func(t *testing.T) {
+			key := newTestCipher(t)
+			writeCipher, _ := chacha20poly1305.New(key)
+			readCipher, _ := chacha20poly1305.New(key)
+			var wire bytes.Buffer
+			w := NewWriter(&wire, writeCipher, nil, 512)
+			// 0 and oversized values fall back to the maximum packet size
+			w.SetChunkPolicy(SequenceChunkSize(10, 1, 0, 4096, 100))
+			if err := write.write(w); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+
+			lengths := chunkLengths(t, key, wire.Bytes())
+			if expected := []int{10, 1, 512, 477}; !slices.Equal(lengths, expected) {
+				t.Errorf("Expected chunk lengths %v, got %v", expected, lengths)
+			}
+			got, err := io.ReadAll(NewReader(bytes.NewReader(wire.Bytes()), readCipher))
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("Expected standard reader to decode the stream, got %d bytes, %v", len(got), err)
+			}
+		})
+	}
+}
+
+func TestChunkPolicies(t *testing.T) {
+	if size := FixedChunkSize(42).NextChunkSize(); size != 42 {
+		t.Errorf("Expected fixed size 42, got %d", size)
+	}
+	random := RandomChunkSize(10, 20)
+	for i := 0; i < 100; i++ {
+		if size := random.NextChunkSize(); size < 10 || size > 20 {
+			t.Fatalf("Expected random size within 10..20, got %d", size)
+		}
+	}
+	sampled := SampledChunkSize([]int{100, 200, 300}, []int{1, 0, 1})
+	for i := 0; i < 100; i++ {
+		if size := sampled.NextChunkSize(); size != 100 && size != 300 {
+			t.Fatalf("Expected a sampled size with a positive weight, got %d", size)
+		}
+	}
+	first := FirstChunks(2, FixedChunkSize(42))
+	var sizes []int
+	for i := 0; i < 4; i++ {
+		sizes = append(sizes, first.NextChunkSize())
+	}
+	if !slices.Equal(sizes, []int{42, 42, 0, 0}) {
+		t.Errorf("Expected the policy to stop after 2 chunks, got %v", sizes)
+	}
+}
@@ -5,20 +5,35 @@ import (
 	"encoding/binary"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/getlantern/tiny-shadowsocks/bufio"
+	"github.com/getlantern/tiny-shadowsocks/internal/pool"
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
 	N "github.com/sagernet/sing/common/network"
 )
 
+var (
+	_ io.ReaderFrom      = (*Writer)(nil)
+	_ N.VectorisedWriter = (*Writer)(nil)
+	_ N.ExtendedWriter   = (*Writer)(nil)
+)
+
 type Writer struct {
 	WriterInterface
 	writer        N.ExtendedWriter
 	cipher        cipher.AEAD
 	maxPacketSize int
 	nonce         []byte
+	exhausted     bool
+	chunkPolicy   ChunkPolicy
 	access        sync.Mutex
+
+	coalesceThreshold int
+	coalesceDelay     time.Duration
+	pending           []byte
+	pendingSince      time.Time
 }
 
 func NewWriter(writer io.Writer, cipher cipher.AEAD, nonce []byte, maxPacketSize int) *Writer {
@@ -33,9 +48,19 @@ func NewWriter(writer io.Writer, cipher cipher.AEAD, nonce []byte, maxPacketSize
 	}
 }
 
-func (w *Writer) Encrypt(destination []byte, source []byte) {
+func (w *Writer) Encrypt(destination []byte, source []byte) error {
+	return w.seal(destination, source)
+}
+
+// seal encrypts source into destination with the next nonce, refusing to
+// go on once the nonce counter wrapped around.
+func (w *Writer) seal(destination []byte, source []byte) error {
+	if w.exhausted {
+		return ErrNonceExhausted
+	}
 	w.cipher.Seal(destination, w.nonce, source, nil)
-	increaseNonce(w.nonce)
+	w.exhausted = !increaseNonce(w.nonce)
+	return nil
 }
 
 func (w *Writer) Write(p []byte) (n int, err error) {
@@ -44,27 +69,26 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	}
 	w.access.Lock()
 	defer w.access.Unlock()
-	for pLen := len(p); pLen > 0; {
-		var data []byte
-		if pLen > w.maxPacketSize {
-			data = p[:w.maxPacketSize]
-			p = p[w.maxPacketSize:]
-			pLen -= w.maxPacketSize
-		} else {
-			data = p
-			pLen = 0
+	if w.coalesceThreshold > 0 {
+		return w.coalesce(p)
+	}
+	return w.writeChunks(p)
+}
+
+func (w *Writer) writeChunks(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		data := p[:min(w.nextChunkSize(), len(p))]
+		p = p[len(data):]
+		// length and payload are sealed into a single pooled slice
+		buffer := pool.Get(PacketLengthBufferSize + 2*Overhead + len(data))
+		binary.BigEndian.PutUint16(buffer, uint16(len(data)))
+		if err = w.seal(buffer[:0], buffer[:PacketLengthBufferSize]); err == nil {
+			err = w.seal(buffer[:PacketLengthBufferSize+Overhead], data)
 		}
-		bufferSize := PacketLengthBufferSize + 2*Overhead + len(data)
-		buffer := buf.NewSize(bufferSize)
-		common.Must(binary.Write(buffer, binary.BigEndian, uint16(len(data))))
-		w.cipher.Seal(buffer.Index(0), w.nonce, buffer.To(PacketLengthBufferSize), nil)
-		increaseNonce(w.nonce)
-		buffer.Extend(Overhead)
-		w.cipher.Seal(buffer.Index(buffer.Len()), w.nonce, data, nil)
-		buffer.Extend(len(data) + Overhead)
-		increaseNonce(w.nonce)
-		_, err = w.writer.Write(buffer.Bytes())
-		buffer.Release()
+		if err == nil {
+			_, err = w.writer.Write(buffer)
+		}
+		pool.Put(buffer)
 		if err != nil {
 			return
 		}
@@ -73,23 +97,213 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	return
 }
 
+// SetChunkPolicy makes the writer size chunks according to policy instead
+// of only splitting at the maximum packet size. A nil policy restores the
+// default.
+func (w *Writer) SetChunkPolicy(policy ChunkPolicy) {
+	w.access.Lock()
+	defer w.access.Unlock()
+	w.chunkPolicy = policy
+}
+
+// chunkSize is nextChunkSize for callers not holding the lock, which
+// guards the state of the chunk policy.
+func (w *Writer) chunkSize() int {
+	w.access.Lock()
+	defer w.access.Unlock()
+	return w.nextChunkSize()
+}
+
+// nextChunkSize returns the payload limit of the next chunk. The caller
+// holds the lock.
+func (w *Writer) nextChunkSize() int {
+	if w.chunkPolicy == nil {
+		return w.maxPacketSize
+	}
+	size := w.chunkPolicy.NextChunkSize()
+	if size <= 0 || size > w.maxPacketSize {
+		return w.maxPacketSize
+	}
+	return size
+}
+
+// SetCoalescing makes the writer batch small writes into a single chunk.
+// Data is held until threshold bytes are pending, until a write finds the
+// oldest pending byte older than delay, or until Flush is called. There is
+// no timer, so delay never sends data on its own: held data waits for the
+// next write or Flush however old it is. A zero threshold turns coalescing
+// off; a zero delay only flushes on threshold or explicit Flush.
+func (w *Writer) SetCoalescing(threshold int, delay time.Duration) error {
+	w.access.Lock()
+	defer w.access.Unlock()
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	w.coalesceThreshold = min(max(threshold, 0), w.maxPacketSize)
+	w.coalesceDelay = delay
+	if w.pending != nil && cap(w.pending) < w.coalesceThreshold {
+		pool.Put(w.pending)
+		w.pending = nil
+	}
+	return nil
+}
+
+func (w *Writer) coalesce(p []byte) (n int, err error) {
+	if w.pending == nil {
+		w.pending = pool.Get(w.coalesceThreshold)[:0]
+	}
+	for len(p) > 0 {
+		if len(w.pending) == 0 {
+			w.pendingSince = time.Now()
+		}
+		copied := min(w.coalesceThreshold-len(w.pending), len(p))
+		w.pending = append(w.pending, p[:copied]...)
+		p = p[copied:]
+		n += copied
+		if len(w.pending) == w.coalesceThreshold {
+			if err = w.flushLocked(); err != nil {
+				return
+			}
+		}
+	}
+	if len(w.pending) > 0 && w.coalesceDelay > 0 && time.Since(w.pendingSince) >= w.coalesceDelay {
+		err = w.flushLocked()
+	}
+	return
+}
+
+// Flush writes any data held back by coalescing as a single chunk.
+func (w *Writer) Flush() error {
+	w.access.Lock()
+	defer w.access.Unlock()
+	return w.flushLocked()
+}
+
+// Buffered returns the number of bytes held back by coalescing.
+func (w *Writer) Buffered() int {
+	w.access.Lock()
+	defer w.access.Unlock()
+	return len(w.pending)
+}
+
+// Release gives the coalescing buffer back to the pool, wipes the nonce
+// and drops the cipher. Pending data is dropped, so callers flush first.
+// The writer must not be used afterwards.
+func (w *Writer) Release() {
+	w.access.Lock()
+	defer w.access.Unlock()
+	if w.pending != nil {
+		clear(w.pending[:cap(w.pending)])
+		pool.Put(w.pending)
+		w.pending = nil
+	}
+	w.cipher = nil
+	clear(w.nonce)
+}
+
+func (w *Writer) flushLocked() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	_, err := w.writeChunks(w.pending)
+	w.pending = w.pending[:0]
+	return err
+}
+
 func (w *Writer) WriteBuffer(buffer *buf.Buffer) error {
-	if buffer.Len() > w.maxPacketSize {
+	w.access.Lock()
+	if buffer.Len() > w.maxPacketSize || w.coalesceThreshold > 0 || w.chunkPolicy != nil {
+		w.access.Unlock()
 		defer buffer.Release()
 		return common.Error(w.Write(buffer.Bytes()))
 	}
+	defer w.access.Unlock()
 	pLen := buffer.Len()
 	headerOffset := PacketLengthBufferSize + Overhead
 	header := buffer.ExtendHeader(headerOffset)
 	binary.BigEndian.PutUint16(header, uint16(pLen))
-	w.cipher.Seal(header[:0], w.nonce, header[:PacketLengthBufferSize], nil)
-	increaseNonce(w.nonce)
-	w.cipher.Seal(buffer.Index(headerOffset), w.nonce, buffer.From(headerOffset), nil)
-	increaseNonce(w.nonce)
+	if err := w.seal(header[:0], header[:PacketLengthBufferSize]); err != nil {
+		buffer.Release()
+		return err
+	}
+	if err := w.seal(buffer.Index(headerOffset), buffer.From(headerOffset)); err != nil {
+		buffer.Release()
+		return err
+	}
 	buffer.Extend(Overhead)
 	return w.writer.WriteBuffer(buffer)
 }
 
+// ReadFrom implements io.ReaderFrom. Plaintext is read straight into the
+// payload area of a pooled chunk, leaving FrontHeadroom bytes for the
+// encrypted length, and sealed in place.
+func (w *Writer) ReadFrom(r io.Reader) (n int64, err error) {
+	frame := pool.Get(w.FrontHeadroom() + w.maxPacketSize + w.RearHeadroom())
+	defer pool.Put(frame)
+	for {
+		readN, readErr := r.Read(frame[w.FrontHeadroom() : w.FrontHeadroom()+w.chunkSize()])
+		if readN > 0 {
+			if err = w.writeFrame(frame, readN); err != nil {
+				return
+			}
+			n += int64(readN)
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				err = readErr
+			}
+			return
+		}
+	}
+}
+
+// WriteVectorised implements N.VectorisedWriter. The buffers are gathered
+// into as few chunks as possible, each one sealed in a single pooled frame.
+func (w *Writer) WriteVectorised(buffers []*buf.Buffer) error {
+	defer buf.ReleaseMulti(buffers)
+	frame := pool.Get(w.FrontHeadroom() + w.maxPacketSize + w.RearHeadroom())
+	defer pool.Put(frame)
+	payload := frame[w.FrontHeadroom() : w.FrontHeadroom()+w.chunkSize()]
+	var pending int
+	for _, buffer := range buffers {
+		for data := buffer.Bytes(); len(data) > 0; {
+			copied := copy(payload[pending:], data)
+			data = data[copied:]
+			pending += copied
+			if pending == len(payload) {
+				if err := w.writeFrame(frame, pending); err != nil {
+					return err
+				}
+				payload = frame[w.FrontHeadroom() : w.FrontHeadroom()+w.chunkSize()]
+				pending = 0
+			}
+		}
+	}
+	if pending > 0 {
+		return w.writeFrame(frame, pending)
+	}
+	return nil
+}
+
+// writeFrame seals the pLen bytes of plaintext found after the front
+// headroom of frame in place and writes the resulting chunk.
+func (w *Writer) writeFrame(frame []byte, pLen int) error {
+	w.access.Lock()
+	defer w.access.Unlock()
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	headerOffset := PacketLengthBufferSize + Overhead
+	binary.BigEndian.PutUint16(frame, uint16(pLen))
+	if err := w.seal(frame[:0], frame[:PacketLengthBufferSize]); err != nil {
+		return err
+	}
+	if err := w.seal(frame[headerOffset:headerOffset], frame[headerOffset:headerOffset+pLen]); err != nil {
+		return err
+	}
+	return common.Error(w.writer.Write(frame[:headerOffset+pLen+Overhead]))
+}
+
 func (w *Writer) TakeNonce() []byte {
 	return w.nonce
 }
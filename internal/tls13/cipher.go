@@ -0,0 +1,149 @@
+package tls13
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+// cipherSuite is one of the TLS 1.3 suites the client offers.
+type cipherSuite struct {
+	id      uint16
+	keySize int
+	hash    func() hash.Hash
+	aead    func(key []byte) (cipher.AEAD, error)
+}
+
+var cipherSuites = []*cipherSuite{
+	{0x1301, 16, sha256.New, newGCM},
+	{0x1302, 32, sha512.New384, newGCM},
+	{0x1303, 32, sha256.New, chacha20poly1305.New},
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func suiteByID(id uint16) *cipherSuite {
+	for _, suite := range cipherSuites {
+		if suite.id == id {
+			return suite
+		}
+	}
+	return nil
+}
+
+// expandLabel is HKDF-Expand-Label from RFC 8446, section 7.1.
+func (s *cipherSuite) expandLabel(secret []byte, label string, context []byte, length int) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(length))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 " + label))
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(context)
+	})
+	out := make([]byte, length)
+	if _, err := hkdf.Expand(s.hash, secret, b.BytesOrPanic()).Read(out); err != nil {
+		panic("tls13: HKDF-Expand-Label failed: " + err.Error())
+	}
+	return out
+}
+
+// deriveSecret is Derive-Secret from RFC 8446, section 7.1, given the
+// transcript of the messages.
+func (s *cipherSuite) deriveSecret(secret []byte, label string, transcript []byte) []byte {
+	return s.expandLabel(secret, label, s.transcriptHash(transcript), s.hash().Size())
+}
+
+func (s *cipherSuite) extract(secret, salt []byte) []byte {
+	if secret == nil {
+		secret = make([]byte, s.hash().Size())
+	}
+	return hkdf.Extract(s.hash, secret, salt)
+}
+
+func (s *cipherSuite) transcriptHash(transcript []byte) []byte {
+	h := s.hash()
+	h.Write(transcript)
+	return h.Sum(nil)
+}
+
+// finishedMAC is the verify_data of a Finished message sent with the
+// traffic secret.
+func (s *cipherSuite) finishedMAC(secret, transcript []byte) []byte {
+	mac := hmac.New(s.hash, s.expandLabel(secret, "finished", nil, s.hash().Size()))
+	mac.Write(s.transcriptHash(transcript))
+	return mac.Sum(nil)
+}
+
+// halfConn protects the records of one direction with a traffic secret.
+type halfConn struct {
+	aead cipher.AEAD
+	iv   []byte
+	seq  uint64
+}
+
+func newHalfConn(suite *cipherSuite, secret []byte) (*halfConn, error) {
+	aead, err := suite.aead(suite.expandLabel(secret, "key", nil, suite.keySize))
+	if err != nil {
+		return nil, err
+	}
+	return &halfConn{aead: aead, iv: suite.expandLabel(secret, "iv", nil, aead.NonceSize())}, nil
+}
+
+func (hc *halfConn) nonce() []byte {
+	nonce := make([]byte, len(hc.iv))
+	copy(nonce, hc.iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(hc.seq >> (8 * i))
+	}
+	hc.seq++
+	return nonce
+}
+
+// seal appends the record carrying data of the given content type.
+func (hc *halfConn) seal(out []byte, contentType byte, data []byte) []byte {
+	length := len(data) + 1 + hc.aead.Overhead()
+	header := []byte{recordApplicationData, 3, 3, byte(length >> 8), byte(length)}
+	inner := append(append(make([]byte, 0, len(data)+1), data...), contentType)
+	out = append(out, header...)
+	return hc.aead.Seal(out, hc.nonce(), inner, header)
+}
+
+// open decrypts the payload of a record in place and returns its content
+// and content type.
+func (hc *halfConn) open(header, payload []byte) (contentType byte, data []byte, err error) {
+	plain, err := hc.aead.Open(payload[:0], hc.nonce(), payload, header)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: record decryption: %w", ErrBadMessage, err)
+	}
+	i := len(plain) - 1
+	for i >= 0 && plain[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return 0, nil, fmt.Errorf("%w: record without content type", ErrBadMessage)
+	}
+	return plain[i], plain[:i], nil
+}
+
+// recordHeader returns the header of a plaintext record.
+func recordHeader(contentType byte, length int) []byte {
+	header := []byte{contentType, 3, 3, 0, 0}
+	binary.BigEndian.PutUint16(header[3:], uint16(length))
+	return header
+}
@@ -0,0 +1,237 @@
+package tls13
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+const (
+	typeKeyUpdate = 24
+
+	alertCloseNotify = 0
+)
+
+// Conn carries application data over rw once the handshake is done.
+// Records are reassembled across EAGAINs, so rw may be non-blocking, and
+// sealed records rw did not take are kept and sent before anything else.
+// Session tickets are dropped and key updates followed.
+type Conn struct {
+	rw     io.ReadWriter
+	suite  *cipherSuite
+	client *halfConn
+	server *halfConn
+
+	clientSecret []byte
+	serverSecret []byte
+
+	header      [recordHeaderSize]byte
+	headerN     int
+	payload     []byte
+	payloadN    int
+	handshake   []byte
+	inbound     []byte
+	outbound    []byte
+	writeClosed bool
+	err         error
+}
+
+// NewConn returns the conn following the handshake that produced state.
+func NewConn(rw io.ReadWriter, state *State) (*Conn, error) {
+	c := &Conn{rw: rw, suite: state.suite, clientSecret: state.clientSecret, serverSecret: state.serverSecret}
+	var err error
+	if c.client, err = newHalfConn(c.suite, c.clientSecret); err != nil {
+		return nil, err
+	}
+	if c.server, err = newHalfConn(c.suite, c.serverSecret); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Write seals p into records and sends them. Once sealed, p counts as
+// written even when rw returns EAGAIN, which is passed on, and the records
+// left go out with the next Write, Read or CloseWrite.
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.writeClosed {
+		return 0, net.ErrClosed
+	}
+	// the sequence numbers are spent, so the records of an earlier call
+	// go first and are never sealed again
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+	for data := p; len(data) > 0; {
+		size := min(len(data), maxPlaintext)
+		c.outbound = c.client.seal(c.outbound, recordApplicationData, data[:size])
+		data = data[size:]
+	}
+	if err := c.flush(); err != nil {
+		if errors.Is(err, syscall.EAGAIN) {
+			return len(p), err
+		}
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush sends the sealed records rw has not taken yet.
+func (c *Conn) flush() error {
+	for len(c.outbound) > 0 {
+		n, err := c.rw.Write(c.outbound)
+		c.outbound = c.outbound[n:]
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+	}
+	c.outbound = nil
+	return nil
+}
+
+// CloseWrite sends a close_notify alert, which only ends the client's side
+// of the stream in TLS 1.3.
+func (c *Conn) CloseWrite() error {
+	if c.writeClosed {
+		return c.flush()
+	}
+	c.writeClosed = true
+	c.outbound = c.client.seal(c.outbound, recordAlert, []byte{1, alertCloseNotify})
+	return c.flush()
+}
+
+func (c *Conn) Read(p []byte) (n int, err error) {
+	if err = c.flush(); err != nil && !errors.Is(err, syscall.EAGAIN) {
+		return 0, err
+	}
+	for len(c.inbound) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if err = c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, c.inbound)
+	c.inbound = c.inbound[n:]
+	return
+}
+
+// readRecord reads and handles the next record, keeping what it read so far
+// when rw returns EAGAIN.
+func (c *Conn) readRecord() error {
+	for c.headerN < recordHeaderSize {
+		n, err := c.rw.Read(c.header[c.headerN:])
+		c.headerN += n
+		if c.headerN < recordHeaderSize && err != nil {
+			if err == io.EOF && c.headerN > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if c.headerN == recordHeaderSize {
+			length := int(binary.BigEndian.Uint16(c.header[3:]))
+			if length > maxCiphertext {
+				return c.fail(fmt.Errorf("%w: %d byte record", ErrBadMessage, length))
+			}
+			c.payload = make([]byte, length)
+			c.payloadN = 0
+		}
+	}
+	for c.payloadN < len(c.payload) {
+		n, err := c.rw.Read(c.payload[c.payloadN:])
+		c.payloadN += n
+		if c.payloadN < len(c.payload) && err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+	c.headerN = 0
+	switch c.header[0] {
+	case recordChangeCipherSpec:
+		return nil
+	case recordApplicationData:
+	default:
+		return c.fail(fmt.Errorf("%w: record type %d", ErrBadMessage, c.header[0]))
+	}
+	contentType, data, err := c.server.open(c.header[:], c.payload)
+	if err != nil {
+		return c.fail(err)
+	}
+	switch contentType {
+	case recordApplicationData:
+		c.inbound = data
+	case recordHandshake:
+		c.handshake = append(c.handshake, data...)
+		return c.handlePostHandshake()
+	case recordAlert:
+		if len(data) == 2 && data[1] == alertCloseNotify {
+			return c.fail(io.EOF)
+		}
+		return c.fail(alertError(data))
+	default:
+		return c.fail(fmt.Errorf("%w: content type %d", ErrBadMessage, contentType))
+	}
+	return nil
+}
+
+// handlePostHandshake handles the complete handshake messages received
+// after the handshake.
+func (c *Conn) handlePostHandshake() error {
+	for len(c.handshake) >= 4 && len(c.handshake) >= 4+messageLength(c.handshake) {
+		length := 4 + messageLength(c.handshake)
+		message := c.handshake[:length]
+		c.handshake = c.handshake[length:]
+		switch message[0] {
+		case typeNewSessionTicket:
+			// resumption is not supported
+		case typeKeyUpdate:
+			if len(message) != 5 {
+				return c.fail(fmt.Errorf("%w: malformed KeyUpdate", ErrBadMessage))
+			}
+			if err := c.updateServerKey(); err != nil {
+				return c.fail(err)
+			}
+			if message[4] == 1 {
+				if err := c.updateClientKey(); err != nil {
+					return c.fail(err)
+				}
+			}
+		default:
+			return c.fail(fmt.Errorf("%w: handshake message %d", ErrBadMessage, message[0]))
+		}
+	}
+	return nil
+}
+
+func (c *Conn) updateServerKey() (err error) {
+	c.serverSecret = c.suite.expandLabel(c.serverSecret, "traffic upd", nil, c.suite.hash().Size())
+	c.server, err = newHalfConn(c.suite, c.serverSecret)
+	return
+}
+
+// updateClientKey answers a KeyUpdate that requested one, then switches
+// to the next client secret.
+func (c *Conn) updateClientKey() error {
+	// update_not_requested, queued behind any records not sent yet
+	c.outbound = c.client.seal(c.outbound, recordHandshake, []byte{typeKeyUpdate, 0, 0, 1, 0})
+	c.clientSecret = c.suite.expandLabel(c.clientSecret, "traffic upd", nil, c.suite.hash().Size())
+	var err error
+	if c.client, err = newHalfConn(c.suite, c.clientSecret); err != nil {
+		return err
+	}
+	if err = c.flush(); errors.Is(err, syscall.EAGAIN) {
+		return nil
+	}
+	return err
+}
+
+// fail makes err the result of every later read.
+func (c *Conn) fail(err error) error {
+	c.err = err
+	return err
+}
@@ -0,0 +1,254 @@
+package tls13
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// handshake reads and writes the records of a handshake in progress.
+type handshake struct {
+	rw         io.ReadWriter
+	config     *Config
+	transcript []byte
+	pending    []byte
+	server     *halfConn
+}
+
+// Handshake runs a TLS 1.3 handshake over rw, which must block. It reads
+// exactly the records of the handshake, so once it returns, rw carries
+// whatever the server sends next. The server is verified unless
+// config.InsecureSkipVerify is set.
+func Handshake(rw io.ReadWriter, config *Config) (*State, error) {
+	h := &handshake{rw: rw, config: config}
+	return h.run()
+}
+
+func (h *handshake) run() (*State, error) {
+	random := h.config.Rand
+	if random == nil {
+		random = rand.Reader
+	}
+	clientRandom := make([]byte, RandomSize)
+	if _, err := io.ReadFull(random, clientRandom); err != nil {
+		return nil, err
+	}
+	var shares []keyShare
+	for _, group := range []struct {
+		id    uint16
+		curve ecdh.Curve
+	}{{groupX25519, ecdh.X25519()}, {groupSecp256r1, ecdh.P256()}} {
+		key, err := group.curve.GenerateKey(random)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, keyShare{group.id, key})
+	}
+	hello, sessionIDStart := clientHello(h.config, clientRandom, shares)
+	sessionID := hello[sessionIDStart : sessionIDStart+SessionIDSize]
+	if h.config.SessionID != nil {
+		if err := h.config.SessionID(hello, sessionID); err != nil {
+			return nil, err
+		}
+	} else if _, err := io.ReadFull(random, sessionID); err != nil {
+		return nil, err
+	}
+	// the first record announces the TLS 1.0 version, like browsers do
+	record := recordHeader(recordHandshake, len(hello))
+	record[2] = 1
+	if _, err := h.rw.Write(append(record, hello...)); err != nil {
+		return nil, err
+	}
+	h.transcript = hello
+
+	message, err := h.readMessage(typeServerHello)
+	if err != nil {
+		return nil, err
+	}
+	serverHello, err := parseServerHello(message)
+	if err != nil {
+		return nil, err
+	}
+	suite := suiteByID(serverHello.suite)
+	if suite == nil {
+		return nil, fmt.Errorf("%w: cipher suite %#04x", ErrUnsupported, serverHello.suite)
+	}
+	i := slices.IndexFunc(shares, func(share keyShare) bool { return share.group == serverHello.shareGroup })
+	if i < 0 {
+		return nil, fmt.Errorf("%w: key share group %d", ErrUnsupported, serverHello.shareGroup)
+	}
+	peerKey, err := shares[i].key.Curve().NewPublicKey(serverHello.shareKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key share: %w", ErrBadMessage, err)
+	}
+	shared, err := shares[i].key.ECDH(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key share: %w", ErrBadMessage, err)
+	}
+	h.transcript = append(h.transcript, message...)
+
+	state := &State{ServerRandom: serverHello.random, CipherSuite: suite.id, suite: suite}
+	earlySecret := suite.extract(nil, nil)
+	handshakeSecret := suite.extract(shared, suite.deriveSecret(earlySecret, "derived", nil))
+	clientHandshakeSecret := suite.deriveSecret(handshakeSecret, "c hs traffic", h.transcript)
+	serverHandshakeSecret := suite.deriveSecret(handshakeSecret, "s hs traffic", h.transcript)
+	if h.server, err = newHalfConn(suite, serverHandshakeSecret); err != nil {
+		return nil, err
+	}
+	client, err := newHalfConn(suite, clientHandshakeSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	if message, err = h.readMessage(typeEncryptedExtensions); err != nil {
+		return nil, err
+	}
+	if state.NegotiatedProtocol, err = parseEncryptedExtensions(message); err != nil {
+		return nil, err
+	}
+	h.transcript = append(h.transcript, message...)
+	var certificateRequested bool
+	var leaf *x509.Certificate
+	var verified bool
+	for {
+		if message, err = h.readMessage(0); err != nil {
+			return nil, err
+		}
+		switch message[0] {
+		case typeCertificateRequest:
+			certificateRequested = true
+		case typeCertificate:
+			if state.PeerCertificates, err = parseCertificate(message); err != nil {
+				return nil, err
+			}
+			if !h.config.InsecureSkipVerify {
+				if leaf, err = h.config.verifyCertificates(state.PeerCertificates); err != nil {
+					return nil, err
+				}
+			}
+		case typeCertificateVerify:
+			if leaf != nil {
+				if err = verifyCertificateVerify(leaf, suite, h.transcript, message); err != nil {
+					return nil, err
+				}
+				leaf = nil
+				verified = true
+			}
+		case typeFinished:
+			if !verified && !h.config.InsecureSkipVerify {
+				return nil, fmt.Errorf("%w: the server did not prove its identity", ErrVerify)
+			}
+			if !hmac.Equal(message[4:], suite.finishedMAC(serverHandshakeSecret, h.transcript)) {
+				return nil, fmt.Errorf("%w: server Finished", ErrVerify)
+			}
+		default:
+			return nil, fmt.Errorf("%w: handshake message %d", ErrBadMessage, message[0])
+		}
+		h.transcript = append(h.transcript, message...)
+		if message[0] == typeFinished {
+			break
+		}
+	}
+
+	masterSecret := suite.extract(nil, suite.deriveSecret(handshakeSecret, "derived", nil))
+	state.clientSecret = suite.deriveSecret(masterSecret, "c ap traffic", h.transcript)
+	state.serverSecret = suite.deriveSecret(masterSecret, "s ap traffic", h.transcript)
+
+	// a middlebox compatible client sends a ChangeCipherSpec before its
+	// first encrypted record
+	out := append(recordHeader(recordChangeCipherSpec, 1), 1)
+	if certificateRequested {
+		// no certificate to offer: an empty context and list
+		certificate := []byte{typeCertificate, 0, 0, 4, 0, 0, 0, 0}
+		h.transcript = append(h.transcript, certificate...)
+		out = client.seal(out, recordHandshake, certificate)
+	}
+	finished := append([]byte{typeFinished, 0, 0, 0}, suite.finishedMAC(clientHandshakeSecret, h.transcript)...)
+	finished[3] = byte(len(finished) - 4)
+	out = client.seal(out, recordHandshake, finished)
+	if _, err = h.rw.Write(out); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// readMessage returns the next handshake message, reading records until it
+// is complete, and checks its type unless expected is zero.
+func (h *handshake) readMessage(expected byte) ([]byte, error) {
+	for len(h.pending) < 4 || len(h.pending) < 4+messageLength(h.pending) {
+		if err := h.readRecord(); err != nil {
+			return nil, err
+		}
+	}
+	length := 4 + messageLength(h.pending)
+	message := slices.Clone(h.pending[:length])
+	h.pending = h.pending[length:]
+	if expected != 0 && message[0] != expected {
+		return nil, fmt.Errorf("%w: handshake message %d instead of %d", ErrBadMessage, message[0], expected)
+	}
+	return message, nil
+}
+
+// messageLength returns the body length of the handshake message starting
+// message.
+func messageLength(message []byte) int {
+	return int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+}
+
+// readRecord appends the handshake data of the next record to pending.
+func (h *handshake) readRecord() error {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(h.rw, header); err != nil {
+		return unexpectedEOF(err)
+	}
+	length := int(binary.BigEndian.Uint16(header[3:]))
+	if length > maxCiphertext {
+		return fmt.Errorf("%w: %d byte record", ErrBadMessage, length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(h.rw, payload); err != nil {
+		return unexpectedEOF(err)
+	}
+	contentType := header[0]
+	switch {
+	case contentType == recordChangeCipherSpec:
+		return nil
+	case h.server != nil:
+		// once the handshake keys are in place, only encrypted records
+		// are trusted
+		if contentType != recordApplicationData {
+			return fmt.Errorf("%w: plaintext record type %d after ServerHello", ErrBadMessage, contentType)
+		}
+		var err error
+		if contentType, payload, err = h.server.open(header, payload); err != nil {
+			return err
+		}
+	}
+	switch contentType {
+	case recordHandshake:
+		h.pending = append(h.pending, payload...)
+		return nil
+	case recordAlert:
+		return alertError(payload)
+	}
+	return fmt.Errorf("%w: record type %d", ErrBadMessage, contentType)
+}
+
+func alertError(payload []byte) error {
+	if len(payload) != 2 {
+		return fmt.Errorf("%w: malformed", ErrAlert)
+	}
+	return fmt.Errorf("%w: level %d, description %d", ErrAlert, payload[0], payload[1])
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
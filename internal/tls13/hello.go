@@ -0,0 +1,232 @@
+package tls13
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	extServerName           = 0
+	extSupportedGroups      = 10
+	extECPointFormats       = 11
+	extSignatureAlgorithms  = 13
+	extALPN                 = 16
+	extExtendedMasterSecret = 23
+	extSessionTicket        = 35
+	extSupportedVersions    = 43
+	extPSKModes             = 45
+	extKeyShare             = 51
+	extRenegotiationInfo    = 0xff01
+
+	groupX25519    = 29
+	groupSecp256r1 = 23
+)
+
+// helloRetryRandom is the random of a HelloRetryRequest.
+var helloRetryRandom = sha256.Sum256([]byte("HelloRetryRequest"))
+
+var signatureAlgorithms = []uint16{
+	0x0403, // ecdsa_secp256r1_sha256
+	0x0804, // rsa_pss_rsae_sha256
+	0x0401, // rsa_pkcs1_sha256
+	0x0503, // ecdsa_secp384r1_sha384
+	0x0805, // rsa_pss_rsae_sha384
+	0x0501, // rsa_pkcs1_sha384
+	0x0806, // rsa_pss_rsae_sha512
+	0x0601, // rsa_pkcs1_sha512
+	0x0807, // ed25519
+}
+
+// keyShare is a key the client offers for one group.
+type keyShare struct {
+	group uint16
+	key   *ecdh.PrivateKey
+}
+
+// clientHello encodes the ClientHello handshake message and returns it with
+// the offset of its session ID.
+func clientHello(config *Config, random []byte, shares []keyShare) ([]byte, int) {
+	var b cryptobyte.Builder
+	b.AddUint8(typeClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(versionTLS12)
+		b.AddBytes(random)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(make([]byte, SessionIDSize))
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, suite := range cipherSuites {
+				b.AddUint16(suite.id)
+			}
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8(0)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			if config.ServerName != "" && !isIP(config.ServerName) {
+				addExtension(b, extServerName, func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddUint8(0)
+						b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+							b.AddBytes([]byte(config.ServerName))
+						})
+					})
+				})
+			}
+			addExtension(b, extExtendedMasterSecret, func(b *cryptobyte.Builder) {})
+			addExtension(b, extRenegotiationInfo, func(b *cryptobyte.Builder) {
+				b.AddUint8(0)
+			})
+			addExtension(b, extSupportedGroups, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					for _, share := range shares {
+						b.AddUint16(share.group)
+					}
+				})
+			})
+			addExtension(b, extECPointFormats, func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(0)
+				})
+			})
+			addExtension(b, extSessionTicket, func(b *cryptobyte.Builder) {})
+			if len(config.NextProtos) > 0 {
+				addExtension(b, extALPN, func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						for _, proto := range config.NextProtos {
+							b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+								b.AddBytes([]byte(proto))
+							})
+						}
+					})
+				})
+			}
+			addExtension(b, extSignatureAlgorithms, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					for _, algorithm := range signatureAlgorithms {
+						b.AddUint16(algorithm)
+					}
+				})
+			})
+			addExtension(b, extKeyShare, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					for _, share := range shares {
+						b.AddUint16(share.group)
+						b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+							b.AddBytes(share.key.PublicKey().Bytes())
+						})
+					}
+				})
+			})
+			addExtension(b, extPSKModes, func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(1) // psk_dhe_ke
+				})
+			})
+			addExtension(b, extSupportedVersions, func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(versionTLS13)
+				})
+			})
+		})
+	})
+	// type, length, version and random come before the session ID length
+	return b.BytesOrPanic(), 1 + 3 + 2 + RandomSize + 1
+}
+
+func addExtension(b *cryptobyte.Builder, id uint16, body cryptobyte.BuilderContinuation) {
+	b.AddUint16(id)
+	b.AddUint16LengthPrefixed(body)
+}
+
+// serverHello holds the fields of the ServerHello the client uses.
+type serverHello struct {
+	random     []byte
+	suite      uint16
+	version    uint16
+	shareGroup uint16
+	shareKey   []byte
+}
+
+func parseServerHello(message []byte) (*serverHello, error) {
+	s := cryptobyte.String(message[4:])
+	hello := &serverHello{}
+	var legacyVersion uint16
+	var sessionID, extensions cryptobyte.String
+	var compression uint8
+	if !s.ReadUint16(&legacyVersion) || !s.ReadBytes(&hello.random, RandomSize) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) || !s.ReadUint16(&hello.suite) ||
+		!s.ReadUint8(&compression) || !s.ReadUint16LengthPrefixed(&extensions) || !s.Empty() {
+		return nil, fmt.Errorf("%w: malformed ServerHello", ErrBadMessage)
+	}
+	if bytes.Equal(hello.random, helloRetryRandom[:]) {
+		return nil, fmt.Errorf("%w: HelloRetryRequest", ErrUnsupported)
+	}
+	for !extensions.Empty() {
+		var id uint16
+		var body cryptobyte.String
+		if !extensions.ReadUint16(&id) || !extensions.ReadUint16LengthPrefixed(&body) {
+			return nil, fmt.Errorf("%w: malformed ServerHello extensions", ErrBadMessage)
+		}
+		switch id {
+		case extSupportedVersions:
+			if !body.ReadUint16(&hello.version) {
+				return nil, fmt.Errorf("%w: malformed supported_versions", ErrBadMessage)
+			}
+		case extKeyShare:
+			if !body.ReadUint16(&hello.shareGroup) || !body.ReadUint16LengthPrefixed((*cryptobyte.String)(&hello.shareKey)) {
+				return nil, fmt.Errorf("%w: malformed key_share", ErrBadMessage)
+			}
+		}
+	}
+	if hello.version != versionTLS13 {
+		return nil, fmt.Errorf("%w: version %#04x", ErrUnsupported, hello.version)
+	}
+	return hello, nil
+}
+
+// parseEncryptedExtensions returns the protocol selected with ALPN.
+func parseEncryptedExtensions(message []byte) (string, error) {
+	s := cryptobyte.String(message[4:])
+	var extensions cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&extensions) || !s.Empty() {
+		return "", fmt.Errorf("%w: malformed EncryptedExtensions", ErrBadMessage)
+	}
+	for !extensions.Empty() {
+		var id uint16
+		var body cryptobyte.String
+		if !extensions.ReadUint16(&id) || !extensions.ReadUint16LengthPrefixed(&body) {
+			return "", fmt.Errorf("%w: malformed EncryptedExtensions", ErrBadMessage)
+		}
+		if id == extALPN {
+			var protos, proto cryptobyte.String
+			if !body.ReadUint16LengthPrefixed(&protos) || !protos.ReadUint8LengthPrefixed(&proto) {
+				return "", fmt.Errorf("%w: malformed ALPN", ErrBadMessage)
+			}
+			return string(proto), nil
+		}
+	}
+	return "", nil
+}
+
+// parseCertificate returns the certificates of a Certificate message.
+func parseCertificate(message []byte) ([][]byte, error) {
+	s := cryptobyte.String(message[4:])
+	var context, list cryptobyte.String
+	if !s.ReadUint8LengthPrefixed(&context) || !s.ReadUint24LengthPrefixed(&list) || !s.Empty() {
+		return nil, fmt.Errorf("%w: malformed Certificate", ErrBadMessage)
+	}
+	var certificates [][]byte
+	for !list.Empty() {
+		var certificate, extensions cryptobyte.String
+		if !list.ReadUint24LengthPrefixed(&certificate) || !list.ReadUint16LengthPrefixed(&extensions) {
+			return nil, fmt.Errorf("%w: malformed Certificate", ErrBadMessage)
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
@@ -0,0 +1,95 @@
+// Package tls13 is a small TLS 1.3 client handshake on top of x/crypto.
+// The protocols that hide behind TLS need control over the ClientHello,
+// which crypto/tls does not give.
+package tls13
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+)
+
+const (
+	recordHeaderSize = 5
+	maxPlaintext     = 16384
+	maxCiphertext    = maxPlaintext + 256
+
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+
+	typeClientHello         = 1
+	typeServerHello         = 2
+	typeNewSessionTicket    = 4
+	typeEncryptedExtensions = 8
+	typeCertificate         = 11
+	typeCertificateRequest  = 13
+	typeCertificateVerify   = 15
+	typeFinished            = 20
+
+	versionTLS12 = 0x0303
+	versionTLS13 = 0x0304
+
+	// SessionIDSize is the size of the legacy session ID the client sends.
+	SessionIDSize = 32
+	// RandomSize is the size of the client and server randoms.
+	RandomSize = 32
+)
+
+var (
+	// ErrUnsupported means the server did not answer with TLS 1.3 and the
+	// parameters the client offered.
+	ErrUnsupported = errors.New("tls13: unsupported server parameters")
+	// ErrBadMessage means the server sent a malformed or unexpected
+	// message.
+	ErrBadMessage = errors.New("tls13: bad message")
+	// ErrVerify means the server certificate was not accepted, or its
+	// CertificateVerify or Finished message did not match the handshake.
+	ErrVerify = errors.New("tls13: verification failed")
+	// ErrAlert means the server sent an alert.
+	ErrAlert = errors.New("tls13: alert")
+)
+
+// Config describes the ClientHello and how the server is verified.
+type Config struct {
+	// ServerName is sent in the server_name extension, unless it is an IP
+	// address, and the server certificate must be valid for it.
+	ServerName string
+	// NextProtos are offered in the ALPN extension.
+	NextProtos []string
+	// SessionID, if set, fills the legacy session ID. It is called with
+	// the encoded ClientHello handshake message, whose session ID is still
+	// zeroed, and sessionID, the slice of it to fill in place.
+	SessionID func(hello, sessionID []byte) error
+	// Rand is the source of the randoms and keys, crypto/rand by default.
+	Rand io.Reader
+	// RootCAs verifies the certificate chain, the system roots being used
+	// when it is nil.
+	RootCAs *x509.CertPool
+	// PinnedSHA256 accepts the server when its leaf certificate has one of
+	// these SHA-256 digests, or chains to a certificate it sent that has
+	// one, instead of verifying the chain against RootCAs. A leaf that is
+	// not pinned itself still has to match ServerName.
+	PinnedSHA256 [][]byte
+	// InsecureSkipVerify accepts any certificate, and does not check that
+	// the server holds its key.
+	InsecureSkipVerify bool
+}
+
+// State is the outcome of a handshake.
+type State struct {
+	// ServerRandom is the random of the ServerHello.
+	ServerRandom []byte
+	// CipherSuite is the suite the server picked.
+	CipherSuite uint16
+	// NegotiatedProtocol is the protocol selected with ALPN, if any.
+	NegotiatedProtocol string
+	// PeerCertificates are the DER certificates the server sent, leaf
+	// first.
+	PeerCertificates [][]byte
+
+	suite        *cipherSuite
+	clientSecret []byte
+	serverSecret []byte
+}
@@ -0,0 +1,363 @@
+package tls13
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate for name and a pool
+// trusting it.
+func testCertificate(t *testing.T, name string, key crypto.Signer) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("failed to create a certificate: %v", err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// serveTLS runs one handshake with crypto/tls and reports the result
+// along with the name and protocols the client asked for. The server conn
+// is then handed to serve, if set.
+func serveTLS(t *testing.T, config *tls.Config, serve func(*tls.Conn)) (net.Conn, chan error, chan *tls.ClientHelloInfo) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	t.Cleanup(func() { client.Close(); server.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	hellos, result := make(chan *tls.ClientHelloInfo, 1), make(chan error, 1)
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		hellos <- hello
+		return nil, nil
+	}
+	go func() {
+		conn := tls.Server(server, config)
+		err := conn.Handshake()
+		result <- err
+		if err == nil && serve != nil {
+			serve(conn)
+		}
+	}()
+	return client, result, hellos
+}
+
+func TestHandshake(t *testing.T) {
+	ecdsaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+	for _, key := range []crypto.Signer{ecdsaKey, rsaKey, ed25519Key} {
+		for _, clientAuth := range []tls.ClientAuthType{tls.NoClientCert, tls.RequestClientCert} {
+			certificate, pool := testCertificate(t, "example.com", key)
+			conn, result, hellos := serveTLS(t, &tls.Config{
+				Certificates: []tls.Certificate{certificate},
+				NextProtos:   []string{"h2", "http/1.1"},
+				ClientAuth:   clientAuth,
+			}, nil)
+			var sessionID []byte
+			state, err := Handshake(conn, &Config{
+				ServerName: "example.com",
+				NextProtos: []string{"http/1.1"},
+				RootCAs:    pool,
+				SessionID: func(hello, id []byte) error {
+					if !bytes.Equal(id, make([]byte, SessionIDSize)) {
+						t.Error("Expected the session ID to be zeroed")
+					}
+					copy(id, "tagged")
+					sessionID = hello
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("Handshake with a %T failed: %v", key, err)
+			}
+			hello := <-hellos
+			if hello.ServerName != "example.com" || len(hello.SupportedProtos) != 1 {
+				t.Errorf("Unexpected ClientHello %q %v", hello.ServerName, hello.SupportedProtos)
+			}
+			if !bytes.Contains(sessionID, []byte("tagged")) {
+				t.Error("Expected the session ID to be filled in place")
+			}
+			if state.NegotiatedProtocol != "http/1.1" || len(state.ServerRandom) != RandomSize {
+				t.Errorf("Unexpected state %q %x", state.NegotiatedProtocol, state.ServerRandom)
+			}
+			if len(state.PeerCertificates) != 1 || !bytes.Equal(state.PeerCertificates[0], certificate.Certificate[0]) {
+				t.Error("Expected the server certificate")
+			}
+			if err := <-result; err != nil {
+				t.Errorf("Expected the server to accept the handshake, got %v", err)
+			}
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certificate, pool := testCertificate(t, "example.com", key)
+	_, otherPool := testCertificate(t, "example.com", key)
+	pin := sha256.Sum256(certificate.Certificate[0])
+	for _, tc := range []struct {
+		name     string
+		config   Config
+		expected error
+	}{
+		{"trusted", Config{ServerName: "example.com", RootCAs: pool}, nil},
+		{"unknown authority", Config{ServerName: "example.com", RootCAs: otherPool}, ErrVerify},
+		{"wrong name", Config{ServerName: "example.org", RootCAs: pool}, ErrVerify},
+		{"pinned", Config{ServerName: "example.org", PinnedSHA256: [][]byte{pin[:]}}, nil},
+		{"wrong pin", Config{ServerName: "example.com", RootCAs: pool, PinnedSHA256: [][]byte{make([]byte, 32)}}, ErrVerify},
+		{"insecure", Config{ServerName: "example.org", InsecureSkipVerify: true}, nil},
+	} {
+		conn, _, _ := serveTLS(t, &tls.Config{Certificates: []tls.Certificate{certificate}}, nil)
+		if _, err := Handshake(conn, &tc.config); !errors.Is(err, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestVerifyPinnedChain(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := testCertificate(t, "ca.example.com", caKey)
+	caCertificate, _ := x509.ParseCertificate(ca.Certificate[0])
+	pin := sha256.Sum256(ca.Certificate[0])
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, caCertificate, key.Public(), caKey)
+	if err != nil {
+		t.Fatalf("failed to create a certificate: %v", err)
+	}
+	// an attacker holding the pinned certificate, but not its key, puts
+	// it behind a leaf of its own
+	attackerKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	attacker, _ := testCertificate(t, "example.com", attackerKey)
+
+	for _, tc := range []struct {
+		name        string
+		serverName  string
+		certificate tls.Certificate
+		expected    error
+	}{
+		{"signed by the pin", "example.com", tls.Certificate{Certificate: [][]byte{leaf, ca.Certificate[0]}, PrivateKey: key}, nil},
+		{"for another host", "other.example.com", tls.Certificate{Certificate: [][]byte{leaf, ca.Certificate[0]}, PrivateKey: key}, ErrVerify},
+		{"behind another leaf", "example.com", tls.Certificate{Certificate: [][]byte{attacker.Certificate[0], ca.Certificate[0]}, PrivateKey: attackerKey}, ErrVerify},
+	} {
+		conn, _, _ := serveTLS(t, &tls.Config{Certificates: []tls.Certificate{tc.certificate}}, nil)
+		if _, err := Handshake(conn, &Config{ServerName: tc.serverName, PinnedSHA256: [][]byte{pin[:]}}); !errors.Is(err, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestHandshakeTLS12(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certificate, _ := testCertificate(t, "example.com", key)
+	conn, result, _ := serveTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MaxVersion:   tls.VersionTLS12,
+	}, nil)
+	if _, err := Handshake(conn, &Config{ServerName: "example.com", InsecureSkipVerify: true}); err == nil {
+		t.Error("Expected a TLS 1.2 server to be rejected")
+	}
+	conn.Close()
+	if err := <-result; err == nil {
+		t.Error("Expected the server handshake to fail")
+	}
+}
+
+func TestHandshakeAlert(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		buffer := make([]byte, 1024)
+		server.Read(buffer)
+		// handshake_failure
+		server.Write([]byte{recordAlert, 3, 3, 0, 2, 2, 40})
+		server.Close()
+	}()
+	if _, err := Handshake(client, &Config{ServerName: "example.com"}); !errors.Is(err, ErrAlert) {
+		t.Errorf("Expected ErrAlert, got %v", err)
+	}
+}
+
+// injectingConn slips a record into what the server sends, right after
+// its first record, the ServerHello.
+type injectingConn struct {
+	net.Conn
+	record   []byte
+	pending  []byte
+	injected bool
+}
+
+func (c *injectingConn) Read(p []byte) (int, error) {
+	if !c.injected {
+		c.injected = true
+		header := make([]byte, recordHeaderSize)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header[3:]))
+		if _, err := io.ReadFull(c.Conn, payload); err != nil {
+			return 0, err
+		}
+		c.pending = append(append(header, payload...), c.record...)
+	}
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func TestHandshakeInjectedRecord(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certificate, pool := testCertificate(t, "example.com", key)
+	for _, tc := range []struct {
+		name   string
+		record []byte
+	}{
+		// an empty record adds nothing to the handshake, so only the
+		// record type can give it away
+		{"empty handshake", []byte{recordHandshake, 3, 3, 0, 0}},
+		{"alert", []byte{recordAlert, 3, 3, 0, 2, 2, 40}},
+	} {
+		raw, _, _ := serveTLS(t, &tls.Config{Certificates: []tls.Certificate{certificate}}, nil)
+		conn := &injectingConn{Conn: raw, record: tc.record}
+		if _, err := Handshake(conn, &Config{ServerName: "example.com", RootCAs: pool}); !errors.Is(err, ErrBadMessage) {
+			t.Errorf("%s: expected a plaintext record after ServerHello to be rejected with ErrBadMessage, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certificate, pool := testCertificate(t, "example.com", key)
+	// echo until the client closes its side, then close
+	raw, _, _ := serveTLS(t, &tls.Config{Certificates: []tls.Certificate{certificate}}, func(conn *tls.Conn) {
+		io.Copy(conn, conn)
+		conn.Close()
+	})
+	state, err := Handshake(raw, &Config{ServerName: "example.com", RootCAs: pool})
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	conn, err := NewConn(raw, state)
+	if err != nil {
+		t.Fatalf("NewConn failed: %v", err)
+	}
+	for _, payload := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("x"), 100000)} {
+		if n, err := conn.Write(payload); err != nil || n != len(payload) {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+		echoed := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, echoed); err != nil {
+			t.Fatalf("ReadFull failed: %v", err)
+		}
+		if !bytes.Equal(echoed, payload) {
+			t.Fatalf("Expected %d bytes to be echoed", len(payload))
+		}
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected close_notify to end the stream, got %v", err)
+	}
+}
+
+// stingyConn takes at most a few bytes per write and refuses every other
+// one with EAGAIN, like a full socket buffer.
+type stingyConn struct {
+	net.Conn
+	refuse bool
+}
+
+func (c *stingyConn) Write(p []byte) (int, error) {
+	if c.refuse = !c.refuse; c.refuse {
+		return 0, syscall.EAGAIN
+	}
+	return c.Conn.Write(p[:min(len(p), 1000)])
+}
+
+func TestConnShortWrites(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certificate, pool := testCertificate(t, "example.com", key)
+	raw, _, _ := serveTLS(t, &tls.Config{Certificates: []tls.Certificate{certificate}}, func(conn *tls.Conn) {
+		io.Copy(conn, conn)
+		conn.Close()
+	})
+	state, err := Handshake(raw, &Config{ServerName: "example.com", RootCAs: pool})
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	conn, err := NewConn(&stingyConn{Conn: raw}, state)
+	if err != nil {
+		t.Fatalf("NewConn failed: %v", err)
+	}
+	for _, payload := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("x"), 100000)} {
+		// retried like a caller polling for writability would
+		for data := payload; ; {
+			n, err := conn.Write(data)
+			data = data[n:]
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, syscall.EAGAIN) {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		echoed := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, echoed); err != nil {
+			t.Fatalf("ReadFull failed: %v", err)
+		}
+		if !bytes.Equal(echoed, payload) {
+			t.Fatalf("Expected %d bytes to be echoed", len(payload))
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package tls13
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"slices"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// verifyCertificates checks the chain the server sent against the pins or
+// the roots of config and returns the leaf.
+func (c *Config) verifyCertificates(certificates [][]byte) (*x509.Certificate, error) {
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("%w: no certificate", ErrVerify)
+	}
+	parsed := make([]*x509.Certificate, len(certificates))
+	for i, der := range certificates {
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrVerify, err)
+		}
+		parsed[i] = certificate
+	}
+	intermediates := x509.NewCertPool()
+	for _, certificate := range parsed[1:] {
+		intermediates.AddCert(certificate)
+	}
+	if len(c.PinnedSHA256) > 0 {
+		// a pinned leaf is trusted as is, otherwise the leaf has to chain
+		// to a pinned certificate, which then is the only root
+		roots := x509.NewCertPool()
+		var pinned bool
+		for i, der := range certificates {
+			digest := sha256.Sum256(der)
+			if !slices.ContainsFunc(c.PinnedSHA256, func(pin []byte) bool { return bytes.Equal(pin, digest[:]) }) {
+				continue
+			}
+			if i == 0 {
+				return parsed[0], nil
+			}
+			roots.AddCert(parsed[i])
+			pinned = true
+		}
+		if !pinned {
+			return nil, fmt.Errorf("%w: no pinned certificate in the chain", ErrVerify)
+		}
+		// the pins stand in for the roots, the name is checked all the same
+		if _, err := parsed[0].Verify(x509.VerifyOptions{DNSName: c.ServerName, Roots: roots, Intermediates: intermediates}); err != nil {
+			return nil, fmt.Errorf("%w: the leaf does not verify against the pinned certificates: %w", ErrVerify, err)
+		}
+		return parsed[0], nil
+	}
+	_, err := parsed[0].Verify(x509.VerifyOptions{
+		DNSName:       c.ServerName,
+		Roots:         c.RootCAs,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrVerify, err)
+	}
+	return parsed[0], nil
+}
+
+// verifyCertificateVerify checks that the server signed the transcript with
+// the key of its certificate, as RFC 8446, section 4.4.3 describes.
+func verifyCertificateVerify(leaf *x509.Certificate, suite *cipherSuite, transcript, message []byte) error {
+	s := cryptobyte.String(message[4:])
+	var scheme uint16
+	var signature cryptobyte.String
+	if !s.ReadUint16(&scheme) || !s.ReadUint16LengthPrefixed(&signature) || !s.Empty() {
+		return fmt.Errorf("%w: malformed CertificateVerify", ErrBadMessage)
+	}
+	signed := bytes.Repeat([]byte{0x20}, 64)
+	signed = append(signed, "TLS 1.3, server CertificateVerify\x00"...)
+	signed = append(signed, suite.transcriptHash(transcript)...)
+
+	var valid bool
+	switch scheme {
+	case 0x0403, 0x0503:
+		hash := crypto.SHA256
+		if scheme == 0x0503 {
+			hash = crypto.SHA384
+		}
+		key, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+		valid = ok && ecdsa.VerifyASN1(key, digest(hash, signed), signature)
+	case 0x0804, 0x0805, 0x0806:
+		hash := map[uint16]crypto.Hash{0x0804: crypto.SHA256, 0x0805: crypto.SHA384, 0x0806: crypto.SHA512}[scheme]
+		key, ok := leaf.PublicKey.(*rsa.PublicKey)
+		valid = ok && rsa.VerifyPSS(key, hash, digest(hash, signed), signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case 0x0807:
+		key, ok := leaf.PublicKey.(ed25519.PublicKey)
+		valid = ok && ed25519.Verify(key, signed, signature)
+	default:
+		return fmt.Errorf("%w: signature scheme %#04x", ErrUnsupported, scheme)
+	}
+	if !valid {
+		return fmt.Errorf("%w: CertificateVerify", ErrVerify)
+	}
+	return nil
+}
+
+func digest(hash crypto.Hash, data []byte) []byte {
+	h := hash.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// isIP reports whether name is an IP address, which is verified against
+// the certificate but not sent as SNI.
+func isIP(name string) bool {
+	return net.ParseIP(name) != nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/config"
+)
+
+// clock abstracts time for the write jitter so tests can check the delays
+// without sleeping.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// maxJitterMs bounds the delay of a jittered write. Non-blocking conns
+// hold delayed writes until the next read or write, so a long delay would
+// leave data queued for as long.
+const maxJitterMs = 1000
+
+// jitterPolicy delays the first writes that follow the request flight by
+// a random duration between min and max, optionally splitting each of them
+// in two parts sent one delay apart.
+type jitterPolicy struct {
+	writes   int
+	min, max time.Duration
+	split    bool
+	clock    clock
+}
+
+// newJitterPolicy validates the jitter settings of cfg, returning nil when
+// jitter is disabled.
+func newJitterPolicy(cfg *config.Config) (*jitterPolicy, error) {
+	if cfg.JitterWrites == 0 {
+		return nil, nil
+	}
+	switch {
+	case cfg.JitterWrites < 0:
+		return nil, fmt.Errorf("%w: jitter_writes %d is negative", ErrInvalidJitter, cfg.JitterWrites)
+	case cfg.JitterMinMs < 0:
+		return nil, fmt.Errorf("%w: jitter_min_ms %d is negative", ErrInvalidJitter, cfg.JitterMinMs)
+	case cfg.JitterMaxMs < cfg.JitterMinMs:
+		return nil, fmt.Errorf("%w: jitter_max_ms %d is below jitter_min_ms %d", ErrInvalidJitter, cfg.JitterMaxMs, cfg.JitterMinMs)
+	case cfg.JitterMaxMs > maxJitterMs:
+		return nil, fmt.Errorf("%w: jitter_max_ms %d is above %d", ErrInvalidJitter, cfg.JitterMaxMs, maxJitterMs)
+	}
+	return &jitterPolicy{
+		writes: cfg.JitterWrites,
+		min:    time.Duration(cfg.JitterMinMs) * time.Millisecond,
+		max:    time.Duration(cfg.JitterMaxMs) * time.Millisecond,
+		split:  cfg.JitterSplit,
+		clock:  systemClock{},
+	}, nil
+}
+
+func (p *jitterPolicy) delay() time.Duration {
+	return p.min + time.Duration(rand.Int63n(int64(p.max-p.min)+1))
+}
+
+// jitter is the per-connection state of a jitterPolicy: the number of
+// writes still to delay and the segments waiting for their due time.
+type jitter struct {
+	*jitterPolicy
+	remaining int
+	queue     []jitterSegment
+}
+
+type jitterSegment struct {
+	data []byte
+	due  time.Time
+}
+
+func (p *jitterPolicy) newJitter() *jitter {
+	if p == nil {
+		return nil
+	}
+	return &jitter{jitterPolicy: p, remaining: p.writes}
+}
+
+// active reports whether writes still have to go through the jitter.
+func (j *jitter) active() bool {
+	return j != nil && (j.remaining > 0 || len(j.queue) > 0)
+}
+
+// schedule queues p behind the segments already waiting. Data arriving
+// once the jittered writes are used up keeps its place in the queue but
+// is not delayed any further.
+func (j *jitter) schedule(p []byte) {
+	due := j.clock.Now()
+	if len(j.queue) > 0 {
+		due = j.queue[len(j.queue)-1].due
+	}
+	if j.remaining == 0 {
+		j.queue = append(j.queue, jitterSegment{data: bytes.Clone(p), due: due})
+		return
+	}
+	j.remaining--
+	if j.split && len(p) > 1 {
+		cut := 1 + rand.Intn(len(p)-1)
+		due = due.Add(j.delay())
+		j.queue = append(j.queue, jitterSegment{data: bytes.Clone(p[:cut]), due: due})
+		p = p[cut:]
+	}
+	j.queue = append(j.queue, jitterSegment{data: bytes.Clone(p), due: due.Add(j.delay())})
+}
+
+// writeJittered schedules p and sends whatever is due. Blocking conns
+// sleep until the whole queue is sent; non-blocking conns never sleep, the
+// remaining segments are released by later reads and writes instead, since
+// sleeping would stall the whole WATM worker. Once queued p counts as
+// written, even when sending fails, so a retry does not queue it twice.
+func (c *ClientConn) writeJittered(p []byte) (int, error) {
+	c.jitter.schedule(p)
+	return len(p), c.releaseJitter(false)
+}
+
+// releaseJitter writes the queued segments that are due, waiting for the
+// others on blocking conns. With force set every segment is written right
+// away, which is what closing the connection needs.
+func (c *ClientConn) releaseJitter(force bool) error {
+	if c.jitter == nil {
+		return nil
+	}
+	for len(c.jitter.queue) > 0 {
+		segment := c.jitter.queue[0]
+		if wait := segment.due.Sub(c.jitter.clock.Now()); wait > 0 && !force {
+			if c.nonBlocking {
+				return nil
+			}
+			c.jitter.clock.Sleep(wait)
+		}
+		if _, err := c.writer.Write(segment.data); err != nil {
+			return err
+		}
+		c.jitter.queue[0] = jitterSegment{}
+		c.jitter.queue = c.jitter.queue[1:]
+		c.touch()
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+// fakeClock records the requested sleeps and advances its time by them.
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+}
+
+func newJitterDialer(t *testing.T, cfg config.Config) (*Dialer, *fakeClock) {
+	t.Helper()
+	cfg.Method = "chacha20-ietf-poly1305"
+	cfg.Password = "testpass"
+	d, err := newDialerFromConfig(&cfg)
+	if err != nil {
+		t.Fatalf("newDialerFromConfig failed: %v", err)
+	}
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	d.jitterPolicy.clock = clock
+	return d, clock
+}
+
+func TestNewJitterPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   config.Config
+		valid bool
+	}{
+		{"disabled", config.Config{}, true},
+		{"range", config.Config{JitterWrites: 3, JitterMinMs: 5, JitterMaxMs: 40}, true},
+		{"negative writes", config.Config{JitterWrites: -1}, false},
+		{"negative min", config.Config{JitterWrites: 1, JitterMinMs: -5, JitterMaxMs: 40}, false},
+		{"inverted range", config.Config{JitterWrites: 1, JitterMinMs: 40, JitterMaxMs: 5}, false},
+		{"max at the cap", config.Config{JitterWrites: 1, JitterMaxMs: maxJitterMs}, true},
+		{"max above the cap", config.Config{JitterWrites: 1, JitterMaxMs: maxJitterMs + 1}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newJitterPolicy(&tc.cfg)
+			if tc.valid && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if !tc.valid && !errors.Is(err, ErrInvalidJitter) {
+				t.Errorf("Expected ErrInvalidJitter, got %v", err)
+			}
+		})
+	}
+}
+
+func TestClientConn_JitterDelaysFirstWrites(t *testing.T) {
+	minDelay, maxDelay := 10*time.Millisecond, 50*time.Millisecond
+	d, clock := newJitterDialer(t, config.Config{JitterWrites: 2, JitterMinMs: 10, JitterMaxMs: 50})
+	writeBuf := &bytes.Buffer{}
+	conn := &mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf}
+	clientConn, err := d.DialConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+	if err != nil {
+		t.Fatalf("DialConn failed: %v", err)
+	}
+	if len(clock.sleeps) != 0 {
+		t.Fatalf("Expected the request flight not to be delayed, slept %v", clock.sleeps)
+	}
+
+	for _, p := range []string{"first", "second", "third"} {
+		if n, err := clientConn.Write([]byte(p)); err != nil || n != len(p) {
+			t.Fatalf("Write(%q) = %d, %v", p, n, err)
+		}
+	}
+	if len(clock.sleeps) != 2 {
+		t.Fatalf("Expected only the first 2 writes to be delayed, slept %v", clock.sleeps)
+	}
+	for _, delay := range clock.sleeps {
+		if delay < minDelay || delay > maxDelay {
+			t.Errorf("Expected delay within %v..%v, got %v", minDelay, maxDelay, delay)
+		}
+	}
+	if _, got := decodeRequest(t, d, writeBuf.Bytes()); string(got) != "firstsecondthird" {
+		t.Errorf("Unexpected stream %q", got)
+	}
+}
+
+func TestClientConn_JitterSplitsWrites(t *testing.T) {
+	d, clock := newJitterDialer(t, config.Config{JitterWrites: 1, JitterMinMs: 10, JitterMaxMs: 50, JitterSplit: true})
+	writeBuf := &bytes.Buffer{}
+	conn := &mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf}
+	clientConn, _ := d.DialConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+	requestLen := writeBuf.Len()
+
+	clientConn.Write([]byte("hello world"))
+	if len(clock.sleeps) != 2 {
+		t.Fatalf("Expected a delay before each half, slept %v", clock.sleeps)
+	}
+	if expected := 2*chunkOverhead + len("hello world"); writeBuf.Len()-requestLen != expected {
+		t.Errorf("Expected the write to be split in 2 chunks of %d bytes in total, got %d", expected, writeBuf.Len()-requestLen)
+	}
+	if _, got := decodeRequest(t, d, writeBuf.Bytes()); string(got) != "hello world" {
+		t.Errorf("Unexpected stream %q", got)
+	}
+}
+
+func TestClientConn_JitterNonBlocking(t *testing.T) {
+	d, clock := newJitterDialer(t, config.Config{JitterWrites: 1, JitterMinMs: 20, JitterMaxMs: 20})
+	writeBuf := &bytes.Buffer{}
+	conn := &mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf}
+	clientConn, _ := d.DialConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+	clientConn.SetNonBlock(true)
+	requestLen := writeBuf.Len()
+
+	if n, err := clientConn.Write([]byte("held")); err != nil || n != 4 {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	// later data queues behind the delayed write to keep the stream order
+	clientConn.Write([]byte("next"))
+	if len(clock.sleeps) != 0 || writeBuf.Len() != requestLen {
+		t.Fatalf("Expected non-blocking writes to be queued without sleeping, slept %v", clock.sleeps)
+	}
+
+	clock.now = clock.now.Add(19 * time.Millisecond)
+	clientConn.Read(make([]byte, 16))
+	if writeBuf.Len() != requestLen {
+		t.Fatal("Expected the write to be held until it is due")
+	}
+
+	clock.now = clock.now.Add(time.Millisecond)
+	clientConn.Read(make([]byte, 16))
+	if len(clock.sleeps) != 0 {
+		t.Errorf("Expected no sleep on a non-blocking conn, slept %v", clock.sleeps)
+	}
+	if _, got := decodeRequest(t, d, writeBuf.Bytes()); string(got) != "heldnext" {
+		t.Errorf("Expected queued writes to be released by a read once due, got %q", got)
+	}
+}
+
+func TestClientConn_JitterReleasedOnClose(t *testing.T) {
+	d, _ := newJitterDialer(t, config.Config{JitterWrites: 1, JitterMinMs: 1000, JitterMaxMs: 1000})
+	writeBuf := &bytes.Buffer{}
+	conn := &mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf}
+	clientConn, _ := d.DialConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+	clientConn.SetNonBlock(true)
+
+	clientConn.Write([]byte("pending"))
+	if err := clientConn.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, got := decodeRequest(t, d, writeBuf.Bytes()); string(got) != "pending" {
+		t.Errorf("Expected Close to send queued writes, got %q", got)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/getlantern/tiny-shadowsocks/internal/mux"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+// newMuxConfig validates the multiplexing settings of cfg, returning nil
+// when streams are not multiplexed.
+func newMuxConfig(cfg *config.Config) (*mux.Config, error) {
+	if !cfg.Multiplex {
+		return nil, nil
+	}
+	protocol, err := mux.ParseProtocol(cfg.MultiplexProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMultiplex, err)
+	}
+	if cfg.MultiplexMaxStreams < 0 || cfg.MultiplexIdleTimeoutMs < 0 {
+		return nil, fmt.Errorf("%w: negative max streams or idle timeout", ErrInvalidMultiplex)
+	}
+	return &mux.Config{
+		Protocol:    protocol,
+		Padding:     cfg.MultiplexPadding,
+		MaxStreams:  cfg.MultiplexMaxStreams,
+		IdleTimeout: time.Duration(cfg.MultiplexIdleTimeoutMs) * time.Millisecond,
+	}, nil
+}
+
+// newMuxSession starts a multiplexed session over conn, the wrapped conn to
+// the server.
+func (d *Dialer) newMuxSession(conn v1net.Conn) *mux.Session {
+	return mux.NewSession(d.DialEarlyConn(conn, mux.Destination), *d.mux)
+}
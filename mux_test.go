@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/getlantern/tiny-shadowsocks/internal/mux"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+)
+
+func TestNewMuxConfig(t *testing.T) {
+	if muxConfig, err := newMuxConfig(&config.Config{MultiplexProtocol: "yamux"}); muxConfig != nil || err != nil {
+		t.Errorf("Expected multiplexing to be off, got %+v, %v", muxConfig, err)
+	}
+	muxConfig, err := newMuxConfig(&config.Config{
+		Multiplex:              true,
+		MultiplexProtocol:      "yamux",
+		MultiplexPadding:       true,
+		MultiplexMaxStreams:    8,
+		MultiplexIdleTimeoutMs: 30000,
+	})
+	if err != nil {
+		t.Fatalf("newMuxConfig failed: %v", err)
+	}
+	expected := mux.Config{Protocol: mux.ProtocolYAMux, Padding: true, MaxStreams: 8, IdleTimeout: 30 * time.Second}
+	if *muxConfig != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *muxConfig)
+	}
+	for _, cfg := range []config.Config{
+		{Multiplex: true, MultiplexProtocol: "h2mux"},
+		{Multiplex: true, MultiplexMaxStreams: -1},
+		{Multiplex: true, MultiplexIdleTimeoutMs: -1},
+	} {
+		if _, err := newMuxConfig(&cfg); !errors.Is(err, ErrInvalidMultiplex) {
+			t.Errorf("Expected ErrInvalidMultiplex for %+v, got %v", cfg, err)
+		}
+	}
+}
+
+func TestShadowsocksWrappingTransport_Multiplex(t *testing.T) {
+	tp := &ShadowsocksWrappingTransport{}
+	err := tp.Configure([]byte(`{"method":"chacha20-ietf-poly1305","password":"abc123","remote_addr":"example.com","remote_port":"443","multiplex":true}`))
+	if err != nil {
+		t.Fatalf("Expected configuration success, got error: %v", err)
+	}
+	writeBuf := &bytes.Buffer{}
+	wrapped, err := tp.Wrap(&mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf})
+	if err != nil {
+		t.Fatalf("Wrap failed: %v", err)
+	}
+	if _, err = wrapped.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	destination, payload := decodeRequest(t, tp.dialer, writeBuf.Bytes())
+	if destination != mux.Destination {
+		t.Errorf("Expected the request to name %s, got %s", mux.Destination, destination)
+	}
+	// the smux header, then the SYN of stream 3
+	if !bytes.HasPrefix(payload, []byte{0, 0, 1, 0, 0, 0, 3, 0, 0, 0}) {
+		t.Errorf("Expected the session to open a stream, got %x", payload)
+	}
+	if !bytes.Contains(payload, []byte("example.com")) || !bytes.HasSuffix(payload, []byte("hello")) {
+		t.Errorf("Expected the stream request and the data, got %q", payload)
+	}
+}
+
+func TestShadowsocksFixedDialingTransport_Multiplex(t *testing.T) {
+	var dials int
+	fdt := &ShadowsocksFixedDialingTransport{}
+	fdt.SetDialer(func(network, address string) (v1net.Conn, error) {
+		dials++
+		return &mockConn{readBuf: &bytes.Buffer{}, writeBuf: &bytes.Buffer{}}, nil
+	})
+	err := fdt.Configure([]byte(`{"method":"chacha20-ietf-poly1305","password":"abc123","remote_addr":"example.com","remote_port":"443","multiplex":true,"multiplex_max_streams":2}`))
+	if err != nil {
+		t.Fatalf("Expected configuration success, got error: %v", err)
+	}
+	var streams []v1net.Conn
+	for range 3 {
+		stream, err := fdt.DialFixed()
+		if err != nil {
+			t.Fatalf("DialFixed failed: %v", err)
+		}
+		streams = append(streams, stream)
+	}
+	if dials != 2 {
+		t.Errorf("Expected two streams per connection, dialed %d", dials)
+	}
+	// a stream closing makes room on its connection
+	streams[0].Close()
+	if _, err := fdt.DialFixed(); err != nil {
+		t.Fatalf("DialFixed failed: %v", err)
+	}
+	if dials != 2 {
+		t.Errorf("Expected the connection to be reused, dialed %d", dials)
+	}
+}
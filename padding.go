@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+
+	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/getlantern/tiny-shadowsocks/internal/shadowio"
+)
+
+// maxRandomPadding is the upper bound of the random padding policy, the
+// range Shadowsocks 2022 clients use for their variable-length header.
+const maxRandomPadding = 900
+
+// chunkOverhead is what every chunk adds to the wire on top of its
+// payload: the encrypted length and the two tags.
+const chunkOverhead = shadowio.PacketLengthBufferSize + 2*shadowio.Overhead
+
+// defaultPaddingBuckets are the initial flight sizes the bucket policy
+// pads to when none are configured.
+var defaultPaddingBuckets = []int{256, 512, 1024, 1400}
+
+// paddingPolicy returns how many bytes of padding to add to an initial
+// flight of the given length.
+type paddingPolicy func(length int) int
+
+// newPaddingPolicy validates the padding settings of cfg, returning nil
+// when the initial flight is not padded.
+func newPaddingPolicy(cfg *config.Config) (paddingPolicy, error) {
+	switch cfg.PaddingPolicy {
+	case "", "none":
+		return nil, nil
+	case "random":
+		return func(int) int {
+			return rand.Intn(maxRandomPadding + 1)
+		}, nil
+	case "bucket":
+		buckets := slices.Clone(cfg.PaddingBuckets)
+		if len(buckets) == 0 {
+			buckets = defaultPaddingBuckets
+		}
+		for _, bucket := range buckets {
+			if bucket < 1 {
+				return nil, fmt.Errorf("%w: padding_buckets entry %d is not positive", ErrInvalidPadding, bucket)
+			}
+		}
+		slices.Sort(buckets)
+		return func(length int) int {
+			for _, bucket := range buckets {
+				if bucket >= length {
+					return bucket - length
+				}
+			}
+			return 0
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown padding_policy %q", ErrInvalidPadding, cfg.PaddingPolicy)
+	}
+}
+
+// requestChunkSizes pads the initial flight of a legacy AEAD connection,
+// the only kind the dialer supports. Those chunks carry no padding field,
+// so the flight grows by splitting the address and first payload into
+// more chunks, each one adding chunkOverhead bytes. The flight therefore
+// lands at most chunkOverhead-1 bytes past the padded length, and short
+// contents can only be split into as many chunks as they have bytes.
+func (c *ClientConn) requestChunkSizes(contentLength int) []int {
+	chunks := (contentLength + MaxPacketSize - 1) / MaxPacketSize
+	flightLength := c.keySaltLength + chunks*chunkOverhead + contentLength
+	padding := c.padding(flightLength)
+	chunks = min(chunks+(padding+chunkOverhead-1)/chunkOverhead, contentLength)
+	if chunks <= 1 {
+		return nil
+	}
+	sizes := make([]int, chunks)
+	for i := range sizes {
+		sizes[i] = contentLength / chunks
+		if i < contentLength%chunks {
+			sizes[i]++
+		}
+	}
+	return sizes
+}
+
+// paddedChunkSize sizes the request chunks from padding, which counts them
+// on its own. The policy shared with the stream is still asked once per
+// chunk so that a limit on its first chunks counts the padded request too.
+type paddedChunkSize struct {
+	padding shadowio.ChunkPolicy
+	shared  shadowio.ChunkPolicy
+}
+
+func (p *paddedChunkSize) NextChunkSize() int {
+	if p.shared != nil {
+		p.shared.NextChunkSize()
+	}
+	return p.padding.NextChunkSize()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+func TestNewPaddingPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   config.Config
+		valid bool
+	}{
+		{"default", config.Config{}, true},
+		{"none", config.Config{PaddingPolicy: "none"}, true},
+		{"random", config.Config{PaddingPolicy: "random"}, true},
+		{"bucket", config.Config{PaddingPolicy: "bucket", PaddingBuckets: []int{1024, 512}}, true},
+		{"bucket with default buckets", config.Config{PaddingPolicy: "bucket"}, true},
+		{"bucket with zero size", config.Config{PaddingPolicy: "bucket", PaddingBuckets: []int{0}}, false},
+		{"unknown", config.Config{PaddingPolicy: "mtu"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newPaddingPolicy(&tc.cfg)
+			if tc.valid && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if !tc.valid && !errors.Is(err, ErrInvalidPadding) {
+				t.Errorf("Expected ErrInvalidPadding, got %v", err)
+			}
+		})
+	}
+}
+
+// initialFlight returns what the client writes when it opens a connection
+// with payload under the given padding settings.
+func initialFlight(t *testing.T, cfg config.Config, payload []byte) (*Dialer, []byte) {
+	t.Helper()
+	cfg.Method = "chacha20-ietf-poly1305"
+	cfg.Password = "testpass"
+	d, err := newDialerFromConfig(&cfg)
+	if err != nil {
+		t.Fatalf("newDialerFromConfig failed: %v", err)
+	}
+	writeBuf := &bytes.Buffer{}
+	conn := &mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf}
+	if _, err = d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080")).Write(payload); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, got := decodeRequest(t, d, writeBuf.Bytes()); !bytes.Equal(got, payload) {
+		t.Fatalf("Expected the server to decode the padded flight, got %q", got)
+	}
+	return d, writeBuf.Bytes()
+}
+
+func TestClientConn_PaddingBucket(t *testing.T) {
+	payload := []byte("GET / HTTP/1.1\r\n\r\n")
+	_, unpadded := initialFlight(t, config.Config{}, payload)
+	for _, bucket := range []int{256, 512} {
+		_, wire := initialFlight(t, config.Config{PaddingPolicy: "bucket", PaddingBuckets: []int{bucket}}, payload)
+		if len(wire) < bucket || len(wire) >= bucket+chunkOverhead {
+			t.Errorf("Expected the %d byte flight to be padded to %d..%d bytes, got %d", len(unpadded), bucket, bucket+chunkOverhead-1, len(wire))
+		}
+	}
+
+	// flights already past the last bucket are left alone
+	_, wire := initialFlight(t, config.Config{PaddingPolicy: "bucket", PaddingBuckets: []int{16}}, payload)
+	if len(wire) != len(unpadded) {
+		t.Errorf("Expected a flight above every bucket to stay %d bytes, got %d", len(unpadded), len(wire))
+	}
+}
+
+func TestClientConn_PaddingRandom(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 2000)
+	_, unpadded := initialFlight(t, config.Config{}, payload)
+	lengths := map[int]bool{}
+	for i := 0; i < 20; i++ {
+		_, wire := initialFlight(t, config.Config{PaddingPolicy: "random"}, payload)
+		padding := len(wire) - len(unpadded)
+		if padding < 0 || padding >= maxRandomPadding+chunkOverhead || padding%chunkOverhead != 0 {
+			t.Fatalf("Expected padding to be whole chunks within 0..%d bytes, got %d", maxRandomPadding+chunkOverhead-1, padding)
+		}
+		lengths[len(wire)] = true
+	}
+	if len(lengths) < 2 {
+		t.Error("Expected random padding to vary the flight length")
+	}
+}
+
+func TestClientConn_PaddingShortContent(t *testing.T) {
+	// a 7 byte IPv4 address and no payload can be split into 7 chunks at most
+	d, wire := initialFlight(t, config.Config{PaddingPolicy: "bucket", PaddingBuckets: []int{1400}}, nil)
+	if expected := d.keySaltLength + 7*chunkOverhead + 7; len(wire) != expected {
+		t.Errorf("Expected %d bytes, got %d", expected, len(wire))
+	}
+}
+
+func TestNewDialer_Padding2022Rejected(t *testing.T) {
+	_, err := newDialerFromConfig(&config.Config{Method: "2022-blake3-chacha20-poly1305", Password: "testpass", PaddingPolicy: "random"})
+	if !errors.Is(err, ErrUnsupportedMethod) {
+		t.Errorf("Expected ErrUnsupportedMethod, got %v", err)
+	}
+}
+
+func TestClientConn_PaddingCountsFirstChunks(t *testing.T) {
+	d, err := newDialerFromConfig(&config.Config{
+		Method:            "chacha20-ietf-poly1305",
+		Password:          "testpass",
+		ChunkPolicy:       "fixed",
+		ChunkSize:         100,
+		ChunkPolicyChunks: 4,
+		PaddingPolicy:     "bucket",
+		PaddingBuckets:    []int{512},
+	})
+	if err != nil {
+		t.Fatalf("newDialerFromConfig failed: %v", err)
+	}
+	writeBuf := &bytes.Buffer{}
+	conn := &mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf}
+	clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+
+	// the 7 byte address and 18 byte request are padded into 14 chunks,
+	// which use up the first chunks of the policy and leave the following
+	// write in a single chunk
+	request := []byte("GET / HTTP/1.1\r\n\r\n")
+	follow := bytes.Repeat([]byte("f"), 1000)
+	clientConn.Write(request)
+	clientConn.Write(follow)
+
+	if expected := d.keySaltLength + 15*chunkOverhead + 7 + len(request) + len(follow); writeBuf.Len() != expected {
+		t.Errorf("Expected %d bytes in 15 chunks on the wire, got %d", expected, writeBuf.Len())
+	}
+	_, got := decodeRequest(t, d, writeBuf.Bytes())
+	if !bytes.Equal(got, append(request, follow...)) {
+		t.Error("Expected the server to decode the padded stream")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin/grpc"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin/poll"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin/proxy"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin/shadowtls"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin/tls"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin/websocket"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+
+	// plugins register themselves when imported
+	_ "github.com/getlantern/tiny-shadowsocks/internal/plugin/kcptun"
+	_ "github.com/getlantern/tiny-shadowsocks/internal/plugin/obfs"
+)
+
+// newPlugin builds the plugin described by cfg, either named by Plugin or
+// implied by the dedicated fields of Obfs or Transport, below which TLS
+// runs when it is set, then the hops and the upstream proxy tunnel, or nil
+// when the conn to the server is used as is.
+func newPlugin(cfg *config.Config, hops []*hop) (plugin.Plugin, error) {
+	p, err := newStreamPlugin(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TLS {
+		if cfg.Transport == "shadowtls" {
+			return nil, fmt.Errorf("%w: tls cannot be combined with the shadowtls transport", ErrInvalidPluginOptions)
+		}
+		if serverNetwork(cfg) == "udp" {
+			return nil, fmt.Errorf("%w: tls cannot be combined with kcp", ErrInvalidPluginOptions)
+		}
+		tlsPlugin, err := newTLS(cfg)
+		if err != nil {
+			return nil, err
+		}
+		p = chainBelow(tlsPlugin, p)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		p = chainBelow(hops[i], p)
+	}
+	if cfg.Proxy != "" {
+		if serverNetwork(cfg) == "udp" {
+			return nil, fmt.Errorf("%w: a proxy cannot be combined with kcp", ErrInvalidPluginOptions)
+		}
+		// the proxy connects to the first server the conn passes
+		target := cfg.ServerAddr
+		if len(cfg.Hops) > 0 {
+			target = cfg.Hops[0].ServerAddr
+		}
+		proxyPlugin, err := proxy.New(proxy.Config{
+			Protocol: cfg.Proxy,
+			Target:   target,
+			Username: cfg.ProxyUsername,
+			Password: cfg.ProxyPassword,
+		})
+		if err != nil {
+			return nil, err
+		}
+		p = chainBelow(proxyPlugin, p)
+	}
+	return p, nil
+}
+
+// chainBelow returns a plugin running below first and then p, if any.
+func chainBelow(below, p plugin.Plugin) plugin.Plugin {
+	if p == nil {
+		return below
+	}
+	return plugin.Chain(below, p)
+}
+
+// newStreamPlugin builds the plugin selected by Plugin, Obfs or Transport,
+// which may not be combined.
+func newStreamPlugin(cfg *config.Config) (plugin.Plugin, error) {
+	var selected []string
+	for name, value := range map[string]string{"plugin": cfg.Plugin, "obfs": cfg.Obfs, "transport": cfg.Transport} {
+		if value != "" {
+			selected = append(selected, name)
+		}
+	}
+	if len(selected) > 1 {
+		slices.Sort(selected)
+		return nil, fmt.Errorf("%w: %s cannot be combined", ErrInvalidPluginOptions, strings.Join(selected, " and "))
+	}
+	switch {
+	case cfg.Obfs != "":
+		opts := plugin.Options{"obfs": cfg.Obfs}
+		if cfg.ObfsHost != "" {
+			opts["obfs-host"] = cfg.ObfsHost
+		}
+		if cfg.ObfsURI != "" {
+			opts["obfs-uri"] = cfg.ObfsURI
+		}
+		return plugin.NewFromOptions("obfs-local", opts)
+	case cfg.Transport != "":
+		return newTransport(cfg)
+	case cfg.Plugin != "":
+		return plugin.New(cfg.Plugin, cfg.PluginOpts)
+	}
+	return nil, nil
+}
+
+// newTransport builds the transport selected by cfg.Transport.
+func newTransport(cfg *config.Config) (plugin.Plugin, error) {
+	switch cfg.Transport {
+	case "websocket":
+		return websocket.New(websocket.Config{
+			Host:      cfg.WebSocketHost,
+			Path:      cfg.WebSocketPath,
+			Headers:   cfg.WebSocketHeaders,
+			EarlyData: cfg.WebSocketEarlyData,
+		})
+	case "grpc":
+		// RemoteAddr is the destination, which must not show in the clear
+		authority := cfg.GRPCAuthority
+		if authority == "" {
+			authority = cfg.ServerAddr
+		}
+		return grpc.New(grpc.Config{ServiceName: cfg.GRPCServiceName, Authority: authority, TLS: cfg.TLS})
+	case "shadowtls":
+		return shadowtls.New(shadowtls.Config{Password: cfg.ShadowTLSPassword, ServerName: cfg.ShadowTLSServerName})
+	case "kcp":
+		return plugin.NewFromOptions("kcptun", kcpOptions(cfg))
+	case "poll":
+		host := cfg.PollHost
+		if host == "" {
+			host = cfg.ServerAddr
+		}
+		return poll.New(poll.Config{
+			Host:        host,
+			Path:        cfg.PollPath,
+			Headers:     cfg.PollHeaders,
+			Proxy:       cfg.PollProxy,
+			MinInterval: time.Duration(cfg.PollMinIntervalMs) * time.Millisecond,
+			MaxInterval: time.Duration(cfg.PollMaxIntervalMs) * time.Millisecond,
+		})
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownTransport, cfg.Transport)
+}
+
+// kcpOptions translates the KCP fields of cfg to the options of the
+// kcptun plugin, leaving out those at their zero value so that kcptun's
+// defaults apply.
+func kcpOptions(cfg *config.Config) plugin.Options {
+	opts := plugin.Options{}
+	for name, value := range map[string]string{"key": cfg.KCPKey, "crypt": cfg.KCPCrypt, "mode": cfg.KCPMode} {
+		if value != "" {
+			opts[name] = value
+		}
+	}
+	for name, value := range map[string]int{
+		"interval":  cfg.KCPIntervalMs,
+		"resend":    cfg.KCPResend,
+		"mtu":       cfg.KCPMTU,
+		"sndwnd":    cfg.KCPSendWindow,
+		"rcvwnd":    cfg.KCPReceiveWindow,
+		"ds":        cfg.KCPDataShards,
+		"ps":        cfg.KCPParityShards,
+		"keepalive": cfg.KCPKeepAliveSec,
+	} {
+		if value != 0 {
+			opts[name] = strconv.Itoa(value)
+		}
+	}
+	for name, value := range map[string]bool{
+		"nodelay":    cfg.KCPNoDelay,
+		"nc":         cfg.KCPNoCongestion,
+		"nocomp":     cfg.KCPNoComp,
+		"acknodelay": cfg.KCPAckNoDelay,
+	} {
+		if value {
+			opts[name] = ""
+		}
+	}
+	if cfg.KCPDataShards < 0 || cfg.KCPParityShards < 0 {
+		// no FEC
+		opts["ds"], opts["ps"] = "0", "0"
+	}
+	return opts
+}
+
+// serverNetwork returns the network the conn to the server is dialed on,
+// UDP for KCP and TCP otherwise.
+func serverNetwork(cfg *config.Config) string {
+	if cfg.Transport == "kcp" || (cfg.Transport == "" && cfg.Obfs == "" && cfg.Plugin == "kcptun") {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// newTLS builds the TLS layer, reading the CA bundle file if one is
+// configured.
+func newTLS(cfg *config.Config) (plugin.Plugin, error) {
+	// the name goes out in the clear, so it is the server's and never
+	// the destination's
+	serverName := cfg.TLSServerName
+	if serverName == "" && cfg.ServerAddr != "" {
+		var err error
+		if serverName, _, err = net.SplitHostPort(cfg.ServerAddr); err != nil {
+			return nil, fmt.Errorf("%w: server_addr: %w", ErrInvalidPluginOptions, err)
+		}
+	}
+	alpn := cfg.TLSALPN
+	if len(alpn) == 0 {
+		switch cfg.Transport {
+		case "grpc":
+			alpn = []string{"h2"}
+		case "websocket", "poll":
+			alpn = []string{"http/1.1"}
+		}
+	}
+	rootCAs := []byte(cfg.TLSCA)
+	if cfg.TLSCAFile != "" {
+		bundle, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPluginOptions, err)
+		}
+		rootCAs = append(append(rootCAs, '\n'), bundle...)
+	}
+	p, err := tls.New(tls.Config{
+		ServerName:         serverName,
+		NextProtos:         alpn,
+		RootCAs:            rootCAs,
+		PinnedSHA256:       cfg.TLSPinnedSHA256,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// wrapConn runs a freshly dialed conn to the server through the configured
+// plugin, if any, before the shadowsocks layer is put on top of it.
+func (d *Dialer) wrapConn(conn v1net.Conn) (v1net.Conn, error) {
+	if d.plugin == nil {
+		return conn, nil
+	}
+	return d.plugin.WrapConn(conn)
+}
+
+// wrapRedial is wrapConn for conns the dialer can dial again with redial,
+// which a plugin.Redialer uses once the conn breaks.
+func (d *Dialer) wrapRedial(conn v1net.Conn, redial func() (v1net.Conn, error)) (v1net.Conn, error) {
+	if redialer, ok := d.plugin.(plugin.Redialer); ok {
+		return redialer.WrapRedial(conn, redial)
+	}
+	return d.wrapConn(conn)
+}
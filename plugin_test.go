@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"maps"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin"
+	"github.com/getlantern/tiny-shadowsocks/internal/plugin/poll"
+	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+func TestNewPlugin_ObfsFields(t *testing.T) {
+	for _, tc := range []struct {
+		obfs   string
+		prefix []byte
+	}{
+		{"http", []byte("GET /ws HTTP/1.1\r\nHost: cdn.example.com\r\n")},
+		{"tls", []byte{0x16, 0x03, 0x01}},
+	} {
+		t.Run(tc.obfs, func(t *testing.T) {
+			d, err := newDialerFromConfig(&config.Config{
+				Method:   "chacha20-ietf-poly1305",
+				Password: "testpass",
+				Obfs:     tc.obfs,
+				ObfsHost: "cdn.example.com",
+				ObfsURI:  "/ws",
+			})
+			if err != nil {
+				t.Fatalf("newDialerFromConfig failed: %v", err)
+			}
+			writeBuf := &bytes.Buffer{}
+			conn, err := d.wrapConn(&mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf})
+			if err != nil {
+				t.Fatalf("wrapConn failed: %v", err)
+			}
+			d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080")).Write([]byte("hello"))
+			if !bytes.HasPrefix(writeBuf.Bytes(), tc.prefix) {
+				t.Errorf("Expected the stream to start with %q, got %q", tc.prefix, writeBuf.Bytes()[:len(tc.prefix)])
+			}
+		})
+	}
+
+	_, err := newDialerFromConfig(&config.Config{
+		Method:   "chacha20-ietf-poly1305",
+		Password: "testpass",
+		Obfs:     "http",
+		Plugin:   "obfs-local",
+	})
+	if !errors.Is(err, ErrInvalidPluginOptions) {
+		t.Errorf("Expected obfs and plugin together to be rejected, got %v", err)
+	}
+}
+
+func TestNewPlugin_WebSocketTransport(t *testing.T) {
+	d, err := newDialerFromConfig(&config.Config{
+		Method:             "chacha20-ietf-poly1305",
+		Password:           "testpass",
+		Transport:          "websocket",
+		WebSocketHost:      "cdn.example.com",
+		WebSocketPath:      "/ws",
+		WebSocketEarlyData: 2048,
+	})
+	if err != nil {
+		t.Fatalf("newDialerFromConfig failed: %v", err)
+	}
+	writeBuf := &bytes.Buffer{}
+	conn, err := d.wrapConn(&mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf})
+	if err != nil {
+		t.Fatalf("wrapConn failed: %v", err)
+	}
+	// the whole first flight fits the early data, so no frame waits for
+	// the upgrade response
+	d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080")).Write([]byte("hello"))
+	if !bytes.HasPrefix(writeBuf.Bytes(), []byte("GET /ws HTTP/1.1\r\nHost: cdn.example.com\r\n")) {
+		t.Errorf("Expected the stream to start with the upgrade request, got %q", writeBuf.Bytes())
+	}
+	if !bytes.Contains(writeBuf.Bytes(), []byte("Sec-WebSocket-Protocol: ")) {
+		t.Error("Expected the first flight in the early data header")
+	}
+
+	for _, tc := range []struct {
+		cfg      config.Config
+		expected error
+	}{
+		{config.Config{Transport: "quic"}, ErrUnknownTransport},
+		{config.Config{Transport: "websocket", Obfs: "http"}, ErrInvalidPluginOptions},
+		{config.Config{Transport: "grpc", GRPCServiceName: "a/b", ServerAddr: "127.0.0.1:443"}, plugin.ErrInvalidOptions},
+		{config.Config{Transport: "grpc", RemoteAddr: "127.0.0.1:443"}, plugin.ErrInvalidOptions},
+		{config.Config{Transport: "shadowtls", ShadowTLSServerName: "www.example.com"}, plugin.ErrInvalidOptions},
+	} {
+		tc.cfg.Method, tc.cfg.Password = "chacha20-ietf-poly1305", "testpass"
+		if _, err := newDialerFromConfig(&tc.cfg); !errors.Is(err, tc.expected) {
+			t.Errorf("Expected %v for transport %q with obfs %q, got %v", tc.expected, tc.cfg.Transport, tc.cfg.Obfs, err)
+		}
+	}
+}
+
+func TestNewPlugin_GRPCTransport(t *testing.T) {
+	d, err := newDialerFromConfig(&config.Config{
+		Method:     "chacha20-ietf-poly1305",
+		Password:   "testpass",
+		ServerAddr: "127.0.0.1:443",
+		Transport:  "grpc",
+	})
+	if err != nil {
+		t.Fatalf("newDialerFromConfig failed: %v", err)
+	}
+	writeBuf := &bytes.Buffer{}
+	conn, err := d.wrapConn(&mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf})
+	if err != nil {
+		t.Fatalf("wrapConn failed: %v", err)
+	}
+	d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080")).Write([]byte("hello"))
+	if !bytes.HasPrefix(writeBuf.Bytes(), []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")) {
+		t.Errorf("Expected the stream to start with the HTTP/2 preface, got %q", writeBuf.Bytes())
+	}
+}
+
+func TestNewPlugin_ShadowTLSTransport(t *testing.T) {
+	d, err := newDialerFromConfig(&config.Config{
+		Method:              "chacha20-ietf-poly1305",
+		Password:            "testpass",
+		Transport:           "shadowtls",
+		ShadowTLSPassword:   "secret",
+		ShadowTLSServerName: "www.example.com",
+	})
+	if err != nil {
+		t.Fatalf("newDialerFromConfig failed: %v", err)
+	}
+	writeBuf := &bytes.Buffer{}
+	// the handshake runs in wrapConn and fails once the server goes away
+	if _, err = d.wrapConn(&mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf}); err == nil {
+		t.Fatal("Expected the handshake to fail without a server")
+	}
+	if !bytes.HasPrefix(writeBuf.Bytes(), []byte{0x16, 0x03, 0x01}) || !bytes.Contains(writeBuf.Bytes(), []byte("www.example.com")) {
+		t.Errorf("Expected a ClientHello for the server name, got %q", writeBuf.Bytes())
+	}
+}
+
+// selfSignedCertificate returns a certificate for name and its PEM.
+func selfSignedCertificate(t *testing.T, name string) (tls.Certificate, []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create a certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestNewPlugin_TLSUnderTransport(t *testing.T) {
+	certificate, caPEM := selfSignedCertificate(t, "tls.example.com")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("failed to write the CA: %v", err)
+	}
+	d, err := newDialerFromConfig(&config.Config{
+		Method:     "chacha20-ietf-poly1305",
+		Password:   "testpass",
+		RemoteAddr: "destination.example.com:443",
+		ServerAddr: "tls.example.com:443",
+		Transport:  "grpc",
+		TLS:        true,
+		TLSCAFile:  caFile,
+	})
+	if err != nil {
+		t.Fatalf("newDialerFromConfig failed: %v", err)
+	}
+
+	type result struct {
+		protocol string
+		preface  []byte
+	}
+	results := make(chan result, 1)
+	raw := listenTCP(t, func(conn net.Conn) {
+		server := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{certificate}, NextProtos: []string{"h2"}})
+		if server.Handshake() != nil {
+			return
+		}
+		preface := make([]byte, 24)
+		io.ReadFull(server, preface)
+		results <- result{server.ConnectionState().NegotiatedProtocol, preface}
+	})
+	conn, err := d.wrapConn(raw)
+	if err != nil {
+		t.Fatalf("wrapConn failed: %v", err)
+	}
+	conn.Write([]byte("hello"))
+	got := <-results
+	if got.protocol != "h2" {
+		t.Errorf("Expected h2 to be negotiated by default under grpc, got %q", got.protocol)
+	}
+	if string(got.preface) != "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n" {
+		t.Errorf("Expected the grpc transport to run inside TLS, got %q", got.preface)
+	}
+
+	for _, cfg := range []config.Config{
+		{TLS: true, Transport: "shadowtls", ShadowTLSPassword: "secret", ShadowTLSServerName: "www.example.com"},
+		{TLS: true, TLSServerName: "tls.example.com", TLSCAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		{TLS: true, TLSServerName: "tls.example.com", TLSCA: "not a certificate"},
+		{TLS: true, ServerAddr: "tls.example.com"},
+		// the destination is no name to fall back on
+		{TLS: true, RemoteAddr: "tls.example.com:443"},
+	} {
+		cfg.Method, cfg.Password = "chacha20-ietf-poly1305", "testpass"
+		if _, err := newDialerFromConfig(&cfg); !errors.Is(err, ErrInvalidPluginOptions) {
+			t.Errorf("Expected %+v to be rejected, got %v", cfg, err)
+		}
+	}
+}
+
+func TestNewPlugin_KCPTransport(t *testing.T) {
+	cfg := &config.Config{
+		Method:           "chacha20-ietf-poly1305",
+		Password:         "testpass",
+		Transport:        "kcp",
+		KCPKey:           "secret",
+		KCPMode:          "manual",
+		KCPNoDelay:       true,
+		KCPIntervalMs:    20,
+		KCPSendWindow:    256,
+		KCPDataShards:    -1,
+		KCPNoComp:        true,
+		KCPKeepAliveSec:  5,
+		KCPReceiveWindow: 1024,
+	}
+	d, err := newDialerFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("newDialerFromConfig failed: %v", err)
+	}
+	if d.network != "udp" {
+		t.Errorf("Expected the server to be dialed over UDP, got %q", d.network)
+	}
+	expected := plugin.Options{
+		"key": "secret", "mode": "manual", "nodelay": "", "interval": "20", "sndwnd": "256", "rcvwnd": "1024",
+		"ds": "0", "ps": "0", "nocomp": "", "keepalive": "5",
+	}
+	if opts := kcpOptions(cfg); !maps.Equal(opts, expected) {
+		t.Errorf("Expected the kcptun options %v, got %v", expected, opts)
+	}
+
+	var network string
+	fdt := &ShadowsocksFixedDialingTransport{}
+	fdt.SetDialer(func(n, address string) (v1net.Conn, error) {
+		network = n
+		return nil, errors.New("no server")
+	})
+	if err := fdt.Configure([]byte(`{"method":"chacha20-ietf-poly1305","password":"abc123","remote_addr":"example.com","remote_port":"443","transport":"kcp"}`)); err != nil {
+		t.Fatalf("Expected configuration success, got error: %v", err)
+	}
+	fdt.DialFixed()
+	if network != "udp" {
+		t.Errorf("Expected DialFixed to dial UDP, got %q", network)
+	}
+
+	for _, cfg := range []config.Config{
+		{Transport: "kcp", TLS: true},
+		{Plugin: "kcptun", TLS: true},
+		{Transport: "kcp", KCPMode: "turbo"},
+		{Transport: "kcp", KCPMTU: -1},
+	} {
+		cfg.Method, cfg.Password = "chacha20-ietf-poly1305", "testpass"
+		if _, err := newDialerFromConfig(&cfg); !errors.Is(err, ErrInvalidPluginOptions) {
+			t.Errorf("Expected %+v to be rejected, got %v", cfg, err)
+		}
+	}
+}
+
+func TestNewPlugin_PollTransport(t *testing.T) {
+	var conns []*mockConn
+	fdt := &ShadowsocksFixedDialingTransport{}
+	fdt.SetDialer(func(network, address string) (v1net.Conn, error) {
+		// every conn breaks before it is answered
+		conn := &mockConn{readBuf: &bytes.Buffer{}, writeBuf: &bytes.Buffer{}}
+		conns = append(conns, conn)
+		return conn, nil
+	})
+	if err := fdt.Configure([]byte(`{"method":"chacha20-ietf-poly1305","password":"abc123","remote_addr":"destination.example.com","remote_port":"80","server_addr":"example.com:8080","transport":"poll","poll_path":"/p","poll_proxy":true}`)); err != nil {
+		t.Fatalf("Expected configuration success, got error: %v", err)
+	}
+	conn, err := fdt.DialFixed()
+	if err != nil {
+		t.Fatalf("DialFixed failed: %v", err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 16)); !errors.Is(err, poll.ErrPollFailed) {
+		t.Errorf("Expected ErrPollFailed, got %v", err)
+	}
+	if len(conns) < 2 {
+		t.Fatalf("Expected the server to be dialed again, got %d conns", len(conns))
+	}
+	for i, conn := range conns {
+		request := conn.writeBuf.String()
+		if !strings.HasPrefix(request, "POST http://example.com:8080/p HTTP/1.1\r\n") || !strings.Contains(request, "X-Seq: 1\r\n") {
+			t.Errorf("Expected conn %d to carry the first request, got %q", i, request)
+		}
+	}
+
+	for _, cfg := range []config.Config{
+		{Transport: "poll", ServerAddr: "example.com:80", PollPath: "p"},
+		{Transport: "poll", ServerAddr: "example.com:80", PollMinIntervalMs: 500, PollMaxIntervalMs: 100},
+		// the destination is no host to fall back on
+		{Transport: "poll"},
+	} {
+		cfg.Method, cfg.Password, cfg.RemoteAddr = "chacha20-ietf-poly1305", "testpass", "example.com"
+		if _, err := newDialerFromConfig(&cfg); !errors.Is(err, ErrInvalidPluginOptions) {
+			t.Errorf("Expected %+v to be rejected, got %v", cfg, err)
+		}
+	}
+}
+
+func TestNewPlugin_UpstreamProxy(t *testing.T) {
+	type result struct {
+		request string
+		salt    []byte
+	}
+	results := make(chan result, 1)
+	raw := listenTCP(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		salt := make([]byte, 32)
+		io.ReadFull(reader, salt)
+		results <- result{request.Method + " " + request.Host + " " + request.Header.Get("Proxy-Authorization"), salt}
+	})
+	fdt := &ShadowsocksFixedDialingTransport{}
+	fdt.SetDialer(func(network, address string) (v1net.Conn, error) { return raw, nil })
+	if err := fdt.Configure([]byte(`{"method":"chacha20-ietf-poly1305","password":"abc123","remote_addr":"example.com","remote_port":"443","server_addr":"ss.example.com:8388","proxy":"http","proxy_username":"user","proxy_password":"pass"}`)); err != nil {
+		t.Fatalf("Expected configuration success, got error: %v", err)
+	}
+	conn, err := fdt.DialFixed()
+	if err != nil {
+		t.Fatalf("DialFixed failed: %v", err)
+	}
+	conn.Write([]byte("hello"))
+	got := <-results
+	if expected := "CONNECT ss.example.com:8388 Basic dXNlcjpwYXNz"; got.request != expected {
+		t.Errorf("Expected %q, got %q", expected, got.request)
+	}
+	if bytes.Equal(got.salt, make([]byte, 32)) {
+		t.Error("Expected the shadowsocks salt through the tunnel")
+	}
+
+	for _, cfg := range []config.Config{
+		{Proxy: "socks4", ServerAddr: "ss.example.com:8388"},
+		{Proxy: "socks5"},
+		{Proxy: "socks5", ServerAddr: "ss.example.com:8388", Transport: "kcp"},
+	} {
+		cfg.Method, cfg.Password = "chacha20-ietf-poly1305", "testpass"
+		if _, err := newDialerFromConfig(&cfg); !errors.Is(err, ErrInvalidPluginOptions) {
+			t.Errorf("Expected %+v to be rejected, got %v", cfg, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// timeouts holds the limits a ClientConn enforces. Blocking conns get them
+// as read deadlines. Non-blocking conns have no timer to fire them, so the
+// clock is checked whenever a read finds nothing or the conn is written
+// to. A zero value disables the matching limit.
+type timeouts struct {
+	handshake time.Duration
+	firstByte time.Duration
+	idle      time.Duration
+}
+
+func (t timeouts) enabled() bool {
+	return t.handshake > 0 || t.firstByte > 0 || t.idle > 0
+}
+
+// readDeadline returns the earliest deadline that applies to the next read
+// and the error reported if it passes.
+//
+//   - handshake counts from the conn creation until the server salt is read
+//   - first byte counts from the request being sent until a response chunk
+//     is decrypted
+//   - idle counts from the last successful read or write
+func (c *ClientConn) readDeadline() (deadline time.Time, timeoutErr *TimeoutError) {
+	consider := func(candidate time.Time, err *TimeoutError) {
+		if deadline.IsZero() || candidate.Before(deadline) {
+			deadline, timeoutErr = candidate, err
+		}
+	}
+	if c.timeouts.handshake > 0 && c.reader == nil {
+		consider(c.createdAt.Add(c.timeouts.handshake), ErrHandshakeTimeout)
+	}
+	if c.timeouts.firstByte > 0 && !c.requestSentAt.IsZero() && (c.reader == nil || !c.reader.Authenticated()) {
+		consider(c.requestSentAt.Add(c.timeouts.firstByte), ErrFirstByteTimeout)
+	}
+	if c.timeouts.idle > 0 {
+		consider(c.lastActivity.Add(c.timeouts.idle), ErrIdleTimeout)
+	}
+	return
+}
+
+// armReadDeadline applies the current deadline to the underlying conn.
+// Non-blocking conns are left alone: a read there returns EAGAIN right away
+// and checkTimeout compares the clock instead, so the worker never spins on
+// a deadline.
+func (c *ClientConn) armReadDeadline() error {
+	if !c.timeouts.enabled() || c.nonBlocking {
+		return nil
+	}
+	deadline, _ := c.readDeadline()
+	if deadline.Equal(c.armedDeadline) {
+		return nil
+	}
+	c.armedDeadline = deadline
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	if deadline.IsZero() {
+		// WATM conns switch to non-blocking mode whenever a deadline is
+		// set, even a zero one, so blocking mode has to be restored
+		return c.Conn.SetNonBlock(false)
+	}
+	return nil
+}
+
+// checkTimeout turns a read error into the timeout of the phase that
+// stalled once its deadline has passed, closing the connection.
+func (c *ClientConn) checkTimeout(err error) error {
+	if err == nil || !c.timeouts.enabled() || !isTimeoutOrRetry(err) {
+		return err
+	}
+	deadline, timeoutErr := c.readDeadline()
+	if deadline.IsZero() || time.Now().Before(deadline) {
+		return err
+	}
+	slog.Warn("closing stalled connection",
+		slog.String("phase", timeoutErr.Phase),
+		slog.String("destination", c.destination.String()))
+	c.Close()
+	c.failed = timeoutErr
+	return timeoutErr
+}
+
+// checkStalled runs the timeout checks of a read on a non-blocking conn
+// that is being written to, which the worker may not read again before
+// the server answers. The server salt and the first chunk are read ahead
+// if they arrived, so only a phase that really stalled times out. Nothing
+// is checked before the request is sent, and idle not at all, since the
+// write is traffic.
+func (c *ClientConn) checkStalled() error {
+	if !c.nonBlocking || !c.timeouts.enabled() || c.writer == nil {
+		return nil
+	}
+	var err error
+	if c.reader == nil {
+		err = c.readResponse()
+	}
+	if err == nil && !c.reader.Authenticated() {
+		err = c.checkCredentials(c.reader.Fill())
+	}
+	if err == nil {
+		return nil
+	}
+	if err = c.checkTimeout(err); errors.Is(err, syscall.EAGAIN) {
+		return nil
+	}
+	return err
+}
+
+// touch records traffic on the connection for the idle timeout.
+func (c *ClientConn) touch() {
+	if c.timeouts.idle > 0 {
+		c.lastActivity = time.Now()
+	}
+}
+
+func isTimeoutOrRetry(err error) bool {
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// activityWriter re-arms the idle deadline every time WriteTo hands a
+// chunk to the destination.
+type activityWriter struct {
+	io.Writer
+	conn *ClientConn
+}
+
+func (w *activityWriter) Write(p []byte) (n int, err error) {
+	n, err = w.Writer.Write(p)
+	w.conn.touch()
+	if armErr := w.conn.armReadDeadline(); err == nil {
+		err = armErr
+	}
+	return
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+const testTimeout = 50 * time.Millisecond
+
+func newTimeoutDialer(t *testing.T, cfg config.Config) *Dialer {
+	t.Helper()
+	cfg.Method = "chacha20-ietf-poly1305"
+	cfg.Password = "testpass"
+	d, err := newDialerFromConfig(&cfg)
+	if err != nil {
+		t.Fatalf("failed to create dialer: %v", err)
+	}
+	return d
+}
+
+// stallingServer reads whatever the client sends, answers with prefix and
+// then never writes again.
+func stallingServer(prefix []byte) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		conn.Write(prefix)
+		buffer := make([]byte, 1024)
+		for {
+			if _, err := conn.Read(buffer); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readWithTimeout(t *testing.T, d *Dialer, prefix []byte, reads int) (error, time.Duration) {
+	t.Helper()
+	conn := listenTCP(t, stallingServer(prefix))
+	clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+	if _, err := clientConn.Write([]byte("request")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	start := time.Now()
+	var err error
+	for i := 0; i < reads && err == nil; i++ {
+		_, err = clientConn.Read(make([]byte, 64))
+	}
+	return err, time.Since(start)
+}
+
+func TestClientConn_HandshakeTimeout(t *testing.T) {
+	d := newTimeoutDialer(t, config.Config{HandshakeTimeoutMs: int(testTimeout / time.Millisecond)})
+	err, elapsed := readWithTimeout(t, d, nil, 1)
+	if !errors.Is(err, ErrHandshakeTimeout) || !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected handshake timeout, got %v", err)
+	}
+	if elapsed > 20*testTimeout {
+		t.Errorf("Expected timeout after about %s, took %s", testTimeout, elapsed)
+	}
+}
+
+func TestClientConn_FirstByteTimeout(t *testing.T) {
+	d := newTimeoutDialer(t, config.Config{FirstByteTimeoutMs: int(testTimeout / time.Millisecond)})
+	// the server sends a valid salt and nothing after it
+	salt := encodeResponse(t, d)
+	err, _ := readWithTimeout(t, d, salt, 1)
+	if !errors.Is(err, ErrFirstByteTimeout) {
+		t.Fatalf("Expected first byte timeout, got %v", err)
+	}
+}
+
+func TestClientConn_IdleTimeout(t *testing.T) {
+	d := newTimeoutDialer(t, config.Config{IdleTimeoutMs: int(testTimeout / time.Millisecond)})
+	err, elapsed := readWithTimeout(t, d, encodeResponse(t, d, []byte("hello")), 2)
+	if !errors.Is(err, ErrIdleTimeout) {
+		t.Fatalf("Expected idle timeout, got %v", err)
+	}
+	if elapsed < testTimeout {
+		t.Errorf("Expected idle timeout to wait at least %s, took %s", testTimeout, elapsed)
+	}
+}
+
+func TestClientConn_TimeoutClosesConn(t *testing.T) {
+	d := newTimeoutDialer(t, config.Config{HandshakeTimeoutMs: 1})
+	conn := &closeTrackingConn{mockConn: mockConn{readBuf: &bytes.Buffer{}, writeBuf: &bytes.Buffer{}}}
+	clientConn := d.DialEarlyConn(&eagainConn{conn}, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+	clientConn.SetNonBlock(true)
+	time.Sleep(2 * time.Millisecond)
+
+	_, err := clientConn.Read(make([]byte, 16))
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("Expected handshake timeout, got %v", err)
+	}
+	if !conn.closed {
+		t.Error("Expected stalled conn to be closed")
+	}
+	if _, again := clientConn.Read(make([]byte, 16)); again != err {
+		t.Errorf("Expected later reads to keep reporting the timeout, got %v", again)
+	}
+}
+
+// eagainConn behaves like a non-blocking WATM conn with nothing to read.
+// Setting a deadline on it fails the test, since non-blocking reads must
+// never spin on one.
+type eagainConn struct {
+	*closeTrackingConn
+}
+
+func (c *eagainConn) Read(b []byte) (int, error) {
+	return 0, syscall.EAGAIN
+}
+
+func (c *eagainConn) SetReadDeadline(time.Time) error {
+	panic("deadline set on a non-blocking conn")
+}
+
+func TestClientConn_NonBlockingTimeout(t *testing.T) {
+	d := newTimeoutDialer(t, config.Config{HandshakeTimeoutMs: int(testTimeout / time.Millisecond)})
+	conn := &eagainConn{&closeTrackingConn{mockConn: mockConn{readBuf: &bytes.Buffer{}, writeBuf: &bytes.Buffer{}}}}
+	clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+	clientConn.SetNonBlock(true)
+
+	if _, err := clientConn.Read(make([]byte, 16)); err != syscall.EAGAIN {
+		t.Fatalf("Expected EAGAIN before the deadline, got %v", err)
+	}
+	time.Sleep(testTimeout)
+	if _, err := clientConn.Read(make([]byte, 16)); !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("Expected handshake timeout once the deadline passed, got %v", err)
+	}
+}
+
+// pendingConn is a non-blocking conn holding what the server sent, then
+// returning EAGAIN.
+type pendingConn struct {
+	mockConn
+}
+
+func (c *pendingConn) Read(b []byte) (int, error) {
+	if c.readBuf.Len() == 0 {
+		return 0, syscall.EAGAIN
+	}
+	return c.readBuf.Read(b)
+}
+
+func TestClientConn_NonBlockingTimeoutOnWrite(t *testing.T) {
+	d := newTimeoutDialer(t, config.Config{HandshakeTimeoutMs: int(testTimeout / time.Millisecond)})
+	for _, tc := range []struct {
+		name     string
+		response []byte
+		expected error
+	}{
+		{"stalled", nil, ErrHandshakeTimeout},
+		// the answer is there, the worker just did not read it yet
+		{"answered", encodeResponse(t, d, []byte("hello")), nil},
+	} {
+		conn := &pendingConn{mockConn{readBuf: bytes.NewBuffer(tc.response), writeBuf: &bytes.Buffer{}}}
+		clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080"))
+		clientConn.SetNonBlock(true)
+		clientConn.Write([]byte("request"))
+		time.Sleep(testTimeout)
+
+		// the worker may keep writing without reading in between
+		if _, err := clientConn.Write([]byte("more")); !errors.Is(err, tc.expected) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.expected, err)
+		}
+		if tc.expected != nil {
+			continue
+		}
+		buffer := make([]byte, 16)
+		if n, err := clientConn.Read(buffer); err != nil || string(buffer[:n]) != "hello" {
+			t.Errorf("%s: expected the chunk read ahead, got %q, %v", tc.name, buffer[:n], err)
+		}
+	}
+}
+
+func TestClientConn_NonBlockingIdleAfterUpload(t *testing.T) {
+	d := newTimeoutDialer(t, config.Config{IdleTimeoutMs: int(testTimeout / time.Millisecond)})
+	for _, tc := range []struct {
+		name   string
+		upload func(c *ClientConn) error
+	}{
+		{"ReadFrom", func(c *ClientConn) error {
+			_, err := c.ReadFrom(bytes.NewReader([]byte("upload")))
+			return err
+		}},
+		{"WriteVectorised", func(c *ClientConn) error {
+			return c.WriteVectorised([]*buf.Buffer{buf.As([]byte("up")), buf.As([]byte("load"))})
+		}},
+	} {
+		conn := &pendingConn{mockConn{readBuf: bytes.NewBuffer(encodeResponse(t, d, []byte("hello"))), writeBuf: &bytes.Buffer{}}}
+		clientConn := d.DialEarlyConn(conn, metadata.ParseSocksaddrHostPortStr("127.0.0.1", "8080")).(*ClientConn)
+		clientConn.SetNonBlock(true)
+		clientConn.Write([]byte("request"))
+		clientConn.Read(make([]byte, 16))
+		time.Sleep(testTimeout)
+
+		// the upload is traffic, so the read that follows is not idle
+		if err := tc.upload(clientConn); err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if _, err := clientConn.Read(make([]byte, 16)); !errors.Is(err, syscall.EAGAIN) {
+			t.Errorf("%s: expected EAGAIN after the upload, got %v", tc.name, err)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/CosmWasm/tinyjson"
 	"github.com/getlantern/tiny-shadowsocks/config"
+	"github.com/getlantern/tiny-shadowsocks/internal/pool"
 	v1 "github.com/refraction-networking/watm/tinygo/v1"
 	v1net "github.com/refraction-networking/watm/tinygo/v1/net"
 	"github.com/sagernet/sing/common/metadata"
@@ -23,7 +24,22 @@ func (t *ShadowsocksWrappingTransport) Wrap(conn v1net.Conn) (v1net.Conn, error)
 	if t.dialer == nil {
 		return nil, fmt.Errorf("dialer is not configured")
 	}
-	return t.dialer.DialEarlyConn(conn, t.destination), conn.SetNonBlock(true)
+	conn, err := t.dialer.wrapConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	if t.dialer.mux != nil {
+		// the host dials each conn, so every session carries this one
+		// stream and closes with it
+		stream, err := t.dialer.newMuxSession(conn).Open(t.destination)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return stream, stream.SetNonBlock(true)
+	}
+	clientConn := t.dialer.DialEarlyConn(conn, t.destination)
+	return clientConn, clientConn.SetNonBlock(true)
 }
 
 func (t *ShadowsocksWrappingTransport) Configure(cfg []byte) error {
@@ -37,10 +53,18 @@ func (t *ShadowsocksWrappingTransport) Configure(cfg []byte) error {
 		v1.SetReadBufferSize(parsedConfig.InternalBufferSize)
 	}
 
-	dialer, err := newDialer(parsedConfig.Method, parsedConfig.Password)
+	if parsedConfig.BufferPoolSize != 0 {
+		pool.SetLimit(parsedConfig.BufferPoolSize)
+	}
+
+	dialer, err := newDialerFromConfig(&parsedConfig)
 	if err != nil {
 		return fmt.Errorf("failed to create dialer: %w", err)
 	}
+	if t.dialer != nil {
+		// the previous master key is no longer needed once replaced
+		t.dialer.Wipe()
+	}
 	t.dialer = dialer
 	t.destination = metadata.ParseSocksaddrHostPortStr(parsedConfig.RemoteAddr, parsedConfig.RemotePort)
 	return nil
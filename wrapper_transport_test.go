@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"testing"
 
@@ -78,3 +79,47 @@ func TestShadowsocksWrappingTransport_Configure_InvalidMethod(t *testing.T) {
 		t.Error("Expected error due to invalid encryption method")
 	}
 }
+
+func TestShadowsocksWrappingTransport_Configure_WipesPreviousKey(t *testing.T) {
+	jsonCfg := []byte(`{"method":"chacha20-ietf-poly1305","password":"abc","remote_addr":"host","remote_port":"1234"}`)
+	tp := &ShadowsocksWrappingTransport{}
+	if err := tp.Configure(jsonCfg); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	previousKey := tp.dialer.key
+	if err := tp.Configure(jsonCfg); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	if !bytes.Equal(previousKey, make([]byte, len(previousKey))) {
+		t.Error("Expected previous master key to be zeroed on reconfigure")
+	}
+	if bytes.Equal(tp.dialer.key, previousKey) {
+		t.Error("Expected new dialer to hold its own key")
+	}
+}
+
+func TestShadowsocksWrappingTransport_Configure_Plugin(t *testing.T) {
+	tp := &ShadowsocksWrappingTransport{}
+	err := tp.Configure([]byte(`{"method":"chacha20-ietf-poly1305","password":"abc123","remote_addr":"example.com","remote_port":"443","plugin":"obfs-local","plugin_opts":"obfs=http;obfs-host=cdn.example.com"}`))
+	if err != nil {
+		t.Fatalf("Expected configuration success, got error: %v", err)
+	}
+	writeBuf := &bytes.Buffer{}
+	wrapped, err := tp.Wrap(&mockConn{readBuf: &bytes.Buffer{}, writeBuf: writeBuf})
+	if err != nil {
+		t.Fatalf("Wrap failed: %v", err)
+	}
+	wrapped.Write([]byte("hello"))
+	if !bytes.HasPrefix(writeBuf.Bytes(), []byte("GET / HTTP/1.1\r\nHost: cdn.example.com\r\n")) {
+		t.Errorf("Expected the plugin to wrap the stream, got %q", writeBuf.Bytes())
+	}
+
+	for cfg, expected := range map[string]error{
+		`{"method":"chacha20-ietf-poly1305","password":"abc123","plugin":"no-such-plugin"}`:                  ErrUnknownPlugin,
+		`{"method":"chacha20-ietf-poly1305","password":"abc123","plugin":"obfs-local","plugin_opts":"obfs"}`: ErrInvalidPluginOptions,
+	} {
+		if err := (&ShadowsocksWrappingTransport{}).Configure([]byte(cfg)); !errors.Is(err, expected) {
+			t.Errorf("Expected %v for %s, got %v", expected, cfg, err)
+		}
+	}
+}